@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/dataexport"
+	"personal-projects/webapp/pkg/repository"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// closurePayload is what users send to close their account.
+type closurePayload struct {
+	Password string `json:"password"`
+}
+
+// exportUser sends everything kept about a user as a ZIP archive: their profile,
+// images, sessions and audit events.
+func (app *application) exportUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	export, err := dataexport.Collect(r.Context(), app.DB, userID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+	app.audit(r, data.AuditEvent{Action: data.AuditDataExported, TargetType: "user", TargetID: strconv.Itoa(userID)})
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, export.FileName()))
+	w.WriteHeader(http.StatusOK)
+
+	err = export.WriteZip(w, app.UploadPath)
+	if err != nil {
+		// too late for an error response; the archive will be unreadable
+		log.Println("could not export user data:", err)
+	}
+}
+
+// requestClosure schedules the user's own account for deletion once the closure
+// cooling-off period is over, as long as they give their password again. Until
+// then, they can call it off with cancelClosure; asking again doesn't move the date.
+func (app *application) requestClosure(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// admins delete users outright, with deleteUser
+	if app.claimsFromContext(r.Context()).Subject != strconv.Itoa(userID) {
+		app.errorJSON(w, errors.New("only users can close their own account"), http.StatusForbidden)
+		return
+	}
+
+	var payload closurePayload
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	valid, err := user.PasswordMatches(payload.Password)
+	if err != nil || !valid {
+		app.errorJSON(w, errors.New("password is incorrect"), http.StatusForbidden)
+		return
+	}
+
+	if user.DeleteAfter == nil {
+		after := time.Now().Add(app.ClosureCoolingOff).UTC().Truncate(time.Second)
+		user, err = app.scheduleDeletion(r, userID, &after, data.AuditEvent{
+			Action: data.AuditClosureRequested,
+			Detail: "to be deleted after " + after.Format(time.RFC3339),
+		})
+		if err != nil {
+			app.repoErrorJSON(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", userETag(user.Version))
+	_ = app.writeJSON(w, http.StatusAccepted, user)
+}
+
+// cancelClosure calls off the deletion of an account whose owner closed it.
+func (app *application) cancelClosure(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+	if user.DeleteAfter == nil {
+		app.errorJSON(w, errors.New("the account is not closed"), http.StatusConflict)
+		return
+	}
+
+	user, err = app.scheduleDeletion(r, userID, nil, data.AuditEvent{Action: data.AuditClosureCancelled})
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user.Version))
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+// scheduleDeletion sets when user id will be deleted, recording e for them in the
+// same transaction, and returns the user as they are now.
+func (app *application) scheduleDeletion(r *http.Request, id int, after *time.Time, e data.AuditEvent) (*data.User, error) {
+	var user *data.User
+	err := app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		err := tx.ScheduleDeletion(r.Context(), id, after)
+		if err != nil {
+			return err
+		}
+
+		user, err = tx.GetUser(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		e.TargetType = "user"
+		e.TargetID = strconv.Itoa(id)
+		_, err = tx.InsertAuditEvent(r.Context(), app.auditEvent(r, e))
+		return err
+	})
+	return user, err
+}
+
+// closeAccounts deletes the accounts whose cooling-off period is over, and returns
+// how many there were. They can still be restored until they are purged.
+func (app *application) closeAccounts(ctx context.Context) (int, error) {
+	var ids []int
+	err := app.DB.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		var err error
+		ids, err = tx.DeleteScheduledUsers(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			_, err = tx.InsertAuditEvent(ctx, data.AuditEvent{
+				Action:     data.AuditUserDeleted,
+				TargetType: "user",
+				TargetID:   strconv.Itoa(id),
+				Detail:     "closed by the user; the cooling-off period is over",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(ids), nil
+}
+
+// closeAccountsEvery deletes the accounts whose cooling-off period is over every
+// interval, until ctx is done.
+func (app *application) closeAccountsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := app.closeAccounts(ctx)
+			if err != nil {
+				log.Println("error deleting closed accounts:", err)
+			}
+			if n > 0 {
+				log.Printf("deleted %d closed accounts", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository/dbrepo"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// accountRequest returns a request for user userID's account, made by claims.
+func accountRequest(method, userID, body string, claims *Claims) *http.Request {
+	req, _ := http.NewRequest(method, "/users/"+userID, strings.NewReader(body))
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("userID", userID)
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx)
+	ctx = context.WithValue(ctx, contextClaimsKey, claims)
+	return req.WithContext(ctx)
+}
+
+func Test_app_exportUser(t *testing.T) {
+	defer resetDB()
+	resetDB()
+
+	err := os.WriteFile(filepath.Join(app.UploadPath, "img.png"), []byte("png"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(app.UploadPath, "img.png"))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.exportUser).ServeHTTP(rr, accountRequest("GET", "1", "", &Claims{}))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", rr.Code, rr.Body)
+	}
+	if rr.Header().Get("Content-Type") != "application/zip" || !strings.Contains(rr.Header().Get("Content-Disposition"), `filename="user-1-`) {
+		t.Errorf("expected a ZIP download but got headers %v", rr.Header())
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("expected a ZIP archive but got %s", err)
+	}
+	var names []string
+	for _, f := range z.File {
+		names = append(names, f.Name)
+	}
+	if !strings.Contains(strings.Join(names, ","), "images/img.png") {
+		t.Errorf("expected the profile picture in the archive, but it holds %v", names)
+	}
+
+	events, _ := app.DB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditDataExported})
+	if len(events) != 1 || events[0].TargetID != "1" {
+		t.Errorf("expected the export to be audited, but got %+v", events)
+	}
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(app.exportUser).ServeHTTP(rr, accountRequest("GET", "3", "", &Claims{}))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a missing user, but got %d", rr.Code)
+	}
+}
+
+func Test_app_closure(t *testing.T) {
+	defer resetDB()
+
+	// user 2 is Jack Smith, whose password is also "secret"
+	fixtures := dbrepo.TestFixtures()
+	jack := fixtures.Users[0]
+	jack.ID, jack.FirstName, jack.LastName, jack.Email, jack.Roles = 2, "Jack", "Smith", "jack@smith.com", nil
+	fixtures.Users = append(fixtures.Users, jack)
+	_ = testDB.Seed(fixtures)
+	ctx := context.Background()
+
+	var tests = []struct {
+		name               string
+		method             string
+		userID             string
+		subject            string
+		json               string
+		expectedStatusCode int
+	}{
+		{"someone else's", "POST", "2", "1", `{"password":"secret"}`, http.StatusForbidden},
+		{"wrong password", "POST", "2", "2", `{"password":"wrong"}`, http.StatusForbidden},
+		{"bad json", "POST", "2", "2", `{"pass":"word"}`, http.StatusBadRequest},
+		{"cancel when not closed", "DELETE", "2", "2", "", http.StatusConflict},
+		{"close", "POST", "2", "2", `{"password":"secret"}`, http.StatusAccepted},
+		{"close again", "POST", "2", "2", `{"password":"secret"}`, http.StatusAccepted},
+		{"cancel", "DELETE", "2", "2", "", http.StatusOK},
+		{"close after cancelling", "POST", "2", "2", `{"password":"secret"}`, http.StatusAccepted},
+	}
+
+	var scheduled *time.Time
+	for _, e := range tests {
+		handler := app.requestClosure
+		if e.method == "DELETE" {
+			handler = app.cancelClosure
+		}
+
+		claims := &Claims{}
+		claims.Subject = e.subject
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(handler).ServeHTTP(rr, accountRequest(e.method, e.userID, e.json, claims))
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body)
+			continue
+		}
+		if rr.Code >= 300 {
+			continue
+		}
+
+		var user data.User
+		_ = json.NewDecoder(rr.Body).Decode(&user)
+		if rr.Header().Get("ETag") != userETag(user.Version) {
+			t.Errorf("%s: expected the ETag for version %d but got %s", e.name, user.Version, rr.Header().Get("ETag"))
+		}
+
+		switch e.name {
+		case "close":
+			if user.DeleteAfter == nil || time.Until(*user.DeleteAfter) < 13*24*time.Hour {
+				t.Fatalf("%s: expected the deletion to be two weeks away, but got %v", e.name, user.DeleteAfter)
+			}
+			scheduled = user.DeleteAfter
+		case "close again":
+			if user.DeleteAfter == nil || !user.DeleteAfter.Equal(*scheduled) {
+				t.Errorf("%s: expected the date to stay %s, but got %v", e.name, scheduled, user.DeleteAfter)
+			}
+		case "cancel":
+			if user.DeleteAfter != nil {
+				t.Errorf("%s: expected the deletion to be called off, but got %v", e.name, user.DeleteAfter)
+			}
+		}
+	}
+
+	var actions []string
+	events, _ := app.DB.AuditEvents(ctx, data.AuditFilter{TargetType: "user", TargetID: "2"})
+	for _, e := range events {
+		actions = append(actions, e.Action)
+	}
+	expected := []string{data.AuditClosureRequested, data.AuditClosureCancelled, data.AuditClosureRequested}
+	if strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected events %v but got %v", expected, actions)
+	}
+
+	// nothing is deleted before the cooling-off period is over
+	n, err := app.closeAccounts(ctx)
+	if err != nil || n != 0 {
+		t.Errorf("expected no accounts to be deleted yet, but got %d, %v", n, err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	err = app.DB.ScheduleDeletion(ctx, 2, &past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = app.closeAccounts(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("expected jack's account to be deleted, but got %d, %v", n, err)
+	}
+	if _, err := app.DB.GetUser(ctx, 2); err == nil {
+		t.Error("expected jack to be deleted")
+	}
+	deleted, _ := app.DB.AuditEvents(ctx, data.AuditFilter{Action: data.AuditUserDeleted})
+	if len(deleted) != 1 || deleted[0].TargetID != "2" || deleted[0].ActorID != 0 {
+		t.Errorf("expected the deletion to be audited, but got %+v", deleted)
+	}
+}
@@ -1,29 +1,394 @@
 package main
 
-import "net/http"
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+type Credentials struct {
+	Username string `json:"email"`
+	Password string `json:"password"`
+}
+
+// userPayload is what clients send when creating a user. data.User never serializes
+// its password, so we accept it alongside.
+type userPayload struct {
+	data.User
+	Password string `json:"password"`
+}
 
 func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
+	var creds Credentials
+
+	// read a json payload
+	err := app.readJSON(w, r, &creds)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	// look up the user by email address
+	email, err := data.NormalizeEmail(creds.Username)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
 
+	user, err := app.DB.GetUserByEmail(r.Context(), email)
+	if err != nil {
+		app.audit(r, data.AuditEvent{Action: data.AuditLoginFailed, TargetType: "user", Detail: "unknown email address " + email})
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	// check password
+	valid, err := user.PasswordMatches(creds.Password)
+	if err != nil || !valid {
+		app.audit(r, data.AuditEvent{Action: data.AuditLoginFailed, TargetType: "user", TargetID: strconv.Itoa(user.ID), Detail: "wrong password"})
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	// this is the only time we see the plain password, so replace an outdated hash now
+	if user.PasswordNeedsRehash() {
+		err = app.DB.RehashPassword(r.Context(), user.ID, user.Password, creds.Password)
+		if err != nil {
+			log.Println("could not rehash password:", err)
+		}
+	}
+
+	// generate tokens
+	tokenPairs, err := app.generateTokenPair(user)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	app.audit(r, data.AuditEvent{ActorID: user.ID, Action: data.AuditTokenIssued, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	// send token to user
+	_ = app.writeJSON(w, http.StatusOK, tokenPairs)
 }
+
 func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	refreshToken := r.Form.Get("refresh_token")
+	claims := &Claims{}
 
+	_, err = jwt.ParseWithClaims(refreshToken, claims, func(token *jwt.Token) (interface{}, error) {
+		// validate the signing algorithm
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(app.JWSecret), nil
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// impersonation tokens end when they expire, rather than turning into the user's own
+	if claims.Actor != nil {
+		app.errorJSON(w, errors.New("impersonation tokens can't be refreshed"), http.StatusBadRequest)
+		return
+	}
+
+	// only hand out new tokens when the refresh token is about to expire
+	if time.Until(claims.ExpiresAt.Time) > 30*time.Second {
+		app.errorJSON(w, errors.New("refresh token does not need renewed yet"), http.StatusTooEarly)
+		return
+	}
+
+	// get the user id from the claims
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
+		return
+	}
+
+	tokenPairs, err := app.generateTokenPair(user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	app.audit(r, data.AuditEvent{ActorID: user.ID, Action: data.AuditTokenRefreshed, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "__Host-refresh_token",
+		Path:     "/",
+		Value:    tokenPairs.RefreshToken,
+		Expires:  time.Now().Add(refreshTokenExpiry),
+		MaxAge:   int(refreshTokenExpiry.Seconds()),
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+		Secure:   true,
+	})
+
+	_ = app.writeJSON(w, http.StatusOK, tokenPairs)
 }
 
 func (app *application) allUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.DB.AllUsers(r.Context())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
 
+	_ = app.writeJSON(w, http.StatusOK, users)
 }
 
 func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
 
+	w.Header().Set("ETag", userETag(user.Version))
+	_ = app.writeJSON(w, http.StatusOK, user)
 }
 
+// updateUser saves the user in the request body. The client must send the ETag it
+// got from getUser in If-Match, so that it can't overwrite changes it hasn't seen.
+// The policy is asked about the user being saved, and, once we know them, about the
+// fields the update changes.
 func (app *application) updateUser(w http.ResponseWriter, r *http.Request) {
+	tags, err := ifMatch(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusPreconditionRequired)
+		return
+	}
+
+	var user data.User
+	err = app.readJSON(w, r, &user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	resource := authz.Resource{Type: "user", ID: strconv.Itoa(user.ID)}
+	if !app.allowed(r, data.PermUsersWrite, resource) {
+		app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
+
+	current, err := app.DB.GetUser(r.Context(), user.ID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	resource.Attributes = map[string]any{"fields": changedFields(current, user)}
+	if !app.allowed(r, data.PermUsersWrite, resource) {
+		app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
 
+	if !etagMatches(tags, current.Version) {
+		app.repoErrorJSON(w, repository.ErrModified)
+		return
+	}
+
+	// UpdateUser checks the version again, in case the user changed since we read it
+	user.Version = current.Version
+	err = app.DB.UpdateUser(r.Context(), user)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	// record what the update actually changed, rather than what the client sent
+	updated, err := app.DB.GetUser(r.Context(), user.ID)
+	if err != nil {
+		log.Println("could not read updated user:", err)
+		updated = current
+	}
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditUserUpdated,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Changes:    data.Diff(current, updated),
+	})
+
+	// every update moves the version on by one
+	w.Header().Set("ETag", userETag(user.Version+1))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changedFields returns the JSON names of the fields of current that UpdateUser
+// would change to save u, in order.
+func changedFields(current *data.User, u data.User) []string {
+	proposed := *current
+	proposed.Email = u.Email
+	proposed.FirstName = u.FirstName
+	proposed.LastName = u.LastName
+
+	fields := []string{}
+	for name := range data.Diff(current, &proposed) {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
 }
+
+// deleteUser deletes a user, who can be restored until they are purged. Like
+// updateUser, it needs the user's ETag in If-Match.
 func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	tags, err := ifMatch(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusPreconditionRequired)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		current, err := tx.GetUser(r.Context(), userID)
+		if err != nil {
+			return err
+		}
+		if !etagMatches(tags, current.Version) {
+			return repository.ErrModified
+		}
 
+		err = tx.DeleteUser(r.Context(), userID, current.Version)
+		if err != nil {
+			return err
+		}
+
+		// a deletion nobody can account for is worse than a failed one
+		_, err = tx.InsertAuditEvent(r.Context(), app.auditEvent(r, data.AuditEvent{
+			Action:     data.AuditUserDeleted,
+			TargetType: "user",
+			TargetID:   strconv.Itoa(userID),
+			Changes:    data.Diff(current, nil),
+		}))
+		return err
+	})
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (app *application) insertUser(w http.ResponseWriter, r *http.Request) {
+	var payload userPayload
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user := payload.User
+	user.Password = payload.Password
+
+	err = app.PasswordPolicy.Check(user.Password, user.FirstName, user.LastName, user.Email)
+	if err != nil {
+		app.passwordErrorJSON(w, err)
+		return
+	}
+
+	id, err := app.DB.InsertUser(r.Context(), user)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	// record the user as stored, with the defaults the database filled in
+	created, err := app.DB.GetUser(r.Context(), id)
+	if err != nil {
+		log.Println("could not read inserted user:", err)
+		user.ID = id
+		created = &user
+	}
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditUserCreated,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(id),
+		Changes:    data.Diff(nil, created),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deletedUsers lists the users that can still be restored, most recently deleted first.
+func (app *application) deletedUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.DB.DeletedUsers(r.Context())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, users)
+}
+
+// restoreUser brings back a deleted user, as long as nobody has taken their email
+// address since.
+func (app *application) restoreUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var restored *data.User
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		err := tx.RestoreUser(r.Context(), userID)
+		if err != nil {
+			return err
+		}
+
+		restored, err = tx.GetUser(r.Context(), userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.InsertAuditEvent(r.Context(), app.auditEvent(r, data.AuditEvent{
+			Action:     data.AuditUserRestored,
+			TargetType: "user",
+			TargetID:   strconv.Itoa(userID),
+			Changes:    data.Diff(nil, restored),
+		}))
+		return err
+	})
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
 
+	w.Header().Set("ETag", userETag(restored.Version))
+	_ = app.writeJSON(w, http.StatusOK, restored)
 }
@@ -1,11 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
 func Test_app_authentication(t *testing.T) {
@@ -14,6 +26,8 @@ func Test_app_authentication(t *testing.T) {
 		requestBody        string
 		expectedStatusCode int
 	}{
+		{"valid user, different case", `{"email":"ADMIN@example.com","password":"secret"}`, http.StatusOK},
+		{"malformed email", `{"email":"admin","password":"secret"}`, http.StatusUnauthorized},
 		{"valid user", `{"email":"admin@example.com","password":"secret"}`, http.StatusOK},
 		{"not json", `Im Not JSON`, http.StatusUnauthorized},
 		{"empty json", `{}`, http.StatusUnauthorized},
@@ -36,3 +50,376 @@ func Test_app_authentication(t *testing.T) {
 		}
 	}
 }
+
+func Test_app_refresh(t *testing.T) {
+	testUser := data.User{
+		ID:        1,
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     "admin@example.com",
+	}
+
+	// a refresh token which is about to expire
+	oldExpiry := refreshTokenExpiry
+	refreshTokenExpiry = time.Second * 10
+	tokens, _ := app.generateTokenPair(&testUser)
+	refreshTokenExpiry = oldExpiry
+
+	freshTokens, _ := app.generateTokenPair(&testUser)
+
+	var tests = []struct {
+		name               string
+		token              string
+		expectedStatusCode int
+	}{
+		{"valid", tokens.RefreshToken, http.StatusOK},
+		{"not yet due", freshTokens.RefreshToken, http.StatusTooEarly},
+		{"expired", expiredToken, http.StatusBadRequest},
+		{"garbage", "fish", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{"refresh_token": {e.token}}
+		req, _ := http.NewRequest("POST", "/refresh-token", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.refresh)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_userHandlers(t *testing.T) {
+	var tests = []struct {
+		name               string
+		method             string
+		json               string
+		paramID            string
+		ifMatch            string
+		handler            http.HandlerFunc
+		expectedStatusCode int
+	}{
+		{"allUsers", "GET", "", "", "", app.allUsers, http.StatusOK},
+		{"getUser valid", "GET", "", "1", "", app.getUser, http.StatusOK},
+		{"getUser invalid", "GET", "", "100", "", app.getUser, http.StatusNotFound},
+		{"getUser bad URL param", "GET", "", "Y", "", app.getUser, http.StatusBadRequest},
+		{"deleteUser", "DELETE", "", "1", `"1"`, app.deleteUser, http.StatusNoContent},
+		{"deleteUser any version", "DELETE", "", "1", "*", app.deleteUser, http.StatusNoContent},
+		{"deleteUser bad URL param", "DELETE", "", "Y", `"1"`, app.deleteUser, http.StatusBadRequest},
+		{"deleteUser missing", "DELETE", "", "100", `"1"`, app.deleteUser, http.StatusNotFound},
+		{"deleteUser no If-Match", "DELETE", "", "1", "", app.deleteUser, http.StatusPreconditionRequired},
+		{"deleteUser stale", "DELETE", "", "1", `"2"`, app.deleteUser, http.StatusPreconditionFailed},
+		{"deleteUser weak tag", "DELETE", "", "1", `W/"1"`, app.deleteUser, http.StatusPreconditionFailed},
+		{"deletedUsers", "GET", "", "", "", app.deletedUsers, http.StatusOK},
+		{"restoreUser not deleted", "POST", "", "1", "", app.restoreUser, http.StatusNotFound},
+		{"restoreUser bad URL param", "POST", "", "Y", "", app.restoreUser, http.StatusBadRequest},
+		{
+			"insertUser valid",
+			"PUT",
+			`{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"purple monkey dishwasher"}`,
+			"",
+			"",
+			app.insertUser,
+			http.StatusNoContent,
+		},
+		{
+			"insertUser duplicate email",
+			"PUT",
+			`{"first_name":"Jack","last_name":"Smith","email":"Admin@Example.com","password":"purple monkey dishwasher"}`,
+			"",
+			"",
+			app.insertUser,
+			http.StatusConflict,
+		},
+		{
+			"insertUser invalid email",
+			"PUT",
+			`{"first_name":"Jack","last_name":"Smith","email":"jack","password":"purple monkey dishwasher"}`,
+			"",
+			"",
+			app.insertUser,
+			http.StatusBadRequest,
+		},
+		{
+			"insertUser weak password",
+			"PUT",
+			`{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}`,
+			"",
+			"",
+			app.insertUser,
+			http.StatusUnprocessableEntity,
+		},
+		{"insertUser invalid", "PUT", `{"foo":"bar"}`, "", "", app.insertUser, http.StatusBadRequest},
+		{"insertUser invalid json", "PUT", `{"first_name":"Jack"`, "", "", app.insertUser, http.StatusBadRequest},
+		{
+			"updateUser valid",
+			"PATCH",
+			`{"id":1,"first_name":"Administrator","last_name":"User","email":"admin@example.com"}`,
+			"",
+			`"1"`,
+			app.updateUser,
+			http.StatusNoContent,
+		},
+		{
+			"updateUser one of several tags",
+			"PATCH",
+			`{"id":1,"first_name":"Administrator","last_name":"User","email":"admin@example.com"}`,
+			"",
+			`"3", "1"`,
+			app.updateUser,
+			http.StatusNoContent,
+		},
+		{
+			"updateUser invalid",
+			"PATCH",
+			`{"id":100,"first_name":"Administrator","last_name":"User","email":"admin@example.com"}`,
+			"",
+			`"1"`,
+			app.updateUser,
+			http.StatusNotFound,
+		},
+		{
+			"updateUser no If-Match",
+			"PATCH",
+			`{"id":1,"first_name":"Administrator","last_name":"User","email":"admin@example.com"}`,
+			"",
+			"",
+			app.updateUser,
+			http.StatusPreconditionRequired,
+		},
+		{
+			"updateUser stale",
+			"PATCH",
+			`{"id":1,"first_name":"Administrator","last_name":"User","email":"admin@example.com"}`,
+			"",
+			`"2"`,
+			app.updateUser,
+			http.StatusPreconditionFailed,
+		},
+	}
+
+	defer resetDB()
+
+	// an admin, as far as the policy is concerned
+	claims := &Claims{Permissions: []string{data.PermUsersRead, data.PermUsersWrite, data.PermUsersDelete}}
+	claims.Subject = "1"
+
+	for _, e := range tests {
+		// every case starts from the fixtures, so deleting the user doesn't break updating it
+		resetDB()
+
+		var req *http.Request
+		if e.json == "" {
+			req, _ = http.NewRequest(e.method, "/", nil)
+		} else {
+			req, _ = http.NewRequest(e.method, "/", strings.NewReader(e.json))
+		}
+
+		if e.ifMatch != "" {
+			req.Header.Set("If-Match", e.ifMatch)
+		}
+
+		if e.paramID != "" {
+			chiCtx := chi.NewRouteContext()
+			chiCtx.URLParams.Add("userID", e.paramID)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		}
+		req = req.WithContext(context.WithValue(req.Context(), contextClaimsKey, claims))
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: wrong status returned; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_updateUser_policy(t *testing.T) {
+	// the support role may rename users, but not change their email addresses
+	policy, err := authz.LoadPolicy("../../pkg/authz/testdata/support.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultEngine := app.Authz
+	app.Authz = authz.NewEngine(policy, nil)
+	defer func() { app.Authz = defaultEngine }()
+	defer resetDB()
+
+	jackTokens, _ := app.generateTokenPair(&data.User{ID: 2})
+	supportTokens, _ := app.generateTokenPair(&data.User{ID: 5, Roles: []string{"support"}})
+
+	var tests = []struct {
+		name               string
+		token              string
+		json               string
+		expectedStatusCode int
+	}{
+		{"own profile", jackTokens.Token, `{"id":2,"first_name":"Jill","last_name":"Smith","email":"jack@example.com"}`, http.StatusNoContent},
+		{"someone else", jackTokens.Token, `{"id":1,"first_name":"Jill","last_name":"User","email":"admin@example.com"}`, http.StatusForbidden},
+		{"support renames", supportTokens.Token, `{"id":2,"first_name":"Jill","last_name":"Smith","email":"jack@example.com"}`, http.StatusNoContent},
+		{"support changes email", supportTokens.Token, `{"id":2,"first_name":"Jack","last_name":"Smith","email":"jill@example.com"}`, http.StatusForbidden},
+	}
+
+	routes := app.routes()
+	for _, e := range tests {
+		resetDB()
+		_, _ = testDB.InsertUser(context.Background(), data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "secret"})
+
+		req, _ := http.NewRequest("PATCH", "/users/", strings.NewReader(e.json))
+		req.Header.Set("Authorization", "Bearer "+e.token)
+		req.Header.Set("If-Match", `"1"`)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body)
+		}
+	}
+}
+
+func Test_app_userLifecycle(t *testing.T) {
+	defer resetDB()
+	resetDB()
+
+	withUserID := func(req *http.Request, id string) *http.Request {
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("userID", id)
+		return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	}
+
+	// insert a user, and find them in the list
+	req, _ := http.NewRequest("PUT", "/users", strings.NewReader(`{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"purple monkey dishwasher"}`))
+	rr := httptest.NewRecorder()
+	app.insertUser(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("insert: expected status %d but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	user, err := app.DB.GetUserByEmail(context.Background(), "jack@example.com")
+	if err != nil {
+		t.Fatalf("inserted user not found: %s", err)
+	}
+	id := strconv.Itoa(user.ID)
+
+	req, _ = http.NewRequest("GET", "/users/"+id, nil)
+	rr = httptest.NewRecorder()
+	app.getUser(rr, withUserID(req, id))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"email":"jack@example.com"`) {
+		t.Errorf("get: expected the inserted user but got %d %s", rr.Code, rr.Body.String())
+	}
+	etag := rr.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Errorf("get: expected ETag \"1\" but got %q", etag)
+	}
+
+	// they update themselves with the ETag we got, which then goes stale
+	claims := &Claims{}
+	claims.Subject = id
+	asThemselves := func(req *http.Request) *http.Request {
+		return req.WithContext(context.WithValue(req.Context(), contextClaimsKey, claims))
+	}
+	body := `{"id":` + id + `,"first_name":"Jill","last_name":"Smith","email":"jack@example.com"}`
+	req, _ = http.NewRequest("PATCH", "/users", strings.NewReader(body))
+	req.Header.Set("If-Match", etag)
+	rr = httptest.NewRecorder()
+	app.updateUser(rr, asThemselves(req))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("update: expected status %d but got %d", http.StatusNoContent, rr.Code)
+	}
+	newETag := rr.Header().Get("ETag")
+
+	req, _ = http.NewRequest("PATCH", "/users", strings.NewReader(body))
+	req.Header.Set("If-Match", etag)
+	rr = httptest.NewRecorder()
+	app.updateUser(rr, asThemselves(req))
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("update: expected status %d with a stale ETag but got %d", http.StatusPreconditionFailed, rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/users/"+id, nil)
+	rr = httptest.NewRecorder()
+	app.getUser(rr, withUserID(req, id))
+	if rr.Header().Get("ETag") != newETag {
+		t.Errorf("get: expected the ETag returned by the update, %s, but got %s", newETag, rr.Header().Get("ETag"))
+	}
+
+	// delete them, and they're gone
+	req, _ = http.NewRequest("DELETE", "/users/"+id, nil)
+	req.Header.Set("If-Match", newETag)
+	rr = httptest.NewRecorder()
+	app.deleteUser(rr, withUserID(req, id))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("delete: expected status %d but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/users/"+id, nil)
+	rr = httptest.NewRecorder()
+	app.getUser(rr, withUserID(req, id))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("get: expected status %d for a deleted user but got %d", http.StatusNotFound, rr.Code)
+	}
+
+	// until they're restored
+	req, _ = http.NewRequest("GET", "/users/deleted", nil)
+	rr = httptest.NewRecorder()
+	app.deletedUsers(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"email":"jack@example.com"`) ||
+		!strings.Contains(rr.Body.String(), `"deleted_at":`) {
+		t.Errorf("deleted: expected the deleted user but got %d %s", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/users/"+id+"/restore", nil)
+	rr = httptest.NewRecorder()
+	app.restoreUser(rr, withUserID(req, id))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"email":"jack@example.com"`) {
+		t.Errorf("restore: expected the restored user but got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("ETag") == newETag {
+		t.Errorf("restore: expected a new ETag, but got the old one, %s", newETag)
+	}
+
+	req, _ = http.NewRequest("GET", "/users/"+id, nil)
+	rr = httptest.NewRecorder()
+	app.getUser(rr, withUserID(req, id))
+	if rr.Code != http.StatusOK {
+		t.Errorf("get: expected status %d for a restored user but got %d", http.StatusOK, rr.Code)
+	}
+
+	events, _ := app.DB.AuditEvents(context.Background(), data.AuditFilter{TargetType: "user", TargetID: id})
+	var actions []string
+	for _, e := range events {
+		actions = append(actions, e.Action)
+	}
+	expected := []string{data.AuditUserCreated, data.AuditUserUpdated, data.AuditUserDeleted, data.AuditUserRestored}
+	if !slices.Equal(actions, expected) {
+		t.Errorf("expected audit events %v but got %v", expected, actions)
+	}
+}
+
+func Test_app_repoErrorJSON(t *testing.T) {
+	var tests = []struct {
+		name               string
+		err                error
+		expectedStatusCode int
+	}{
+		{"not found", repository.ErrNotFound, http.StatusNotFound},
+		{"duplicate email", &repository.ConstraintError{Kind: repository.ErrDuplicateEmail, Err: errors.New("23505")}, http.StatusConflict},
+		{"invalid email", data.ErrInvalidEmail, http.StatusBadRequest},
+		{"modified", repository.ErrModified, http.StatusPreconditionFailed},
+		{"conflict", fmt.Errorf("saving: %w", repository.ErrConflict), http.StatusConflict},
+		{"anything else", errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		app.repoErrorJSON(rr, e.err)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
@@ -1,6 +1,21 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"personal-projects/webapp/pkg/authz"
+	"strconv"
+	"strings"
+)
+
+type contextKey string
+
+const contextClaimsKey contextKey = "claims"
+const contextIPKey contextKey = "user_ip"
 
 func (app *application) enableCORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -16,14 +31,125 @@ func (app *application) enableCORS(h http.Handler) http.Handler {
 	})
 }
 
+// addIPToContext stores the client's IP address in the context, for the audit log.
+// X-Forwarded-For is only believed when the request comes from one of the trusted
+// proxies; otherwise anyone could say they were anyone.
+func (app *application) addIPToContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextIPKey, app.clientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the address of whoever made r. Proxies append the address they
+// got the request from to X-Forwarded-For, so the client is the last address that
+// isn't one of our proxies; anything before it could have been made up.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || host == "" {
+		return "unknown"
+	}
+	ip := host
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && app.trustedProxy(ip); i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		ip = addr.String()
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip is one of the trusted proxies.
+func (app *application) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, p := range app.TrustedProxies {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma separated list of addresses and CIDR ranges.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", field, err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", field, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// ipFromContext returns the address stored by addIPToContext, or "" if there is none.
+func (app *application) ipFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(contextIPKey).(string)
+	return ip
+}
+
 func (app *application) authRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, _, err := app.GetTokenFromHeaderAndVerify(w, r)
+		_, claims, err := app.GetTokenFromHeaderAndVerify(w, r)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		next.ServeHTTP(w, r)
+		// make the verified claims available to the handlers, and to the
+		// authorization policy
+		ctx := context.WithValue(r.Context(), contextClaimsKey, claims)
+		ctx = authz.WithSubject(ctx, claims.subject())
+		next.ServeHTTP(w, r.WithContext(ctx))
 		return
 	})
 }
+
+// notImpersonating refuses impersonation tokens, for what only users acting as
+// themselves should do, like changing their password. It must follow authRequired.
+func (app *application) notImpersonating(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.claimsFromContext(r.Context()).Actor != nil {
+			app.errorJSON(w, errors.New("not allowed while impersonating"), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// subject is who the claims were issued to. A subject that isn't a user id gets
+// user id 0, which matches nobody.
+func (c *Claims) subject() authz.Subject {
+	userID, _ := strconv.Atoi(c.Subject)
+	return authz.Subject{UserID: userID, Roles: c.Roles, Permissions: c.Permissions}
+}
+
+// claimsFromContext returns the claims stored by authRequired.
+func (app *application) claimsFromContext(ctx context.Context) *Claims {
+	return ctx.Value(contextClaimsKey).(*Claims)
+}
+
+// allowed asks the authorization policy whether the subject of the request's claims
+// may take action on resource, for handlers that decide for themselves.
+func (app *application) allowed(r *http.Request, action string, resource authz.Resource) bool {
+	claims := app.claimsFromContext(r.Context())
+	return app.Authz.Decide(authz.Request{Subject: claims.subject(), Action: action, Resource: resource}).Allowed
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_app_addIPToContext(t *testing.T) {
+	defer func() { app.TrustedProxies = nil }()
+	app.TrustedProxies, _ = parseTrustedProxies("10.0.0.0/8, 192.0.2.10")
+
+	var tests = []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		expectedIP string
+	}{
+		{"direct", "198.51.100.7:1234", nil, "198.51.100.7"},
+		{"made up header", "198.51.100.7:1234", []string{"203.0.113.1"}, "198.51.100.7"},
+		{"through a proxy", "10.0.0.1:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"through a proxy, without a header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"through two proxies", "10.0.0.1:1234", []string{"203.0.113.1, 192.0.2.10"}, "203.0.113.1"},
+		{"through a proxy, made up header", "10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.1"}, "203.0.113.1"},
+		{"through a proxy, headers", "10.0.0.1:1234", []string{"1.2.3.4", "203.0.113.1"}, "203.0.113.1"},
+		{"through a proxy, garbage", "10.0.0.1:1234", []string{"<script>"}, "10.0.0.1"},
+		{"no remote address", "", []string{"203.0.113.1"}, "unknown"},
+	}
+
+	for _, e := range tests {
+		var ip string
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = app.ipFromContext(r.Context())
+		})
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = e.remoteAddr
+		for _, f := range e.forwarded {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		app.addIPToContext(next).ServeHTTP(httptest.NewRecorder(), req)
+
+		if ip != e.expectedIP {
+			t.Errorf("%s: expected ip %q but got %q", e.name, e.expectedIP, ip)
+		}
+	}
+}
+
+func Test_parseTrustedProxies(t *testing.T) {
+	var tests = []struct {
+		name          string
+		proxies       string
+		expectedCount int
+		expectedErr   bool
+	}{
+		{"none", "", 0, false},
+		{"addresses and ranges", "10.0.0.0/8, 192.0.2.10,::1", 3, false},
+		{"bad address", "10.0.0", 0, true},
+		{"bad range", "10.0.0.0/33", 0, true},
+	}
+
+	for _, e := range tests {
+		proxies, err := parseTrustedProxies(e.proxies)
+		if (err != nil) != e.expectedErr {
+			t.Errorf("%s: expected error %t but got %v", e.name, e.expectedErr, err)
+		}
+		if len(proxies) != e.expectedCount {
+			t.Errorf("%s: expected %d proxies but got %d", e.name, e.expectedCount, len(proxies))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"personal-projects/webapp/pkg/data"
+	"strconv"
+	"time"
+)
+
+// settings for reading the audit log
+var (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	// exports are read from the database this many events at a time
+	auditExportBatch = 500
+)
+
+// auditEvent fills in who made the request, and from where: the subject of the
+// token, if there is one and the event doesn't already name an actor, the IP
+// address and the user agent. For impersonation tokens, the actor is the admin,
+// and the detail says who they were acting as.
+func (app *application) auditEvent(r *http.Request, e data.AuditEvent) data.AuditEvent {
+	if e.ActorID == 0 {
+		if claims, ok := r.Context().Value(contextClaimsKey).(*Claims); ok {
+			e.ActorID, _ = strconv.Atoi(claims.Subject)
+			if claims.Actor != nil {
+				e.Detail = data.ActingAs(e.Detail, e.ActorID)
+				e.ActorID, _ = strconv.Atoi(claims.Actor.Subject)
+			}
+		}
+	}
+	e.IP = app.ipFromContext(r.Context())
+	e.UserAgent = r.UserAgent()
+	return e
+}
+
+// audit records e in the audit log. A failure is logged, but doesn't fail the
+// request; changes that must not happen unrecorded write their event in the same
+// transaction instead.
+func (app *application) audit(r *http.Request, e data.AuditEvent) {
+	_, err := app.DB.InsertAuditEvent(r.Context(), app.auditEvent(r, e))
+	if err != nil {
+		log.Printf("could not record %s audit event: %s", e.Action, err)
+	}
+}
+
+// auditEvents lists the audit events that match the query, oldest first: actor,
+// action, target_type, target_id, since and until (RFC 3339 times), and after
+// and limit for paging.
+func (app *application) auditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r.URL.Query())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultAuditLimit
+	}
+
+	events, err := app.DB.AuditEvents(r.Context(), filter)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+	if events == nil {
+		events = []*data.AuditEvent{}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, events)
+}
+
+// exportAuditEvents sends every audit event that matches the query, as for
+// auditEvents but ignoring limit, as newline delimited JSON.
+func (app *application) exportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r.URL.Query())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// read the first batch before committing to a status, so that errors can
+	// still be reported properly
+	filter.Limit = auditExportBatch
+	events, err := app.DB.AuditEvents(r.Context(), filter)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.ndjson"`, time.Now().UTC().Format("20060102T150405Z")))
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	for {
+		for _, e := range events {
+			err = enc.Encode(e)
+			if err != nil {
+				// the client has gone
+				return
+			}
+		}
+		if len(events) < filter.Limit {
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		filter.AfterID = events[len(events)-1].ID
+		events, err = app.DB.AuditEvents(r.Context(), filter)
+		if err != nil {
+			// too late for an error response; a short export is the best we can do
+			log.Println("could not export audit events:", err)
+			return
+		}
+	}
+}
+
+// auditFilter reads the filters auditEvents and exportAuditEvents accept.
+func auditFilter(query url.Values) (data.AuditFilter, error) {
+	filter := data.AuditFilter{
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetID:   query.Get("target_id"),
+	}
+
+	ints := []struct {
+		name string
+		dest *int
+	}{
+		{"actor", &filter.ActorID},
+		{"after", &filter.AfterID},
+		{"limit", &filter.Limit},
+	}
+	for _, p := range ints {
+		if v := query.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return filter, fmt.Errorf("invalid %s %q", p.name, v)
+			}
+			*p.dest = n
+		}
+	}
+	if filter.Limit > maxAuditLimit {
+		return filter, fmt.Errorf("limit must be at most %d", maxAuditLimit)
+	}
+
+	times := []struct {
+		name string
+		dest *time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	}
+	for _, p := range times {
+		if v := query.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s %q; use an RFC 3339 time", p.name, v)
+			}
+			*p.dest = t
+		}
+	}
+
+	return filter, nil
+}
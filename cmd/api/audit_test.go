@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"personal-projects/webapp/pkg/data"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_app_audit(t *testing.T) {
+	defer resetDB()
+	resetDB()
+
+	routes := app.routes()
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("User-Agent", "audit-test")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// a failed and a successful login, and a new user
+	send("POST", "/auth", "", `{"email":"admin@example.com","password":"wrong"}`)
+	rr := send("POST", "/auth", "", `{"email":"admin@example.com","password":"secret"}`)
+	var tokens TokenPairs
+	_ = json.NewDecoder(rr.Body).Decode(&tokens)
+	rr = send("PUT", "/users", tokens.Token, `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"purple monkey dishwasher"}`)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("insert user: expected status %d but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	rr = send("GET", "/audit", tokens.Token, "")
+	var events []data.AuditEvent
+	_ = json.NewDecoder(rr.Body).Decode(&events)
+	if rr.Code != http.StatusOK || len(events) != 3 {
+		t.Fatalf("expected 3 audit events but got %d %s", rr.Code, rr.Body.String())
+	}
+
+	failed, issued, created := events[0], events[1], events[2]
+	if failed.Action != data.AuditLoginFailed || failed.ActorID != 0 || failed.TargetID != "1" || failed.IP != "10.0.0.1" || failed.UserAgent != "audit-test" {
+		t.Errorf("unexpected failed login event %+v", failed)
+	}
+	if issued.Action != data.AuditTokenIssued || issued.ActorID != 1 {
+		t.Errorf("unexpected token event %+v", issued)
+	}
+	if created.Action != data.AuditUserCreated || created.ActorID != 1 || created.Changes["email"].After != "jack@example.com" {
+		t.Errorf("unexpected user created event %+v", created)
+	}
+	if _, ok := created.Changes["password"]; ok {
+		t.Error("the audit log should never hold passwords")
+	}
+
+	var tests = []struct {
+		name               string
+		url                string
+		token              string
+		expectedStatusCode int
+		expectedCount      int
+	}{
+		{"filter by action", "/audit?action=auth.login_failed", tokens.Token, http.StatusOK, 1},
+		{"filter by actor", "/audit?actor=1", tokens.Token, http.StatusOK, 2},
+		{"filter by target", "/audit?target_type=user&target_id=1", tokens.Token, http.StatusOK, 2},
+		{"page", "/audit?after=1&limit=1", tokens.Token, http.StatusOK, 1},
+		{"since", "/audit?since=2999-01-01T00:00:00Z", tokens.Token, http.StatusOK, 0},
+		{"bad actor", "/audit?actor=fish", tokens.Token, http.StatusBadRequest, 0},
+		{"bad time", "/audit?since=yesterday", tokens.Token, http.StatusBadRequest, 0},
+		{"limit too high", "/audit?limit=100000", tokens.Token, http.StatusBadRequest, 0},
+		{"no token", "/audit", "", http.StatusUnauthorized, 0},
+	}
+
+	for _, e := range tests {
+		rr := send("GET", e.url, e.token, "")
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		var got []data.AuditEvent
+		_ = json.NewDecoder(rr.Body).Decode(&got)
+		if len(got) != e.expectedCount {
+			t.Errorf("%s: expected %d events but got %d", e.name, e.expectedCount, len(got))
+		}
+	}
+
+	// without audit:read, the log is out of reach
+	nobody, _ := app.generateTokenPair(&data.User{ID: 2})
+	rr = send("GET", "/audit", nobody.Token, "")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status %d without audit:read but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// the export is one event a line, in batches
+	defer func(batch int) { auditExportBatch = batch }(auditExportBatch)
+	auditExportBatch = 2
+
+	rr = send("GET", "/audit/export", tokens.Token, "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected an ndjson export but got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	var ids []int
+	lines := bufio.NewScanner(rr.Body)
+	for lines.Scan() {
+		var e data.AuditEvent
+		err := json.Unmarshal(lines.Bytes(), &e)
+		if err != nil {
+			t.Fatalf("export line %q is not an event: %s", lines.Text(), err)
+		}
+		ids = append(ids, e.ID)
+	}
+	// reading the log is not itself logged, so there are still 3 events
+	if len(ids) != 3 || ids[0] != events[0].ID || ids[2] != events[2].ID {
+		t.Errorf("expected the 3 events in order, but got ids %v", ids)
+	}
+
+	// deleting a user is recorded with what was deleted
+	jack, _ := app.DB.GetUserByEmail(context.Background(), "jack@example.com")
+	req, _ := http.NewRequest("DELETE", "/users/"+strconv.Itoa(jack.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	req.Header.Set("If-Match", "*")
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("delete user: expected status %d but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	deleted, _ := app.DB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditUserDeleted})
+	if len(deleted) != 1 || deleted[0].TargetID != strconv.Itoa(jack.ID) || deleted[0].Changes["email"].Before != "jack@example.com" {
+		t.Errorf("expected the deletion of Jack to be recorded, but got %+v", deleted)
+	}
+}
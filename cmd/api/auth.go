@@ -6,6 +6,7 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 	"net/http"
 	"personal-projects/webapp/pkg/data"
+	"slices"
 	"strings"
 	"time"
 )
@@ -20,9 +21,25 @@ type TokenPairs struct {
 
 type Claims struct {
 	UserName string `json:"name"`
+	// Roles and Permissions are the user's when the token was issued; changes take
+	// effect when it is refreshed.
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	// Actor is set on impersonation tokens: the admin acting as the subject.
+	Actor *Actor `json:"act,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Actor is the act claim of RFC 8693: who is acting as the token's subject.
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// Can reports whether the token grants permission.
+func (c *Claims) Can(permission string) bool {
+	return slices.Contains(c.Permissions, permission)
+}
+
 func (app *application) GetTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Request) (string, *Claims, error) {
 	// add a header
 	w.Header().Add("Vary", "Authorization")
@@ -73,23 +90,8 @@ func (app *application) GetTokenFromHeaderAndVerify(w http.ResponseWriter, r *ht
 }
 
 func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
-	// Create the token
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["name"] = fmt.Sprintf("%s %s", user.FirstName, user.LastName)
-	claims["sub"] = fmt.Sprint(user.ID)
-	claims["aud"] = app.Domain
-	claims["iss"] = app.Domain
-	if user.IsAdmin == 1 {
-		claims["admin"] = true
-	} else {
-		claims["admin"] = false
-	}
-	// set the expiry
-	claims["exp"] = time.Now().Add(jwtTokenExpiry).Unix()
-
 	// create signed token
-	signedAccessToken, err := token.SignedString([]byte(app.JWSecret))
+	signedAccessToken, err := app.generateAccessToken(user, nil)
 	if err != nil {
 		return TokenPairs{}, err
 	}
@@ -111,3 +113,23 @@ func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
 	}
 	return tokenPairs, nil
 }
+
+// generateAccessToken signs an access token for user. act, if not nil, is the admin
+// acting as them.
+func (app *application) generateAccessToken(user *data.User, act *Actor) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	claims["name"] = fmt.Sprintf("%s %s", user.FirstName, user.LastName)
+	claims["sub"] = fmt.Sprint(user.ID)
+	claims["aud"] = app.Domain
+	claims["iss"] = app.Domain
+	claims["roles"] = user.Roles
+	claims["permissions"] = user.Permissions
+	if act != nil {
+		claims["act"] = act
+	}
+	// set the expiry
+	claims["exp"] = time.Now().Add(jwtTokenExpiry).Unix()
+
+	return token.SignedString([]byte(app.JWSecret))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"personal-projects/webapp/pkg/avatar"
+	"personal-projects/webapp/pkg/data"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var avatarURLExpiry = time.Hour * 24 * 7
+
+// avatarURL returns a signed URL for a user's avatar, which can be embedded in emails
+// or used by clients without a web session. The URL always resolves to an image, since
+// users without a profile picture are served a generated identicon. Signing a URL
+// takes users:read on the user, which the default policy grants for one's own avatar.
+func (app *application) avatarURL(w http.ResponseWriter, r *http.Request) {
+	if app.AvatarSecret == "" {
+		app.errorJSON(w, errors.New("avatar signing is not configured"), http.StatusNotImplemented)
+		return
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = "md"
+	}
+	if _, ok := avatar.Sizes[size]; !ok {
+		app.errorJSON(w, fmt.Errorf("invalid size %q", size))
+		return
+	}
+
+	if !app.allowed(r, data.PermUsersRead, userResource(r)) {
+		app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
+
+	_, err = app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	expires := time.Now().Add(avatarURLExpiry)
+	path := fmt.Sprintf("/avatars/%d/%s", userID, size)
+
+	var payload = struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}{
+		URL:     app.WebURL + avatar.SignURL([]byte(app.AvatarSecret), path, expires),
+		Expires: expires,
+	}
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
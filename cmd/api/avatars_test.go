@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"personal-projects/webapp/pkg/avatar"
+	"personal-projects/webapp/pkg/data"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_app_avatarURL(t *testing.T) {
+	app.AvatarSecret = "avatar-secret"
+	app.WebURL = "http://localhost:8080"
+	defer func() { app.AvatarSecret = "" }()
+
+	var tests = []struct {
+		name               string
+		userID             string
+		query              string
+		claims             *Claims
+		expectedStatusCode int
+	}{
+		{"own avatar", "1", "", &Claims{}, http.StatusOK},
+		{"own avatar, small", "1", "?size=sm", &Claims{}, http.StatusOK},
+		{"bad size", "1", "?size=huge", &Claims{}, http.StatusBadRequest},
+		{"someone else's avatar", "2", "", &Claims{}, http.StatusForbidden},
+		{"admin, missing user", "2", "", &Claims{Permissions: []string{data.PermUsersRead}}, http.StatusNotFound},
+		{"bad id", "fish", "", &Claims{}, http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		e.claims.Subject = "1"
+
+		req, _ := http.NewRequest("GET", "/users/"+e.userID+"/avatar-url"+e.query, nil)
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("userID", e.userID)
+		ctx := context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx)
+		ctx = context.WithValue(ctx, contextClaimsKey, e.claims)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.avatarURL)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+
+		if rr.Code == http.StatusOK {
+			var payload struct {
+				URL string `json:"url"`
+			}
+			_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+			u, err := url.Parse(payload.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !avatar.VerifyURL([]byte(app.AvatarSecret), u, time.Now()) {
+				t.Errorf("%s: returned url %s does not verify", e.name, payload.URL)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errPreconditionRequired is returned to clients that try to change a user without
+// saying which version of it they have seen.
+var errPreconditionRequired = errors.New("an If-Match header with the user's ETag is required")
+
+// userETag returns the entity tag for a version of a user.
+func userETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatch returns the entity tags in the request's If-Match header, or
+// errPreconditionRequired if there are none.
+func ifMatch(r *http.Request) ([]string, error) {
+	var tags []string
+	for _, value := range r.Header.Values("If-Match") {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil, errPreconditionRequired
+	}
+	return tags, nil
+}
+
+// etagMatches reports whether one of tags is "*" or the tag for version. If-Match
+// uses strong comparison, so weak tags never match.
+func etagMatches(tags []string, version int) bool {
+	for _, tag := range tags {
+		if tag == "*" || tag == userETag(version) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"personal-projects/webapp/pkg/data"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// impersonationToken is what impersonate returns. There is no refresh token: an
+// impersonation ends when its access token expires.
+type impersonationToken struct {
+	Token     string    `json:"access_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// impersonate issues an access token for a user, with the caller as its act claim,
+// so that support staff can see the api as the user does. Everything done with it
+// is recorded as done by the caller, and what only users themselves should do, like
+// changing their password, is refused. Nobody can impersonate someone who may do
+// something they may not.
+func (app *application) impersonate(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	claims := app.claimsFromContext(r.Context())
+	if claims.Subject == strconv.Itoa(userID) {
+		app.errorJSON(w, errors.New("you can't impersonate yourself"))
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	for _, p := range user.Permissions {
+		if !claims.Can(p) {
+			app.errorJSON(w, fmt.Errorf("user %d may do more than you: %s", userID, p), http.StatusForbidden)
+			return
+		}
+	}
+
+	token, err := app.generateAccessToken(user, &Actor{Subject: claims.Subject})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Now().Add(jwtTokenExpiry).UTC().Truncate(time.Second)
+
+	// an impersonation nobody can account for mustn't happen
+	_, err = app.DB.InsertAuditEvent(r.Context(), app.auditEvent(r, data.AuditEvent{
+		Action:     data.AuditImpersonationStarted,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(userID),
+		Detail:     "api token, expires " + expiresAt.Format(time.RFC3339),
+	}))
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, impersonationToken{Token: token, ExpiresAt: expiresAt})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"personal-projects/webapp/pkg/data"
+	"strings"
+	"testing"
+)
+
+func Test_app_impersonate(t *testing.T) {
+	defer resetDB()
+	resetDB()
+	ctx := context.Background()
+
+	_, err := testDB.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _ := testDB.GetUser(ctx, 1)
+	jack, _ := testDB.GetUser(ctx, 2)
+	adminTokens, _ := app.generateTokenPair(admin)
+	jackTokens, _ := app.generateTokenPair(jack)
+
+	routes := app.routes()
+	send := func(method, url, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var tests = []struct {
+		name               string
+		url                string
+		token              string
+		expectedStatusCode int
+	}{
+		{"self", "/users/1/impersonate", adminTokens.Token, http.StatusBadRequest},
+		{"missing user", "/users/100/impersonate", adminTokens.Token, http.StatusNotFound},
+		{"not permitted", "/users/1/impersonate", jackTokens.Token, http.StatusForbidden},
+		{"valid", "/users/2/impersonate", adminTokens.Token, http.StatusOK},
+	}
+
+	var token impersonationToken
+	for _, e := range tests {
+		rr := send("POST", e.url, e.token)
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body)
+		}
+		if rr.Code == http.StatusOK {
+			_ = json.NewDecoder(rr.Body).Decode(&token)
+		}
+	}
+
+	// the token is jack's, with the admin as its actor
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	_, claims, err := app.GetTokenFromHeaderAndVerify(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("expected a valid token but got %s", err)
+	}
+	if claims.Subject != "2" || claims.Actor == nil || claims.Actor.Subject != "1" || len(claims.Permissions) != 0 {
+		t.Errorf("expected a token for jack, acted on by the admin, but got %+v", claims)
+	}
+	if token.ExpiresAt.IsZero() {
+		t.Error("expected the token to say when it expires")
+	}
+
+	events, _ := testDB.AuditEvents(ctx, data.AuditFilter{Action: data.AuditImpersonationStarted})
+	if len(events) != 1 || events[0].ActorID != 1 || events[0].TargetID != "2" || !strings.HasPrefix(events[0].Detail, "api token, expires ") {
+		t.Errorf("expected the impersonation to be audited once, but got %+v", events)
+	}
+
+	// the admin sees what jack sees, but can't do what only jack should
+	var impersonating = []struct {
+		name               string
+		method             string
+		url                string
+		expectedStatusCode int
+	}{
+		{"profile", "GET", "/users/2", http.StatusOK},
+		{"someone else", "GET", "/users/1", http.StatusForbidden},
+		{"password", "PUT", "/users/2/password", http.StatusForbidden},
+		{"export", "GET", "/users/2/export", http.StatusForbidden},
+		{"closure", "POST", "/users/2/closure", http.StatusForbidden},
+		{"impersonate again", "POST", "/users/1/impersonate", http.StatusForbidden},
+	}
+	for _, e := range impersonating {
+		rr := send(e.method, e.url, token.Token)
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("impersonating, %s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+
+	// it can't be swapped for jack's own tokens
+	postedData := url.Values{"refresh_token": {token.Token}}
+	req, _ = http.NewRequest("POST", "/refresh-token", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("refresh: expected status 400 but got %d", rr.Code)
+	}
+
+	// nobody can become someone who may do more than they may
+	err = testDB.AssignRole(ctx, 2, data.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	support, _ := app.generateTokenPair(&data.User{ID: 1, Permissions: []string{data.PermUsersRead, data.PermUsersImpersonate}})
+	rr = send("POST", "/users/2/impersonate", support.Token)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("may do more: expected status 403 but got %d", rr.Code)
+	}
+}
+
+func Test_app_auditEvent_impersonating(t *testing.T) {
+	claims := &Claims{Actor: &Actor{Subject: "1"}}
+	claims.Subject = "2"
+	req, _ := http.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), contextClaimsKey, claims))
+
+	e := app.auditEvent(req, data.AuditEvent{Action: data.AuditImageUploaded, Detail: "jack.png"})
+	if e.ActorID != 1 || e.Detail != "jack.png; acting as user 2" {
+		t.Errorf("expected the admin to act as jack, but got actor %d, detail %q", e.ActorID, e.Detail)
+	}
+}
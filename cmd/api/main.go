@@ -1,37 +1,190 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
+	"os"
+	"personal-projects/webapp/pkg/auditchain"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/passwordpolicy"
 	"personal-projects/webapp/pkg/repository"
-	"personal-projects/webapp/pkg/repository/dbrepo"
+	"personal-projects/webapp/pkg/scanner"
+	"personal-projects/webapp/pkg/tus"
+	"time"
 )
 
 const port = 8090
 
 type application struct {
-	DSN      string
-	DB       repository.DatabaseRepo
-	Domain   string
-	JWSecret string
+	DBDriver     string
+	DSN          string
+	SQLiteFile   string
+	DB           repository.DatabaseRepo
+	Domain       string
+	JWSecret     string
+	AvatarSecret string
+	WebURL       string
+	UploadPath   string
+	// ClosureCoolingOff is how long users who close their account have to change
+	// their mind before it is deleted.
+	ClosureCoolingOff time.Duration
+	Uploads           *tus.Handler
+	Scanner           scanner.Scanner
+	Quarantine        *scanner.Quarantine
+	PasswordPolicy    passwordpolicy.Policy
+	Authz             *authz.Engine
+	// TrustedProxies are the addresses of the reverse proxies in front of the api,
+	// whose X-Forwarded-For headers say who the client is.
+	TrustedProxies []netip.Prefix
 }
 
 func main() {
 	var app application
+	var tusDir, clamdNetwork, clamdAddr, quarantineDir string
+	var dbTimeout, cacheTTL time.Duration
+	var cacheSize, bcryptCost int
+	var migrate, cacheNotify bool
+	var passwordHash, breachedPasswords string
+	var policyFile, decisionLog string
+	var auditKey string
+	var auditCheckpointInterval, purgeAfter time.Duration
+	var passwordMinLength, passwordMinScore int
+	var trustedProxies string
+	var argon2Memory, argon2Time, argon2Threads uint
 	flag.StringVar(&app.Domain, "domain", "example.com", "Domain for application")
+	flag.StringVar(&app.DBDriver, "db-driver", "postgres", "database to use: postgres|sqlite")
 	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5431 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "Posgtres connection")
+	flag.StringVar(&app.SQLiteFile, "sqlite-file", "./webapp.db", "database file when -db-driver=sqlite")
+	flag.BoolVar(&migrate, "migrate", false, "apply pending schema migrations on startup; always done for sqlite")
+	flag.DurationVar(&dbTimeout, "db-timeout", 3*time.Second, "maximum duration of a single database query; negative for no limit")
+	flag.IntVar(&cacheSize, "cache-size", 1000, "number of user lookups to cache; 0 turns the cache off")
+	flag.DurationVar(&cacheTTL, "cache-ttl", time.Minute, "how long a cached user lookup may be used")
+	flag.BoolVar(&cacheNotify, "cache-notify", false, "share cache invalidations with other instances through Postgres LISTEN/NOTIFY")
+	flag.StringVar(&passwordHash, "password-hash", "argon2id", "algorithm for new password hashes: argon2id|bcrypt; hashes made with the other are upgraded on login")
+	flag.UintVar(&argon2Memory, "argon2-memory", uint(data.DefaultArgon2id.Memory), "argon2id memory in KiB")
+	flag.UintVar(&argon2Time, "argon2-time", uint(data.DefaultArgon2id.Time), "argon2id number of passes")
+	flag.UintVar(&argon2Threads, "argon2-threads", uint(data.DefaultArgon2id.Threads), "argon2id degree of parallelism")
+	flag.IntVar(&bcryptCost, "bcrypt-cost", 12, "bcrypt cost")
+	flag.IntVar(&passwordMinLength, "password-min-length", passwordpolicy.Default.MinLength, "fewest characters a new password may have")
+	flag.IntVar(&passwordMinScore, "password-min-score", passwordpolicy.Default.MinScore, "lowest strength score, from 0 to 4, a new password may have")
+	flag.StringVar(&breachedPasswords, "breached-passwords", "", "sorted SHA-1 list of breached passwords from Have I Been Pwned, as one file or a directory of range files; new passwords are not checked against one if empty")
+	flag.StringVar(&policyFile, "policy", "", "YAML or JSON authorization policy; the built-in default if empty")
+	flag.StringVar(&decisionLog, "decision-log", "-", "file to append authorization decisions to, one JSON object a line; - for stderr; none if empty")
+	flag.StringVar(&auditKey, "audit-signing-key", "", "PEM Ed25519 key to sign audit log checkpoints with, as made by cmd/cli -action=audit-keygen; the log isn't sealed if empty")
+	flag.DurationVar(&auditCheckpointInterval, "audit-checkpoint-interval", time.Hour, "how often to seal the audit log with a signed checkpoint")
+	flag.DurationVar(&purgeAfter, "purge-after", 30*24*time.Hour, "how long deleted users can be restored before they and their images are removed for good; 0 keeps them forever")
+	flag.DurationVar(&app.ClosureCoolingOff, "closure-cooling-off", 14*24*time.Hour, "how long users who close their account can change their mind before it is deleted")
 	flag.StringVar(&app.JWSecret, "jwt-secret", "2dce505d96a53c5768052ee90f3df2055657518dad489160df9913f66042e160", "signing secret")
+	flag.StringVar(&app.AvatarSecret, "avatar-secret", "", "secret used to sign avatar URLs; must match the web app")
+	flag.StringVar(&app.WebURL, "web-url", "http://localhost:8080", "base URL of the web app, which serves avatars")
+	flag.StringVar(&app.UploadPath, "upload-path", "./uploads/img", "directory for uploaded images; must match the web app")
+	flag.StringVar(&tusDir, "tus-dir", "./uploads/tus", "directory for partial resumable uploads")
+	flag.StringVar(&clamdNetwork, "clamd-network", "tcp", "how to reach clamd: tcp|unix")
+	flag.StringVar(&clamdAddr, "clamd-addr", "", "clamd address (host:port or socket path); uploads are not scanned if empty")
+	flag.StringVar(&quarantineDir, "quarantine-dir", "./uploads/quarantine", "directory for infected uploads")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is believed; none if empty")
 	flag.Parse()
 
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.TrustedProxies = proxies
+
+	passwords, err := data.NewPasswordHasher(passwordHash,
+		data.Argon2id{Memory: uint32(argon2Memory), Time: uint32(argon2Time), Threads: uint8(argon2Threads)},
+		data.Bcrypt{Cost: bcryptCost},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data.Passwords = passwords
+
+	app.PasswordPolicy = passwordpolicy.Default
+	app.PasswordPolicy.MinLength = passwordMinLength
+	app.PasswordPolicy.MinScore = passwordMinScore
+	if breachedPasswords != "" {
+		breached, err := passwordpolicy.OpenBreachedFile(breachedPasswords)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer breached.Close()
+		app.PasswordPolicy.Breached = breached
+	}
+
+	policy, err := authz.LoadPolicy(policyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	decisions, err := authz.OpenDecisionLog(decisionLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if decisions != nil {
+		defer decisions.Close()
+	}
+	app.Authz = authz.NewEngine(policy, decisions)
+
 	conn, err := app.connectToDB()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	if migrate || app.DBDriver == "sqlite" {
+		err = app.migrateDB(conn)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	app.DB = app.newRepo(conn, dbTimeout)
+	if cacheSize > 0 {
+		app.DB = app.cacheRepo(app.DB, conn, cacheSize, cacheTTL, cacheNotify)
+	}
+
+	// seal the audit log, which the web app writes to as well, every so often
+	if auditKey != "" {
+		key, err := auditchain.LoadPrivateKey(auditKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go auditchain.SealEvery(context.Background(), app.DB, key, auditCheckpointInterval)
+	}
+
+	err = os.MkdirAll(app.UploadPath, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// scan uploads for malware
+	if clamdAddr != "" {
+		app.Scanner = &scanner.ClamdScanner{Network: clamdNetwork, Address: clamdAddr, Timeout: time.Minute}
+		app.Quarantine = &scanner.Quarantine{Dir: quarantineDir}
+	} else {
+		log.Println("WARNING: no clamd address given; uploads will not be scanned for malware")
+	}
+
+	// set up resumable uploads, and remove abandoned ones every hour
+	app.Uploads, err = app.newUploadHandler(tusDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go app.Uploads.CollectGarbage(context.Background(), time.Hour)
+
+	// delete the accounts users closed, once they can no longer change their mind
+	go app.closeAccountsEvery(context.Background(), time.Hour)
+
+	// remove deleted users for good once they can no longer be restored
+	if purgeAfter > 0 {
+		go app.purgeEvery(context.Background(), time.Hour, purgeAfter)
+	}
+
 	log.Printf("Starting api on port %d", port)
 
 	err = http.ListenAndServe(fmt.Sprintf(":%d", port), app.routes())
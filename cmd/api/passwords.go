@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"personal-projects/webapp/pkg/data"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// passwordPayload is what clients send to set a password.
+type passwordPayload struct {
+	// CurrentPassword is required when users change their own password.
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+// setPassword changes a user's password. Users changing their own must give their
+// current password as well; users the policy allows users:write on someone else
+// may reset their password without it, as long as that user can't do anything they
+// can't. Either way, the new password must follow the password policy.
+func (app *application) setPassword(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	claims := app.claimsFromContext(r.Context())
+	own := claims.Subject == fmt.Sprint(userID)
+	if !app.allowed(r, data.PermUsersWrite, userResource(r)) {
+		app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
+
+	var payload passwordPayload
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	if own {
+		valid, err := user.PasswordMatches(payload.CurrentPassword)
+		if err != nil || !valid {
+			app.errorJSON(w, errors.New("current password is incorrect"), http.StatusForbidden)
+			return
+		}
+	} else {
+		// setting someone's password is as good as logging in as them
+		for _, p := range user.Permissions {
+			if !claims.Can(p) {
+				app.errorJSON(w, fmt.Errorf("user %d may do more than you: %s", userID, p), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	err = app.PasswordPolicy.Check(payload.Password, user.FirstName, user.LastName, user.Email)
+	if err != nil {
+		app.passwordErrorJSON(w, err)
+		return
+	}
+
+	err = app.DB.ResetPassword(r.Context(), userID, payload.Password)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	action := data.AuditPasswordReset
+	if own {
+		action = data.AuditPasswordChanged
+	}
+	app.audit(r, data.AuditEvent{Action: action, TargetType: "user", TargetID: strconv.Itoa(userID)})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/passwordpolicy"
+	"personal-projects/webapp/pkg/repository/dbrepo"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_app_setPassword(t *testing.T) {
+	var tests = []struct {
+		name               string
+		userID             string
+		claims             *Claims
+		json               string
+		expectedStatusCode int
+		expectedRules      []string
+	}{
+		{"change own", "1", &Claims{}, `{"current_password":"secret","password":"purple monkey dishwasher"}`, http.StatusNoContent, nil},
+		{"change own, wrong current password", "1", &Claims{}, `{"current_password":"wrong","password":"purple monkey dishwasher"}`, http.StatusForbidden, nil},
+		{"change own, no current password", "1", &Claims{Permissions: []string{data.PermUsersWrite}}, `{"password":"purple monkey dishwasher"}`, http.StatusForbidden, nil},
+		{"change own, weak", "1", &Claims{}, `{"current_password":"secret","password":"secret"}`, http.StatusUnprocessableEntity, []string{passwordpolicy.RuleMinLength, passwordpolicy.RuleStrength}},
+		{"change own, name", "1", &Claims{}, `{"current_password":"secret","password":"purple admin dishwasher"}`, http.StatusUnprocessableEntity, []string{passwordpolicy.RuleContext}},
+		{"reset someone else's", "2", &Claims{}, `{"password":"purple monkey dishwasher"}`, http.StatusForbidden, nil},
+		{"admin reset", "2", &Claims{Permissions: []string{data.PermUsersWrite}}, `{"password":"purple monkey dishwasher"}`, http.StatusNoContent, nil},
+		{"admin reset, too long", "2", &Claims{Permissions: []string{data.PermUsersWrite}}, `{"password":"` + strings.Repeat("kP9#vL2!qZ", 8) + `"}`, http.StatusUnprocessableEntity, []string{passwordpolicy.RuleMaxLength}},
+		{"admin reset, missing user", "3", &Claims{Permissions: []string{data.PermUsersWrite}}, `{"password":"purple monkey dishwasher"}`, http.StatusNotFound, nil},
+		{"bad id", "fish", &Claims{}, `{"password":"purple monkey dishwasher"}`, http.StatusBadRequest, nil},
+		{"bad json", "1", &Claims{}, `{"pass":"word"}`, http.StatusBadRequest, nil},
+	}
+
+	defer resetDB()
+
+	for _, e := range tests {
+		// user 2 is Jack Smith, whose password is also "secret"
+		fixtures := dbrepo.TestFixtures()
+		jack := fixtures.Users[0]
+		jack.ID, jack.FirstName, jack.LastName, jack.Email, jack.Roles = 2, "Jack", "Smith", "jack@smith.com", nil
+		fixtures.Users = append(fixtures.Users, jack)
+		_ = testDB.Seed(fixtures)
+
+		e.claims.Subject = "1"
+
+		req, _ := http.NewRequest("PUT", "/users/"+e.userID+"/password", strings.NewReader(e.json))
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("userID", e.userID)
+		ctx := context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx)
+		ctx = context.WithValue(ctx, contextClaimsKey, e.claims)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.setPassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+
+		if rr.Code == http.StatusUnprocessableEntity {
+			var payload struct {
+				Error struct {
+					Message    string                    `json:"message"`
+					Violations passwordpolicy.Violations `json:"violations"`
+				} `json:"error"`
+			}
+			_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+			var rules []string
+			for _, v := range payload.Error.Violations {
+				rules = append(rules, v.Rule)
+			}
+			if strings.Join(rules, ",") != strings.Join(e.expectedRules, ",") {
+				t.Errorf("%s: expected violations %v but got %v", e.name, e.expectedRules, rules)
+			}
+			if !strings.HasPrefix(payload.Error.Message, "password ") {
+				t.Errorf("%s: expected a message about the password but got %q", e.name, payload.Error.Message)
+			}
+		}
+
+		if rr.Code == http.StatusNoContent {
+			id, _ := strconv.Atoi(e.userID)
+			user, _ := testDB.GetUser(context.Background(), id)
+			if user.Password == jack.Password {
+				t.Errorf("%s: password was not changed", e.name)
+			}
+		}
+	}
+}
+
+func Test_app_setPassword_mayDoMore(t *testing.T) {
+	defer resetDB()
+
+	// jack is an admin, and so may do more than someone who can only write users
+	fixtures := dbrepo.TestFixtures()
+	jack := fixtures.Users[0]
+	jack.ID, jack.FirstName, jack.LastName, jack.Email = 2, "Jack", "Smith", "jack@smith.com"
+	fixtures.Users = append(fixtures.Users, jack)
+	_ = testDB.Seed(fixtures)
+
+	claims := &Claims{Permissions: []string{data.PermUsersWrite}}
+	claims.Subject = "1"
+	req, _ := http.NewRequest("PUT", "/users/2/password", strings.NewReader(`{"password":"purple monkey dishwasher"}`))
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("userID", "2")
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx)
+	ctx = context.WithValue(ctx, contextClaimsKey, claims)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.setPassword)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 but got %d", rr.Code)
+	}
+	user, _ := testDB.GetUser(context.Background(), 2)
+	if user.Password != jack.Password {
+		t.Error("password was changed")
+	}
+}
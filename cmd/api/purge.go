@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"strconv"
+	"time"
+)
+
+// purgeDeletedUsers removes the users deleted more than retention ago for good,
+// along with their image files, unless other images are stored in them, and returns
+// how many there were. If a file can't be removed, nobody is purged, and the next run
+// tries again.
+func (app *application) purgeDeletedUsers(ctx context.Context, retention time.Duration) (int, error) {
+	var purged []data.PurgedUser
+	err := app.DB.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		var err error
+		purged, err = tx.PurgeDeletedUsers(ctx, time.Now().Add(-retention))
+		if err != nil {
+			return err
+		}
+
+		for _, u := range purged {
+			for _, fileName := range u.FileNames {
+				count, err := tx.CountUserImagesByFileName(ctx, fileName)
+				if err != nil {
+					return err
+				}
+				if count > 0 {
+					continue
+				}
+
+				err = os.Remove(filepath.Join(app.UploadPath, fileName))
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+
+			_, err = tx.InsertAuditEvent(ctx, data.AuditEvent{
+				Action:     data.AuditUserPurged,
+				TargetType: "user",
+				TargetID:   strconv.Itoa(u.ID),
+				Detail:     fmt.Sprintf("deleted more than %s ago; %d images removed", retention, len(u.FileNames)),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(purged), nil
+}
+
+// purgeEvery purges the users deleted more than retention ago every interval, until
+// ctx is done.
+func (app *application) purgeEvery(ctx context.Context, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := app.purgeDeletedUsers(ctx, retention)
+			if err != nil {
+				log.Println("error purging deleted users:", err)
+			}
+			if n > 0 {
+				log.Printf("purged %d deleted users", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/data"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_app_purgeDeletedUsers(t *testing.T) {
+	defer resetDB()
+	resetDB()
+	ctx := context.Background()
+
+	id, err := app.DB.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.DB.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "jack.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(app.UploadPath, "jack.png")
+	err = os.WriteFile(path, []byte("png"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.DB.DeleteUser(ctx, id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// still within the retention window
+	n, err := app.purgeDeletedUsers(ctx, time.Hour)
+	if err != nil || n != 0 {
+		t.Errorf("expected nobody to be purged within an hour, but got %d, %v", n, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the image to be kept, but got %s", err)
+	}
+
+	n, err = app.purgeDeletedUsers(ctx, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected one user to be purged, but got %d, %v", n, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the image to be removed, but got %v", err)
+	}
+	if err := app.DB.RestoreUser(ctx, id); err == nil {
+		t.Error("expected a purged user not to be restorable")
+	}
+
+	events, _ := app.DB.AuditEvents(ctx, data.AuditFilter{Action: data.AuditUserPurged})
+	if len(events) != 1 || events[0].TargetID != strconv.Itoa(id) {
+		t.Errorf("expected the purge to be audited, but got %+v", events)
+	}
+}
+
+func Test_app_purgeDeletedUsers_sharedFile(t *testing.T) {
+	defer resetDB()
+	resetDB()
+	ctx := context.Background()
+
+	// the admin's image is stored in the same file as jack's
+	id, err := app.DB.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.DB.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "img.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(app.UploadPath, "img.png")
+	err = os.WriteFile(path, []byte("png"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	err = app.DB.DeleteUser(ctx, id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := app.purgeDeletedUsers(ctx, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected one user to be purged, but got %d, %v", n, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the admin's image to be kept, but got %s", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"personal-projects/webapp/pkg/data"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// allRoles lists every role, with the permissions it grants.
+func (app *application) allRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.DB.AllRoles(r.Context())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, roles)
+}
+
+// assignRole gives the user a role. Assigning a role the user already has succeeds,
+// so that clients can safely retry. The user's tokens only carry the new
+// permissions once they are refreshed.
+func (app *application) assignRole(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	role := chi.URLParam(r, "role")
+	err = app.DB.AssignRole(r.Context(), userID, role)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+	app.audit(r, data.AuditEvent{Action: data.AuditRoleAssigned, TargetType: "user", TargetID: strconv.Itoa(userID), Detail: role})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeRole takes a role away from the user.
+func (app *application) revokeRole(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	role := chi.URLParam(r, "role")
+	err = app.DB.RevokeRole(r.Context(), userID, role)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+	app.audit(r, data.AuditEvent{Action: data.AuditRoleRevoked, TargetType: "user", TargetID: strconv.Itoa(userID), Detail: role})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// grantPermission lets everyone with the role do something more.
+func (app *application) grantPermission(w http.ResponseWriter, r *http.Request) {
+	err := app.DB.GrantPermission(r.Context(), chi.URLParam(r, "role"), chi.URLParam(r, "permission"))
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokePermission stops the role from granting a permission.
+func (app *application) revokePermission(w http.ResponseWriter, r *http.Request) {
+	err := app.DB.RevokePermission(r.Context(), chi.URLParam(r, "role"), chi.URLParam(r, "permission"))
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"personal-projects/webapp/pkg/data"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func Test_app_permissions(t *testing.T) {
+	defer resetDB()
+	resetDB()
+
+	admin, _ := app.DB.GetUser(context.Background(), 1)
+	adminTokens, _ := app.generateTokenPair(admin)
+	nobodyTokens, _ := app.generateTokenPair(&data.User{ID: 2, FirstName: "Jack", LastName: "Smith"})
+
+	var tests = []struct {
+		name               string
+		method             string
+		url                string
+		token              string
+		expectedStatusCode int
+	}{
+		{"list users", "GET", "/users", adminTokens.Token, http.StatusOK},
+		{"list users, no permission", "GET", "/users", nobodyTokens.Token, http.StatusForbidden},
+		{"list users, no token", "GET", "/users", "", http.StatusUnauthorized},
+		{"get user, no permission", "GET", "/users/1", nobodyTokens.Token, http.StatusForbidden},
+		// the policy lets users see themselves; user 2 isn't in the fixtures
+		{"get own user", "GET", "/users/2", nobodyTokens.Token, http.StatusNotFound},
+		{"delete own user", "DELETE", "/users/2", nobodyTokens.Token, http.StatusForbidden},
+		{"insert user, no permission", "PUT", "/users", nobodyTokens.Token, http.StatusForbidden},
+		{"delete user, no permission", "DELETE", "/users/1", nobodyTokens.Token, http.StatusForbidden},
+		{"debug vars", "GET", "/debug/vars", adminTokens.Token, http.StatusOK},
+		{"debug vars, no permission", "GET", "/debug/vars", nobodyTokens.Token, http.StatusForbidden},
+		{"list roles", "GET", "/roles", adminTokens.Token, http.StatusOK},
+		{"list roles, no permission", "GET", "/roles", nobodyTokens.Token, http.StatusForbidden},
+		{"assign role, no permission", "PUT", "/users/2/roles/admin", nobodyTokens.Token, http.StatusForbidden},
+		{"grant permission, no permission", "PUT", "/roles/admin/permissions/users:read", nobodyTokens.Token, http.StatusForbidden},
+	}
+
+	routes := app.routes()
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, nil)
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.token)
+		}
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_roles(t *testing.T) {
+	defer resetDB()
+	resetDB()
+
+	ctx := context.Background()
+	id, _ := app.DB.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com", Password: "purple monkey dishwasher"})
+	_, _ = app.DB.InsertRole(ctx, data.Role{Name: "viewer"})
+
+	admin, _ := app.DB.GetUser(ctx, 1)
+	tokens, _ := app.generateTokenPair(admin)
+
+	var tests = []struct {
+		name               string
+		method             string
+		url                string
+		expectedStatusCode int
+	}{
+		{"assign", "PUT", "/users/2/roles/viewer", http.StatusNoContent},
+		{"assign again", "PUT", "/users/2/roles/viewer", http.StatusNoContent},
+		{"assign missing role", "PUT", "/users/2/roles/nobody", http.StatusNotFound},
+		{"assign to missing user", "PUT", "/users/3/roles/viewer", http.StatusNotFound},
+		{"assign, bad id", "PUT", "/users/fish/roles/viewer", http.StatusBadRequest},
+		{"grant", "PUT", "/roles/viewer/permissions/users:read", http.StatusNoContent},
+		{"grant missing permission", "PUT", "/roles/viewer/permissions/users:fly", http.StatusNotFound},
+		{"revoke permission", "DELETE", "/roles/viewer/permissions/users:read", http.StatusNoContent},
+		{"revoke permission again", "DELETE", "/roles/viewer/permissions/users:read", http.StatusNotFound},
+		{"grant again", "PUT", "/roles/viewer/permissions/users:read", http.StatusNoContent},
+	}
+
+	routes := app.routes()
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.Token)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+
+	// Jack's next token carries what the viewer role grants
+	jack, _ := app.DB.GetUser(ctx, id)
+	jackTokens, _ := app.generateTokenPair(jack)
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer "+jackTokens.Token)
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the viewer to list users, but got status %d", rr.Code)
+	}
+
+	_, claims, _ := app.GetTokenFromHeaderAndVerify(httptest.NewRecorder(), req)
+	if claims == nil || !slices.Equal(claims.Roles, []string{"viewer"}) || !slices.Equal(claims.Permissions, []string{data.PermUsersRead}) {
+		t.Errorf("expected the viewer role and users:read in the token, but got %+v", claims)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/users/2/roles/viewer", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("revoke role: expected status %d but got %d", http.StatusNoContent, rr.Code)
+	}
+	jack, _ = app.DB.GetUser(ctx, id)
+	if len(jack.Roles) != 0 {
+		t.Errorf("expected the role to be revoked, but Jack has %v", jack.Roles)
+	}
+
+	req, _ = http.NewRequest("GET", "/roles", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), `"name":"viewer"`) {
+		t.Errorf("expected the viewer role in the list, but got %s", rr.Body.String())
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"expvar"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"net/http"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
 )
 
 func (app *application) routes() http.Handler {
@@ -11,6 +14,7 @@ func (app *application) routes() http.Handler {
 
 	// register middleware
 	mux.Use(middleware.Recoverer)
+	mux.Use(app.addIPToContext)
 	// mux.User(aapp.enableCORS)
 
 	// authentication routes - auth handler, refresh
@@ -25,15 +29,58 @@ func (app *application) routes() http.Handler {
 		}
 		_ = app.writeJSON(w, http.StatusOK, payload)
 	})
-	// protected routes
+	// runtime and cache counters, including user_cache hits and misses
+	mux.With(app.authRequired, app.Authz.Require(data.PermDebugRead, authz.ResourceType("debug"))).Get("/debug/vars", expvar.Handler().ServeHTTP)
+	// resumable uploads
+	mux.With(app.authRequired).Mount("/uploads", app.Uploads.Routes())
+
+	// protected routes; those that use notImpersonating refuse impersonation tokens
 	mux.Route("/users", func(mux chi.Router) {
 		// use auth middleware
+		mux.Use(app.authRequired)
 
-		mux.Get("/", app.allUsers)
-		mux.Get("/{userID}", app.getUser)
-		mux.Delete("/{userID}", app.deleteUser)
-		mux.Put("/", app.insertUser)
+		mux.With(app.Authz.Require(data.PermUsersRead, authz.ResourceType("user"))).Get("/", app.allUsers)
+		mux.With(app.Authz.Require(data.PermUsersDelete, authz.ResourceType("user"))).Get("/deleted", app.deletedUsers)
+		mux.With(app.Authz.Require(data.PermUsersRead, userResource)).Get("/{userID}", app.getUser)
+		mux.With(app.Authz.Require(data.PermUsersDelete, userResource)).Delete("/{userID}", app.deleteUser)
+		mux.With(app.Authz.Require(data.PermUsersDelete, userResource)).Post("/{userID}/restore", app.restoreUser)
+		mux.With(app.notImpersonating, app.Authz.Require(data.PermUsersRead, userResource)).Get("/{userID}/export", app.exportUser)
+		mux.With(app.notImpersonating, app.Authz.Require(data.PermUsersWrite, userResource)).Post("/{userID}/closure", app.requestClosure)
+		mux.With(app.notImpersonating, app.Authz.Require(data.PermUsersWrite, userResource)).Delete("/{userID}/closure", app.cancelClosure)
+		mux.With(app.notImpersonating, app.Authz.Require(data.PermUsersImpersonate, userResource)).Post("/{userID}/impersonate", app.impersonate)
+		mux.With(app.Authz.Require(data.PermUsersWrite, authz.ResourceType("user"))).Put("/", app.insertUser)
+		// these ask the policy themselves, since they act differently for users acting on
+		// their own, or on what the request body changes
 		mux.Patch("/", app.updateUser)
+		mux.Get("/{userID}/avatar-url", app.avatarURL)
+		mux.With(app.notImpersonating).Put("/{userID}/password", app.setPassword)
+		mux.With(app.notImpersonating, app.Authz.Require(data.PermRolesWrite, userResource)).Put("/{userID}/roles/{role}", app.assignRole)
+		mux.With(app.notImpersonating, app.Authz.Require(data.PermRolesWrite, userResource)).Delete("/{userID}/roles/{role}", app.revokeRole)
+	})
+	mux.Route("/roles", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+
+		mux.With(app.Authz.Require(data.PermRolesRead, authz.ResourceType("role"))).Get("/", app.allRoles)
+		mux.With(app.notImpersonating, app.Authz.Require(data.PermRolesWrite, roleResource)).Put("/{role}/permissions/{permission}", app.grantPermission)
+		mux.With(app.notImpersonating, app.Authz.Require(data.PermRolesWrite, roleResource)).Delete("/{role}/permissions/{permission}", app.revokePermission)
+	})
+	mux.Route("/audit", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+		mux.Use(app.notImpersonating)
+		mux.Use(app.Authz.Require(data.PermAuditRead, authz.ResourceType("audit")))
+
+		mux.Get("/", app.auditEvents)
+		mux.Get("/export", app.exportAuditEvents)
 	})
 	return mux
 }
+
+// userResource is the user a /users/{userID} route acts on.
+func userResource(r *http.Request) authz.Resource {
+	return authz.Resource{Type: "user", ID: chi.URLParam(r, "userID")}
+}
+
+// roleResource is the role a /roles/{role} route acts on.
+func roleResource(r *http.Request) authz.Resource {
+	return authz.Resource{Type: "role", ID: chi.URLParam(r, "role")}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/avatar"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/scanner"
+	"personal-projects/webapp/pkg/tus"
+	"strconv"
+	"time"
+)
+
+// settings for resumable uploads
+var (
+	maxResumableUploadSize     int64 = 1024 * 1024 * 50
+	resumableUploadExpiry            = time.Hour * 24
+	maxResumableUploadsPerUser       = 3
+)
+
+// newUploadHandler returns the tus handler used for resumable profile picture uploads,
+// storing partial uploads in dir. Its routes must be protected by authRequired.
+func (app *application) newUploadHandler(dir string) (*tus.Handler, error) {
+	return tus.New(tus.Config{
+		Dir:                dir,
+		MaxSize:            maxResumableUploadSize,
+		Expiration:         resumableUploadExpiry,
+		MaxUploadsPerOwner: maxResumableUploadsPerUser,
+		Owner: func(r *http.Request) string {
+			return app.claimsFromContext(r.Context()).Subject
+		},
+		OnComplete: app.completeUpload,
+	})
+}
+
+// completeUpload moves a finished resumable upload into the upload directory, and makes
+// it the token owner's profile picture.
+func (app *application) completeUpload(r *http.Request, u tus.Upload) error {
+	userID, err := strconv.Atoi(app.claimsFromContext(r.Context()).Subject)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(u.Path)
+	if err != nil {
+		return err
+	}
+	err = app.scanUpload(r, f, u.FileName(), userID)
+	if err == nil {
+		// only pictures, whatever the file is called or claims to be
+		_, err = avatar.Check(f)
+	}
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// stored under a name of our own, never the one the client sent
+	fileName, err := data.NewImageFileName(u.FileName())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(u.Path, filepath.Join(app.UploadPath, fileName))
+	if err != nil {
+		return err
+	}
+
+	imageID, err := app.DB.InsertUserImage(r.Context(), data.UserImage{
+		UserID:   userID,
+		FileName: fileName,
+	})
+	if err != nil {
+		return err
+	}
+
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditImageUploaded,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(userID),
+		Detail:     fmt.Sprintf("image %d, %s", imageID, fileName),
+	})
+	return nil
+}
+
+// scanUpload checks an uploaded file for malware, and leaves f positioned at its start.
+// Infected files are copied to quarantine, and an error wrapping scanner.ErrInfected
+// is returned. Without a configured scanner every file is accepted.
+func (app *application) scanUpload(r *http.Request, f io.ReadSeeker, fileName string, userID int) error {
+	if app.Scanner == nil {
+		return nil
+	}
+
+	result, err := app.Scanner.Scan(r.Context(), f)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	if !result.Infected {
+		return nil
+	}
+
+	path, err := app.Quarantine.Store(f, scanner.Record{
+		FileName:  fileName,
+		UserID:    userID,
+		Signature: result.Signature,
+		IP:        app.ipFromContext(r.Context()),
+	})
+	if err != nil {
+		log.Println("could not quarantine upload:", err)
+	}
+	log.Printf("rejected upload %s from user %d: %s found, quarantined as %s", fileName, userID, result.Signature, path)
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditUploadQuarantined,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(userID),
+		Detail:     fmt.Sprintf("%s, %s, quarantined as %s", fileName, result.Signature, filepath.Base(path)),
+	})
+
+	return fmt.Errorf("%w: %s", scanner.ErrInfected, result.Signature)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/avatar"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/scanner"
+	"personal-projects/webapp/pkg/tus"
+	"strings"
+	"testing"
+)
+
+func Test_app_completeUpload(t *testing.T) {
+	defer resetDB()
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+	partial := filepath.Join(t.TempDir(), "upload.bin")
+	err := os.WriteFile(partial, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := &Claims{}
+	claims.Subject = "1"
+	req, _ := http.NewRequest("PATCH", "/uploads/abc", nil)
+	req = req.WithContext(context.WithValue(req.Context(), contextClaimsKey, claims))
+
+	u := tus.Upload{
+		ID:       "abc",
+		Path:     partial,
+		Metadata: map[string]string{"filename": "resumable.png"},
+	}
+	err = app.completeUpload(req, u)
+	if err != nil {
+		t.Errorf("completing upload failed: %s", err)
+	}
+
+	user, _ := testDB.GetUser(context.Background(), 1)
+	if user.ProfilePic.FileName == "resumable.png" || filepath.Ext(user.ProfilePic.FileName) != ".png" {
+		t.Errorf("expected the upload to be stored under a new name, but got %s", user.ProfilePic.FileName)
+	}
+	if _, err := os.Stat(filepath.Join(app.UploadPath, user.ProfilePic.FileName)); os.IsNotExist(err) {
+		t.Error("expected completed upload to be moved to the upload path")
+	}
+}
+
+func Test_app_completeUploadNotAnImage(t *testing.T) {
+	defer resetDB()
+	partial := filepath.Join(t.TempDir(), "upload.bin")
+	err := os.WriteFile(partial, []byte("<svg onload=\"alert(1)\"/>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := &Claims{}
+	claims.Subject = "1"
+	req, _ := http.NewRequest("PATCH", "/uploads/abc", nil)
+	req = req.WithContext(context.WithValue(req.Context(), contextClaimsKey, claims))
+
+	u := tus.Upload{
+		ID:       "abc",
+		Path:     partial,
+		Metadata: map[string]string{"filename": "resumable.png"},
+	}
+	err = app.completeUpload(req, u)
+	if !errors.Is(err, avatar.ErrUnsupported) {
+		t.Errorf("expected the upload to be rejected as not a picture, but got %v", err)
+	}
+}
+
+type infectedScanner struct{}
+
+func (infectedScanner) Scan(ctx context.Context, r io.Reader) (scanner.Result, error) {
+	_, _ = io.Copy(io.Discard, r)
+	return scanner.Result{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+}
+
+func Test_app_scanUpload_quarantineIP(t *testing.T) {
+	defer func() {
+		app.Scanner = nil
+		app.Quarantine = nil
+		resetDB()
+	}()
+	app.Scanner = infectedScanner{}
+	app.Quarantine = &scanner.Quarantine{Dir: t.TempDir()}
+
+	// the address the request came from, not the proxy's
+	req, _ := http.NewRequest("PATCH", "/uploads/abc", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req = req.WithContext(context.WithValue(req.Context(), contextIPKey, "192.0.2.1"))
+
+	err := app.scanUpload(req, strings.NewReader("not really a png"), "img.png", 1)
+	if !errors.Is(err, scanner.ErrInfected) {
+		t.Errorf("expected the upload to be rejected, but got %v", err)
+	}
+
+	records, _ := filepath.Glob(filepath.Join(app.Quarantine.Dir, "*.json"))
+	if len(records) != 1 {
+		t.Fatalf("expected one quarantined file, but found %d", len(records))
+	}
+	b, _ := os.ReadFile(records[0])
+	var rec scanner.Record
+	_ = json.Unmarshal(b, &rec)
+	if rec.IP != "192.0.2.1" {
+		t.Errorf("expected the quarantine record to have ip 192.0.2.1, but got %q", rec.IP)
+	}
+
+	events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditUploadQuarantined})
+	if len(events) != 1 {
+		t.Fatalf("expected one quarantine audit event, but found %d", len(events))
+	}
+	if events[0].TargetID != "1" || events[0].IP != "192.0.2.1" || !strings.Contains(events[0].Detail, "img.png, Eicar-Test-Signature") {
+		t.Errorf("wrong quarantine audit event: %+v", events[0])
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/passwordpolicy"
+	"personal-projects/webapp/pkg/repository"
 )
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, wrap ...string) error {
@@ -59,6 +62,47 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 	_ = app.writeJSON(w, statusCode, theError, "error")
 }
 
+// repoErrorJSON sends err with the status that matches what the repository reported.
+func (app *application) repoErrorJSON(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		app.errorJSON(w, err, http.StatusNotFound)
+	case errors.Is(err, repository.ErrDuplicateEmail):
+		// don't pass on what the database said about its indexes
+		app.errorJSON(w, repository.ErrDuplicateEmail, http.StatusConflict)
+	case errors.Is(err, repository.ErrModified):
+		app.errorJSON(w, err, http.StatusPreconditionFailed)
+	case errors.Is(err, repository.ErrConflict):
+		app.errorJSON(w, err, http.StatusConflict)
+	case errors.Is(err, data.ErrInvalidEmail):
+		app.errorJSON(w, err, http.StatusBadRequest)
+	default:
+		app.errorJSON(w, err, http.StatusInternalServerError)
+	}
+}
+
+// passwordErrorJSON sends the rules a new password breaks, one message each, or a
+// server error if they couldn't be checked.
+func (app *application) passwordErrorJSON(w http.ResponseWriter, err error) {
+	var violations passwordpolicy.Violations
+	if !errors.As(err, &violations) {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	type jsonError struct {
+		Message    string                    `json:"message"`
+		Violations passwordpolicy.Violations `json:"violations"`
+	}
+
+	theError := jsonError{
+		Message:    violations.Error(),
+		Violations: violations,
+	}
+
+	_ = app.writeJSON(w, http.StatusUnprocessableEntity, theError, "error")
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
 	maxBytes := 1024 * 1024 // one megabyte
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
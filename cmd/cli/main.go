@@ -1,29 +1,114 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
+	"io"
 	"log"
+	"os"
+	"personal-projects/webapp/pkg/auditchain"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"personal-projects/webapp/pkg/repository/dbrepo"
 	"time"
+
+	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
 type application struct {
-	JWTSecret string
-	Action    string
+	JWTSecret  string
+	Action     string
+	DBDriver   string
+	DSN        string
+	SQLiteFile string
+	PolicyFile string
+	CasesFile  string
+	AuditKey   string
+	AuditFile  string
 }
 
 // This is used to generate a token, so that we can test our api. Run this with go run ./cmd/cli and copy
 // the token that is printed out.
 // go run ./cmd/cli -action=valid     // will produce a valid token
 // go run ./cmd/cli -action=expired   // will produce an expired token
+//
+// It also lists the users that share an email address once case is ignored, which
+// have to be dealt with before the unique email index can be created:
+// go run ./cmd/cli -action=duplicate-emails -dsn=...
+//
+// And it tests an authorization policy against a file of cases, each a request and
+// whether it should be allowed, without running the apps:
+// go run ./cmd/cli -action=test-policy -policy=policy.yaml -cases=cases.yaml
+//
+// And it looks after the audit log's hash chain: it makes the key the api signs
+// checkpoints with (writing audit.key and audit.key.pub), and walks the chain,
+// from the database or an unfiltered NDJSON export, to find the first broken link:
+// go run ./cmd/cli -action=audit-keygen -audit-key=audit.key
+// go run ./cmd/cli -action=verify-audit -audit-key=audit.key.pub -dsn=...
+// go run ./cmd/cli -action=verify-audit -audit-key=audit.key.pub -audit-file=audit.ndjson
 
 func main() {
 	var app application
 	flag.StringVar(&app.JWTSecret, "jwt-secret", "2dce505d96a53c5768052ee90f3df2055657518dad489160df9913f66042e160", "secret")
-	flag.StringVar(&app.Action, "action", "valid", "action: valid|expired")
+	flag.StringVar(&app.Action, "action", "valid", "action: valid|expired|duplicate-emails|test-policy|audit-keygen|verify-audit")
+	flag.StringVar(&app.DBDriver, "db-driver", "postgres", "database to use: postgres|sqlite")
+	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5431 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "Posgtres connection")
+	flag.StringVar(&app.SQLiteFile, "sqlite-file", "./webapp.db", "database file when -db-driver=sqlite")
+	flag.StringVar(&app.PolicyFile, "policy", "", "authorization policy for test-policy; the built-in default if empty")
+	flag.StringVar(&app.CasesFile, "cases", "", "YAML or JSON cases for test-policy")
+	flag.StringVar(&app.AuditKey, "audit-key", "", "where audit-keygen writes the signing key; the public key verify-audit checks checkpoints with")
+	flag.StringVar(&app.AuditFile, "audit-file", "", "unfiltered NDJSON audit log export for verify-audit; the database if empty")
 	flag.Parse()
 
+	if app.Action == "duplicate-emails" {
+		err := app.duplicateEmails()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if app.Action == "test-policy" {
+		passed, err := app.testPolicy()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if app.Action == "audit-keygen" {
+		if app.AuditKey == "" {
+			log.Fatal("audit-keygen needs -audit-key")
+		}
+		err := auditchain.GenerateKey(app.AuditKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote %s, for the api's -audit-signing-key, and %s.pub, for verify-audit.\n", app.AuditKey, app.AuditKey)
+		return
+	}
+
+	if app.Action == "verify-audit" {
+		intact, err := app.verifyAudit()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !intact {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// generate a token
 	token := jwt.New(jwt.SigningMethodHS256)
 
@@ -31,7 +116,13 @@ func main() {
 	claims := token.Claims.(jwt.MapClaims)
 	claims["name"] = "John Doe"
 	claims["sub"] = "1"
-	claims["admin"] = true
+	// the admin role, and everything it grants
+	var permissions []string
+	for _, p := range data.KnownPermissions {
+		permissions = append(permissions, p.Name)
+	}
+	claims["roles"] = []string{data.RoleAdmin}
+	claims["permissions"] = permissions
 	claims["aud"] = "example.com"
 	claims["iss"] = "example.com"
 	// leave this to 3 days, for easy manual testing
@@ -56,3 +147,196 @@ func main() {
 	// print to console
 	fmt.Println(string(signedAccessToken))
 }
+
+// openDB opens the database given by -db-driver.
+func (app *application) openDB() (*sql.DB, error) {
+	switch app.DBDriver {
+	case "postgres":
+		return sql.Open("pgx", app.DSN)
+	case "sqlite":
+		return dbrepo.OpenSQLite(app.SQLiteFile)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", app.DBDriver)
+	}
+}
+
+// duplicateEmails prints every group of users whose email addresses only differ in case.
+func (app *application) duplicateEmails() error {
+	db, err := app.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	duplicates, err := dbrepo.FindDuplicateEmails(context.Background(), db)
+	if err != nil {
+		return err
+	}
+
+	if len(duplicates) == 0 {
+		fmt.Println("No duplicate email addresses.")
+		return nil
+	}
+
+	for _, d := range duplicates {
+		fmt.Printf("%s (%d users):\n", d.Email, len(d.Users))
+		for _, u := range d.Users {
+			fmt.Printf("\tid %d\t%s\t%s %s\n", u.ID, u.Email, u.FirstName, u.LastName)
+		}
+	}
+	fmt.Printf("%d duplicate email addresses; merge or change them before migrating.\n", len(duplicates))
+
+	return nil
+}
+
+// testPolicy evaluates every case against the policy, printing how each went, and
+// reports whether they all passed.
+func (app *application) testPolicy() (bool, error) {
+	if app.CasesFile == "" {
+		return false, errors.New("test-policy needs -cases")
+	}
+
+	policy, err := authz.LoadPolicy(app.PolicyFile)
+	if err != nil {
+		return false, err
+	}
+	cases, err := authz.LoadCases(app.CasesFile)
+	if err != nil {
+		return false, err
+	}
+
+	failed := 0
+	for _, c := range cases {
+		d, err := c.Check(policy)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL\t%s: %s\n", c.Name, err)
+			continue
+		}
+
+		if d.Rule == "" {
+			fmt.Printf("PASS\t%s: denied, as no rule matched\n", c.Name)
+		} else {
+			fmt.Printf("PASS\t%s: %s by rule %s\n", c.Name, d.Effect(), d.Rule)
+		}
+	}
+	fmt.Printf("%d of %d cases passed.\n", len(cases)-failed, len(cases))
+
+	return failed == 0, nil
+}
+
+// verifyAudit walks the audit log's hash chain, oldest event first, printing the
+// first broken link if there is one, and reports whether the chain is intact.
+func (app *application) verifyAudit() (bool, error) {
+	var key ed25519.PublicKey
+	if app.AuditKey != "" {
+		var err error
+		key, err = auditchain.LoadPublicKey(app.AuditKey)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		fmt.Println("WARNING: no -audit-key given; checkpoint signatures will not be checked")
+	}
+
+	v := auditchain.NewVerifier(key)
+	var err error
+	if app.AuditFile != "" {
+		err = readAuditFile(app.AuditFile, v.Add)
+	} else {
+		err = app.readAuditDB(v.Add)
+	}
+
+	report := v.Report()
+	var broken *auditchain.BrokenLinkError
+	if errors.As(err, &broken) {
+		fmt.Printf("BROKEN\t%s\n", broken.Reason)
+		fmt.Printf("The chain is broken at event %d; the events before it are intact (checked: %d).\n", broken.EventID, report.Events)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("OK\t%d events", report.Events)
+	if report.Unchained > 0 {
+		fmt.Printf(", the first %d from before events were hashed, so they could not be checked", report.Unchained)
+	}
+	fmt.Println()
+	if report.LastHash != "" {
+		fmt.Printf("Last hash: %s\n", report.LastHash)
+	}
+	if key != nil {
+		if report.Checkpoints == 0 {
+			fmt.Println("No checkpoints have been signed yet, so nothing vouches for the chain.")
+		} else {
+			fmt.Printf("Checkpoints: %d, sealed up to event %d. Events since, not sealed yet: %d.\n",
+				report.Checkpoints, report.Sealed, report.Unsealed)
+		}
+	}
+
+	return true, nil
+}
+
+// readAuditFile hands every event in an NDJSON export to add, in order.
+func readAuditFile(path string, add func(e *data.AuditEvent) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var e data.AuditEvent
+		err = dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		err = add(&e)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// auditBatch is how many events readAuditDB reads at a time.
+const auditBatch = 500
+
+// readAuditDB hands every event in the database to add, in order.
+func (app *application) readAuditDB(add func(e *data.AuditEvent) error) error {
+	db, err := app.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var repo repository.DatabaseRepo = dbrepo.NewPostgresDBRepo(db)
+	if app.DBDriver == "sqlite" {
+		repo = dbrepo.NewSQLiteDBRepo(db)
+	}
+
+	filter := data.AuditFilter{Limit: auditBatch}
+	for {
+		events, err := repo.AuditEvents(context.Background(), filter)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			err = add(e)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(events) < auditBatch {
+			return nil
+		}
+		filter.AfterID = events[len(events)-1].ID
+	}
+}
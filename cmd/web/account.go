@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/dataexport"
+	"personal-projects/webapp/pkg/repository"
+	"strconv"
+	"time"
+)
+
+// closureDateFormat is how the profile page and flash messages show when a closed
+// account will be deleted.
+const closureDateFormat = "2 January 2006"
+
+// ExportData downloads everything kept about the logged in user as a ZIP archive:
+// their profile, pictures, sessions and audit events.
+func (app *application) ExportData(w http.ResponseWriter, r *http.Request) {
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	export, err := dataexport.Collect(r.Context(), app.DB, user.ID)
+	if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not export your data")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+	app.audit(r, data.AuditEvent{Action: data.AuditDataExported, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, export.FileName()))
+	w.WriteHeader(http.StatusOK)
+
+	err = export.WriteZip(w, uploadPath)
+	if err != nil {
+		// too late to say so; the archive will be unreadable
+		log.Println("could not export user data:", err)
+	}
+}
+
+// CloseAccount schedules the logged in user's account for deletion once the closure
+// cooling-off period is over, as long as they give their password again. They can
+// keep logging in until then, and call it off with CancelClosure.
+func (app *application) CloseAccount(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("password")
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Enter your password to close your account")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	user, err := app.DB.GetUser(r.Context(), sessionUser.ID)
+	if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not close your account")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	if valid, err := user.PasswordMatches(form.Data.Get("password")); err != nil || !valid {
+		app.Session.Put(r.Context(), "error", "Your password is incorrect")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	// closing it again doesn't move the date
+	after := user.DeleteAfter
+	if after == nil {
+		at := time.Now().Add(app.ClosureCoolingOff).UTC().Truncate(time.Second)
+		after = &at
+		err = app.scheduleDeletion(r, user.ID, after, data.AuditEvent{
+			Action: data.AuditClosureRequested,
+			Detail: "to be deleted after " + at.Format(time.RFC3339),
+		})
+		if err != nil {
+			log.Println(err)
+			app.Session.Put(r.Context(), "error", "Could not close your account")
+			http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+			return
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Your account will be deleted on %s. Until then, you can change your mind here.", after.Format(closureDateFormat)))
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// CancelClosure calls off the deletion of the logged in user's closed account.
+func (app *application) CancelClosure(w http.ResponseWriter, r *http.Request) {
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	err := app.scheduleDeletion(r, user.ID, nil, data.AuditEvent{Action: data.AuditClosureCancelled})
+	if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not keep your account")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your account will be kept")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// scheduleDeletion sets when user id will be deleted, recording e for them in the
+// same transaction, and refreshes the session user.
+func (app *application) scheduleDeletion(r *http.Request, id int, after *time.Time, e data.AuditEvent) error {
+	err := app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		err := tx.ScheduleDeletion(r.Context(), id, after)
+		if err != nil {
+			return err
+		}
+
+		e.TargetType = "user"
+		e.TargetID = strconv.Itoa(id)
+		_, err = tx.InsertAuditEvent(r.Context(), app.auditEvent(r, e))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the version has moved on
+	return app.refreshSessionUser(r, id)
+}
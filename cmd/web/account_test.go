@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"personal-projects/webapp/pkg/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_app_ExportData(t *testing.T) {
+	defer resetDB()
+	resetDB()
+
+	req := httptest.NewRequest(http.MethodGet, "/user/export", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.ExportData)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", rr.Code)
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Disposition"), `attachment; filename="user-1-`) {
+		t.Errorf("expected a download but got Content-Disposition %q", rr.Header().Get("Content-Disposition"))
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("expected a ZIP archive but got %s", err)
+	}
+	if len(z.File) == 0 || z.File[0].Name != "profile.json" {
+		t.Errorf("expected the archive to start with profile.json, but got %d files", len(z.File))
+	}
+
+	events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditDataExported})
+	if len(events) != 1 || events[0].ActorID != 1 || events[0].TargetID != "1" {
+		t.Errorf("expected the export to be audited, but got %+v", events)
+	}
+}
+
+func Test_app_CloseAccount(t *testing.T) {
+	var tests = []struct {
+		name          string
+		handler       http.HandlerFunc
+		password      string
+		expectedFlash string
+		expectedError string
+		closed        bool
+	}{
+		{"no password", app.CloseAccount, "", "", "Enter your password to close your account", false},
+		{"wrong password", app.CloseAccount, "password", "", "Your password is incorrect", false},
+		{"close", app.CloseAccount, "secret", "Your account will be deleted on", "", true},
+		{"close again", app.CloseAccount, "secret", "Your account will be deleted on", "", true},
+		{"cancel", app.CancelClosure, "", "Your account will be kept", "", false},
+	}
+
+	defer resetDB()
+	resetDB()
+
+	var scheduled *time.Time
+	for _, e := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/user/close-account", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req.PostForm = map[string][]string{"password": {e.password}}
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status 303 but got %d", e.name, rr.Code)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); !strings.HasPrefix(flash, e.expectedFlash) || (flash == "") != (e.expectedFlash == "") {
+			t.Errorf("%s: expected flash starting %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+
+		user, _ := testDB.GetUser(context.Background(), 1)
+		if (user.DeleteAfter != nil) != e.closed {
+			t.Errorf("%s: expected closed to be %t, but the deletion is set for %v", e.name, e.closed, user.DeleteAfter)
+			continue
+		}
+		if !e.closed {
+			continue
+		}
+
+		// the session gives the profile page the date
+		if sessionUser := app.Session.Get(req.Context(), "user").(data.User); e.name == "close" && sessionUser.DeleteAfter == nil {
+			t.Errorf("%s: expected the session user to be refreshed", e.name)
+		}
+		if scheduled == nil {
+			scheduled = user.DeleteAfter
+			if time.Until(*scheduled) < 13*24*time.Hour {
+				t.Errorf("%s: expected the deletion to be two weeks away, but it is set for %s", e.name, scheduled)
+			}
+		} else if !user.DeleteAfter.Equal(*scheduled) {
+			t.Errorf("%s: expected the date to stay %s, but got %s", e.name, scheduled, user.DeleteAfter)
+		}
+	}
+
+	var actions []string
+	events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{TargetType: "user", TargetID: "1"})
+	for _, e := range events {
+		actions = append(actions, e.Action)
+	}
+	expected := []string{data.AuditClosureRequested, data.AuditClosureCancelled}
+	if strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected events %v but got %v", expected, actions)
+	}
+}
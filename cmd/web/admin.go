@@ -0,0 +1,424 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/passwordpolicy"
+	"personal-projects/webapp/pkg/repository"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// adminPageSize is how many users the admin user list shows a page.
+var adminPageSize = 20
+
+// errors that stop an admin role change, without anything else going wrong
+var (
+	errRolesForbidden = errors.New("you may not change who is an admin")
+	// admins can't lock themselves out
+	errOwnAdminRole = errors.New("you can't take away your own admin role")
+)
+
+// adminUserResource is the user an /admin/users/{userID} route acts on.
+func adminUserResource(r *http.Request) authz.Resource {
+	return authz.Resource{Type: "user", ID: chi.URLParam(r, "userID")}
+}
+
+// adminUserURL is the admin page for user id.
+func adminUserURL(id int) string {
+	return fmt.Sprintf("/admin/users/%d", id)
+}
+
+// AdminUsers lists the users a page at a time, sorted by last name. With q, it
+// only lists those whose name or email address contains it, ignoring case.
+func (app *application) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	var td = make(map[string]any)
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	users, total, err := app.DB.SearchUsers(r.Context(), q, adminPageSize, (page-1)*adminPageSize)
+	pages := max((total+adminPageSize-1)/adminPageSize, 1)
+	if err == nil && page > pages {
+		// past the end, show the last page instead
+		page = pages
+		users, total, err = app.DB.SearchUsers(r.Context(), q, adminPageSize, (page-1)*adminPageSize)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not list users", http.StatusInternalServerError)
+		return
+	}
+
+	td["users"] = users
+	td["total"] = total
+	td["q"] = q
+	td["page"] = page
+	td["pages"] = pages
+	if page > 1 {
+		td["prev"] = page - 1
+	}
+	if page < pages {
+		td["next"] = page + 1
+	}
+
+	_ = app.render(w, r, "admin-users.page.gohtml", &TemplateData{
+		Data: td,
+	})
+}
+
+// AdminUser shows one user, with forms to edit them, reset their password and
+// delete their pictures.
+func (app *application) AdminUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	images, err := app.DB.AllUserImages(r.Context(), user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	var td = make(map[string]any)
+	td["user"] = user
+	td["images"] = images
+	td["admin"] = user.HasRole(data.RoleAdmin)
+
+	_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{
+		Data: td,
+	})
+}
+
+// adminUser reads the user an /admin/users/{userID} route is for. If there is no
+// such user, it sends the admin back to the list and returns false.
+func (app *application) adminUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		if !errors.Is(err, repository.ErrNotFound) {
+			log.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "User not found")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// AdminUpdateUser saves a user's name and email address, and gives them the admin
+// role or takes it away, as long as nobody has changed them since the form was shown.
+// Changing the admin role takes roles:write as well.
+func (app *application) AdminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("first_name", "last_name", "email", "version")
+	email, err := data.NormalizeEmail(form.Data.Get("email"))
+	form.Check(err == nil, "email", "invalid email address")
+	version, err := strconv.Atoi(form.Data.Get("version"))
+	form.Check(err == nil, "version", "invalid version")
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Please give a first and last name, and a valid email address")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	admin := form.Has("admin")
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		current, err := tx.GetUser(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+
+		changed := *current
+		changed.FirstName = strings.TrimSpace(form.Data.Get("first_name"))
+		changed.LastName = strings.TrimSpace(form.Data.Get("last_name"))
+		changed.Email = email
+		changed.Version = version
+		err = tx.UpdateUser(r.Context(), changed)
+		if err != nil {
+			return err
+		}
+
+		action := ""
+		switch {
+		case admin && !current.HasRole(data.RoleAdmin):
+			action = data.AuditRoleAssigned
+		case !admin && current.HasRole(data.RoleAdmin):
+			action = data.AuditRoleRevoked
+		}
+		if action != "" {
+			if !app.Authz.Allowed(r.Context(), data.PermRolesWrite, adminUserResource(r)) {
+				return errRolesForbidden
+			}
+			if action == data.AuditRoleRevoked && user.ID == sessionUser.ID {
+				return errOwnAdminRole
+			}
+
+			if action == data.AuditRoleAssigned {
+				err = tx.AssignRole(r.Context(), user.ID, data.RoleAdmin)
+			} else {
+				err = tx.RevokeRole(r.Context(), user.ID, data.RoleAdmin)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		updated, err := tx.GetUser(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.InsertAuditEvent(r.Context(), app.auditEvent(r, data.AuditEvent{
+			Action:     data.AuditUserUpdated,
+			TargetType: "user",
+			TargetID:   strconv.Itoa(user.ID),
+			Changes:    data.Diff(current, updated),
+		}))
+		if err != nil || action == "" {
+			return err
+		}
+		_, err = tx.InsertAuditEvent(r.Context(), app.auditEvent(r, data.AuditEvent{
+			Action:     action,
+			TargetType: "user",
+			TargetID:   strconv.Itoa(user.ID),
+			Detail:     data.RoleAdmin,
+		}))
+		return err
+	})
+
+	switch {
+	case err == nil:
+		app.Session.Put(r.Context(), "flash", "User saved")
+	case errors.Is(err, repository.ErrModified):
+		app.Session.Put(r.Context(), "error", "Someone else has changed this user in the meantime; this is how they are now")
+	case errors.Is(err, repository.ErrDuplicateEmail):
+		app.Session.Put(r.Context(), "error", "Another user has that email address")
+	case errors.Is(err, errRolesForbidden):
+		app.Session.Put(r.Context(), "error", "You may not change who is an admin")
+	case errors.Is(err, errOwnAdminRole):
+		app.Session.Put(r.Context(), "error", "You can't take away your own admin role")
+	default:
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not save the user")
+	}
+
+	// their changes to themselves show on their own profile page too
+	if err == nil && user.ID == sessionUser.ID {
+		_ = app.refreshSessionUser(r, user.ID)
+	}
+
+	http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+}
+
+// AdminResetPassword sets a new password for a user, without their current one, as
+// long as it follows the password policy and the user can't do anything the admin
+// can't. Admins change their own on their profile page, which asks for it.
+func (app *application) AdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	admin := app.Session.Get(r.Context(), "user").(data.User)
+	if user.ID == admin.ID {
+		app.Session.Put(r.Context(), "error", "Change your own password on your profile page")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+	// setting someone's password is as good as logging in as them
+	for _, p := range user.Permissions {
+		if !admin.Can(p) {
+			app.Session.Put(r.Context(), "error", "You can't reset the password of someone who may do more than you")
+			http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+			return
+		}
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("new_password", "confirm_password")
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Please fill in both password fields")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	password := form.Data.Get("new_password")
+	if password != form.Data.Get("confirm_password") {
+		app.Session.Put(r.Context(), "error", "The new passwords do not match")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	err = app.PasswordPolicy.Check(password, user.FirstName, user.LastName, user.Email)
+	var violations passwordpolicy.Violations
+	if errors.As(err, &violations) {
+		// reads "New password must be ...; is too easy to guess ..."
+		app.Session.Put(r.Context(), "error", "New "+violations.Error())
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	if err == nil {
+		err = app.DB.ResetPassword(r.Context(), user.ID, password)
+	}
+	if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not reset the password")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditEvent{Action: data.AuditPasswordReset, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	app.Session.Put(r.Context(), "flash", "Password reset")
+	http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+}
+
+// AdminConfirmDeleteUser asks whether a user should really be deleted.
+func (app *application) AdminConfirmDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	var td = make(map[string]any)
+	td["user"] = user
+
+	_ = app.render(w, r, "admin-delete-user.page.gohtml", &TemplateData{
+		Data: td,
+	})
+}
+
+// AdminDeleteUser deletes a user, as long as nobody has changed them since the
+// confirmation was shown. They can be restored through the api until they are
+// purged. Admins close their own account on their profile page instead.
+func (app *application) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == app.Session.Get(r.Context(), "user").(data.User).ID {
+		app.Session.Put(r.Context(), "error", "Close your own account on your profile page")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	version, err := strconv.Atoi(r.PostForm.Get("version"))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		current, err := tx.GetUser(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+
+		// at the version the confirmation was showing
+		err = tx.DeleteUser(r.Context(), user.ID, version)
+		if err != nil {
+			return err
+		}
+
+		// a deletion nobody can account for is worse than a failed one
+		_, err = tx.InsertAuditEvent(r.Context(), app.auditEvent(r, data.AuditEvent{
+			Action:     data.AuditUserDeleted,
+			TargetType: "user",
+			TargetID:   strconv.Itoa(user.ID),
+			Changes:    data.Diff(current, nil),
+		}))
+		return err
+	})
+	if errors.Is(err, repository.ErrModified) {
+		app.Session.Put(r.Context(), "error", "Someone else has changed this user in the meantime; check them before deleting")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not delete the user")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Deleted %s %s", user.FirstName, user.LastName))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminDeleteProfilePic deletes one of a user's pictures, both from the database
+// and from disk.
+func (app *application) AdminDeleteProfilePic(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	imageID, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	err = app.deleteUserImage(r, user.ID, imageID)
+	if errors.Is(err, repository.ErrNotFound) {
+		app.Session.Put(r.Context(), "error", "Profile picture not found")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not delete image")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	if user.ID == app.Session.Get(r.Context(), "user").(data.User).ID {
+		_ = app.refreshSessionUser(r, user.ID)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Image deleted")
+	http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// adminRequest returns a request from the admin, user 1, with the route parameters
+// in params, and the admin's permissions in the context as auth leaves them.
+func adminRequest(method, target string, params map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+
+	chiCtx := chi.NewRouteContext()
+	for k, v := range params {
+		chiCtx.URLParams.Add(k, v)
+	}
+	admin, _ := testDB.GetUser(context.Background(), 1)
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx)
+	ctx = authz.WithSubject(ctx, authz.Subject{UserID: 1, Roles: admin.Roles, Permissions: admin.Permissions})
+
+	req = addContextAndSessionToRequest(req.WithContext(ctx), app)
+	app.Session.Put(req.Context(), "user", *admin)
+	return req
+}
+
+func Test_app_AdminUsers(t *testing.T) {
+	var tests = []struct {
+		name           string
+		query          string
+		pageSize       int
+		expectedHTML   []string
+		unexpectedHTML []string
+	}{
+		{"everyone", "", 20, []string{"admin@example.com", "jack@smith.com", "Page 1 of 1"}, []string{"Next"}},
+		{"search", "?q=SMITH", 20, []string{"jack@smith.com"}, []string{"admin@example.com"}},
+		{"nobody", "?q=fish", 20, []string{"Nobody matches"}, []string{"admin@example.com", "jack@smith.com"}},
+		{"first page", "", 1, []string{"Page 1 of 2", "page=2"}, []string{"Previous"}},
+		{"last page", "?page=2", 1, []string{"Page 2 of 2", "page=1"}, []string{"Next"}},
+		{"past the end", "?page=9", 1, []string{"Page 2 of 2"}, nil},
+	}
+
+	seedSecondUser()
+	defer resetDB()
+	defer func() { adminPageSize = 20 }()
+
+	for _, e := range tests {
+		adminPageSize = e.pageSize
+
+		req := adminRequest(http.MethodGet, "/admin/users"+e.query, nil)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminUsers)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200 but got %d", e.name, rr.Code)
+		}
+		for _, s := range e.expectedHTML {
+			if !strings.Contains(rr.Body.String(), s) {
+				t.Errorf("%s: expected to find %q in the page", e.name, s)
+			}
+		}
+		for _, s := range e.unexpectedHTML {
+			if strings.Contains(rr.Body.String(), s) {
+				t.Errorf("%s: did not expect to find %q in the page", e.name, s)
+			}
+		}
+	}
+}
+
+func Test_app_AdminUser(t *testing.T) {
+	seedSecondUser()
+	defer resetDB()
+
+	req := adminRequest(http.MethodGet, "/admin/users/2", map[string]string{"userID": "2"})
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.AdminUser)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 but got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `value="jack@smith.com"`) || !strings.Contains(rr.Body.String(), "/admin/users/2/profile-pics/2/delete") {
+		t.Error("expected jack's details and picture in the page")
+	}
+	if !strings.Contains(rr.Body.String(), "/admin/users/2/impersonate") {
+		t.Error("expected the admin to be offered to log in as jack")
+	}
+
+	req = adminRequest(http.MethodGet, "/admin/users/100", map[string]string{"userID": "100"})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/users" {
+		t.Errorf("expected a missing user to go back to the list, but got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if msg := app.Session.GetString(req.Context(), "error"); msg != "User not found" {
+		t.Errorf("expected error %q but got %q", "User not found", msg)
+	}
+}
+
+func Test_app_AdminUpdateUser(t *testing.T) {
+	var tests = []struct {
+		name          string
+		userID        string
+		email         string
+		admin         bool
+		stale         bool
+		permissions   []string
+		expectedFlash string
+		expectedError string
+		expectedAdmin bool
+	}{
+		{"save", "2", "jack@example.com", false, false, nil, "User saved", "", false},
+		{"make admin", "2", "jack@smith.com", true, false, nil, "User saved", "", true},
+		{"make admin without roles:write", "2", "jack@smith.com", true, false, []string{data.PermUsersRead, data.PermUsersWrite}, "", "You may not change who is an admin", false},
+		{"stale", "2", "jack@example.com", false, true, nil, "", "Someone else has changed this user in the meantime; this is how they are now", false},
+		{"duplicate email", "2", "admin@example.com", false, false, nil, "", "Another user has that email address", false},
+		{"bad email", "2", "jack", false, false, nil, "", "Please give a first and last name, and a valid email address", false},
+		{"demote self", "1", "admin@example.com", false, false, nil, "", "You can't take away your own admin role", true},
+	}
+
+	defer resetDB()
+
+	for _, e := range tests {
+		seedSecondUser()
+
+		req := adminRequest(http.MethodPost, "/admin/users/"+e.userID, map[string]string{"userID": e.userID})
+		if e.permissions != nil {
+			req = req.WithContext(authz.WithSubject(req.Context(), authz.Subject{UserID: 1, Permissions: e.permissions}))
+		}
+
+		version := "1"
+		if e.stale {
+			version = "0"
+		}
+		req.PostForm = map[string][]string{
+			"first_name": {"Jack"},
+			"last_name":  {"Smith"},
+			"email":      {e.email},
+			"version":    {version},
+		}
+		if e.admin {
+			req.PostForm.Set("admin", "on")
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminUpdateUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/users/"+e.userID {
+			t.Errorf("%s: expected a redirect back to the user, but got %d to %q", e.name, rr.Code, rr.Header().Get("Location"))
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+
+		user, _ := testDB.GetUser(context.Background(), 2)
+		if e.userID == "2" && user.HasRole(data.RoleAdmin) != e.expectedAdmin {
+			t.Errorf("%s: expected admin to be %t", e.name, e.expectedAdmin)
+		}
+		if e.userID == "2" && e.email != "jack@smith.com" && (user.Email == e.email) != (e.expectedFlash != "") {
+			t.Errorf("%s: expected the email address to be saved only on success, but it is %q", e.name, user.Email)
+		}
+
+		// the failed changes are all or nothing
+		events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditUserUpdated})
+		if (len(events) == 1) != (e.expectedFlash != "") {
+			t.Errorf("%s: expected %t for an audit event, but got %d", e.name, e.expectedFlash != "", len(events))
+		}
+		if e.expectedAdmin && e.userID == "2" {
+			events, _ = testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditRoleAssigned})
+			if len(events) != 1 || events[0].Detail != data.RoleAdmin {
+				t.Errorf("%s: expected the role to be audited, but got %+v", e.name, events)
+			}
+		}
+	}
+}
+
+func Test_app_AdminResetPassword(t *testing.T) {
+	var tests = []struct {
+		name          string
+		userID        string
+		permissions   []string
+		newPassword   string
+		confirm       string
+		expectedFlash string
+		expectedError string
+	}{
+		{"self", "1", nil, "purple monkey dishwasher", "purple monkey dishwasher", "", "Change your own password on your profile page"},
+		{"missing field", "2", nil, "purple monkey dishwasher", "", "", "Please fill in both password fields"},
+		{"not confirmed", "2", nil, "purple monkey dishwasher", "purple monkey", "", "The new passwords do not match"},
+		{"contains name", "2", nil, "purple jack dishwasher", "purple jack dishwasher", "", "New password must not contain your name or email address"},
+		{"valid", "2", nil, "purple monkey dishwasher", "purple monkey dishwasher", "Password reset", ""},
+		{"may do more", "2", []string{data.PermUsersRead, data.PermUsersWrite}, "orange monkey dishwasher", "orange monkey dishwasher", "", "You can't reset the password of someone who may do more than you"},
+	}
+
+	seedSecondUser()
+	defer resetDB()
+	// jack may do everything the admin may
+	_ = testDB.AssignRole(context.Background(), 2, data.RoleAdmin)
+
+	for _, e := range tests {
+		req := adminRequest(http.MethodPost, "/admin/users/"+e.userID+"/password", map[string]string{"userID": e.userID})
+		if e.permissions != nil {
+			app.Session.Put(req.Context(), "user", data.User{ID: 1, Permissions: e.permissions})
+		}
+		req.PostForm = map[string][]string{
+			"new_password":     {e.newPassword},
+			"confirm_password": {e.confirm},
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminResetPassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status 303 but got %d", e.name, rr.Code)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+	}
+
+	user, _ := testDB.GetUser(context.Background(), 2)
+	if ok, _ := user.PasswordMatches("purple monkey dishwasher"); !ok {
+		t.Error("expected jack's password to have been reset")
+	}
+	events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditPasswordReset})
+	if len(events) != 1 || events[0].ActorID != 1 || events[0].TargetID != "2" {
+		t.Errorf("expected the reset to be audited, but got %+v", events)
+	}
+}
+
+func Test_app_AdminDeleteUser(t *testing.T) {
+	var tests = []struct {
+		name               string
+		userID             string
+		version            string
+		expectedStatusCode int
+		expectedLocation   string
+		expectedFlash      string
+		expectedError      string
+	}{
+		{"self", "1", "1", http.StatusSeeOther, "/admin/users/1", "", "Close your own account on your profile page"},
+		{"no version", "2", "", http.StatusBadRequest, "", "", ""},
+		{"stale", "2", "0", http.StatusSeeOther, "/admin/users/2", "", "Someone else has changed this user in the meantime; check them before deleting"},
+		{"delete", "2", "1", http.StatusSeeOther, "/admin/users", "Deleted Jack Smith", ""},
+		{"already deleted", "2", "2", http.StatusSeeOther, "/admin/users", "", "User not found"},
+	}
+
+	seedSecondUser()
+	defer resetDB()
+
+	for _, e := range tests {
+		req := adminRequest(http.MethodPost, "/admin/users/"+e.userID+"/delete", map[string]string{"userID": e.userID})
+		req.PostForm = map[string][]string{"version": {e.version}}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminDeleteUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected a redirect to %q but got %q", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+	}
+
+	events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditUserDeleted})
+	if len(events) != 1 || events[0].TargetID != "2" {
+		t.Errorf("expected the deletion to be audited once, but got %+v", events)
+	}
+}
+
+func Test_app_AdminDeleteProfilePic(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+
+	var tests = []struct {
+		name               string
+		imageID            string
+		expectedStatusCode int
+		expectedFlash      string
+		expectedError      string
+	}{
+		{"another user's image", "1", http.StatusSeeOther, "", "Profile picture not found"},
+		{"bad id", "fish", http.StatusBadRequest, "", ""},
+		{"valid image", "2", http.StatusSeeOther, "Image deleted", ""},
+	}
+
+	seedSecondUser()
+	defer resetDB()
+
+	for _, e := range tests {
+		req := adminRequest(http.MethodPost, "/admin/users/2/profile-pics/"+e.imageID+"/delete", map[string]string{"userID": "2", "imageID": e.imageID})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminDeleteProfilePic)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+	}
+
+	images, _ := testDB.AllUserImages(context.Background(), 2)
+	if len(images) != 0 {
+		t.Errorf("expected jack's picture to be gone, but got %+v", images)
+	}
+	events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditImageDeleted})
+	if len(events) != 1 || events[0].Detail != "image 2, jack.png" {
+		t.Errorf("expected the deletion to be audited, but got %+v", events)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"personal-projects/webapp/pkg/data"
+)
+
+// auditEvent fills in who made the request, and from where: the logged in user,
+// unless the event already names an actor, the IP address and the user agent. While
+// an admin is logged in as someone else, the admin is the actor, and the detail says
+// who they were acting as.
+func (app *application) auditEvent(r *http.Request, e data.AuditEvent) data.AuditEvent {
+	if e.ActorID == 0 && app.Session.Exists(r.Context(), "user") {
+		e.ActorID = app.Session.Get(r.Context(), "user").(data.User).ID
+		if impersonator, ok := app.impersonator(r); ok {
+			e.Detail = data.ActingAs(e.Detail, e.ActorID)
+			e.ActorID = impersonator.ID
+		}
+	}
+	e.IP = app.ipFromContext(r.Context())
+	e.UserAgent = r.UserAgent()
+	return e
+}
+
+// audit records e in the audit log. A failure is logged, but doesn't fail the
+// request; changes that must not happen unrecorded write their event in the same
+// transaction instead.
+func (app *application) audit(r *http.Request, e data.AuditEvent) {
+	_, err := app.DB.InsertAuditEvent(r.Context(), app.auditEvent(r, e))
+	if err != nil {
+		log.Printf("could not record %s audit event: %s", e.Action, err)
+	}
+}
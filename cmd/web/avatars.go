@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/avatar"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/identicon"
+	"personal-projects/webapp/pkg/repository"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// avatarMaxAge is how long browsers and proxies may cache an avatar before revalidating it.
+var avatarMaxAge = time.Hour
+
+// identiconSize is the size, in pixels, of a generated avatar requested at its original size.
+const identiconSize = 512
+
+// maxRenditions is how many resized avatars are kept in memory.
+const maxRenditions = 512
+
+// renditions holds resized avatars by etag, so that each picture is only decoded and
+// resized once per size.
+var renditions = &renditionCache{max: maxRenditions}
+
+// renditionCache is a bounded map of resized avatars. When it is full, the oldest
+// rendition is dropped.
+type renditionCache struct {
+	mu    sync.Mutex
+	max   int
+	items map[string][]byte
+	order []string
+}
+
+func (c *renditionCache) get(etag string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	body, ok := c.items[etag]
+	return body, ok
+}
+
+func (c *renditionCache) put(etag string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.items = make(map[string][]byte)
+	}
+	if _, ok := c.items[etag]; ok {
+		return
+	}
+	if len(c.order) >= c.max {
+		delete(c.items, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.items[etag] = body
+	c.order = append(c.order, etag)
+}
+
+// Avatar serves a user's profile picture (or, when an imageID is given, one of their
+// previous pictures) at the requested size. Users without a picture get a generated
+// identicon from the same URL, so there is always an image to show. The user's
+// visibility setting is enforced unless the URL carries a valid signature. Anything
+// the caller may not see is a 404, so that private avatars do not reveal that they exist.
+func (app *application) Avatar(w http.ResponseWriter, r *http.Request) {
+	// whatever we send is what we say it is
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	sizeName := chi.URLParam(r, "size")
+	size, ok := avatar.Sizes[sizeName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	signed := avatar.VerifyURL([]byte(app.AvatarSecret), r.URL, time.Now())
+	if !signed && !app.canViewAvatar(r, user) {
+		http.NotFound(w, r)
+		return
+	}
+
+	fileName := user.ProfilePic.FileName
+	if imageID := chi.URLParam(r, "imageID"); imageID != "" {
+		fileName = app.userImageFileName(r.Context(), user.ID, imageID)
+		if fileName == "" {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	// users who never uploaded a picture get a generated one
+	if fileName == "" {
+		app.serveIdenticon(w, r, user, sizeName, size, signed)
+		return
+	}
+
+	src, err := os.ReadFile(filepath.Join(uploadPath, fileName))
+	if err != nil {
+		log.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// only ever serve what passes for a picture; files uploaded before uploads were
+	// checked may be anything
+	contentType, err := avatar.Check(bytes.NewReader(src))
+	if err != nil {
+		log.Printf("not serving %s: %s", fileName, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// the etag depends only on the stored file and the size, so we can answer
+	// conditional requests before doing any image processing
+	sum := sha256.Sum256(src)
+	etag := fmt.Sprintf(`"%x-%s"`, sum[:16], sizeName)
+	if notModified(w, r, user, etag, signed) {
+		return
+	}
+
+	body := src
+	if size > 0 {
+		contentType = "image/png"
+		body, err = resizeAvatar(etag, src, size)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "could not resize image", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// resizeAvatar returns the picture in src resized to size as a PNG, from the cache when
+// it has been resized before. src must have passed avatar.Check.
+func resizeAvatar(etag string, src []byte, size int) ([]byte, error) {
+	if body, ok := renditions.get(etag); ok {
+		return body, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, avatar.Resize(img, size))
+	if err != nil {
+		return nil, err
+	}
+
+	renditions.put(etag, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// serveIdenticon serves the generated avatar for a user, as a PNG or, with ?format=svg, as an SVG.
+func (app *application) serveIdenticon(w http.ResponseWriter, r *http.Request, user *data.User, sizeName string, size int, signed bool) {
+	if size == 0 {
+		size = identiconSize
+	}
+	format := "png"
+	if r.URL.Query().Get("format") == "svg" {
+		format = "svg"
+	}
+
+	// identicons are deterministic, so the etag only depends on what we would draw
+	etag := fmt.Sprintf(`"identicon-%d-%s-%s"`, user.ID, sizeName, format)
+	if notModified(w, r, user, etag, signed) {
+		return
+	}
+
+	var buf bytes.Buffer
+	icon := identicon.New(strconv.Itoa(user.ID))
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_ = icon.SVG(&buf, size)
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		_ = icon.PNG(&buf, size)
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+// notModified sets the caching headers for an avatar, and answers the request with
+// 304 Not Modified if the client already has the current representation.
+func notModified(w http.ResponseWriter, r *http.Request, owner *data.User, etag string, signed bool) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", avatarCacheControl(r, owner, signed))
+	if owner.AvatarVisibility != data.AvatarPublic {
+		w.Header().Add("Vary", "Cookie")
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// canViewAvatar applies the owner's avatar visibility setting to the current session.
+func (app *application) canViewAvatar(r *http.Request, owner *data.User) bool {
+	if owner.AvatarVisibility == data.AvatarPublic {
+		return true
+	}
+
+	if !app.Session.Exists(r.Context(), "user") {
+		return false
+	}
+	if owner.AvatarVisibility == data.AvatarUsers {
+		return true
+	}
+
+	viewer := app.Session.Get(r.Context(), "user").(data.User)
+	return viewer.ID == owner.ID || viewer.Can(data.PermUsersRead)
+}
+
+// userImageFileName returns the file name of one of a user's images, or an empty
+// string if the image does not belong to them.
+func (app *application) userImageFileName(ctx context.Context, userID int, imageID string) string {
+	id, err := strconv.Atoi(imageID)
+	if err != nil {
+		return ""
+	}
+
+	images, err := app.DB.AllUserImages(ctx, userID)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+
+	for _, i := range images {
+		if i.ID == id {
+			return i.FileName
+		}
+	}
+	return ""
+}
+
+func avatarCacheControl(r *http.Request, owner *data.User, signed bool) string {
+	maxAge := avatarMaxAge
+	if signed {
+		// never let a cached copy outlive the signature
+		expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+		maxAge = min(maxAge, time.Until(time.Unix(expires, 0)))
+	}
+
+	if owner.AvatarVisibility == data.AvatarPublic && !signed {
+		return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+	}
+	return fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds()))
+}
+
+// etagMatches implements the weak comparison used for If-None-Match.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateAvatarVisibility lets the logged in user choose who may see their profile picture.
+func (app *application) UpdateAvatarVisibility(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("visibility", "version")
+	visibility := form.Data.Get("visibility")
+	form.Check(visibility == data.AvatarPublic || visibility == data.AvatarUsers || visibility == data.AvatarPrivate,
+		"visibility", "invalid visibility")
+	version, err := strconv.Atoi(form.Data.Get("version"))
+	form.Check(err == nil, "version", "invalid version")
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Invalid avatar visibility")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+	var before data.User
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		current, err := tx.GetUser(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		before = *current
+
+		return tx.UpdateAvatarVisibility(r.Context(), user.ID, visibility, version)
+	})
+	if errors.Is(err, repository.ErrModified) {
+		// show them what the profile looks like now
+		_ = app.refreshSessionUser(r, user.ID)
+		app.Session.Put(r.Context(), "error", "Your profile was modified by someone else. Please check it and try again.")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not update avatar visibility")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	err = app.refreshSessionUser(r, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	after := app.Session.Get(r.Context(), "user").(data.User)
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditUserUpdated,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Changes:    data.Diff(before, after),
+	})
+
+	app.Session.Put(r.Context(), "flash", "Avatar visibility updated")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/avatar"
+	"personal-projects/webapp/pkg/data"
+	"testing"
+	"time"
+)
+
+func Test_app_Avatar(t *testing.T) {
+	defer func(p string) { uploadPath = p }(uploadPath)
+	uploadPath = "./testdata"
+
+	routes := app.routes()
+
+	var tests = []struct {
+		name                string
+		url                 string
+		expectedStatusCode  int
+		expectedContentType string
+	}{
+		{"original", "/avatars/1/original", http.StatusOK, "image/png"},
+		{"resized", "/avatars/1/sm", http.StatusOK, "image/png"},
+		{"previous image", "/avatars/1/sm/1", http.StatusOK, "image/png"},
+		{"someone else's image", "/avatars/1/sm/2", http.StatusNotFound, ""},
+		{"bad size", "/avatars/1/huge", http.StatusNotFound, ""},
+		{"no such user", "/avatars/2/md", http.StatusNotFound, ""},
+		{"bad user id", "/avatars/fish/md", http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest(http.MethodGet, e.url, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectedContentType != "" && rr.Header().Get("Content-Type") != e.expectedContentType {
+			t.Errorf("%s: expected content type %s but got %s", e.name, e.expectedContentType, rr.Header().Get("Content-Type"))
+		}
+		if rr.Code == http.StatusOK && rr.Header().Get("ETag") == "" {
+			t.Errorf("%s: no etag set", e.name)
+		}
+		if rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: expected nosniff but got %q", e.name, rr.Header().Get("X-Content-Type-Options"))
+		}
+	}
+}
+
+func Test_app_AvatarNotAnImage(t *testing.T) {
+	defer func(p string) { uploadPath = p }(uploadPath)
+	uploadPath = t.TempDir()
+
+	// files stored before uploads were checked, under the name of the profile picture
+	var tests = []struct {
+		name string
+		file []byte
+	}{
+		{"html", []byte("<html><script>alert(1)</script></html>")},
+		{"too large", []byte("GIF89a\x50\xc3\x50\xc3\x00\x00\x00")},
+	}
+
+	routes := app.routes()
+	for _, e := range tests {
+		err := os.WriteFile(filepath.Join(uploadPath, "img.png"), e.file, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, size := range []string{"original", "md"} {
+			req := httptest.NewRequest(http.MethodGet, "/avatars/1/"+size, nil)
+			rr := httptest.NewRecorder()
+			routes.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("%s, %s: expected status 404 but got %d", e.name, size, rr.Code)
+			}
+			if bytes.Equal(rr.Body.Bytes(), e.file) {
+				t.Errorf("%s, %s: served the stored file", e.name, size)
+			}
+		}
+	}
+}
+
+func Test_resizeAvatar(t *testing.T) {
+	defer func(c *renditionCache) { renditions = c }(renditions)
+	renditions = &renditionCache{max: 1}
+
+	src, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := resizeAvatar(`"a-sm"`, src, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a cached rendition is served without looking at the picture again
+	cached, err := resizeAvatar(`"a-sm"`, nil, 64)
+	if err != nil || !bytes.Equal(cached, first) {
+		t.Errorf("expected the cached rendition, but got %d bytes and %v", len(cached), err)
+	}
+
+	// the oldest rendition makes room for a new one
+	_, _ = resizeAvatar(`"a-md"`, src, 256)
+	if _, ok := renditions.get(`"a-sm"`); ok {
+		t.Error("expected the oldest rendition to be dropped")
+	}
+	if _, ok := renditions.get(`"a-md"`); !ok {
+		t.Error("expected the new rendition to be cached")
+	}
+}
+
+func Test_app_AvatarConditionalRequest(t *testing.T) {
+	defer func(p string) { uploadPath = p }(uploadPath)
+	uploadPath = "./testdata"
+
+	routes := app.routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/avatars/1/md", nil)
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+
+	etag := rr.Header().Get("ETag")
+	if rr.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("wrong cache control: %s", rr.Header().Get("Cache-Control"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/avatars/1/md", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected status 304 but got %d", rr.Code)
+	}
+
+	// a different size is a different representation
+	req = httptest.NewRequest(http.MethodGet, "/avatars/1/sm", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 but got %d", rr.Code)
+	}
+}
+
+func Test_app_canViewAvatar(t *testing.T) {
+	var tests = []struct {
+		name       string
+		visibility string
+		viewer     *data.User
+		expected   bool
+	}{
+		{"public, anonymous", data.AvatarPublic, nil, true},
+		{"users, anonymous", data.AvatarUsers, nil, false},
+		{"users, logged in", data.AvatarUsers, &data.User{ID: 2}, true},
+		{"private, anonymous", data.AvatarPrivate, nil, false},
+		{"private, other user", data.AvatarPrivate, &data.User{ID: 2}, false},
+		{"private, owner", data.AvatarPrivate, &data.User{ID: 1}, true},
+		{"private, admin", data.AvatarPrivate, &data.User{ID: 2, Permissions: []string{data.PermUsersRead}}, true},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/avatars/1/md", nil)
+		req = addContextAndSessionToRequest(req, app)
+		if e.viewer != nil {
+			app.Session.Put(req.Context(), "user", *e.viewer)
+		}
+
+		owner := &data.User{ID: 1, AvatarVisibility: e.visibility}
+		if app.canViewAvatar(req, owner) != e.expected {
+			t.Errorf("%s: expected %t", e.name, e.expected)
+		}
+	}
+}
+
+func Test_avatarCacheControl(t *testing.T) {
+	owner := &data.User{ID: 1, AvatarVisibility: data.AvatarPrivate}
+	signed := avatar.SignURL([]byte("secret"), "/avatars/1/md", time.Now().Add(time.Minute))
+	req := httptest.NewRequest(http.MethodGet, signed, nil)
+
+	cc := avatarCacheControl(req, owner, true)
+	if cc != "private, max-age=59" && cc != "private, max-age=60" {
+		t.Errorf("expected max-age capped by the signature expiry, but got %s", cc)
+	}
+}
+
+func Test_etagMatches(t *testing.T) {
+	var tests = []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+	}
+
+	for _, e := range tests {
+		if etagMatches(e.header, `"abc"`) != e.expected {
+			t.Errorf("%s: expected %t", e.header, e.expected)
+		}
+	}
+}
+
+func Test_app_UpdateAvatarVisibility(t *testing.T) {
+	var tests = []struct {
+		name          string
+		visibility    string
+		version       string
+		expectedFlash string
+		expectedError string
+	}{
+		{"valid", "private", "1", "Avatar visibility updated", ""},
+		{"invalid", "everyone", "1", "", "Invalid avatar visibility"},
+		{"no version", "private", "", "", "Invalid avatar visibility"},
+		{"stale version", "private", "5", "", "Your profile was modified by someone else. Please check it and try again."},
+	}
+
+	defer resetDB()
+
+	for _, e := range tests {
+		resetDB()
+
+		req := httptest.NewRequest(http.MethodPost, "/user/avatar-visibility", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req.PostForm = map[string][]string{"visibility": {e.visibility}, "version": {e.version}}
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.UpdateAvatarVisibility)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status 303 but got %d", e.name, rr.Code)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+	}
+}
+
+func Test_app_serveIdenticon(t *testing.T) {
+	user := &data.User{ID: 5, AvatarVisibility: data.AvatarPublic}
+
+	var tests = []struct {
+		name                string
+		url                 string
+		expectedContentType string
+	}{
+		{"png", "/avatars/5/md", "image/png"},
+		{"svg", "/avatars/5/md?format=svg", "image/svg+xml"},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest(http.MethodGet, e.url, nil)
+		rr := httptest.NewRecorder()
+		app.serveIdenticon(rr, req, user, "md", avatar.Sizes["md"], false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200 but got %d", e.name, rr.Code)
+		}
+		if rr.Header().Get("Content-Type") != e.expectedContentType {
+			t.Errorf("%s: expected content type %s but got %s", e.name, e.expectedContentType, rr.Header().Get("Content-Type"))
+		}
+
+		// the same identicon again is not modified
+		req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+		rr = httptest.NewRecorder()
+		app.serveIdenticon(rr, req, user, "md", avatar.Sizes["md"], false)
+		if rr.Code != http.StatusNotModified {
+			t.Errorf("%s: expected status 304 but got %d", e.name, rr.Code)
+		}
+	}
+}
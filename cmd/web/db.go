@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"expvar"
+	"fmt"
 	"log"
+	"personal-projects/webapp/pkg/migrations"
+	"personal-projects/webapp/pkg/repository"
+	"personal-projects/webapp/pkg/repository/cacherepo"
+	"personal-projects/webapp/pkg/repository/dbrepo"
+	"time"
 
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
@@ -24,12 +32,81 @@ func openDB(dsn string) (*sql.DB, error) {
 }
 
 func (app *application) connectToDB() (*sql.DB, error) {
-	connection, err := openDB(app.DSN)
+	switch app.DBDriver {
+	case "postgres":
+		connection, err := openDB(app.DSN)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Println("Connected to Postgres!")
+
+		return connection, nil
+	case "sqlite":
+		connection, err := dbrepo.OpenSQLite(app.SQLiteFile)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Println("Connected to SQLite at", app.SQLiteFile)
+
+		return connection, nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", app.DBDriver)
+	}
+}
+
+// newRepo returns the repository for the configured database driver.
+func (app *application) newRepo(conn *sql.DB, timeout time.Duration) repository.DatabaseRepo {
+	if app.DBDriver == "sqlite" {
+		repo := dbrepo.NewSQLiteDBRepo(conn)
+		repo.Timeout = timeout
+		return repo
+	}
+	repo := dbrepo.NewPostgresDBRepo(conn)
+	repo.Timeout = timeout
+	return repo
+}
+
+// cacheRepo puts a cache of up to size user lookups, each kept for at most ttl, in
+// front of repo. With notify, instances sharing a Postgres database tell each other
+// about the users they change.
+func (app *application) cacheRepo(repo repository.DatabaseRepo, conn *sql.DB, size int, ttl time.Duration, notify bool) repository.DatabaseRepo {
+	cache := cacherepo.New(repo, size, ttl)
+
+	if notify {
+		if app.DBDriver == "postgres" {
+			go cache.ListenPostgres(context.Background(), conn)
+		} else {
+			log.Println("WARNING: cache invalidation notifications need Postgres; ignoring -cache-notify")
+		}
+	}
+
+	expvar.Publish("user_cache", expvar.Func(func() any {
+		return cache.Stats()
+	}))
+
+	return cache
+}
+
+// migrateDB brings the schema up to date with the migrations embedded in the binary.
+func (app *application) migrateDB(conn *sql.DB) error {
+	newMigrator := migrations.NewPostgres
+	if app.DBDriver == "sqlite" {
+		newMigrator = migrations.NewSQLite
+	}
+
+	m, err := newMigrator(conn)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	err = m.Up(context.Background())
+	if err != nil {
+		return err
 	}
 
-	log.Println("Connected to Postgres!")
+	log.Println("Database schema is up to date")
 
-	return connection, nil
+	return nil
 }
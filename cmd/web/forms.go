@@ -5,9 +5,9 @@ import (
 	"strings"
 )
 
-type errors map[string][]string
+type formErrors map[string][]string
 
-func (e errors) Get(field string) string {
+func (e formErrors) Get(field string) string {
 	errorSlice := e[field]
 	if len(errorSlice) == 0 {
 		return ""
@@ -16,13 +16,13 @@ func (e errors) Get(field string) string {
 	return errorSlice[0]
 }
 
-func (e errors) Add(field, messsage string) {
+func (e formErrors) Add(field, messsage string) {
 	e[field] = append(e[field], messsage)
 }
 
 type Form struct {
 	Data   url.Values
-	Errors errors
+	Errors formErrors
 }
 
 func NewForm(data url.Values) *Form {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -9,12 +10,23 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"personal-projects/webapp/pkg/avatar"
 	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"personal-projects/webapp/pkg/scanner"
+	"strconv"
 	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
 var pathToTemplates = "./templates/"
-var uploadPath = "./static/img"
+
+// uploads are kept outside ./static, and served through the avatar handler
+var uploadPath = "./uploads/img"
+
+// legacyUploadPath is where uploads used to be stored, inside the public static directory.
+var legacyUploadPath = "./static/img"
 
 func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 	var td = make(map[string]any)
@@ -36,6 +48,8 @@ type TemplateData struct {
 	Error string
 	Flash string
 	User  data.User
+	// Impersonator is the admin logged in as User, if any.
+	Impersonator *data.User
 }
 
 func (app *application) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) error {
@@ -52,6 +66,9 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, t string,
 	if app.Session.Exists(r.Context(), "user") {
 		td.User = app.Session.Get(r.Context(), "user").(data.User)
 	}
+	if impersonator, ok := app.impersonator(r); ok {
+		td.Impersonator = &impersonator
+	}
 
 	// execute the template, passing it data, if any
 	err = parsedTemplate.Execute(w, td)
@@ -80,11 +97,17 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	email := r.Form.Get("email")
+	email, err := data.NormalizeEmail(r.Form.Get("email"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
 	password := r.Form.Get("password")
 
-	user, err := app.DB.GetUserByEmail(email)
+	user, err := app.DB.GetUserByEmail(r.Context(), email)
 	if err != nil {
+		app.audit(r, data.AuditEvent{Action: data.AuditLoginFailed, TargetType: "user", Detail: "unknown email address " + email})
 		app.Session.Put(r.Context(), "error", "Invalid login!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
@@ -93,6 +116,7 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	// authenticate the user
 
 	if !app.authenticate(r, user, password) {
+		app.audit(r, data.AuditEvent{Action: data.AuditLoginFailed, TargetType: "user", TargetID: strconv.Itoa(user.ID), Detail: "wrong password"})
 		app.Session.Put(r.Context(), "error", "Invalid login!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
@@ -100,15 +124,32 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 
 	// prevent fixation attac
 	_ = app.Session.RenewToken(r.Context())
+	// logging in as someone else ends any impersonation
+	app.Session.Remove(r.Context(), "impersonator")
+	app.audit(r, data.AuditEvent{Action: data.AuditLogin, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
 
-	app.Session.Put(r.Context(), "flash", "Successfully logged in!")
+	flash := "Successfully logged in!"
+	if user.DeleteAfter != nil {
+		flash += fmt.Sprintf(" Your account will be deleted on %s, unless you change your mind on your profile.", user.DeleteAfter.Format(closureDateFormat))
+	}
+	app.Session.Put(r.Context(), "flash", flash)
 	// redirect to some page
 	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 }
 
 func (app *application) Profile(w http.ResponseWriter, r *http.Request) {
+	var td = make(map[string]any)
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+	images, err := app.DB.AllUserImages(r.Context(), user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	td["images"] = images
 
-	_ = app.render(w, r, "profile.page.gohtml", &TemplateData{})
+	_ = app.render(w, r, "profile.page.gohtml", &TemplateData{
+		Data: td,
+	})
 }
 
 func (app *application) authenticate(r *http.Request, user *data.User, password string) bool {
@@ -116,45 +157,212 @@ func (app *application) authenticate(r *http.Request, user *data.User, password
 		return false
 	}
 
-	app.Session.Put(r.Context(), "user", user)
+	// upgrade hashes made with an older algorithm or weaker parameters while we
+	// know the password; the login works either way
+	if user.PasswordNeedsRehash() {
+		err := app.DB.RehashPassword(r.Context(), user.ID, user.Password, password)
+		if err != nil {
+			log.Println("could not rehash password:", err)
+		}
+	}
+
+	app.Session.Put(r.Context(), "user", *user)
 	return true
 }
 
 func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request) {
 	// call a function that extracts a file from an upload (request)
 	files, err := app.UploadFiles(r, uploadPath)
+	if errors.Is(err, scanner.ErrInfected) {
+		app.Session.Put(r.Context(), "error", "The uploaded file was rejected because it contains malware")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, avatar.ErrUnsupported) {
+		app.Session.Put(r.Context(), "error", "Profile pictures must be PNG, JPEG or GIF images")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, avatar.ErrTooLarge) {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("Profile pictures may be at most %d megapixels", avatar.MaxPixels/1_000_000))
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(files) == 0 {
+		app.Session.Put(r.Context(), "error", "Please choose a picture to upload")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+	err = app.saveProfilePic(r, files[0].FileName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// redirect back to profile page
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// ActivateProfilePic makes one of the user's previously uploaded images their profile picture.
+func (app *application) ActivateProfilePic(w http.ResponseWriter, r *http.Request) {
+	imageID, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	err = app.DB.SetActiveUserImage(r.Context(), user.ID, imageID)
+	if errors.Is(err, repository.ErrNotFound) {
+		app.Session.Put(r.Context(), "error", "Profile picture not found")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not change profile picture")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	err = app.refreshSessionUser(r, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Profile picture changed")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// DeleteProfilePic deletes one of the user's images, both from the database and from disk.
+func (app *application) DeleteProfilePic(w http.ResponseWriter, r *http.Request) {
+	imageID, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	err = app.deleteUserImage(r, user.ID, imageID)
+	if errors.Is(err, repository.ErrNotFound) {
+		app.Session.Put(r.Context(), "error", "Profile picture not found")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not delete image")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	err = app.refreshSessionUser(r, user.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+
+	app.Session.Put(r.Context(), "flash", "Image deleted")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// deleteUserImage deletes one of user userID's images, both from the database and
+// from disk. It returns repository.ErrNotFound if they have no such image.
+func (app *application) deleteUserImage(r *http.Request, userID, imageID int) error {
+	// find the image, so that we know which file to remove
+	images, err := app.DB.AllUserImages(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	var fileName string
+	for _, i := range images {
+		if i.ID == imageID {
+			fileName = i.FileName
+		}
+	}
+
+	// delete the row and the file together; if the file can't be removed, the row
+	// stays, and if another image is stored in it, the file stays
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		if fileName == "" {
+			return repository.ErrNotFound
+		}
+
+		err := repo.DeleteUserImage(r.Context(), userID, imageID)
+		if err != nil {
+			return err
+		}
+
+		count, err := repo.CountUserImagesByFileName(r.Context(), fileName)
+		if err != nil || count > 0 {
+			return err
+		}
+
+		err = os.Remove(filepath.Join(uploadPath, fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditImageDeleted,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(userID),
+		Detail:     fmt.Sprintf("image %d, %s", imageID, fileName),
+	})
+	return nil
+}
+
+// saveProfilePic makes an uploaded file the logged in user's new profile picture,
+// and refreshes the user in the session.
+func (app *application) saveProfilePic(r *http.Request, fileName string) error {
 	// get user from the session
 	user := app.Session.Get(r.Context(), "user").(data.User)
 
 	// create a var of type data.UserImage
 	var i = data.UserImage{
 		UserID:   user.ID,
-		FileName: files[0].OriginalFileName,
+		FileName: fileName,
 	}
 	//insert the user image into user_images
-	_, err = app.DB.InsertUserImage(i)
+	imageID, err := app.DB.InsertUserImage(r.Context(), i)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return err
 	}
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditImageUploaded,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Detail:     fmt.Sprintf("image %d, %s", imageID, fileName),
+	})
 	// refresh the session variable "user"
-	updatedUser, err := app.DB.GetUser(user.ID)
+	return app.refreshSessionUser(r, user.ID)
+}
+
+// refreshSessionUser reloads the user from the database and stores it in the session.
+func (app *application) refreshSessionUser(r *http.Request, id int) error {
+	updatedUser, err := app.DB.GetUser(r.Context(), id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return err
 	}
-	app.Session.Put(r.Context(), "user", updatedUser)
-	// redirect back to profile page
-	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+	app.Session.Put(r.Context(), "user", *updatedUser)
+	return nil
 }
 
 type UploadedFile struct {
 	OriginalFileName string
-	FileSize         int64
+	// FileName is the name the file is stored under in the upload directory
+	FileName string
+	FileSize int64
 }
 
 func (app *application) UploadFiles(r *http.Request, uploadDir string) ([]*UploadedFile, error) {
@@ -175,17 +383,37 @@ func (app *application) UploadFiles(r *http.Request, uploadDir string) ([]*Uploa
 
 				uploadedFile.OriginalFileName = hdr.Filename
 
-				var outfile *os.File
+				// check the file for malware before it goes anywhere near the upload directory
+				err = app.scanUpload(r, infile, hdr.Filename)
+				if err != nil {
+					return nil, err
+				}
+
+				// only pictures, whatever the file is called or claims to be
+				_, err = avatar.Check(infile)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", hdr.Filename, err)
+				}
+				_, err = infile.Seek(0, io.SeekStart)
+				if err != nil {
+					return nil, err
+				}
+
+				// never the name it was uploaded as, which may be anyone's, or a path
+				uploadedFile.FileName, err = data.NewImageFileName(hdr.Filename)
+				if err != nil {
+					return nil, err
+				}
+
+				outfile, err := os.Create(filepath.Join(uploadDir, uploadedFile.FileName))
+				if err != nil {
+					return nil, err
+				}
 				defer outfile.Close()
 
-				if outfile, err := os.Create(filepath.Join(uploadDir, uploadedFile.OriginalFileName)); err != nil {
+				uploadedFile.FileSize, err = io.Copy(outfile, infile)
+				if err != nil {
 					return nil, err
-				} else {
-					fileSize, err := io.Copy(outfile, infile)
-					if err != nil {
-						return nil, err
-					}
-					uploadedFile.FileSize = fileSize
 				}
 				uploadedFiles = append(uploadedFiles, &uploadedFile)
 				return uploadedFiles, nil
@@ -14,10 +14,13 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"personal-projects/webapp/pkg/data"
 	"strings"
 	"sync"
 	"testing"
+
+	"github.com/go-chi/chi/v5"
 )
 
 func Test_application_handlers(t *testing.T) {
@@ -152,6 +155,7 @@ func Test_app_Login(t *testing.T) {
 		postedData         url.Values
 		expectedStatusCode int
 		expectedLoc        string
+		expectedAudit      string
 	}{
 		{
 			name: "valid login",
@@ -161,6 +165,26 @@ func Test_app_Login(t *testing.T) {
 			},
 			expectedStatusCode: http.StatusSeeOther,
 			expectedLoc:        "/user/profile",
+			expectedAudit:      data.AuditLogin,
+		},
+		{
+			name: "valid login, different case",
+			postedData: url.Values{
+				"email":    {" Admin@Example.COM"},
+				"password": {"secret"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectedLoc:        "/user/profile",
+			expectedAudit:      data.AuditLogin,
+		},
+		{
+			name: "malformed email",
+			postedData: url.Values{
+				"email":    {"admin"},
+				"password": {"secret"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectedLoc:        "/",
 		},
 		{
 			name: "missing form data",
@@ -178,6 +202,7 @@ func Test_app_Login(t *testing.T) {
 			},
 			expectedStatusCode: http.StatusSeeOther,
 			expectedLoc:        "/",
+			expectedAudit:      data.AuditLoginFailed,
 		},
 		{
 			name: "bad credentials",
@@ -187,10 +212,15 @@ func Test_app_Login(t *testing.T) {
 			},
 			expectedStatusCode: http.StatusSeeOther,
 			expectedLoc:        "/",
+			expectedAudit:      data.AuditLoginFailed,
 		},
 	}
 
+	defer resetDB()
+
 	for _, e := range tests {
+		resetDB()
+
 		req, _ := http.NewRequest("POST", "/login", strings.NewReader(e.postedData.Encode()))
 		req = addContextAndSessionToRequest(req, app)
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
@@ -210,6 +240,49 @@ func Test_app_Login(t *testing.T) {
 		} else {
 			t.Errorf("%s: no location header set", e.name)
 		}
+
+		events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{})
+		switch {
+		case e.expectedAudit == "" && len(events) > 0:
+			t.Errorf("%s: expected no audit event, but got %s", e.name, events[0].Action)
+		case e.expectedAudit != "" && (len(events) != 1 || events[0].Action != e.expectedAudit || events[0].IP != "unknown"):
+			t.Errorf("%s: expected one %s audit event with the IP address, but got %+v", e.name, e.expectedAudit, events)
+		}
+	}
+}
+
+func Test_app_Login_rehash(t *testing.T) {
+	// earlier logins have already upgraded the fixture
+	resetDB()
+	defer resetDB()
+
+	// the fixture's password was hashed with bcrypt
+	before, _ := testDB.GetUser(context.Background(), 1)
+	if !before.PasswordNeedsRehash() {
+		t.Fatal("expected the fixture's password to need rehashing")
+	}
+
+	postedData := url.Values{
+		"email":    {"admin@example.com"},
+		"password": {"secret"},
+	}
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(postedData.Encode()))
+	req = addContextAndSessionToRequest(req, app)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.Login)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected status %d but got %d", http.StatusSeeOther, rr.Code)
+	}
+
+	after, _ := testDB.GetUser(context.Background(), 1)
+	if !strings.HasPrefix(after.Password, "$argon2id$") {
+		t.Errorf("expected an argon2id hash after logging in but got %s", after.Password)
+	}
+	if ok, _ := after.PasswordMatches("secret"); !ok {
+		t.Error("password no longer matches after rehashing")
 	}
 }
 
@@ -238,12 +311,15 @@ func Test_app_UploadFiles(t *testing.T) {
 	}
 
 	// perform our tests
-	if _, err := os.Stat(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].OriginalFileName)); os.IsNotExist(err) {
+	if _, err := os.Stat(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].FileName)); os.IsNotExist(err) {
 		t.Errorf("expected file to exist: %s", err.Error())
 	}
+	if uploadedFiles[0].OriginalFileName != "img.png" || uploadedFiles[0].FileName == "img.png" || filepath.Ext(uploadedFiles[0].FileName) != ".png" {
+		t.Errorf("expected img.png to be stored under a new name, but got %s", uploadedFiles[0].FileName)
+	}
 
 	// clean up
-	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].OriginalFileName))
+	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].FileName))
 
 	wg.Wait()
 }
@@ -323,5 +399,185 @@ func Test_app_UploadProfilePic(t *testing.T) {
 		t.Errorf("wrong status code")
 	}
 
-	_ = os.Remove("./testdata/uploads/img.png")
+	user, _ := testDB.GetUser(context.Background(), 1)
+	_ = os.Remove(filepath.Join("./testdata/uploads", user.ProfilePic.FileName))
+	resetDB()
+}
+
+func Test_app_UploadProfilePic_noFile(t *testing.T) {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	_ = mw.WriteField("note", "no file here")
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.UploadProfilePic)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected status 303 but got %d", rr.Code)
+	}
+	if msg := app.Session.GetString(req.Context(), "error"); msg != "Please choose a picture to upload" {
+		t.Errorf("expected an error asking for a picture but got %q", msg)
+	}
+}
+
+func Test_app_UploadProfilePic_notAnImage(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	w, _ := mw.CreateFormFile("file", "img.png")
+	_, _ = w.Write([]byte("<html><script>alert(1)</script></html>"))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.UploadProfilePic)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected status 303 but got %d", rr.Code)
+	}
+	if msg := app.Session.GetString(req.Context(), "error"); msg != "Profile pictures must be PNG, JPEG or GIF images" {
+		t.Errorf("expected an error about the picture format but got %q", msg)
+	}
+	user, _ := testDB.GetUser(context.Background(), 1)
+	if user.ProfilePic.FileName != "img.png" {
+		t.Errorf("expected the profile picture to be unchanged, but got %s", user.ProfilePic.FileName)
+	}
+}
+
+func addImageIDToRequest(req *http.Request, imageID string) *http.Request {
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("imageID", imageID)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+}
+
+func Test_app_ActivateProfilePic(t *testing.T) {
+	var tests = []struct {
+		name               string
+		imageID            string
+		expectedStatusCode int
+		expectedFlash      string
+		expectedError      string
+	}{
+		{"valid image", "1", http.StatusSeeOther, "Profile picture changed", ""},
+		{"someone else's image", "2", http.StatusSeeOther, "", "Profile picture not found"},
+		{"bad id", "fish", http.StatusBadRequest, "", ""},
+	}
+
+	seedSecondUser()
+	defer resetDB()
+
+	for _, e := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/user/profile-pics/"+e.imageID+"/activate", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req = addImageIDToRequest(req, e.imageID)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.ActivateProfilePic)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+	}
+}
+
+func Test_app_DeleteProfilePic(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+
+	var tests = []struct {
+		name               string
+		imageID            string
+		expectedStatusCode int
+		expectedFlash      string
+		expectedError      string
+	}{
+		{"valid image", "1", http.StatusSeeOther, "Image deleted", ""},
+		{"someone else's image", "2", http.StatusSeeOther, "", "Profile picture not found"},
+		{"bad id", "fish", http.StatusBadRequest, "", ""},
+	}
+
+	seedSecondUser()
+	defer resetDB()
+
+	for _, e := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/user/profile-pics/"+e.imageID+"/delete", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req = addImageIDToRequest(req, e.imageID)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.DeleteProfilePic)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+	}
+}
+
+func Test_app_deleteUserImage_sharedFile(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+	seedSecondUser()
+	defer resetDB()
+	ctx := context.Background()
+
+	path := filepath.Join(uploadPath, "shared.png")
+	err := os.WriteFile(path, []byte("png"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	adminsID, _ := testDB.InsertUserImage(ctx, data.UserImage{UserID: 1, FileName: "shared.png"})
+	jacksID, _ := testDB.InsertUserImage(ctx, data.UserImage{UserID: 2, FileName: "shared.png"})
+
+	var tests = []struct {
+		name         string
+		userID       int
+		imageID      int
+		expectedFile bool
+	}{
+		{"still used by jack", 1, adminsID, true},
+		{"last one", 2, jacksID, false},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: e.userID})
+
+		err := app.deleteUserImage(req, e.userID, e.imageID)
+		if err != nil {
+			t.Errorf("%s: deleting image failed: %s", e.name, err)
+		}
+		_, err = os.Stat(path)
+		if e.expectedFile == os.IsNotExist(err) {
+			t.Errorf("%s: expected the file to exist: %t", e.name, e.expectedFile)
+		}
+	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"personal-projects/webapp/pkg/data"
+	"strconv"
+)
+
+// impersonator returns the admin who is logged in as the session user, if any.
+func (app *application) impersonator(r *http.Request) (data.User, bool) {
+	if !app.Session.Exists(r.Context(), "impersonator") {
+		return data.User{}, false
+	}
+	return app.Session.Get(r.Context(), "impersonator").(data.User), true
+}
+
+// Impersonate logs the admin in as another user, so that they see the app as that
+// user does, until they StopImpersonating. The admin stays in the session as the
+// impersonator, and is recorded as the actor of everything done meanwhile. Nobody
+// can impersonate someone who may do something they may not.
+func (app *application) Impersonate(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	admin := app.Session.Get(r.Context(), "user").(data.User)
+	if user.ID == admin.ID {
+		app.Session.Put(r.Context(), "error", "You can't log in as yourself")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+	for _, p := range user.Permissions {
+		if !admin.Can(p) {
+			app.Session.Put(r.Context(), "error", "You can't log in as someone who may do more than you")
+			http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+			return
+		}
+	}
+
+	// an impersonation nobody can account for mustn't happen
+	_, err := app.DB.InsertAuditEvent(r.Context(), app.auditEvent(r, data.AuditEvent{
+		Action:     data.AuditImpersonationStarted,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Detail:     "web",
+	}))
+	if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not log in as them")
+		http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	_ = app.Session.RenewToken(r.Context())
+	app.Session.Put(r.Context(), "impersonator", admin)
+	app.Session.Put(r.Context(), "user", *user)
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("You are logged in as %s %s. What you do is recorded as done by you.", user.FirstName, user.LastName))
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// StopImpersonating logs the admin back in as themselves, and takes them back to
+// the user they were logged in as.
+func (app *application) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+	admin, ok := app.impersonator(r)
+	if !ok {
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	app.audit(r, data.AuditEvent{
+		ActorID:    admin.ID,
+		Action:     data.AuditImpersonationEnded,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Detail:     "web",
+	})
+
+	_ = app.Session.RenewToken(r.Context())
+	app.Session.Remove(r.Context(), "impersonator")
+	app.Session.Put(r.Context(), "user", admin)
+	// their roles may have changed in the meantime
+	err := app.refreshSessionUser(r, admin.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "You are logged in as yourself again")
+	http.Redirect(w, r, adminUserURL(user.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"personal-projects/webapp/pkg/data"
+	"strings"
+	"testing"
+)
+
+func Test_app_Impersonate(t *testing.T) {
+	var tests = []struct {
+		name          string
+		userID        string
+		permissions   []string
+		expectedFlash string
+		expectedError string
+		impersonating bool
+	}{
+		{"self", "1", nil, "", "You can't log in as yourself", false},
+		{"missing user", "100", nil, "", "User not found", false},
+		{"may do more", "2", []string{data.PermUsersRead, data.PermUsersImpersonate}, "", "You can't log in as someone who may do more than you", false},
+		{"valid", "2", nil, "You are logged in as Jack Smith. What you do is recorded as done by you.", "", true},
+	}
+
+	seedSecondUser()
+	defer resetDB()
+	// jack may do everything the admin may
+	_ = testDB.AssignRole(context.Background(), 2, data.RoleAdmin)
+
+	for _, e := range tests {
+		req := adminRequest(http.MethodPost, "/admin/users/"+e.userID+"/impersonate", map[string]string{"userID": e.userID})
+		if e.permissions != nil {
+			app.Session.Put(req.Context(), "user", data.User{ID: 1, Permissions: e.permissions})
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.Impersonate)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status 303 but got %d", e.name, rr.Code)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+
+		impersonator, ok := app.impersonator(req)
+		if ok != e.impersonating {
+			t.Errorf("%s: expected impersonating to be %t", e.name, e.impersonating)
+		}
+		if e.impersonating {
+			if impersonator.ID != 1 || app.Session.Get(req.Context(), "user").(data.User).ID != 2 {
+				t.Errorf("%s: expected the admin to be logged in as jack", e.name)
+			}
+			if rr.Header().Get("Location") != "/user/profile" {
+				t.Errorf("%s: expected a redirect to jack's profile but got %q", e.name, rr.Header().Get("Location"))
+			}
+		}
+	}
+
+	events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditImpersonationStarted})
+	if len(events) != 1 || events[0].ActorID != 1 || events[0].TargetID != "2" {
+		t.Errorf("expected the impersonation to be audited once, but got %+v", events)
+	}
+}
+
+func Test_app_StopImpersonating(t *testing.T) {
+	seedSecondUser()
+	defer resetDB()
+
+	req := httptest.NewRequest(http.MethodPost, "/user/stop-impersonating", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 2})
+	app.Session.Put(req.Context(), "impersonator", data.User{ID: 1})
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.StopImpersonating)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/users/2" {
+		t.Errorf("expected a redirect back to jack, but got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if _, ok := app.impersonator(req); ok {
+		t.Error("expected the impersonation to be over")
+	}
+	// read afresh, with the admin's roles
+	if user := app.Session.Get(req.Context(), "user").(data.User); user.ID != 1 || !user.HasRole(data.RoleAdmin) {
+		t.Errorf("expected the admin to be themselves again, but got %+v", user)
+	}
+
+	events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditImpersonationEnded})
+	if len(events) != 1 || events[0].ActorID != 1 || events[0].TargetID != "2" || events[0].Detail != "web" {
+		t.Errorf("expected the end to be audited, but got %+v", events)
+	}
+
+	// once is enough
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Header().Get("Location") != "/user/profile" {
+		t.Errorf("expected a redirect to the profile but got %q", rr.Header().Get("Location"))
+	}
+}
+
+func Test_app_auditEvent_impersonating(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/user/avatar-visibility", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 2})
+
+	e := app.auditEvent(req, data.AuditEvent{Action: data.AuditUserUpdated})
+	if e.ActorID != 2 || e.Detail != "" {
+		t.Errorf("expected jack to act for himself, but got actor %d, detail %q", e.ActorID, e.Detail)
+	}
+
+	app.Session.Put(req.Context(), "impersonator", data.User{ID: 1})
+	e = app.auditEvent(req, data.AuditEvent{Action: data.AuditUserUpdated})
+	if e.ActorID != 1 || e.Detail != "acting as user 2" {
+		t.Errorf("expected the admin to act as jack, but got actor %d, detail %q", e.ActorID, e.Detail)
+	}
+}
+
+func Test_app_render_impersonating(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/user/profile", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 2, FirstName: "Jack", LastName: "Smith"})
+
+	rr := httptest.NewRecorder()
+	_ = app.render(rr, req, "home.page.gohtml", &TemplateData{})
+	if strings.Contains(rr.Body.String(), "stop-impersonating") {
+		t.Error("did not expect the impersonation banner")
+	}
+
+	app.Session.Put(req.Context(), "impersonator", data.User{ID: 1, FirstName: "Admin", LastName: "User"})
+	rr = httptest.NewRecorder()
+	_ = app.render(rr, req, "home.page.gohtml", &TemplateData{})
+	if !strings.Contains(rr.Body.String(), "<strong>Jack Smith</strong> on behalf of Admin User") || !strings.Contains(rr.Body.String(), "/user/stop-impersonating") {
+		t.Error("expected the impersonation banner on every page")
+	}
+}
@@ -1,42 +1,160 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
 	"log"
 	"net/http"
+	"os"
+	"personal-projects/webapp/pkg/authz"
 	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/passwordpolicy"
 	"personal-projects/webapp/pkg/repository"
-	"personal-projects/webapp/pkg/repository/dbrepo"
+	"personal-projects/webapp/pkg/scanner"
+	"personal-projects/webapp/pkg/tus"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
 )
 
 type application struct {
-	DSN     string
-	DB      repository.DatabaseRepo
-	Session *scs.SessionManager
+	DBDriver       string
+	DSN            string
+	SQLiteFile     string
+	DB             repository.DatabaseRepo
+	Session        *scs.SessionManager
+	AvatarSecret   string
+	Uploads        *tus.Handler
+	Scanner        scanner.Scanner
+	Quarantine     *scanner.Quarantine
+	PasswordPolicy passwordpolicy.Policy
+	Authz          *authz.Engine
+	// ClosureCoolingOff is how long users who close their account have to change
+	// their mind before it is deleted.
+	ClosureCoolingOff time.Duration
 }
 
 func main() {
 	gob.Register(data.User{})
 	// set up an app config
 	app := application{}
+	var tusDir, clamdNetwork, clamdAddr, quarantineDir string
+	var dbTimeout, cacheTTL time.Duration
+	var cacheSize, bcryptCost int
+	var migrate, cacheNotify bool
+	var passwordHash, breachedPasswords string
+	var policyFile, decisionLog string
+	var passwordMinLength, passwordMinScore int
+	var argon2Memory, argon2Time, argon2Threads uint
 
+	flag.StringVar(&app.DBDriver, "db-driver", "postgres", "database to use: postgres|sqlite")
 	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5431 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "Posgtres connection")
+	flag.StringVar(&app.SQLiteFile, "sqlite-file", "./webapp.db", "database file when -db-driver=sqlite")
+	flag.BoolVar(&migrate, "migrate", false, "apply pending schema migrations on startup; always done for sqlite")
+	flag.DurationVar(&dbTimeout, "db-timeout", 3*time.Second, "maximum duration of a single database query; negative for no limit")
+	flag.IntVar(&cacheSize, "cache-size", 1000, "number of user lookups to cache; 0 turns the cache off")
+	flag.DurationVar(&cacheTTL, "cache-ttl", time.Minute, "how long a cached user lookup may be used")
+	flag.BoolVar(&cacheNotify, "cache-notify", false, "share cache invalidations with other instances through Postgres LISTEN/NOTIFY")
+	flag.StringVar(&passwordHash, "password-hash", "argon2id", "algorithm for new password hashes: argon2id|bcrypt; hashes made with the other are upgraded on login")
+	flag.UintVar(&argon2Memory, "argon2-memory", uint(data.DefaultArgon2id.Memory), "argon2id memory in KiB")
+	flag.UintVar(&argon2Time, "argon2-time", uint(data.DefaultArgon2id.Time), "argon2id number of passes")
+	flag.UintVar(&argon2Threads, "argon2-threads", uint(data.DefaultArgon2id.Threads), "argon2id degree of parallelism")
+	flag.IntVar(&bcryptCost, "bcrypt-cost", 12, "bcrypt cost")
+	flag.IntVar(&passwordMinLength, "password-min-length", passwordpolicy.Default.MinLength, "fewest characters a new password may have")
+	flag.IntVar(&passwordMinScore, "password-min-score", passwordpolicy.Default.MinScore, "lowest strength score, from 0 to 4, a new password may have")
+	flag.StringVar(&breachedPasswords, "breached-passwords", "", "sorted SHA-1 list of breached passwords from Have I Been Pwned, as one file or a directory of range files; new passwords are not checked against one if empty")
+	flag.StringVar(&policyFile, "policy", "", "YAML or JSON authorization policy; the built-in default if empty")
+	flag.StringVar(&decisionLog, "decision-log", "-", "file to append authorization decisions to, one JSON object a line; - for stderr; none if empty")
+	flag.DurationVar(&app.ClosureCoolingOff, "closure-cooling-off", 14*24*time.Hour, "how long users who close their account can change their mind before the api deletes it")
+	flag.StringVar(&app.AvatarSecret, "avatar-secret", "", "secret used to sign avatar URLs")
+	flag.StringVar(&tusDir, "tus-dir", "./uploads/tus", "directory for partial resumable uploads")
+	flag.StringVar(&clamdNetwork, "clamd-network", "tcp", "how to reach clamd: tcp|unix")
+	flag.StringVar(&clamdAddr, "clamd-addr", "", "clamd address (host:port or socket path); uploads are not scanned if empty")
+	flag.StringVar(&quarantineDir, "quarantine-dir", "./uploads/quarantine", "directory for infected uploads")
 	flag.Parse()
 
+	passwords, err := data.NewPasswordHasher(passwordHash,
+		data.Argon2id{Memory: uint32(argon2Memory), Time: uint32(argon2Time), Threads: uint8(argon2Threads)},
+		data.Bcrypt{Cost: bcryptCost},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data.Passwords = passwords
+
+	app.PasswordPolicy = passwordpolicy.Default
+	app.PasswordPolicy.MinLength = passwordMinLength
+	app.PasswordPolicy.MinScore = passwordMinScore
+	if breachedPasswords != "" {
+		breached, err := passwordpolicy.OpenBreachedFile(breachedPasswords)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer breached.Close()
+		app.PasswordPolicy.Breached = breached
+	}
+
+	err = os.MkdirAll(uploadPath, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	policy, err := authz.LoadPolicy(policyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	decisions, err := authz.OpenDecisionLog(decisionLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if decisions != nil {
+		defer decisions.Close()
+	}
+	app.Authz = authz.NewEngine(policy, decisions)
+
 	conn, err := app.connectToDB()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	if migrate || app.DBDriver == "sqlite" {
+		err = app.migrateDB(conn)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	app.DB = app.newRepo(conn, dbTimeout)
+	if cacheSize > 0 {
+		app.DB = app.cacheRepo(app.DB, conn, cacheSize, cacheTTL, cacheNotify)
+	}
+
+	// pictures uploaded before uploads moved out of the static directory
+	err = app.moveLegacyUploads(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// get a session manager
 	app.Session = getSession()
 
+	// scan uploads for malware
+	if clamdAddr != "" {
+		app.Scanner = &scanner.ClamdScanner{Network: clamdNetwork, Address: clamdAddr, Timeout: time.Minute}
+		app.Quarantine = &scanner.Quarantine{Dir: quarantineDir}
+	} else {
+		log.Println("WARNING: no clamd address given; uploads will not be scanned for malware")
+	}
+
+	// set up resumable uploads, and remove abandoned ones every hour
+	app.Uploads, err = app.newUploadHandler(tusDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go app.Uploads.CollectGarbage(context.Background(), time.Hour)
+
 	// print out a message
 	log.Println("Starting server on port 8080...")
 
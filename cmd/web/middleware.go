@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
 )
 
 type contextKey string
@@ -55,6 +57,11 @@ func getIP(r *http.Request) (string, error) {
 
 	return ip, nil
 }
+
+// auth sends visitors who haven't logged in back to the home page. For those who
+// have, it stores the session user in the context as an authz.Subject, so that routes
+// can be guarded by the authorization policy. The roles and permissions are the
+// ones the user had when they logged in.
 func (app *application) auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.Session.Exists(r.Context(), "user") {
@@ -62,6 +69,26 @@ func (app *application) auth(next http.Handler) http.Handler {
 			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 			return
 		}
+
+		user := app.Session.Get(r.Context(), "user").(data.User)
+		ctx := authz.WithSubject(r.Context(), authz.Subject{
+			UserID:      user.ID,
+			Roles:       user.Roles,
+			Permissions: user.Permissions,
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// notImpersonating keeps admins who are logged in as someone else away from what
+// only the user themselves should do, like changing their password.
+func (app *application) notImpersonating(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := app.impersonator(r); ok {
+			app.Session.Put(r.Context(), "error", "You can't do that while logged in as someone else")
+			http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
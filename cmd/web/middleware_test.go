@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"personal-projects/webapp/pkg/authz"
 	"personal-projects/webapp/pkg/data"
 	"strings"
 	"testing"
@@ -100,3 +101,67 @@ func Test_app_auth(t *testing.T) {
 		}
 	}
 }
+
+func Test_app_auth_permissions(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var tests = []struct {
+		name               string
+		user               data.User
+		expectedStatusCode int
+	}{
+		{"permitted", data.User{ID: 2, Permissions: []string{data.PermUsersRead, data.PermUsersWrite}}, http.StatusOK},
+		{"other permissions", data.User{ID: 2, Permissions: []string{data.PermUsersRead}}, http.StatusForbidden},
+		{"no permissions", data.User{ID: 2}, http.StatusForbidden},
+		{"own profile", data.User{ID: 1}, http.StatusOK},
+	}
+
+	// the policy decides for user 1's profile
+	resource := func(*http.Request) authz.Resource { return authz.Resource{Type: "user", ID: "1"} }
+
+	for _, e := range tests {
+		handlerToTest := app.auth(app.Authz.Require(data.PermUsersWrite, resource)(nextHandler))
+		req := httptest.NewRequest("GET", "http://testing", nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", e.user)
+
+		rr := httptest.NewRecorder()
+		handlerToTest.ServeHTTP(rr, req)
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_notImpersonating(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var tests = []struct {
+		name               string
+		impersonating      bool
+		expectedStatusCode int
+		expectedError      string
+	}{
+		{"themselves", false, http.StatusOK, ""},
+		{"impersonating", true, http.StatusSeeOther, "You can't do that while logged in as someone else"},
+	}
+
+	for _, e := range tests {
+		handlerToTest := app.notImpersonating(nextHandler)
+		req := httptest.NewRequest("POST", "http://testing", nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 2})
+		if e.impersonating {
+			app.Session.Put(req.Context(), "impersonator", data.User{ID: 1})
+		}
+
+		rr := httptest.NewRecorder()
+		handlerToTest.ServeHTTP(rr, req)
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/passwordpolicy"
+	"strconv"
+)
+
+// ChangePassword sets a new password for the logged in user, who must give their
+// current one, as long as the new one follows the password policy.
+func (app *application) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("current_password", "new_password", "confirm_password")
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Please fill in all the password fields")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	password := form.Data.Get("new_password")
+	if password != form.Data.Get("confirm_password") {
+		app.Session.Put(r.Context(), "error", "The new passwords do not match")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	user, err := app.DB.GetUser(r.Context(), sessionUser.ID)
+	if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not change password")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	if valid, err := user.PasswordMatches(form.Data.Get("current_password")); err != nil || !valid {
+		app.Session.Put(r.Context(), "error", "Your current password is incorrect")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	err = app.PasswordPolicy.Check(password, user.FirstName, user.LastName, user.Email)
+	var violations passwordpolicy.Violations
+	if errors.As(err, &violations) {
+		// reads "New password must be ...; is too easy to guess ..."
+		app.Session.Put(r.Context(), "error", "New "+violations.Error())
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	if err == nil {
+		err = app.DB.ResetPassword(r.Context(), user.ID, password)
+	}
+	if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Could not change password")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditEvent{Action: data.AuditPasswordChanged, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	// the version has moved on
+	err = app.refreshSessionUser(r, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_ = app.Session.RenewToken(r.Context())
+
+	app.Session.Put(r.Context(), "flash", "Password changed")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository/dbrepo"
+	"testing"
+)
+
+func Test_app_ChangePassword(t *testing.T) {
+	var tests = []struct {
+		name            string
+		currentPassword string
+		newPassword     string
+		confirmPassword string
+		expectedFlash   string
+		expectedError   string
+	}{
+		{"valid", "secret", "purple monkey dishwasher", "purple monkey dishwasher", "Password changed", ""},
+		{"missing field", "secret", "purple monkey dishwasher", "", "", "Please fill in all the password fields"},
+		{"not confirmed", "secret", "purple monkey dishwasher", "purple monkey", "", "The new passwords do not match"},
+		{"wrong current password", "password", "purple monkey dishwasher", "purple monkey dishwasher", "", "Your current password is incorrect"},
+		{"too short", "secret", "kP9#vL2", "kP9#vL2", "", "New password must be at least 8 characters long; is too easy to guess; try a longer one, or a few unrelated words"},
+		{"contains name", "secret", "purple admin dishwasher", "purple admin dishwasher", "", "New password must not contain your name or email address"},
+	}
+
+	defer resetDB()
+
+	for _, e := range tests {
+		resetDB()
+
+		req := httptest.NewRequest(http.MethodPost, "/user/password", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req.PostForm = map[string][]string{
+			"current_password": {e.currentPassword},
+			"new_password":     {e.newPassword},
+			"confirm_password": {e.confirmPassword},
+		}
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.ChangePassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status 303 but got %d", e.name, rr.Code)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+
+		// only a successful change replaces the password
+		user, _ := testDB.GetUser(context.Background(), 1)
+		changed := user.Password != dbrepo.TestFixtures().Users[0].Password
+		if changed != (e.expectedFlash != "") {
+			t.Errorf("%s: expected password changed to be %t", e.name, e.expectedFlash != "")
+		}
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"net/http"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
+	"strconv"
 )
 
 func (app *application) routes() http.Handler {
@@ -17,13 +20,51 @@ func (app *application) routes() http.Handler {
 	// register routes
 	mux.Get("/", app.Home)
 	mux.Post("/login", app.Login)
+	mux.Get("/avatars/{userID}/{size}", app.Avatar)
+	mux.Get("/avatars/{userID}/{size}/{imageID}", app.Avatar)
 	mux.Route("/user", func(mux chi.Router) {
 		mux.Use(app.auth)
-		mux.Get("/profile", app.Profile)
-		mux.Post("/upload-profile-pic", app.UploadProfilePic)
+		mux.With(app.Authz.Require(data.PermUsersRead, app.sessionUserResource)).Get("/profile", app.Profile)
+		mux.With(app.Authz.Require(data.PermUsersRead, app.sessionUserResource), app.notImpersonating).Get("/export", app.ExportData)
+		mux.Post("/stop-impersonating", app.StopImpersonating)
+		// everything else here changes the logged in user's profile
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.Authz.Require(data.PermUsersWrite, app.sessionUserResource))
+			mux.Post("/upload-profile-pic", app.UploadProfilePic)
+			mux.Post("/profile-pics/{imageID}/activate", app.ActivateProfilePic)
+			mux.Post("/profile-pics/{imageID}/delete", app.DeleteProfilePic)
+			mux.Post("/avatar-visibility", app.UpdateAvatarVisibility)
+			mux.With(app.notImpersonating).Post("/password", app.ChangePassword)
+			mux.With(app.notImpersonating).Post("/close-account", app.CloseAccount)
+			mux.With(app.notImpersonating).Post("/cancel-closure", app.CancelClosure)
+			mux.Mount("/uploads", app.Uploads.Routes())
+		})
 	})
-	// static assets
+	// the admin area, for users the policy lets list users; changes are checked one
+	// by one, so that an admin who may only read sees the pages but can't save them.
+	// Admins logged in as someone else must go back to being themselves first.
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.auth)
+		mux.Use(app.notImpersonating)
+		mux.Use(app.Authz.Require(data.PermUsersRead, authz.ResourceType("user")))
+		mux.Get("/users", app.AdminUsers)
+		mux.Get("/users/{userID}", app.AdminUser)
+		mux.With(app.Authz.Require(data.PermUsersWrite, adminUserResource)).Post("/users/{userID}", app.AdminUpdateUser)
+		mux.With(app.Authz.Require(data.PermUsersWrite, adminUserResource)).Post("/users/{userID}/password", app.AdminResetPassword)
+		mux.With(app.Authz.Require(data.PermUsersWrite, adminUserResource)).Post("/users/{userID}/profile-pics/{imageID}/delete", app.AdminDeleteProfilePic)
+		mux.With(app.Authz.Require(data.PermUsersDelete, adminUserResource)).Get("/users/{userID}/delete", app.AdminConfirmDeleteUser)
+		mux.With(app.Authz.Require(data.PermUsersDelete, adminUserResource)).Post("/users/{userID}/delete", app.AdminDeleteUser)
+		mux.With(app.Authz.Require(data.PermUsersImpersonate, adminUserResource)).Post("/users/{userID}/impersonate", app.Impersonate)
+	})
+	// static assets; uploads used to be kept in static/img, and are only ever served as avatars
 	fileServer := http.FileServer(http.Dir("./static"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
+	mux.Handle("/static/img/*", http.NotFoundHandler())
 	return mux
 }
+
+// sessionUserResource is the logged in user, whose profile the /user routes act on.
+func (app *application) sessionUserResource(r *http.Request) authz.Resource {
+	user := app.Session.Get(r.Context(), "user").(data.User)
+	return authz.Resource{Type: "user", ID: strconv.Itoa(user.ID)}
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"github.com/go-chi/chi/v5"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -15,7 +18,31 @@ func Test_application_routes(t *testing.T) {
 		{"/", "GET"},
 		{"/login", "POST"},
 		{"/user/profile", "GET"},
+		{"/user/upload-profile-pic", "POST"},
+		{"/user/profile-pics/{imageID}/activate", "POST"},
+		{"/user/profile-pics/{imageID}/delete", "POST"},
+		{"/avatars/{userID}/{size}", "GET"},
+		{"/avatars/{userID}/{size}/{imageID}", "GET"},
+		{"/user/avatar-visibility", "POST"},
+		{"/user/password", "POST"},
+		{"/user/export", "GET"},
+		{"/user/close-account", "POST"},
+		{"/user/cancel-closure", "POST"},
+		{"/user/stop-impersonating", "POST"},
+		{"/user/uploads/", "POST"},
+		{"/user/uploads/{uploadID}", "HEAD"},
+		{"/user/uploads/{uploadID}", "PATCH"},
+		{"/user/uploads/{uploadID}", "DELETE"},
+		{"/admin/users", "GET"},
+		{"/admin/users/{userID}", "GET"},
+		{"/admin/users/{userID}", "POST"},
+		{"/admin/users/{userID}/password", "POST"},
+		{"/admin/users/{userID}/profile-pics/{imageID}/delete", "POST"},
+		{"/admin/users/{userID}/delete", "GET"},
+		{"/admin/users/{userID}/delete", "POST"},
+		{"/admin/users/{userID}/impersonate", "POST"},
 		{"/static/*", "GET"},
+		{"/static/img/*", "GET"},
 	}
 	mux := app.routes()
 
@@ -40,3 +67,33 @@ func routeExists(testRoute, testMethod string, chiRoutes chi.Routes) bool {
 
 	return found
 }
+
+func Test_application_routesLegacyUploads(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer func() { _ = os.Chdir(wd) }()
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, "static", "img"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "static", "site.css"), []byte("body {}"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "static", "img", "img.png"), []byte("someone's picture"), 0644)
+	_ = os.Chdir(dir)
+
+	var tests = []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+	}{
+		{"static asset", "/static/site.css", http.StatusOK},
+		{"old upload", "/static/img/img.png", http.StatusNotFound},
+	}
+
+	routes := app.routes()
+	for _, e := range tests {
+		req := httptest.NewRequest(http.MethodGet, e.url, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
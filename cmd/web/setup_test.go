@@ -2,15 +2,43 @@ package main
 
 import (
 	"os"
+	"personal-projects/webapp/pkg/authz"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/passwordpolicy"
 	"personal-projects/webapp/pkg/repository/dbrepo"
 	"testing"
+	"time"
 )
 
 var app application
+var testDB *dbrepo.MemoryDBRepo
 
 func TestMain(m *testing.M) {
 	pathToTemplates = "./../../templates/"
 	app.Session = getSession()
-	app.DB = &dbrepo.TestDBRepo{}
-	os.Exit(m.Run())
+	testDB, _ = dbrepo.NewMemoryDBRepo(dbrepo.TestFixtures())
+	app.DB = testDB
+	app.PasswordPolicy = passwordpolicy.Default
+	app.Authz = authz.NewEngine(authz.DefaultPolicy(), nil)
+	app.ClosureCoolingOff = 14 * 24 * time.Hour
+
+	tusDir, _ := os.MkdirTemp("", "tus")
+	app.Uploads, _ = app.newUploadHandler(tusDir)
+
+	code := m.Run()
+	_ = os.RemoveAll(tusDir)
+	os.Exit(code)
+}
+
+// resetDB puts back the test fixtures, for tests that change the database.
+func resetDB() {
+	_ = testDB.Seed(dbrepo.TestFixtures())
+}
+
+// seedSecondUser adds jack@smith.com, user 2, whose profile picture is image 2.
+func seedSecondUser() {
+	fixtures := dbrepo.TestFixtures()
+	fixtures.Users = append(fixtures.Users, data.User{ID: 2, FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com"})
+	fixtures.Images = append(fixtures.Images, data.UserImage{ID: 2, UserID: 2, FileName: "jack.png", IsActive: true})
+	_ = testDB.Seed(fixtures)
 }
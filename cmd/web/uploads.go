@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/avatar"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/scanner"
+	"personal-projects/webapp/pkg/tus"
+	"strconv"
+	"time"
+)
+
+// settings for resumable uploads
+var (
+	maxResumableUploadSize     int64 = 1024 * 1024 * 50
+	resumableUploadExpiry            = time.Hour * 24
+	maxResumableUploadsPerUser       = 3
+)
+
+// newUploadHandler returns the tus handler used for resumable profile picture uploads,
+// storing partial uploads in dir.
+func (app *application) newUploadHandler(dir string) (*tus.Handler, error) {
+	return tus.New(tus.Config{
+		Dir:                dir,
+		MaxSize:            maxResumableUploadSize,
+		Expiration:         resumableUploadExpiry,
+		MaxUploadsPerOwner: maxResumableUploadsPerUser,
+		Owner: func(r *http.Request) string {
+			user := app.Session.Get(r.Context(), "user").(data.User)
+			return strconv.Itoa(user.ID)
+		},
+		OnComplete: app.completeUpload,
+	})
+}
+
+// completeUpload moves a finished resumable upload into the upload directory, and makes
+// it the user's profile picture, just like a regular upload.
+func (app *application) completeUpload(r *http.Request, u tus.Upload) error {
+	f, err := os.Open(u.Path)
+	if err != nil {
+		return err
+	}
+	err = app.scanUpload(r, f, u.FileName())
+	if err == nil {
+		// only pictures, whatever the file is called or claims to be
+		_, err = avatar.Check(f)
+	}
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// stored under a name of our own, like any other upload
+	fileName, err := data.NewImageFileName(u.FileName())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(u.Path, filepath.Join(uploadPath, fileName))
+	if err != nil {
+		return err
+	}
+
+	return app.saveProfilePic(r, fileName)
+}
+
+// scanUpload checks an uploaded file for malware, and leaves f positioned at its start.
+// Infected files are copied to quarantine, and an error wrapping scanner.ErrInfected
+// is returned. Without a configured scanner every file is accepted.
+func (app *application) scanUpload(r *http.Request, f io.ReadSeeker, fileName string) error {
+	if app.Scanner == nil {
+		return nil
+	}
+
+	result, err := app.Scanner.Scan(r.Context(), f)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	if !result.Infected {
+		return nil
+	}
+
+	var userID int
+	if app.Session.Exists(r.Context(), "user") {
+		userID = app.Session.Get(r.Context(), "user").(data.User).ID
+	}
+
+	path, err := app.Quarantine.Store(f, scanner.Record{
+		FileName:  fileName,
+		UserID:    userID,
+		Signature: result.Signature,
+		IP:        app.ipFromContext(r.Context()),
+	})
+	if err != nil {
+		log.Println("could not quarantine upload:", err)
+	}
+	log.Printf("rejected upload %s from user %d: %s found, quarantined as %s", fileName, userID, result.Signature, path)
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditUploadQuarantined,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(userID),
+		Detail:     fmt.Sprintf("%s, %s, quarantined as %s", fileName, result.Signature, filepath.Base(path)),
+	})
+
+	return fmt.Errorf("%w: %s", scanner.ErrInfected, result.Signature)
+}
+
+// moveLegacyUploads moves the pictures users uploaded to legacyUploadPath, which was
+// public, into uploadPath. Files nobody uses are left where they are, and nothing in
+// uploadPath is ever overwritten. Once everything has moved this does nothing.
+func (app *application) moveLegacyUploads(ctx context.Context) error {
+	entries, err := os.ReadDir(legacyUploadPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		count, err := app.DB.CountUserImagesByFileName(ctx, entry.Name())
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			continue
+		}
+
+		dst := filepath.Join(uploadPath, entry.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			log.Printf("not moving %s: %s already exists", entry.Name(), dst)
+			continue
+		}
+		err = os.Rename(filepath.Join(legacyUploadPath, entry.Name()), dst)
+		if err != nil {
+			return err
+		}
+		moved++
+	}
+
+	if moved > 0 {
+		log.Printf("moved %d uploaded pictures from %s to %s", moved, legacyUploadPath, uploadPath)
+	}
+	return nil
+}
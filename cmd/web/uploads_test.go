@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/avatar"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/scanner"
+	"personal-projects/webapp/pkg/tus"
+	"strings"
+	"testing"
+)
+
+func Test_app_completeUpload(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+	defer resetDB()
+
+	src, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(t.TempDir(), "upload.bin")
+	err = os.WriteFile(partial, src, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/user/uploads/abc", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	u := tus.Upload{
+		ID:       "abc",
+		Path:     partial,
+		Metadata: map[string]string{"filename": "resumable.png"},
+	}
+	err = app.completeUpload(req, u)
+	if err != nil {
+		t.Errorf("completing upload failed: %s", err)
+	}
+
+	user, _ := testDB.GetUser(context.Background(), 1)
+	if user.ProfilePic.FileName == "resumable.png" || filepath.Ext(user.ProfilePic.FileName) != ".png" {
+		t.Errorf("expected the upload to be stored under a new name, but got %s", user.ProfilePic.FileName)
+	}
+	stored := filepath.Join("./testdata/uploads", user.ProfilePic.FileName)
+	if _, err := os.Stat(stored); os.IsNotExist(err) {
+		t.Error("expected completed upload to be moved to the upload path")
+	}
+	_ = os.Remove(stored)
+}
+
+func Test_app_completeUploadNotAnImage(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+	defer resetDB()
+
+	partial := filepath.Join(t.TempDir(), "upload.bin")
+	err := os.WriteFile(partial, []byte("<script>alert(1)</script>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/user/uploads/abc", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	u := tus.Upload{
+		ID:       "abc",
+		Path:     partial,
+		Metadata: map[string]string{"filename": "resumable.png"},
+	}
+	err = app.completeUpload(req, u)
+	if !errors.Is(err, avatar.ErrUnsupported) {
+		t.Errorf("expected the upload to be rejected as not a picture, but got %v", err)
+	}
+
+	user, _ := testDB.GetUser(context.Background(), 1)
+	if user.ProfilePic.FileName != "img.png" {
+		t.Errorf("expected the profile picture to be unchanged, but got %s", user.ProfilePic.FileName)
+	}
+}
+
+type fakeScanner struct {
+	infected bool
+}
+
+func (s *fakeScanner) Scan(ctx context.Context, r io.Reader) (scanner.Result, error) {
+	_, _ = io.Copy(io.Discard, r)
+	if s.infected {
+		return scanner.Result{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+	}
+	return scanner.Result{}, nil
+}
+
+func Test_app_UploadProfilePicScanned(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+	defer func() {
+		app.Scanner = nil
+		app.Quarantine = nil
+		resetDB()
+	}()
+	app.Quarantine = &scanner.Quarantine{Dir: t.TempDir()}
+
+	var tests = []struct {
+		name          string
+		infected      bool
+		expectedError string
+		expectedFile  bool
+	}{
+		{"clean", false, "", true},
+		{"infected", true, "The uploaded file was rejected because it contains malware", false},
+	}
+
+	for _, e := range tests {
+		app.Scanner = &fakeScanner{infected: e.infected}
+
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		w, _ := mw.CreateFormFile("file", "img.png")
+		f, _ := os.Open("./testdata/img.png")
+		_, _ = io.Copy(w, f)
+		_ = f.Close()
+		_ = mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/user/upload-profile-pic", body)
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Add("Content-Type", mw.FormDataContentType())
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.UploadProfilePic)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status 303 but got %d", e.name, rr.Code)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+		stored, _ := filepath.Glob("./testdata/uploads/*.png")
+		if e.expectedFile != (len(stored) == 1) {
+			t.Errorf("%s: expected file in upload path: %t", e.name, e.expectedFile)
+		}
+		for _, f := range stored {
+			_ = os.Remove(f)
+		}
+	}
+
+	quarantined, _ := filepath.Glob(filepath.Join(app.Quarantine.Dir, "*.json"))
+	if len(quarantined) != 1 {
+		t.Errorf("expected one quarantined file, but found %d", len(quarantined))
+	}
+
+	events, _ := testDB.AuditEvents(context.Background(), data.AuditFilter{Action: data.AuditUploadQuarantined})
+	if len(events) != 1 {
+		t.Fatalf("expected one quarantine audit event, but found %d", len(events))
+	}
+	if events[0].ActorID != 1 || events[0].TargetID != "1" || !strings.Contains(events[0].Detail, "img.png, Eicar-Test-Signature") {
+		t.Errorf("wrong quarantine audit event: %+v", events[0])
+	}
+}
+
+func Test_app_moveLegacyUploads(t *testing.T) {
+	defer func(p, legacy string) { uploadPath, legacyUploadPath = p, legacy }(uploadPath, legacyUploadPath)
+	uploadPath = t.TempDir()
+	legacyUploadPath = t.TempDir()
+
+	// img.png is the admin's picture, unused.png is nobody's, and taken.png is in both places
+	for _, name := range []string{"img.png", "unused.png", "taken.png"} {
+		_ = os.WriteFile(filepath.Join(legacyUploadPath, name), []byte("legacy"), 0644)
+	}
+	_ = os.WriteFile(filepath.Join(uploadPath, "taken.png"), []byte("current"), 0644)
+	_, _ = testDB.InsertUserImage(context.Background(), data.UserImage{UserID: 1, FileName: "taken.png"})
+	defer resetDB()
+
+	err := app.moveLegacyUploads(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name           string
+		dir            string
+		file           string
+		expectedExists bool
+		expected       string
+	}{
+		{"moved", uploadPath, "img.png", true, "legacy"},
+		{"moved, not left behind", legacyUploadPath, "img.png", false, ""},
+		{"unused", legacyUploadPath, "unused.png", true, "legacy"},
+		{"taken, not overwritten", uploadPath, "taken.png", true, "current"},
+		{"taken, left behind", legacyUploadPath, "taken.png", true, "legacy"},
+	}
+
+	for _, e := range tests {
+		contents, err := os.ReadFile(filepath.Join(e.dir, e.file))
+		if e.expectedExists != (err == nil) {
+			t.Errorf("%s: expected %s to exist: %t", e.name, e.file, e.expectedExists)
+		}
+		if e.expectedExists && string(contents) != e.expected {
+			t.Errorf("%s: expected %q but got %q", e.name, e.expected, contents)
+		}
+	}
+
+	// nothing to move is not an error
+	legacyUploadPath = filepath.Join(legacyUploadPath, "gone")
+	if err := app.moveLegacyUploads(context.Background()); err != nil {
+		t.Errorf("expected no error without a legacy directory, but got %s", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Package auditchain makes the audit log tamper-evident. Every event carries the
+// hash of the event before it, so editing or removing one breaks the chain from
+// there on, and checkpoint events signed with an Ed25519 key vouch for the chain up
+// to the event they seal, so that it can't simply be rebuilt after an edit.
+package auditchain
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"personal-projects/webapp/pkg/data"
+	"time"
+)
+
+// Precision is how finely event times are kept. Postgres keeps microseconds, so
+// repositories round times to this before hashing, to hash what they read back.
+const Precision = time.Microsecond
+
+// hashed is what an event's hash covers, in a fixed order.
+type hashed struct {
+	PrevHash   string          `json:"prev_hash"`
+	Time       string          `json:"time"`
+	ActorID    int             `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"user_agent"`
+	Detail     string          `json:"detail"`
+	Changes    json.RawMessage `json:"changes"`
+}
+
+// Hash returns the hex SHA-256 of prev, the hash of the event before e, and e's
+// contents. e's id and its own hashes aren't covered.
+func Hash(prev string, e data.AuditEvent) (string, error) {
+	changes, err := canonicalChanges(e.Changes)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(hashed{
+		PrevHash:   prev,
+		Time:       e.Time.UTC().Format(time.RFC3339Nano),
+		ActorID:    e.ActorID,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		IP:         e.IP,
+		UserAgent:  e.UserAgent,
+		Detail:     e.Detail,
+		Changes:    changes,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// canonicalChanges encodes changes the way they read back from a database: as
+// plain JSON values, with object keys sorted.
+func canonicalChanges(changes map[string]data.Change) (json.RawMessage, error) {
+	if len(changes) == 0 {
+		return json.RawMessage("null"), nil
+	}
+
+	b, err := json.Marshal(changes)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// BrokenLinkError reports the first event at which the chain doesn't hold.
+type BrokenLinkError struct {
+	EventID int
+	Reason  string
+}
+
+func (e *BrokenLinkError) Error() string {
+	return fmt.Sprintf("audit chain broken at event %d: %s", e.EventID, e.Reason)
+}
+
+// Report sums up a verified chain.
+type Report struct {
+	// Events counts every event seen, and Unchained those from before events were
+	// hashed, which can't be verified.
+	Events    int
+	Unchained int
+	// Checkpoints counts the checkpoints whose signature was checked, and Sealed is
+	// the id of the last event one of them sealed.
+	Checkpoints int
+	Sealed      int
+	// Unsealed counts the events after the last sealed one. Nothing vouches for
+	// them yet, so they could have been removed without a trace.
+	Unsealed int
+	// LastHash is the hash of the last event.
+	LastHash string
+}
+
+// sealWindow is how many recent hashes a Verifier remembers for checkpoints to
+// refer to. A checkpoint seals the latest event when it's written, so only events
+// written in the meantime come between them.
+const sealWindow = 10000
+
+// Verifier walks a chain, oldest event first.
+type Verifier struct {
+	// Key checks checkpoint signatures; if nil, checkpoints are chained like any
+	// other event but their signatures aren't checked.
+	Key ed25519.PublicKey
+
+	report Report
+	lastID int
+	recent map[int]string
+	order  []int
+	err    error
+}
+
+// NewVerifier returns a Verifier that checks checkpoints against key, which may be nil.
+func NewVerifier(key ed25519.PublicKey) *Verifier {
+	return &Verifier{Key: key, recent: make(map[int]string)}
+}
+
+// Add checks the next event. It returns a *BrokenLinkError at the first event that
+// doesn't follow from the ones before it, and the same error from then on.
+func (v *Verifier) Add(e *data.AuditEvent) error {
+	if v.err != nil {
+		return v.err
+	}
+	v.err = v.add(e)
+	return v.err
+}
+
+func (v *Verifier) add(e *data.AuditEvent) error {
+	broken := func(format string, args ...any) error {
+		return &BrokenLinkError{EventID: e.ID, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	if e.ID <= v.lastID {
+		return broken("it comes after event %d", v.lastID)
+	}
+
+	if e.Hash == "" {
+		// nothing may follow the chain without being part of it
+		if v.report.LastHash != "" {
+			return broken("it has no hash, but event %d before it does", v.lastID)
+		}
+		v.report.Events++
+		v.report.Unchained++
+		v.lastID = e.ID
+		return nil
+	}
+
+	if e.PrevHash != v.report.LastHash {
+		if v.report.LastHash == "" {
+			return broken("it refers to a previous hash, but the chain starts here")
+		}
+		return broken("its previous hash doesn't match the hash of event %d; an event between them is missing, or was changed", v.lastID)
+	}
+	hash, err := Hash(e.PrevHash, *e)
+	if err != nil {
+		return broken("%s", err)
+	}
+	if hash != e.Hash {
+		return broken("its hash doesn't match its contents; it was changed after it was written")
+	}
+
+	if e.Action == data.AuditCheckpoint && v.Key != nil {
+		sealed, err := v.checkCheckpoint(e)
+		if err != nil {
+			return broken("%s", err)
+		}
+		v.report.Checkpoints++
+		v.report.Sealed = sealed
+		v.report.Unsealed = 0
+		for _, id := range v.order {
+			if id > sealed {
+				v.report.Unsealed++
+			}
+		}
+	}
+
+	v.report.Events++
+	v.report.Unsealed++
+	v.report.LastHash = e.Hash
+	v.lastID = e.ID
+	v.remember(e.ID, e.Hash)
+	return nil
+}
+
+// checkCheckpoint checks that checkpoint e is signed by v.Key, and seals an event
+// in the chain. It returns the sealed event's id.
+func (v *Verifier) checkCheckpoint(e *data.AuditEvent) (int, error) {
+	id, sig, err := parseCheckpoint(e)
+	if err != nil {
+		return 0, err
+	}
+	hash, ok := v.recent[id]
+	if !ok {
+		return 0, fmt.Errorf("the checkpoint seals event %d, which is not among the %d events before it", id, sealWindow)
+	}
+	if !ed25519.Verify(v.Key, checkpointMessage(id, hash), sig) {
+		return 0, fmt.Errorf("the checkpoint's signature for event %d doesn't match; the events up to it were changed, or it was signed with another key", id)
+	}
+	return id, nil
+}
+
+func (v *Verifier) remember(id int, hash string) {
+	v.recent[id] = hash
+	v.order = append(v.order, id)
+	if len(v.order) > sealWindow {
+		delete(v.recent, v.order[0])
+		v.order = v.order[1:]
+	}
+}
+
+// Report returns what the events added so far add up to.
+func (v *Verifier) Report() Report {
+	return v.report
+}
@@ -0,0 +1,214 @@
+package auditchain
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"personal-projects/webapp/pkg/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chain returns events with ids and hashes, as a repository would store them. Events
+// with unchained set are left without hashes, like events from before hashing.
+func chain(t *testing.T, unchained int, events ...data.AuditEvent) []*data.AuditEvent {
+	t.Helper()
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var prev string
+	var chained []*data.AuditEvent
+	for i, e := range events {
+		e.ID = i + 1
+		if e.Time.IsZero() {
+			e.Time = start.Add(time.Duration(i) * time.Minute)
+		}
+		if i >= unchained {
+			e.PrevHash = prev
+			var err error
+			e.Hash, err = Hash(prev, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prev = e.Hash
+		}
+		chained = append(chained, &e)
+	}
+	return chained
+}
+
+// rehash recomputes the hashes from event i on, as someone covering their tracks would.
+func rehash(t *testing.T, events []*data.AuditEvent, i int) {
+	t.Helper()
+	for ; i < len(events); i++ {
+		events[i].PrevHash = ""
+		if i > 0 {
+			events[i].PrevHash = events[i-1].Hash
+		}
+		var err error
+		events[i].Hash, err = Hash(events[i].PrevHash, *events[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// verify adds events to a verifier until one fails, and returns the verifier's
+// report and error.
+func verify(key ed25519.PublicKey, events []*data.AuditEvent) (Report, error) {
+	v := NewVerifier(key)
+	for _, e := range events {
+		err := v.Add(e)
+		if err != nil {
+			return v.Report(), err
+		}
+	}
+	return v.Report(), nil
+}
+
+func Test_Hash(t *testing.T) {
+	e := data.AuditEvent{
+		Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		ActorID: 1,
+		Action:  data.AuditUserUpdated,
+		Changes: map[string]data.Change{"first_name": {Before: "Jack", After: "John"}, "version": {Before: 1, After: 2}},
+	}
+	hash, err := Hash("", e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != 64 {
+		t.Errorf("expected a hex SHA-256 but got %q", hash)
+	}
+
+	// changes hash the same once they have been through JSON, as when read back
+	read := e
+	read.Changes = map[string]data.Change{"version": {Before: 1.0, After: 2.0}, "first_name": {Before: "Jack", After: "John"}}
+	read.Time = e.Time.In(time.FixedZone("CEST", 2*60*60))
+	if got, _ := Hash("", read); got != hash {
+		t.Errorf("expected the event read back to hash the same, but got %s and %s", hash, got)
+	}
+
+	// but anything else changes it
+	changed := e
+	changed.ActorID = 2
+	if got, _ := Hash("", changed); got == hash {
+		t.Error("expected a different actor to change the hash")
+	}
+	if got, _ := Hash(hash, e); got == hash {
+		t.Error("expected a different previous hash to change the hash")
+	}
+}
+
+func Test_Verifier(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := data.AuditEvent{ActorID: 1, Action: data.AuditLogin, TargetType: "user", TargetID: "1", IP: "10.0.0.1"}
+	update := data.AuditEvent{ActorID: 1, Action: data.AuditUserUpdated, TargetType: "user", TargetID: "2",
+		Changes: map[string]data.Change{"email": {Before: "jack@example.com", After: "jack@smith.com"}}}
+	deleted := data.AuditEvent{ActorID: 1, Action: data.AuditUserDeleted, TargetType: "user", TargetID: "2"}
+
+	// sealed returns login, update and deleted with a checkpoint after update, signed with private
+	sealed := func(t *testing.T) []*data.AuditEvent {
+		events := chain(t, 0, login, update, deleted)
+		checkpoint := Checkpoint(private, events[1])
+		checkpoint.Time = events[1].Time.Add(time.Second)
+		events = append(events[:2], append([]*data.AuditEvent{&checkpoint}, events[2:]...)...)
+		for i, e := range events {
+			e.ID = i + 1
+		}
+		rehash(t, events, 2)
+		return events
+	}
+
+	var tests = []struct {
+		name           string
+		key            ed25519.PublicKey
+		events         func(t *testing.T) []*data.AuditEvent
+		expectedReport Report
+		brokenAt       int
+		expectedReason string
+	}{
+		{"intact", nil, func(t *testing.T) []*data.AuditEvent { return chain(t, 0, login, update, deleted) },
+			Report{Events: 3, Unsealed: 3}, 0, ""},
+		{"from before hashing", nil, func(t *testing.T) []*data.AuditEvent { return chain(t, 2, login, update, deleted, login) },
+			Report{Events: 4, Unchained: 2, Unsealed: 2}, 0, ""},
+		{"edited", nil, func(t *testing.T) []*data.AuditEvent {
+			events := chain(t, 0, login, update, deleted)
+			events[1].Changes = map[string]data.Change{"email": {Before: "jack@example.com", After: "someone@else.com"}}
+			return events
+		}, Report{}, 2, "hash doesn't match its contents"},
+		{"removed", nil, func(t *testing.T) []*data.AuditEvent {
+			events := chain(t, 0, login, update, deleted)
+			return append(events[:1], events[2:]...)
+		}, Report{}, 3, "doesn't match the hash of event 1"},
+		{"out of order", nil, func(t *testing.T) []*data.AuditEvent {
+			events := chain(t, 0, login, update, deleted)
+			return append(events, events[1])
+		}, Report{}, 2, "comes after event 3"},
+		{"unhashed after hashing", nil, func(t *testing.T) []*data.AuditEvent {
+			events := chain(t, 0, login, update, deleted)
+			events[2].Hash = ""
+			return events
+		}, Report{}, 3, "has no hash"},
+		{"first refers back", nil, func(t *testing.T) []*data.AuditEvent {
+			events := chain(t, 0, login, update, deleted)
+			return events[1:]
+		}, Report{}, 2, "the chain starts here"},
+		{"sealed", public, sealed,
+			Report{Events: 4, Checkpoints: 1, Sealed: 2, Unsealed: 2}, 0, ""},
+		{"signatures not checked", nil, sealed,
+			Report{Events: 4, Unsealed: 4}, 0, ""},
+		{"sealed with another key", otherPublic, sealed, Report{}, 3, "signature for event 2 doesn't match"},
+		{"rehashed after an edit", public, func(t *testing.T) []*data.AuditEvent {
+			events := sealed(t)
+			events[1].Changes = map[string]data.Change{"email": {Before: "jack@example.com", After: "someone@else.com"}}
+			rehash(t, events, 1)
+			return events
+		}, Report{}, 3, "signature for event 2 doesn't match"},
+		{"checkpoint without a target", public, func(t *testing.T) []*data.AuditEvent {
+			events := sealed(t)
+			events[2].TargetID = ""
+			rehash(t, events, 2)
+			return events
+		}, Report{}, 3, "doesn't say which event it seals"},
+		{"checkpoint of a later event", public, func(t *testing.T) []*data.AuditEvent {
+			events := sealed(t)
+			events[2].TargetID = "4"
+			rehash(t, events, 2)
+			return events
+		}, Report{}, 3, "seals event 4, which is not among"},
+	}
+
+	for _, e := range tests {
+		report, err := verify(e.key, e.events(t))
+
+		if e.brokenAt == 0 {
+			if err != nil {
+				t.Errorf("%s: expected the chain to verify, but got %s", e.name, err)
+				continue
+			}
+			report.LastHash = ""
+			if report != e.expectedReport {
+				t.Errorf("%s: expected report %+v but got %+v", e.name, e.expectedReport, report)
+			}
+			continue
+		}
+
+		var broken *BrokenLinkError
+		if !errors.As(err, &broken) {
+			t.Errorf("%s: expected a broken link but got %v", e.name, err)
+			continue
+		}
+		if broken.EventID != e.brokenAt || !strings.Contains(broken.Reason, e.expectedReason) {
+			t.Errorf("%s: expected a break at event %d because %q, but got %s", e.name, e.brokenAt, e.expectedReason, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package auditchain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"strconv"
+	"time"
+)
+
+// checkpointTarget is the target type of checkpoints, whose target is the event
+// they seal.
+const checkpointTarget = "audit_event"
+
+// checkpointMessage is what a checkpoint signs: the sealed event's id and hash,
+// which covers every event before it.
+func checkpointMessage(id int, hash string) []byte {
+	return []byte(fmt.Sprintf("audit checkpoint %d %s", id, hash))
+}
+
+// Checkpoint returns the event that seals sealed with key. Once it has been
+// added to the chain, the events up to sealed can't be changed without a
+// verifier noticing, even by someone who can recompute every hash.
+func Checkpoint(key ed25519.PrivateKey, sealed *data.AuditEvent) data.AuditEvent {
+	sig := ed25519.Sign(key, checkpointMessage(sealed.ID, sealed.Hash))
+	return data.AuditEvent{
+		Action:     data.AuditCheckpoint,
+		TargetType: checkpointTarget,
+		TargetID:   strconv.Itoa(sealed.ID),
+		Detail:     base64.StdEncoding.EncodeToString(sig),
+	}
+}
+
+// parseCheckpoint returns the id of the event checkpoint e seals, and its signature.
+func parseCheckpoint(e *data.AuditEvent) (int, []byte, error) {
+	id, err := strconv.Atoi(e.TargetID)
+	if e.TargetType != checkpointTarget || err != nil {
+		return 0, nil, fmt.Errorf("the checkpoint doesn't say which event it seals")
+	}
+	sig, err := base64.StdEncoding.DecodeString(e.Detail)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return 0, nil, fmt.Errorf("the checkpoint's signature is malformed")
+	}
+	return id, sig, nil
+}
+
+// Seal adds a checkpoint for the latest event to repo, unless the latest event is
+// itself a checkpoint. It returns the checkpoint, or nil if there was nothing new
+// to seal.
+func Seal(ctx context.Context, repo repository.DatabaseRepo, key ed25519.PrivateKey) (*data.AuditEvent, error) {
+	last, err := repo.LastAuditEvent(ctx)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if last.Action == data.AuditCheckpoint || last.Hash == "" {
+		return nil, nil
+	}
+
+	checkpoint := Checkpoint(key, last)
+	checkpoint.ID, err = repo.InsertAuditEvent(ctx, checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// SealEvery seals the chain every interval until ctx is done.
+func SealEvery(ctx context.Context, repo repository.DatabaseRepo, key ed25519.PrivateKey, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkpoint, err := Seal(ctx, repo, key)
+			if err != nil {
+				log.Println("error sealing the audit log:", err)
+			}
+			if checkpoint != nil {
+				log.Printf("sealed the audit log up to event %s", checkpoint.TargetID)
+			}
+		}
+	}
+}
+
+// GenerateKey writes a new signing key to path, and its public key to path.pub,
+// both PEM encoded. It won't overwrite an existing key.
+func GenerateKey(path string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return err
+	}
+
+	err = writePEM(path, 0600, "PRIVATE KEY", privateDER)
+	if err != nil {
+		return err
+	}
+	return writePEM(path+".pub", 0644, "PUBLIC KEY", publicDER)
+}
+
+func writePEM(path string, perm os.FileMode, typ string, der []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	err = pem.Encode(f, &pem.Block{Type: typ, Bytes: der})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadPrivateKey reads a PEM encoded PKCS #8 Ed25519 key, as GenerateKey writes.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return private, nil
+}
+
+// LoadPublicKey reads a PEM encoded PKIX Ed25519 public key, as GenerateKey writes.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return public, nil
+}
+
+func readPEM(path, typ string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("%s: no PEM %s", path, typ)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,131 @@
+package auditchain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"testing"
+)
+
+// chainRepo keeps a chained audit log in memory; every other method panics.
+type chainRepo struct {
+	repository.DatabaseRepo
+	events []*data.AuditEvent
+}
+
+func (r *chainRepo) InsertAuditEvent(ctx context.Context, e data.AuditEvent) (int, error) {
+	e.ID = len(r.events) + 1
+	if len(r.events) > 0 {
+		e.PrevHash = r.events[len(r.events)-1].Hash
+	}
+	var err error
+	e.Hash, err = Hash(e.PrevHash, e)
+	if err != nil {
+		return 0, err
+	}
+	r.events = append(r.events, &e)
+	return e.ID, nil
+}
+
+func (r *chainRepo) LastAuditEvent(ctx context.Context) (*data.AuditEvent, error) {
+	if len(r.events) == 0 {
+		return nil, repository.ErrNotFound
+	}
+	return r.events[len(r.events)-1], nil
+}
+
+func Test_Seal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.key")
+	err := GenerateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := LoadPublicKey(path + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &chainRepo{}
+	checkpoint, err := Seal(ctx, repo, private)
+	if err != nil || checkpoint != nil {
+		t.Errorf("expected nothing to seal in an empty log, but got %v, %v", checkpoint, err)
+	}
+
+	for _, e := range []data.AuditEvent{
+		{ActorID: 1, Action: data.AuditLogin},
+		{ActorID: 1, Action: data.AuditUserDeleted, TargetType: "user", TargetID: "2"},
+	} {
+		_, _ = repo.InsertAuditEvent(ctx, e)
+	}
+
+	checkpoint, err = Seal(ctx, repo, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint == nil || checkpoint.ID != 3 || checkpoint.TargetID != "2" {
+		t.Fatalf("expected event 3 to seal event 2, but got %+v", checkpoint)
+	}
+
+	// nothing has happened since
+	checkpoint, err = Seal(ctx, repo, private)
+	if err != nil || checkpoint != nil {
+		t.Errorf("expected nothing new to seal, but got %v, %v", checkpoint, err)
+	}
+
+	report, err := verify(public, repo.events)
+	if err != nil {
+		t.Fatalf("expected the sealed log to verify, but got %s", err)
+	}
+	if report.Checkpoints != 1 || report.Sealed != 2 || report.Unsealed != 1 {
+		t.Errorf("expected one checkpoint sealing event 2, but got %+v", report)
+	}
+}
+
+func Test_GenerateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.key")
+	err := GenerateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing key is never replaced
+	if err := GenerateKey(path); !os.IsExist(err) {
+		t.Errorf("expected generating over an existing key to fail, but got %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the private key to be readable by its owner only, but its mode is %s", info.Mode())
+	}
+
+	private, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := LoadPublicKey(path + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !public.Equal(private.Public().(ed25519.PublicKey)) {
+		t.Error("expected the public key to belong to the private key")
+	}
+
+	// each loader only takes its own kind of key
+	if _, err := LoadPublicKey(path); err == nil {
+		t.Error("expected a private key not to load as a public key")
+	}
+	if _, err := LoadPrivateKey(path + ".pub"); err == nil {
+		t.Error("expected a public key not to load as a private key")
+	}
+}
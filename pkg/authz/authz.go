@@ -0,0 +1,57 @@
+// Package authz decides whether the person making a request may do what they ask.
+// Authentication happens first, in each app's own way: the web app reads the user
+// from the session, the api from the JWT. Either way it ends by storing a Subject
+// in the request context, which RequirePermission, or an Engine's policy, then
+// checks.
+package authz
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+// Subject is who a request is made by, and what their roles allow them to do.
+type Subject struct {
+	UserID      int      `json:"id"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// Can reports whether the subject has permission.
+func (s Subject) Can(permission string) bool {
+	return slices.Contains(s.Permissions, permission)
+}
+
+type contextKey struct{}
+
+// WithSubject returns a copy of ctx that carries s.
+func WithSubject(ctx context.Context, s Subject) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// SubjectFromContext returns the subject stored by WithSubject, if there is one.
+func SubjectFromContext(ctx context.Context) (Subject, bool) {
+	s, ok := ctx.Value(contextKey{}).(Subject)
+	return s, ok
+}
+
+// RequirePermission returns middleware that only lets requests through if their
+// subject has permission. Requests without a subject get 401 Unauthorized, and
+// subjects without the permission get 403 Forbidden.
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, ok := SubjectFromContext(r.Context())
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			if !s.Can(permission) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
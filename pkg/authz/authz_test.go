@@ -0,0 +1,39 @@
+package authz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequirePermission(t *testing.T) {
+	var tests = []struct {
+		name           string
+		subject        *Subject
+		expectedStatus int
+	}{
+		{"no subject", nil, http.StatusUnauthorized},
+		{"no permissions", &Subject{UserID: 1}, http.StatusForbidden},
+		{"other permissions", &Subject{UserID: 1, Permissions: []string{"users:read"}}, http.StatusForbidden},
+		{"permitted", &Subject{UserID: 1, Permissions: []string{"users:read", "users:write"}}, http.StatusOK},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := RequirePermission("users:write")(next)
+
+	for _, e := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if e.subject != nil {
+			req = req.WithContext(WithSubject(req.Context(), *e.subject))
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
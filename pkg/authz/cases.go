@@ -0,0 +1,69 @@
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Case is a request, and whether a policy should allow it, for testing policies
+// without running the apps.
+type Case struct {
+	Name    string  `json:"name"`
+	Request Request `json:"request"`
+	Expect  Effect  `json:"expect"`
+}
+
+// Check evaluates the case against p. The error says why it failed, if it did.
+func (c Case) Check(p *Policy) (Decision, error) {
+	d := p.Evaluate(c.Request)
+	if d.Allowed != (c.Expect == Allow) {
+		if d.Rule == "" {
+			return d, fmt.Errorf("expected %s, but no rule matched, so it was denied", c.Expect)
+		}
+		return d, fmt.Errorf("expected %s, but rule %s decided %s", c.Expect, d.Rule, d.Effect())
+	}
+	return d, nil
+}
+
+// LoadCases reads test cases from a YAML or JSON file, which holds a list of them
+// under cases:.
+func LoadCases(path string) ([]Case, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cases, err := ParseCases(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cases, nil
+}
+
+// ParseCases reads test cases written in YAML or JSON.
+func ParseCases(b []byte) ([]Case, error) {
+	var doc struct {
+		Cases []Case `json:"cases"`
+	}
+	err := decode(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(doc.Cases) == 0 {
+		return nil, errors.New("no cases")
+	}
+	for i, c := range doc.Cases {
+		if c.Name == "" {
+			return nil, fmt.Errorf("case %d has no name", i+1)
+		}
+		if c.Expect != Allow && c.Expect != Deny {
+			return nil, fmt.Errorf("case %s: expect must be allow or deny, not %q", c.Name, c.Expect)
+		}
+		if c.Request.Action == "" {
+			return nil, fmt.Errorf("case %s: no action", c.Name)
+		}
+	}
+	return doc.Cases, nil
+}
@@ -0,0 +1,115 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Engine applies a policy to requests, and writes every decision it makes to a
+// log.
+type Engine struct {
+	policy *Policy
+
+	mu  sync.Mutex
+	log io.Writer
+}
+
+// NewEngine returns an engine for policy. If decisions isn't nil, each decision
+// is written to it as a line of JSON.
+func NewEngine(policy *Policy, decisions io.Writer) *Engine {
+	return &Engine{policy: policy, log: decisions}
+}
+
+// OpenDecisionLog opens the file a decision log is appended to. "-" means standard
+// error, and an empty path means no log, for which it returns nil.
+func OpenDecisionLog(path string) (io.WriteCloser, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return nopCloser{os.Stderr}, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// loggedDecision is a line of the decision log.
+type loggedDecision struct {
+	Time time.Time `json:"time"`
+	Decision
+}
+
+// Decide evaluates req against the policy, and logs the decision.
+func (e *Engine) Decide(req Request) Decision {
+	d := e.policy.Evaluate(req)
+
+	if e.log != nil {
+		line, err := json.Marshal(loggedDecision{Time: time.Now().UTC(), Decision: d})
+		if err != nil {
+			log.Println("could not log authorization decision:", err)
+			return d
+		}
+
+		e.mu.Lock()
+		_, err = e.log.Write(append(line, '\n'))
+		e.mu.Unlock()
+		if err != nil {
+			log.Println("could not log authorization decision:", err)
+		}
+	}
+
+	return d
+}
+
+// Allowed reports whether the subject stored in ctx may take action on resource.
+// Without a subject, the answer is no.
+func (e *Engine) Allowed(ctx context.Context, action string, resource Resource) bool {
+	s, ok := SubjectFromContext(ctx)
+	if !ok {
+		return false
+	}
+	return e.Decide(Request{Subject: s, Action: action, Resource: resource}).Allowed
+}
+
+// ResourceFunc works out what an HTTP request acts on, usually from its URL.
+type ResourceFunc func(r *http.Request) Resource
+
+// ResourceType returns a ResourceFunc for routes that act on a kind of resource as a
+// whole, like a list of users, rather than on one of them.
+func ResourceType(typ string) ResourceFunc {
+	return func(*http.Request) Resource {
+		return Resource{Type: typ}
+	}
+}
+
+// Require returns middleware that only lets requests through if the policy allows
+// their subject to take action on the resource that resource returns. Like
+// RequirePermission, it responds 401 Unauthorized to requests without a subject,
+// and 403 Forbidden to those the policy denies.
+func (e *Engine) Require(action string, resource ResourceFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, ok := SubjectFromContext(r.Context())
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			d := e.Decide(Request{Subject: s, Action: action, Resource: resource(r)})
+			if !d.Allowed {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEngine_Require(t *testing.T) {
+	var tests = []struct {
+		name           string
+		subject        *Subject
+		url            string
+		expectedStatus int
+		expectedLog    string
+	}{
+		{"no subject", nil, "/users/1", http.StatusUnauthorized, ""},
+		{"nothing allows it", &Subject{UserID: 2}, "/users/1", http.StatusForbidden, `"allowed":false`},
+		{"own profile", &Subject{UserID: 2}, "/users/2", http.StatusOK, `"rule":"own-profile"`},
+		{"permission", &Subject{UserID: 2, Permissions: []string{"users:read"}}, "/users/1", http.StatusOK, `"rule":"permissions"`},
+	}
+
+	var decisions bytes.Buffer
+	engine := NewEngine(DefaultPolicy(), &decisions)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := engine.Require("users:read", func(r *http.Request) Resource {
+		return Resource{Type: "user", ID: strings.TrimPrefix(r.URL.Path, "/users/")}
+	})(next)
+
+	for _, e := range tests {
+		decisions.Reset()
+
+		req := httptest.NewRequest("GET", e.url, nil)
+		if e.subject != nil {
+			req = req.WithContext(WithSubject(req.Context(), *e.subject))
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		line := decisions.String()
+		if e.expectedLog == "" {
+			if line != "" {
+				t.Errorf("%s: expected no decision to be logged, but got %s", e.name, line)
+			}
+			continue
+		}
+		if !strings.Contains(line, e.expectedLog) {
+			t.Errorf("%s: expected %s in the decision log, but got %s", e.name, e.expectedLog, line)
+		}
+
+		var logged struct {
+			Time    string  `json:"time"`
+			Request Request `json:"request"`
+		}
+		err := json.Unmarshal([]byte(line), &logged)
+		if err != nil || logged.Time == "" || logged.Request.Resource.ID != strings.TrimPrefix(e.url, "/users/") {
+			t.Errorf("%s: expected a timestamped decision for the request, but got %s", e.name, line)
+		}
+	}
+}
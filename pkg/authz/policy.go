@@ -0,0 +1,347 @@
+package authz
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Effect is what a rule does to the requests it matches.
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// Resource is what a request acts on. Attributes carry anything else a rule may
+// look at, such as the fields an update changes.
+type Resource struct {
+	Type       string         `json:"type"`
+	ID         string         `json:"id,omitempty"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+// Request asks whether Subject may take Action on Resource.
+type Request struct {
+	Subject  Subject  `json:"subject"`
+	Action   string   `json:"action"`
+	Resource Resource `json:"resource"`
+}
+
+// Decision is a policy's answer to a Request.
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// Rule is the rule that decided, or empty if no rule matched, in which case the
+	// request is denied.
+	Rule    string  `json:"rule,omitempty"`
+	Request Request `json:"request"`
+}
+
+// Effect is what the decision came to.
+func (d Decision) Effect() Effect {
+	if d.Allowed {
+		return Allow
+	}
+	return Deny
+}
+
+// Condition compares one attribute of a request with a value, or with another
+// attribute. Attributes are named:
+//
+//	action
+//	subject.id, subject.roles, subject.permissions
+//	resource.type, resource.id, resource.<attribute>
+//
+// A condition on an attribute the request doesn't have never holds.
+type Condition struct {
+	Attr string `json:"attr"`
+	// Op is one of:
+	//	eq, ne            the attribute is, or isn't, the value
+	//	in, not_in        the attribute is, or isn't, one of a list of values
+	//	contains          the attribute, a list, holds the value, or any of them
+	//	not_contains      the attribute, a list, holds neither the value nor any of them
+	Op string `json:"op"`
+	// Value and ValueAttr are mutually exclusive.
+	Value     any    `json:"value,omitempty"`
+	ValueAttr string `json:"value_attr,omitempty"`
+}
+
+// Rule matches requests for one of its actions that meet all its conditions.
+// Actions may be "*" for every action, or end in ":*" for every action on a
+// resource, like "users:*".
+type Rule struct {
+	Name    string      `json:"name"`
+	Effect  Effect      `json:"effect"`
+	Actions []string    `json:"actions"`
+	When    []Condition `json:"when,omitempty"`
+}
+
+// Policy is a list of rules. A request is allowed if an allow rule matches it and
+// no deny rule does; everything else is denied.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+//go:embed default_policy.yaml
+var defaultPolicy []byte
+
+// DefaultPolicy returns the policy used unless the apps are given another: the
+// permissions a user's roles grant, and access to their own profile.
+func DefaultPolicy() *Policy {
+	p, err := ParsePolicy(defaultPolicy)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// LoadPolicy reads a policy from a YAML or JSON file. An empty path means
+// DefaultPolicy.
+func LoadPolicy(path string) (*Policy, error) {
+	if path == "" {
+		return DefaultPolicy(), nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := ParsePolicy(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// ParsePolicy reads a policy written in YAML or JSON, and checks it makes sense.
+func ParsePolicy(b []byte) (*Policy, error) {
+	var p Policy
+	err := decode(b, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// decode reads YAML, or JSON, which is YAML too, into v, using v's json tags and
+// rejecting unknown fields.
+func decode(b []byte, v any) error {
+	var doc any
+	err := yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+var ops = []string{"eq", "ne", "in", "not_in", "contains", "not_contains"}
+
+func (p *Policy) validate() error {
+	if len(p.Rules) == 0 {
+		return errors.New("policy has no rules")
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule %d has no name", i+1)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rule %s: name is used more than once", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if rule.Effect != Allow && rule.Effect != Deny {
+			return fmt.Errorf("rule %s: effect must be allow or deny, not %q", rule.Name, rule.Effect)
+		}
+		if len(rule.Actions) == 0 {
+			return fmt.Errorf("rule %s: no actions", rule.Name)
+		}
+
+		for _, c := range rule.When {
+			err := c.validate()
+			if err != nil {
+				return fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c Condition) validate() error {
+	if !validAttr(c.Attr) {
+		return fmt.Errorf("unknown attribute %q", c.Attr)
+	}
+	if !slices.Contains(ops, c.Op) {
+		return fmt.Errorf("%s: unknown op %q; use one of %s", c.Attr, c.Op, strings.Join(ops, ", "))
+	}
+
+	switch {
+	case c.ValueAttr != "" && c.Value != nil:
+		return fmt.Errorf("%s: give either value or value_attr, not both", c.Attr)
+	case c.ValueAttr != "":
+		if !validAttr(c.ValueAttr) {
+			return fmt.Errorf("unknown attribute %q", c.ValueAttr)
+		}
+	case c.Value == nil:
+		return fmt.Errorf("%s: no value or value_attr", c.Attr)
+	case c.Op == "in" || c.Op == "not_in":
+		if _, ok := c.Value.([]any); !ok {
+			return fmt.Errorf("%s: %s needs a list of values", c.Attr, c.Op)
+		}
+	}
+	return nil
+}
+
+func validAttr(attr string) bool {
+	switch attr {
+	case "action", "subject.id", "subject.roles", "subject.permissions", "resource.type", "resource.id":
+		return true
+	}
+	name, ok := strings.CutPrefix(attr, "resource.")
+	return ok && name != ""
+}
+
+// Evaluate decides req. Deny rules win over allow rules; if neither matches, the
+// request is denied.
+func (p *Policy) Evaluate(req Request) Decision {
+	d := Decision{Request: req}
+	for _, rule := range p.Rules {
+		if !rule.matches(req) {
+			continue
+		}
+		if rule.Effect == Deny {
+			return Decision{Allowed: false, Rule: rule.Name, Request: req}
+		}
+		if d.Rule == "" {
+			d.Allowed, d.Rule = true, rule.Name
+		}
+	}
+	return d
+}
+
+func (rule Rule) matches(req Request) bool {
+	if !slices.ContainsFunc(rule.Actions, func(a string) bool { return actionMatches(a, req.Action) }) {
+		return false
+	}
+	for _, c := range rule.When {
+		if !c.holds(req) {
+			return false
+		}
+	}
+	return true
+}
+
+func actionMatches(pattern, action string) bool {
+	if pattern == "*" || pattern == action {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "*")
+	return ok && strings.HasSuffix(prefix, ":") && strings.HasPrefix(action, prefix)
+}
+
+func (c Condition) holds(req Request) bool {
+	attr, ok := req.attr(c.Attr)
+	if !ok {
+		return false
+	}
+
+	value := c.Value
+	if c.ValueAttr != "" {
+		value, ok = req.attr(c.ValueAttr)
+		if !ok {
+			return false
+		}
+	}
+
+	switch c.Op {
+	case "eq":
+		return scalar(attr) == scalar(value)
+	case "ne":
+		return scalar(attr) != scalar(value)
+	case "in":
+		return slices.Contains(list(value), scalar(attr))
+	case "not_in":
+		return !slices.Contains(list(value), scalar(attr))
+	case "contains":
+		return slices.ContainsFunc(list(value), func(v string) bool { return slices.Contains(list(attr), v) })
+	case "not_contains":
+		return !slices.ContainsFunc(list(value), func(v string) bool { return slices.Contains(list(attr), v) })
+	}
+	return false
+}
+
+// attr returns the named attribute of the request.
+func (req Request) attr(name string) (any, bool) {
+	switch name {
+	case "action":
+		return req.Action, true
+	case "subject.id":
+		return req.Subject.UserID, true
+	case "subject.roles":
+		return req.Subject.Roles, true
+	case "subject.permissions":
+		return req.Subject.Permissions, true
+	case "resource.type":
+		return req.Resource.Type, true
+	case "resource.id":
+		return req.Resource.ID, req.Resource.ID != ""
+	}
+
+	v, ok := req.Resource.Attributes[strings.TrimPrefix(name, "resource.")]
+	return v, ok
+}
+
+// scalar turns a value into a string, so that values compare the same whether they
+// came from YAML, JSON or Go: 2, 2.0 and "2" are all "2".
+func scalar(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// list turns a value into a list of scalars; a single value is a list of one.
+func list(v any) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []any:
+		out := make([]string, len(v))
+		for i, e := range v {
+			out[i] = scalar(e)
+		}
+		return out
+	case nil:
+		return nil
+	default:
+		return []string{scalar(v)}
+	}
+}
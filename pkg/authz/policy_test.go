@@ -0,0 +1,152 @@
+package authz
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	var tests = []struct {
+		name          string
+		policy        string
+		expectedError string
+	}{
+		{"yaml", "rules:\n  - {name: all, effect: allow, actions: ['*']}", ""},
+		{"json", `{"rules":[{"name":"all","effect":"allow","actions":["*"]}]}`, ""},
+		{"no rules", "rules: []", "no rules"},
+		{"no name", "rules:\n  - {effect: allow, actions: ['*']}", "no name"},
+		{"same name", "rules:\n  - {name: a, effect: allow, actions: ['*']}\n  - {name: a, effect: deny, actions: ['*']}", "more than once"},
+		{"bad effect", "rules:\n  - {name: a, effect: maybe, actions: ['*']}", "effect must be"},
+		{"no actions", "rules:\n  - {name: a, effect: allow}", "no actions"},
+		{"unknown field", "rules:\n  - {name: a, effect: allow, actions: ['*'], unless: []}", "unknown field"},
+		{"unknown attribute", "rules:\n  - {name: a, effect: allow, actions: ['*'], when: [{attr: subject.name, op: eq, value: x}]}", "unknown attribute"},
+		{"unknown op", "rules:\n  - {name: a, effect: allow, actions: ['*'], when: [{attr: action, op: like, value: x}]}", "unknown op"},
+		{"no value", "rules:\n  - {name: a, effect: allow, actions: ['*'], when: [{attr: action, op: eq}]}", "no value"},
+		{"both values", "rules:\n  - {name: a, effect: allow, actions: ['*'], when: [{attr: action, op: eq, value: x, value_attr: subject.id}]}", "not both"},
+		{"in without a list", "rules:\n  - {name: a, effect: allow, actions: ['*'], when: [{attr: action, op: in, value: x}]}", "needs a list"},
+	}
+
+	for _, e := range tests {
+		_, err := ParsePolicy([]byte(e.policy))
+		switch {
+		case e.expectedError == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		case e.expectedError != "" && err == nil:
+			t.Errorf("%s: expected an error containing %q, but got none", e.name, e.expectedError)
+		case e.expectedError != "" && !strings.Contains(err.Error(), e.expectedError):
+			t.Errorf("%s: expected an error containing %q, but got %q", e.name, e.expectedError, err)
+		}
+	}
+}
+
+func TestPolicy_Evaluate(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+rules:
+  - name: readers
+    effect: allow
+    actions: ["users:read"]
+    when:
+      - {attr: subject.roles, op: contains, value: [reader, editor]}
+  - name: editors
+    effect: allow
+    actions: ["users:*"]
+    when:
+      - {attr: subject.roles, op: contains, value: editor}
+  - name: own
+    effect: allow
+    actions: ["users:read"]
+    when:
+      - {attr: resource.id, op: eq, value_attr: subject.id}
+  - name: not-the-admin
+    effect: deny
+    actions: ["users:delete"]
+    when:
+      - {attr: resource.id, op: in, value: [1]}
+  - name: frozen
+    effect: deny
+    actions: ["*"]
+    when:
+      - {attr: resource.frozen, op: eq, value: true}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name         string
+		subject      Subject
+		action       string
+		resource     Resource
+		expectedRule string
+		allowed      bool
+	}{
+		{"nobody", Subject{UserID: 2}, "users:read", Resource{Type: "user", ID: "1"}, "", false},
+		{"reader", Subject{UserID: 2, Roles: []string{"reader"}}, "users:read", Resource{Type: "user", ID: "1"}, "readers", true},
+		{"reader writes", Subject{UserID: 2, Roles: []string{"reader"}}, "users:write", Resource{Type: "user", ID: "1"}, "", false},
+		{"editor writes", Subject{UserID: 2, Roles: []string{"editor"}}, "users:write", Resource{Type: "user", ID: "3"}, "editors", true},
+		{"editor, other resource", Subject{UserID: 2, Roles: []string{"editor"}}, "roles:write", Resource{Type: "role"}, "", false},
+		{"first allow names the rule", Subject{UserID: 2, Roles: []string{"editor"}}, "users:read", Resource{Type: "user", ID: "2"}, "readers", true},
+		{"own", Subject{UserID: 2}, "users:read", Resource{Type: "user", ID: "2"}, "own", true},
+		{"own, no id", Subject{UserID: 2}, "users:read", Resource{Type: "user"}, "", false},
+		{"deny wins", Subject{UserID: 2, Roles: []string{"editor"}}, "users:delete", Resource{Type: "user", ID: "1"}, "not-the-admin", false},
+		{"deny elsewhere", Subject{UserID: 2, Roles: []string{"editor"}}, "users:delete", Resource{Type: "user", ID: "3"}, "editors", true},
+		{"attribute", Subject{UserID: 2, Roles: []string{"editor"}}, "users:write", Resource{Type: "user", ID: "3", Attributes: map[string]any{"frozen": true}}, "frozen", false},
+	}
+
+	for _, e := range tests {
+		d := policy.Evaluate(Request{Subject: e.subject, Action: e.action, Resource: e.resource})
+		if d.Allowed != e.allowed || d.Rule != e.expectedRule {
+			t.Errorf("%s: expected allowed %t by %q, but got %t by %q", e.name, e.allowed, e.expectedRule, d.Allowed, d.Rule)
+		}
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+
+	var tests = []struct {
+		name     string
+		subject  Subject
+		action   string
+		resource Resource
+		allowed  bool
+	}{
+		{"permission", Subject{UserID: 2, Permissions: []string{"users:read"}}, "users:read", Resource{Type: "user", ID: "1"}, true},
+		{"no permission", Subject{UserID: 2, Permissions: []string{"users:read"}}, "users:delete", Resource{Type: "user", ID: "1"}, false},
+		{"own profile", Subject{UserID: 2}, "users:write", Resource{Type: "user", ID: "2"}, true},
+		{"own account", Subject{UserID: 2}, "users:delete", Resource{Type: "user", ID: "2"}, false},
+		{"own roles", Subject{UserID: 2}, "roles:write", Resource{Type: "user", ID: "2"}, false},
+		{"someone else", Subject{UserID: 2}, "users:read", Resource{Type: "user", ID: "1"}, false},
+	}
+
+	for _, e := range tests {
+		d := policy.Evaluate(Request{Subject: e.subject, Action: e.action, Resource: e.resource})
+		if d.Allowed != e.allowed {
+			t.Errorf("%s: expected allowed %t, but got %t by %q", e.name, e.allowed, d.Allowed, d.Rule)
+		}
+	}
+}
+
+func TestLoadCases(t *testing.T) {
+	policy, err := LoadPolicy("./testdata/support.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases, err := LoadCases("./testdata/support_cases.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		_, err := c.Check(policy)
+		if err != nil {
+			t.Errorf("%s: %s", c.Name, err)
+		}
+	}
+
+	// the default policy has no support role
+	_, err = cases[0].Check(DefaultPolicy())
+	if err == nil {
+		t.Errorf("expected %s to fail against the default policy", cases[0].Name)
+	}
+}
@@ -0,0 +1,95 @@
+package avatar
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignURL(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+
+	var tests = []struct {
+		name     string
+		secret   []byte
+		rawURL   func(signed string) string
+		expected bool
+	}{
+		{"valid", secret, func(s string) string { return s }, true},
+		{"wrong secret", []byte("other"), func(s string) string { return s }, false},
+		{"no secret", nil, func(s string) string { return s }, false},
+		{"other path", secret, func(s string) string { return "/avatars/2/md?" + mustParse(t, s).RawQuery }, false},
+		{"unsigned", secret, func(s string) string { return "/avatars/1/md" }, false},
+		{"expired", secret, func(string) string { return SignURL(secret, "/avatars/1/md", now.Add(-time.Minute)) }, false},
+	}
+
+	signed := SignURL(secret, "/avatars/1/md", now.Add(time.Hour))
+	for _, e := range tests {
+		u := mustParse(t, e.rawURL(signed))
+		if VerifyURL(e.secret, u, now) != e.expected {
+			t.Errorf("%s: expected %t", e.name, e.expected)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 300, 200))
+
+	img := Resize(src, 64)
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+		t.Errorf("expected a 64x64 image, but got %v", img.Bounds())
+	}
+}
+
+func TestCheck(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	encoded := func(encode func(b *bytes.Buffer) error) []byte {
+		var b bytes.Buffer
+		if err := encode(&b); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	var tests = []struct {
+		name                string
+		file                []byte
+		expectedContentType string
+		expectedErr         error
+	}{
+		{"png", encoded(func(b *bytes.Buffer) error { return png.Encode(b, img) }), "image/png", nil},
+		{"jpeg", encoded(func(b *bytes.Buffer) error { return jpeg.Encode(b, img, nil) }), "image/jpeg", nil},
+		{"gif", encoded(func(b *bytes.Buffer) error { return gif.Encode(b, img, nil) }), "image/gif", nil},
+		{"html", []byte("<html><script>alert(1)</script></html>"), "", ErrUnsupported},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), "", ErrUnsupported},
+		{"empty", nil, "", ErrUnsupported},
+		// a gif header claiming 50000x50000 pixels
+		{"too large", []byte("GIF89a\x50\xc3\x50\xc3\x00\x00\x00"), "", ErrTooLarge},
+		{"no pixels", []byte("GIF89a\x00\x00\x00\x00\x00\x00\x00"), "", ErrTooLarge},
+	}
+
+	for _, e := range tests {
+		contentType, err := Check(bytes.NewReader(e.file))
+		if contentType != e.expectedContentType {
+			t.Errorf("%s: expected content type %q but got %q", e.name, e.expectedContentType, contentType)
+		}
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v but got %v", e.name, e.expectedErr, err)
+		}
+	}
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,129 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Audit actions are named <target>.<what happened>.
+const (
+	AuditLogin                = "auth.login"                 // a user logged in to the web app
+	AuditLoginFailed          = "auth.login_failed"          // someone gave a wrong email address or password
+	AuditTokenIssued          = "auth.token_issued"          // a user logged in to the api
+	AuditTokenRefreshed       = "auth.token_refreshed"       // a user swapped a refresh token for new tokens
+	AuditImpersonationStarted = "auth.impersonation_started" // an admin logged in as another user, or got an api token to act as them
+	AuditImpersonationEnded   = "auth.impersonation_ended"   // an admin went back to being themselves in the web app
+	AuditUserCreated          = "user.created"               // a user was inserted
+	AuditUserUpdated          = "user.updated"               // a user's profile or settings changed
+	AuditUserDeleted          = "user.deleted"               // a user was deleted, and can be restored until they are purged
+	AuditUserRestored         = "user.restored"              // a deleted user was brought back
+	AuditUserPurged           = "user.purged"                // a deleted user was removed for good, with their images
+	AuditClosureRequested     = "user.closure_requested"     // a user asked for their account to be deleted after a cooling-off period
+	AuditClosureCancelled     = "user.closure_cancelled"     // a user changed their mind before their account was deleted
+	AuditDataExported         = "user.data_exported"         // a copy of everything kept about a user was downloaded
+	AuditPasswordChanged      = "user.password_changed"      // a user changed their own password
+	AuditPasswordReset        = "user.password_reset"        // someone else set a user's password
+	AuditImageUploaded        = "user.image_uploaded"        // a user uploaded a profile picture
+	AuditImageDeleted         = "user.image_deleted"         // a profile picture was deleted, by its owner or an admin
+	AuditUploadQuarantined    = "user.upload_quarantined"    // an upload contained malware, and was put in quarantine instead of stored
+	AuditRoleAssigned         = "user.role_assigned"         // a user was given a role
+	AuditRoleRevoked          = "user.role_revoked"          // a role was taken away from a user
+	AuditCheckpoint           = "audit.checkpoint"           // the events so far were signed, so that they can be verified later
+)
+
+// AuditEvent records something a user did, or had done to them. Events are only
+// ever added, never changed or removed.
+type AuditEvent struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+	// ActorID is the user who did it, or 0 if nobody was logged in, as for a
+	// failed login.
+	ActorID    int    `json:"actor_id"`
+	Action     string `json:"action"`
+	TargetType string `json:"target_type,omitempty"`
+	TargetID   string `json:"target_id,omitempty"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"user_agent"`
+	// Detail says anything else worth knowing, like why a login failed.
+	Detail string `json:"detail,omitempty"`
+	// Changes holds the fields that changed, by their JSON names.
+	Changes map[string]Change `json:"changes,omitempty"`
+	// PrevHash is the Hash of the event before this one, and Hash covers PrevHash
+	// and everything above but the id, so that the events form a chain that breaks
+	// if one is edited or removed. The repository sets both.
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Change is a field's value before and after an event. Before is nil for
+// something new, and After for something deleted.
+type Change struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// AuditFilter narrows down the events AuditEvents returns. Zero fields don't
+// filter.
+type AuditFilter struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   string
+	// Since and Until bound the time of the events; Since is inclusive, Until isn't.
+	Since time.Time
+	Until time.Time
+	// AfterID skips the events up to and including this one, for paging.
+	AfterID int
+	Limit   int
+}
+
+// ActingAs adds to detail that the actor was logged in as user id, for events done
+// while impersonating them. The actor of those is always the admin.
+func ActingAs(detail string, id int) string {
+	note := fmt.Sprintf("acting as user %d", id)
+	if detail == "" {
+		return note
+	}
+	return detail + "; " + note
+}
+
+// Diff compares two values by their JSON encodings, which leaves out anything
+// that is never serialized, like password hashes. Either may be nil, for
+// something created or deleted. It returns nil if nothing changed.
+func Diff(before, after any) map[string]Change {
+	b, a := jsonFields(before), jsonFields(after)
+
+	changes := make(map[string]Change)
+	for name, was := range b {
+		if now, ok := a[name]; !ok || !reflect.DeepEqual(was, now) {
+			changes[name] = Change{Before: was, After: a[name]}
+		}
+	}
+	for name, now := range a {
+		if _, ok := b[name]; !ok {
+			changes[name] = Change{After: now}
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// jsonFields returns the fields v has when encoded as a JSON object.
+func jsonFields(v any) map[string]any {
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil() {
+		return nil
+	}
+
+	var fields map[string]any
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	_ = json.Unmarshal(b, &fields)
+	return fields
+}
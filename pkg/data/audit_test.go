@@ -0,0 +1,49 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	jack := User{ID: 2, FirstName: "Jack", Email: "jack@example.com", Password: "hash", Roles: []string{}}
+	renamed := jack
+	renamed.FirstName, renamed.Password = "John", "another hash"
+
+	var tests = []struct {
+		name     string
+		before   any
+		after    any
+		expected map[string]Change
+	}{
+		{"unchanged", jack, jack, nil},
+		{"changed", jack, renamed, map[string]Change{"first_name": {Before: "Jack", After: "John"}}},
+		{"pointers", &jack, &renamed, map[string]Change{"first_name": {Before: "Jack", After: "John"}}},
+		{"created", nil, map[string]any{"email": "jack@example.com"}, map[string]Change{"email": {After: "jack@example.com"}}},
+		{"deleted", map[string]any{"email": "jack@example.com"}, (*User)(nil), map[string]Change{"email": {Before: "jack@example.com"}}},
+	}
+
+	for _, e := range tests {
+		got := Diff(e.before, e.after)
+		if !reflect.DeepEqual(got, e.expected) {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestActingAs(t *testing.T) {
+	var tests = []struct {
+		name     string
+		detail   string
+		expected string
+	}{
+		{"no detail", "", "acting as user 2"},
+		{"detail", "image 3, jack.png", "image 3, jack.png; acting as user 2"},
+	}
+
+	for _, e := range tests {
+		if got := ActingAs(e.detail, 2); got != e.expected {
+			t.Errorf("%s: expected %q but got %q", e.name, e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package data
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+// ErrInvalidEmail is returned by NormalizeEmail for anything that is not a bare
+// email address.
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// NormalizeEmail trims and lower-cases an email address, so that the same address
+// typed in different ways is stored and looked up as one. The whole address is
+// lower-cased: mail servers may treat the local part as case-sensitive, but none
+// that our users are on do, and two accounts that differ only in case are a
+// mistake rather than a feature.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	// reject display names ("Admin <admin@example.com>") and comments, which
+	// ParseAddress would otherwise accept and strip
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > 255 {
+		return "", ErrInvalidEmail
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 1 || !strings.Contains(email[at+1:], ".") {
+		return "", ErrInvalidEmail
+	}
+
+	return email, nil
+}
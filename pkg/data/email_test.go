@@ -0,0 +1,41 @@
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	var tests = []struct {
+		name     string
+		email    string
+		expected string
+		valid    bool
+	}{
+		{"lower case", "admin@example.com", "admin@example.com", true},
+		{"mixed case", "Admin@Example.COM", "admin@example.com", true},
+		{"surrounding space", "  admin@example.com\t", "admin@example.com", true},
+		{"plus address", "admin+test@example.com", "admin+test@example.com", true},
+		{"empty", "", "", false},
+		{"no at", "admin.example.com", "", false},
+		{"no local part", "@example.com", "", false},
+		{"no domain dot", "admin@localhost", "", false},
+		{"display name", "Admin <admin@example.com>", "", false},
+		{"two addresses", "a@example.com, b@example.com", "", false},
+		{"inner space", "ad min@example.com", "", false},
+	}
+
+	for _, e := range tests {
+		email, err := NormalizeEmail(e.email)
+
+		if e.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+		if !e.valid && !errors.Is(err, ErrInvalidEmail) {
+			t.Errorf("%s: expected ErrInvalidEmail but got %v", e.name, err)
+		}
+		if email != e.expected {
+			t.Errorf("%s: expected %q but got %q", e.name, e.expected, email)
+		}
+	}
+}
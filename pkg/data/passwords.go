@@ -0,0 +1,219 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash is returned when a stored password hash is in a format that none
+// of the configured hashers understand.
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Hasher is one way of hashing passwords.
+type Hasher interface {
+	// Hash returns an encoded hash of password, with a fresh salt.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches hash, which must be in this
+	// hasher's format.
+	Verify(hash, password string) (bool, error)
+	// Identify reports whether hash is in this hasher's format.
+	Identify(hash string) bool
+	// Outdated reports whether hash, which is in this hasher's format, was made
+	// with weaker parameters than the hasher's own.
+	Outdated(hash string) bool
+}
+
+// PasswordHasher hashes new passwords with Current, and checks passwords against
+// hashes made by Current or any of Others. Hashes that Current didn't make, or made
+// with weaker parameters, should be replaced the next time the password is known.
+type PasswordHasher struct {
+	Current Hasher
+	Others  []Hasher
+}
+
+// Passwords is the PasswordHasher used by the repositories and User.PasswordMatches.
+// Programs may replace it at startup, before it is used.
+var Passwords = &PasswordHasher{
+	Current: DefaultArgon2id,
+	Others:  []Hasher{Bcrypt{Cost: 12}},
+}
+
+// Hash returns a hash of password made by the current hasher.
+func (p *PasswordHasher) Hash(password string) (string, error) {
+	return p.Current.Hash(password)
+}
+
+// Verify reports whether password matches hash, whichever hasher made it.
+func (p *PasswordHasher) Verify(hash, password string) (bool, error) {
+	h := p.identify(hash)
+	if h == nil {
+		return false, ErrUnknownHash
+	}
+	return h.Verify(hash, password)
+}
+
+// NeedsRehash reports whether hash should be replaced by a new one from Hash,
+// because it was made by another hasher or with weaker parameters.
+func (p *PasswordHasher) NeedsRehash(hash string) bool {
+	return !p.Current.Identify(hash) || p.Current.Outdated(hash)
+}
+
+// identify returns the hasher that understands hash, or nil.
+func (p *PasswordHasher) identify(hash string) Hasher {
+	if p.Current.Identify(hash) {
+		return p.Current
+	}
+	for _, h := range p.Others {
+		if h.Identify(hash) {
+			return h
+		}
+	}
+	return nil
+}
+
+// Argon2id hashes passwords with argon2id, and encodes them in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$salt$hash.
+type Argon2id struct {
+	// Memory is in KiB.
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// DefaultArgon2id follows the second recommendation of RFC 9106, with fewer threads,
+// since a server hashes many passwords at once.
+var DefaultArgon2id = Argon2id{Memory: 64 * 1024, Time: 3, Threads: 2}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+	// the shortest salt or key a hash may have; with an empty key, any password matches
+	argon2MinLength = 16
+)
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, argon2KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a Argon2id) Verify(hash, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a Argon2id) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (a Argon2id) Outdated(hash string) bool {
+	params, _, _, err := decodeArgon2id(hash)
+	return err != nil || params.Memory < a.Memory || params.Time < a.Time
+}
+
+// decodeArgon2id splits a hash made by Argon2id.Hash into its parts.
+func decodeArgon2id(hash string) (params Argon2id, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters %q: %w", parts[3], err)
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+
+	// argon2.IDKey panics without a pass or a thread, and nothing Hash made looks like this
+	if params.Memory < 1 || params.Time < 1 || params.Threads < 1 ||
+		len(salt) < argon2MinLength || len(key) < argon2MinLength {
+		return params, nil, nil, fmt.Errorf("%w: argon2id parameters, salt or hash out of range", ErrUnknownHash)
+	}
+
+	return params, salt, key, nil
+}
+
+// Bcrypt hashes passwords with bcrypt.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b Bcrypt) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b Bcrypt) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (b Bcrypt) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < b.Cost
+}
+
+// NewPasswordHasher returns a PasswordHasher that makes new hashes with algorithm,
+// argon2id or bcrypt, and still accepts hashes made with the other one.
+func NewPasswordHasher(algorithm string, a Argon2id, b Bcrypt) (*PasswordHasher, error) {
+	switch algorithm {
+	case "argon2id":
+		if a.Memory == 0 || a.Time == 0 || a.Threads == 0 {
+			return nil, errors.New("argon2id memory, time and threads must all be positive")
+		}
+		return &PasswordHasher{Current: a, Others: []Hasher{b}}, nil
+	case "bcrypt":
+		if b.Cost < bcrypt.MinCost || b.Cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return &PasswordHasher{Current: b, Others: []Hasher{a}}, nil
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm %q", algorithm)
+	}
+}
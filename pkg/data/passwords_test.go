@@ -0,0 +1,176 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// cheap parameters, so that the tests don't take long
+var (
+	testArgon2id = Argon2id{Memory: 1024, Time: 1, Threads: 1}
+	testBcrypt   = Bcrypt{Cost: 4}
+)
+
+func TestHashers(t *testing.T) {
+	var tests = []struct {
+		name   string
+		hasher Hasher
+		prefix string
+	}{
+		{"argon2id", testArgon2id, "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{"bcrypt", testBcrypt, "$2a$04$"},
+	}
+
+	for _, e := range tests {
+		hash, err := e.hasher.Hash("secret")
+		if err != nil {
+			t.Fatalf("%s: error hashing: %s", e.name, err)
+		}
+		if !strings.HasPrefix(hash, e.prefix) {
+			t.Errorf("%s: expected a hash starting with %s but got %s", e.name, e.prefix, hash)
+		}
+		if len(hash) > 255 {
+			t.Errorf("%s: hash is too long for the password column: %d", e.name, len(hash))
+		}
+		if !e.hasher.Identify(hash) {
+			t.Errorf("%s: does not identify its own hash", e.name)
+		}
+		if e.hasher.Outdated(hash) {
+			t.Errorf("%s: says its own hash is outdated", e.name)
+		}
+
+		if ok, err := e.hasher.Verify(hash, "secret"); !ok || err != nil {
+			t.Errorf("%s: correct password did not match: %v", e.name, err)
+		}
+		if ok, err := e.hasher.Verify(hash, "wrong"); ok || err != nil {
+			t.Errorf("%s: wrong password matched, or returned an error: %v", e.name, err)
+		}
+
+		again, _ := e.hasher.Hash("secret")
+		if again == hash {
+			t.Errorf("%s: the same password hashed the same way twice; salts are not random", e.name)
+		}
+	}
+}
+
+func TestHashers_Outdated(t *testing.T) {
+	weakArgon2id, _ := testArgon2id.Hash("secret")
+	strongArgon2id, _ := Argon2id{Memory: 2048, Time: 2, Threads: 1}.Hash("secret")
+	weakBcrypt, _ := testBcrypt.Hash("secret")
+	strongBcrypt, _ := Bcrypt{Cost: 5}.Hash("secret")
+
+	var tests = []struct {
+		name     string
+		hasher   Hasher
+		hash     string
+		outdated bool
+	}{
+		{"argon2id, less memory", Argon2id{Memory: 2048, Time: 1, Threads: 1}, weakArgon2id, true},
+		{"argon2id, fewer passes", Argon2id{Memory: 1024, Time: 2, Threads: 1}, weakArgon2id, true},
+		{"argon2id, more threads", Argon2id{Memory: 1024, Time: 1, Threads: 4}, weakArgon2id, false},
+		{"argon2id, stronger", testArgon2id, strongArgon2id, false},
+		{"bcrypt, lower cost", Bcrypt{Cost: 5}, weakBcrypt, true},
+		{"bcrypt, higher cost", testBcrypt, strongBcrypt, false},
+	}
+
+	for _, e := range tests {
+		if e.hasher.Outdated(e.hash) != e.outdated {
+			t.Errorf("%s: expected outdated to be %t", e.name, e.outdated)
+		}
+	}
+}
+
+func TestArgon2id_VerifyInvalid(t *testing.T) {
+	// "saltsaltsaltsalt" and "keykeykeykeykeyk", both 16 bytes
+	const salt, key = "c2FsdHNhbHRzYWx0c2FsdA", "a2V5a2V5a2V5a2V5a2V5aw"
+
+	var tests = []struct {
+		name string
+		hash string
+	}{
+		{"no memory", "$argon2id$v=19$m=0,t=1,p=1$" + salt + "$" + key},
+		{"no passes", "$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + key},
+		{"no threads", "$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + key},
+		{"short salt", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$" + key},
+		{"short key", "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$a2V5"},
+		{"empty key", "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$"},
+	}
+
+	for _, e := range tests {
+		ok, err := testArgon2id.Verify(e.hash, "secret")
+		if ok {
+			t.Errorf("%s: expected no password to match", e.name)
+		}
+		if !errors.Is(err, ErrUnknownHash) {
+			t.Errorf("%s: expected ErrUnknownHash but got %v", e.name, err)
+		}
+	}
+}
+
+func TestPasswordHasher(t *testing.T) {
+	p := &PasswordHasher{Current: testArgon2id, Others: []Hasher{testBcrypt}}
+
+	argon2Hash, _ := p.Hash("secret")
+	bcryptHash, _ := testBcrypt.Hash("secret")
+
+	var tests = []struct {
+		name        string
+		hash        string
+		password    string
+		match       bool
+		needsRehash bool
+		wantErr     bool
+	}{
+		{"current", argon2Hash, "secret", true, false, false},
+		{"current, wrong password", argon2Hash, "wrong", false, false, false},
+		{"other algorithm", bcryptHash, "secret", true, true, false},
+		{"other algorithm, wrong password", bcryptHash, "wrong", false, true, false},
+		{"unknown", "plain text", "plain text", false, true, true},
+		{"corrupt argon2id", "$argon2id$v=19$m=x$salt$hash", "secret", false, true, true},
+	}
+
+	for _, e := range tests {
+		match, err := p.Verify(e.hash, e.password)
+		if match != e.match {
+			t.Errorf("%s: expected match to be %t", e.name, e.match)
+		}
+		if (err != nil) != e.wantErr {
+			t.Errorf("%s: unexpected error result: %v", e.name, err)
+		}
+		if p.NeedsRehash(e.hash) != e.needsRehash {
+			t.Errorf("%s: expected needs rehash to be %t", e.name, e.needsRehash)
+		}
+	}
+
+	_, err := p.Verify("plain text", "plain text")
+	if !errors.Is(err, ErrUnknownHash) {
+		t.Errorf("expected ErrUnknownHash but got %v", err)
+	}
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	var tests = []struct {
+		name      string
+		algorithm string
+		argon2id  Argon2id
+		bcrypt    Bcrypt
+		valid     bool
+	}{
+		{"argon2id", "argon2id", DefaultArgon2id, Bcrypt{Cost: 12}, true},
+		{"bcrypt", "bcrypt", DefaultArgon2id, Bcrypt{Cost: 12}, true},
+		{"argon2id without memory", "argon2id", Argon2id{Time: 1, Threads: 1}, Bcrypt{Cost: 12}, false},
+		{"bcrypt cost too high", "bcrypt", DefaultArgon2id, Bcrypt{Cost: 32}, false},
+		{"unknown", "md5", DefaultArgon2id, Bcrypt{Cost: 12}, false},
+	}
+
+	for _, e := range tests {
+		p, err := NewPasswordHasher(e.algorithm, e.argon2id, e.bcrypt)
+		if e.valid && (err != nil || len(p.Others) != 1) {
+			t.Errorf("%s: unexpected error %v", e.name, err)
+		}
+		if !e.valid && err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+}
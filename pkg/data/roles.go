@@ -0,0 +1,57 @@
+package data
+
+import "slices"
+
+// Permissions are named <resource>:<action>. Users get them through their roles.
+const (
+	PermUsersRead        = "users:read"        // list users, and see anyone's profile and picture
+	PermUsersWrite       = "users:write"       // create and edit users, and reset their passwords
+	PermUsersDelete      = "users:delete"      // delete users
+	PermUsersImpersonate = "users:impersonate" // log in as another user, to see what they see
+	PermRolesRead        = "roles:read"        // list roles and what they grant
+	PermRolesWrite       = "roles:write"       // create roles, assign them and change what they grant
+	PermDebugRead        = "debug:read"        // see runtime counters
+	PermAuditRead        = "audit:read"        // search and export the audit log
+)
+
+// RoleAdmin is the role that replaced the is_admin flag. It starts out with every
+// permission.
+const RoleAdmin = "admin"
+
+// Permission is something a role allows its users to do.
+type Permission struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// KnownPermissions lists every permission the code checks for, as the migrations
+// create them.
+var KnownPermissions = []Permission{
+	{Name: PermUsersRead, Description: "List users, and see anyone's profile and picture"},
+	{Name: PermUsersWrite, Description: "Create and edit users, and reset their passwords"},
+	{Name: PermUsersDelete, Description: "Delete users"},
+	{Name: PermUsersImpersonate, Description: "Log in as another user, to see what they see"},
+	{Name: PermRolesRead, Description: "List roles and what they grant"},
+	{Name: PermRolesWrite, Description: "Create roles, assign them and change what they grant"},
+	{Name: PermDebugRead, Description: "See runtime counters"},
+	{Name: PermAuditRead, Description: "Search and export the audit log"},
+}
+
+// Role is a named set of permissions.
+type Role struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// HasRole reports whether the user has been given the role.
+func (u *User) HasRole(role string) bool {
+	return slices.Contains(u.Roles, role)
+}
+
+// Can reports whether any of the user's roles grants permission.
+func (u *User) Can(permission string) bool {
+	return slices.Contains(u.Permissions, permission)
+}
@@ -1,12 +1,45 @@
 package data
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"time"
+)
 
-// UserImage is the type for user profile images.
+// UserImage is the type for user profile images. A user may have many images,
+// but only one of them is active (shown as the profile picture) at a time.
 type UserImage struct {
 	ID        int       `json:"id"`
 	UserID    int       `json:"user_id"`
 	FileName  string    `json:"file_name"`
+	IsActive  bool      `json:"is_active"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 }
+
+// NewImageFileName returns a new random name to store an image uploaded as
+// uploadedAs under, keeping its extension, so that no upload can overwrite another
+// user's image or be written outside the upload directory.
+func NewImageFileName(uploadedAs string) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	// the extension is kept only if it looks like one
+	ext := strings.ToLower(filepath.Ext(uploadedAs))
+	if len(ext) > 10 {
+		ext = ""
+	}
+	for _, r := range strings.TrimPrefix(ext, ".") {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			ext = ""
+			break
+		}
+	}
+
+	return hex.EncodeToString(b) + ext, nil
+}
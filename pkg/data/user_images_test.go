@@ -0,0 +1,37 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewImageFileName(t *testing.T) {
+	var tests = []struct {
+		name        string
+		uploadedAs  string
+		expectedExt string
+	}{
+		{"png", "img.png", ".png"},
+		{"upper case", "Holiday.JPG", ".jpg"},
+		{"no extension", "avatar", ""},
+		{"path", "../../etc/passwd.png", ".png"},
+		{"odd extension", "img.p ng", ""},
+		{"long extension", "img.abcdefghijkl", ""},
+	}
+
+	for _, e := range tests {
+		name, err := NewImageFileName(e.uploadedAs)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", e.name, err)
+		}
+		if len(name) != 32+len(e.expectedExt) || !strings.HasSuffix(name, e.expectedExt) || strings.ContainsAny(name, "/\\") {
+			t.Errorf("%s: expected a random name ending in %q but got %q", e.name, e.expectedExt, name)
+		}
+	}
+
+	a, _ := NewImageFileName("img.png")
+	b, _ := NewImageFileName("img.png")
+	if a == b {
+		t.Errorf("expected two different names but got %s twice", a)
+	}
+}
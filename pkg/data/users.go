@@ -1,38 +1,56 @@
 package data
 
 import (
-	"errors"
-	"golang.org/x/crypto/bcrypt"
 	"time"
 )
 
+// Avatar visibility settings, which control who may fetch a user's profile picture.
+const (
+	AvatarPublic  = "public"  // anyone
+	AvatarUsers   = "users"   // logged in users only
+	AvatarPrivate = "private" // the owner and admins only
+)
+
 // User describes the data for the User type.
 type User struct {
-	ID         int       `json:"id"`
-	FirstName  string    `json:"first_name"`
-	LastName   string    `json:"last_name"`
-	Email      string    `json:"email"`
-	Password   string    `json:"-"`
-	IsAdmin    int       `json:"is_admin"`
-	CreatedAt  time.Time `json:"-"`
-	UpdatedAt  time.Time `json:"-"`
-	ProfilePic UserImage `json:"-"`
+	ID               int       `json:"id"`
+	FirstName        string    `json:"first_name"`
+	LastName         string    `json:"last_name"`
+	Email            string    `json:"email"`
+	Password         string    `json:"-"`
+	AvatarVisibility string    `json:"avatar_visibility"`
+	Version          int       `json:"version"`
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"-"`
+	ProfilePic       UserImage `json:"-"`
+	// Roles and Permissions are filled in when a user is read, sorted by name.
+	// Permissions is everything the roles grant.
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	// DeletedAt is when the user was deleted. Only DeletedUsers returns deleted
+	// users; everything else acts as if they were gone.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// DeleteAfter is when a user who closed their account will be deleted, unless
+	// they change their mind before then.
+	DeleteAfter *time.Time `json:"delete_after,omitempty"`
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
+// PurgedUser is a deleted user that PurgeDeletedUsers removed for good, along with
+// the file names of their images, which are left for the caller to remove.
+type PurgedUser struct {
+	ID        int
+	FileNames []string
+}
+
+// PasswordMatches compares a user supplied password with the hash we have stored
+// for a given user in the database, using Passwords. If the password and hash
+// match, we return true; otherwise, we return false.
 func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:
-			return false, err
-		}
-	}
+	return Passwords.Verify(u.Password, plainText)
+}
 
-	return true, nil
+// PasswordNeedsRehash reports whether the user's password hash was made with
+// another algorithm, or weaker parameters, than the ones Passwords uses now.
+func (u *User) PasswordNeedsRehash() bool {
+	return Passwords.NeedsRehash(u.Password)
 }
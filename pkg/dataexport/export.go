@@ -0,0 +1,176 @@
+// Package dataexport gathers everything kept about a user into a ZIP archive, for
+// users who ask for a copy of their data.
+package dataexport
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// sessionActions are the audit actions that start a session.
+var sessionActions = map[string]string{
+	data.AuditLogin:          "web",
+	data.AuditTokenIssued:    "api",
+	data.AuditTokenRefreshed: "api",
+}
+
+// Session is a time the user logged in, or renewed their api tokens.
+type Session struct {
+	Time      time.Time `json:"time"`
+	App       string    `json:"app"`
+	Action    string    `json:"action"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// Export is everything kept about a user.
+type Export struct {
+	User   *data.User
+	Images []*data.UserImage
+	// Sessions come from the audit log: the web app keeps its sessions in memory,
+	// and api tokens aren't stored at all, so the logins are all there is.
+	Sessions []Session
+	// AuditEvents are the events the user did, or had done to them, oldest first.
+	// Other people's addresses and user agents are left out of the events they did.
+	AuditEvents []*data.AuditEvent
+	Created     time.Time
+}
+
+// Collect reads everything kept about user id from repo. It returns
+// repository.ErrNotFound if there is no such user.
+func Collect(ctx context.Context, repo repository.DatabaseRepo, id int) (*Export, error) {
+	user, err := repo.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := repo.AllUserImages(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := repo.AuditEvents(ctx, data.AuditFilter{ActorID: id})
+	if err != nil {
+		return nil, err
+	}
+	undergone, err := repo.AuditEvents(ctx, data.AuditFilter{TargetType: "user", TargetID: strconv.Itoa(id)})
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Export{User: user, Images: images, Created: time.Now().UTC()}
+
+	seen := make(map[int]bool)
+	for _, event := range append(done, undergone...) {
+		if seen[event.ID] {
+			continue
+		}
+		seen[event.ID] = true
+
+		if event.ActorID != id {
+			event.IP = ""
+			event.UserAgent = ""
+		}
+		e.AuditEvents = append(e.AuditEvents, event)
+	}
+	sort.Slice(e.AuditEvents, func(a, b int) bool {
+		return e.AuditEvents[a].ID < e.AuditEvents[b].ID
+	})
+
+	e.Sessions = []Session{}
+	for _, event := range e.AuditEvents {
+		app, ok := sessionActions[event.Action]
+		if !ok || event.ActorID != id {
+			continue
+		}
+		e.Sessions = append(e.Sessions, Session{
+			Time:      event.Time,
+			App:       app,
+			Action:    event.Action,
+			IP:        event.IP,
+			UserAgent: event.UserAgent,
+		})
+	}
+
+	return e, nil
+}
+
+// FileName is the name to offer the archive for download under.
+func (e *Export) FileName() string {
+	return fmt.Sprintf("user-%d-%s.zip", e.User.ID, e.Created.Format("20060102T150405Z"))
+}
+
+// WriteZip writes the export to w as a ZIP archive of JSON files, with the image
+// files, which it reads from imageDir, under images/. An image whose file is gone
+// is listed, but left out.
+func (e *Export) WriteZip(w io.Writer, imageDir string) error {
+	z := zip.NewWriter(w)
+
+	files := []struct {
+		name string
+		v    any
+	}{
+		{"profile.json", e.User},
+		{"images.json", e.Images},
+		{"sessions.json", e.Sessions},
+		{"audit_events.json", e.AuditEvents},
+	}
+	for _, f := range files {
+		err := writeJSON(z, f.name, e.Created, f.v)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, i := range e.Images {
+		err := copyImage(z, filepath.Join(imageDir, filepath.Base(i.FileName)), path.Join("images", path.Base(i.FileName)), e.Created)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return z.Close()
+}
+
+func writeJSON(z *zip.Writer, name string, modified time.Time, v any) error {
+	f, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func copyImage(z *zip.Writer, src, name string, modified time.Time) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// images are compressed already
+	f, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	return err
+}
@@ -0,0 +1,174 @@
+package dataexport
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"personal-projects/webapp/pkg/repository/dbrepo"
+	"slices"
+	"testing"
+)
+
+// newTestRepo returns a repository with the admin, id 1, and jack, id 2, who have
+// each done something, and had something done to them.
+func newTestRepo(t *testing.T) repository.DatabaseRepo {
+	t.Helper()
+	ctx := context.Background()
+
+	repo, err := dbrepo.NewMemoryDBRepo(dbrepo.TestFixtures())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []data.AuditEvent{
+		{ActorID: 1, Action: data.AuditLogin, TargetType: "user", TargetID: "1", IP: "10.0.0.1", UserAgent: "admin's browser"},
+		{ActorID: 2, Action: data.AuditTokenIssued, TargetType: "user", TargetID: "2", IP: "10.0.0.2", UserAgent: "jack's phone"},
+		{ActorID: 2, Action: data.AuditLogin, TargetType: "user", TargetID: "2", IP: "10.0.0.2", UserAgent: "jack's browser"},
+		{ActorID: 1, Action: data.AuditUserUpdated, TargetType: "user", TargetID: "2", IP: "10.0.0.1", UserAgent: "admin's browser"},
+		{ActorID: 0, Action: data.AuditLoginFailed, TargetType: "user", TargetID: "2", IP: "10.0.0.3", Detail: "wrong password"},
+		{ActorID: 2, Action: data.AuditUserUpdated, TargetType: "user", TargetID: "1", IP: "10.0.0.2", UserAgent: "jack's browser"},
+	} {
+		_, err := repo.InsertAuditEvent(ctx, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return repo
+}
+
+func Test_Collect(t *testing.T) {
+	repo := newTestRepo(t)
+
+	_, err := Collect(context.Background(), repo, 100)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected repository.ErrNotFound for a missing user, but got %v", err)
+	}
+
+	e, err := Collect(context.Background(), repo, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.User.Email != "jack@example.com" {
+		t.Errorf("expected jack's profile but got %+v", e.User)
+	}
+
+	var ids []int
+	for _, event := range e.AuditEvents {
+		ids = append(ids, event.ID)
+	}
+	if !slices.Equal(ids, []int{2, 3, 4, 5, 6}) {
+		t.Errorf("expected the events jack did or had done to him, once each and in order, but got %v", ids)
+	}
+
+	// the admin's and the stranger's addresses aren't jack's to have
+	for _, event := range e.AuditEvents {
+		if event.ActorID != 2 && (event.IP != "" || event.UserAgent != "") {
+			t.Errorf("expected event %d not to say where someone else was, but got %q, %q", event.ID, event.IP, event.UserAgent)
+		}
+		if event.ActorID == 2 && event.IP != "10.0.0.2" {
+			t.Errorf("expected event %d to keep jack's own address, but got %q", event.ID, event.IP)
+		}
+	}
+
+	if len(e.Sessions) != 2 || e.Sessions[0].App != "api" || e.Sessions[1].App != "web" || e.Sessions[1].UserAgent != "jack's browser" {
+		t.Errorf("expected jack's api and web logins, but got %+v", e.Sessions)
+	}
+}
+
+func TestExport_WriteZip(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	imageDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(imageDir, "img.png"), []byte("png"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// its file has gone missing
+	_, err = repo.InsertUserImage(ctx, data.UserImage{UserID: 1, FileName: "gone.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := Collect(ctx, repo, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = e.WriteZip(&buf, imageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	expected := []string{"audit_events.json", "images.json", "images/img.png", "profile.json", "sessions.json"}
+	if !slices.Equal(names, expected) {
+		t.Errorf("expected the archive to hold %v but it holds %v", expected, names)
+	}
+
+	if string(files["images/img.png"]) != "png" {
+		t.Errorf("expected the image as it was stored, but got %q", files["images/img.png"])
+	}
+
+	var profile data.User
+	err = json.Unmarshal(files["profile.json"], &profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.ID != 1 || profile.Email != "admin@example.com" {
+		t.Errorf("expected the admin's profile but got %+v", profile)
+	}
+
+	var images []data.UserImage
+	err = json.Unmarshal(files["images.json"], &images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Errorf("expected both images to be listed, but got %+v", images)
+	}
+
+	var events []data.AuditEvent
+	err = json.Unmarshal(files["audit_events.json"], &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Errorf("expected the admin's 3 events but got %d", len(events))
+	}
+}
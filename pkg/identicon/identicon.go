@@ -0,0 +1,95 @@
+package identicon
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// gridSize is the number of cells on each side of an identicon. The left half is
+// mirrored onto the right, so that identicons are symmetric.
+const gridSize = 5
+
+var background = color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+// Identicon is a deterministic, symmetric pattern generated from a seed, such as a
+// user's ID. The same seed always produces the same identicon.
+type Identicon struct {
+	Color color.RGBA
+	Grid  [gridSize][gridSize]bool
+}
+
+// New generates the identicon for seed.
+func New(seed string) *Identicon {
+	sum := sha256.Sum256([]byte(seed))
+
+	// keep the colour away from white, so that it stands out from the background
+	i := &Identicon{
+		Color: color.RGBA{R: sum[0] / 4 * 3, G: sum[1] / 4 * 3, B: sum[2] / 4 * 3, A: 0xff},
+	}
+
+	half := (gridSize + 1) / 2
+	for row := 0; row < gridSize; row++ {
+		for col := 0; col < half; col++ {
+			on := sum[3+row*half+col]%2 == 0
+			i.Grid[row][col] = on
+			i.Grid[row][gridSize-1-col] = on
+		}
+	}
+
+	return i
+}
+
+// Image renders the identicon as a size x size image, with a margin around the grid.
+func (i *Identicon) Image(size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+
+	cell := size / (gridSize + 1)
+	margin := (size - cell*gridSize) / 2
+	fill := &image.Uniform{C: i.Color}
+
+	for row := 0; row < gridSize; row++ {
+		for col := 0; col < gridSize; col++ {
+			if !i.Grid[row][col] {
+				continue
+			}
+			r := image.Rect(margin+col*cell, margin+row*cell, margin+(col+1)*cell, margin+(row+1)*cell)
+			draw.Draw(img, r, fill, image.Point{}, draw.Src)
+		}
+	}
+
+	return img
+}
+
+// PNG writes the identicon to w as a size x size PNG.
+func (i *Identicon) PNG(w io.Writer, size int) error {
+	return png.Encode(w, i.Image(size))
+}
+
+// SVG writes the identicon to w as an SVG document, displayed at size x size.
+func (i *Identicon) SVG(w io.Writer, size int) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="-0.5 -0.5 %d %d" shape-rendering="crispEdges">`,
+		size, size, gridSize+1, gridSize+1)
+	fmt.Fprintf(&b, `<rect x="-0.5" y="-0.5" width="%d" height="%d" fill="#%02x%02x%02x"/>`,
+		gridSize+1, gridSize+1, background.R, background.G, background.B)
+	fmt.Fprintf(&b, `<g fill="#%02x%02x%02x">`, i.Color.R, i.Color.G, i.Color.B)
+	for row := 0; row < gridSize; row++ {
+		for col := 0; col < gridSize; col++ {
+			if i.Grid[row][col] {
+				fmt.Fprintf(&b, `<rect x="%d" y="%d" width="1" height="1"/>`, col, row)
+			}
+		}
+	}
+	b.WriteString(`</g></svg>`)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
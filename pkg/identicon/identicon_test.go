@@ -0,0 +1,65 @@
+package identicon
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image/png"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	a := New("1")
+	b := New("1")
+	c := New("2")
+
+	if *a != *b {
+		t.Error("the same seed produced different identicons")
+	}
+	if *a == *c {
+		t.Error("different seeds produced the same identicon")
+	}
+
+	for row := 0; row < gridSize; row++ {
+		for col := 0; col < gridSize; col++ {
+			if a.Grid[row][col] != a.Grid[row][gridSize-1-col] {
+				t.Fatalf("identicon is not symmetric at row %d, col %d", row, col)
+			}
+		}
+	}
+}
+
+func TestIdenticon_PNG(t *testing.T) {
+	var buf bytes.Buffer
+	err := New("1").PNG(&buf, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+		t.Errorf("expected a 64x64 image, but got %v", img.Bounds())
+	}
+}
+
+func TestIdenticon_SVG(t *testing.T) {
+	var buf bytes.Buffer
+	err := New("1").SVG(&buf, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		XMLName xml.Name
+		Width   string `xml:"width,attr"`
+	}
+	err = xml.Unmarshal(buf.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("svg is not valid xml: %s", err)
+	}
+	if doc.XMLName.Local != "svg" || doc.Width != "64" {
+		t.Errorf("unexpected svg root %s with width %s", doc.XMLName.Local, doc.Width)
+	}
+}
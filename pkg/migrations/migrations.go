@@ -0,0 +1,357 @@
+// Package migrations applies the versioned schema changes that ship inside the
+// binaries. Each change is a pair of files named <version>_<name>.up.sql and
+// <version>_<name>.down.sql; applied versions are recorded in schema_migrations
+// together with a checksum of the up file, so that editing a migration after it
+// has run is reported rather than silently ignored.
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed postgres/*.sql
+var postgresFS embed.FS
+
+//go:embed sqlite/*.sql
+var sqliteFS embed.FS
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// Status reports whether a migration has been applied.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// DriftError is returned when migrations recorded in the database no longer match
+// the ones in the binary.
+type DriftError struct {
+	// Changed lists applied versions whose up file has been edited since.
+	Changed []int
+	// Unknown lists applied versions the binary knows nothing about.
+	Unknown []int
+}
+
+func (e *DriftError) Error() string {
+	var parts []string
+	if len(e.Changed) > 0 {
+		parts = append(parts, fmt.Sprintf("checksum mismatch for applied versions %v", e.Changed))
+	}
+	if len(e.Unknown) > 0 {
+		parts = append(parts, fmt.Sprintf("unknown applied versions %v", e.Unknown))
+	}
+	return "migrations: schema drift: " + strings.Join(parts, "; ")
+}
+
+// Dialect holds what differs between databases.
+type Dialect struct {
+	Name string
+	// Lock and Unlock keep concurrent runners apart. They are called on the
+	// connection the migrations run on; either may be nil.
+	Lock   func(ctx context.Context, conn *sql.Conn) error
+	Unlock func(ctx context.Context, conn *sql.Conn) error
+	// Placeholder returns the bind parameter for the nth (1-based) argument.
+	Placeholder func(n int) string
+}
+
+// lockID is an arbitrary key for pg_advisory_lock, shared by every binary that
+// migrates the same database.
+const lockID = 7308135229146405137
+
+// Postgres serializes runners with a session level advisory lock.
+var Postgres = Dialect{
+	Name: "postgres",
+	Lock: func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "select pg_advisory_lock($1)", int64(lockID))
+		return err
+	},
+	Unlock: func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "select pg_advisory_unlock($1)", int64(lockID))
+		return err
+	},
+	Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+}
+
+// SQLite has no advisory locks, but it only allows one writer at a time, and each
+// migration runs in its own transaction.
+var SQLite = Dialect{
+	Name:        "sqlite",
+	Placeholder: func(int) string { return "?" },
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	DB         *sql.DB
+	Dialect    Dialect
+	Migrations []Migration
+}
+
+// NewPostgres returns a Migrator for the postgres migrations embedded in the binary.
+func NewPostgres(db *sql.DB) (*Migrator, error) {
+	migrations, err := Load(postgresFS, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Dialect: Postgres, Migrations: migrations}, nil
+}
+
+// NewSQLite returns a Migrator for the sqlite migrations embedded in the binary.
+func NewSQLite(db *sql.DB) (*Migrator, error) {
+	migrations, err := Load(sqliteFS, "sqlite")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Dialect: SQLite, Migrations: migrations}, nil
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in dir, sorted by version. Every version needs both
+// an up and a down file, and versions must be unique.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		parts := fileName.FindStringSubmatch(e.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("migrations: unexpected file %s", e.Name())
+		}
+
+		version, _ := strconv.Atoi(parts[1])
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		} else if m.Name != parts[2] {
+			return nil, fmt.Errorf("migrations: version %d is used by both %s and %s", version, m.Name, parts[2])
+		}
+
+		contents, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if parts[3] == "up" {
+			m.Up = string(contents)
+			sum := sha256.Sum256(contents)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrations: version %d (%s) needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("migrations: no migrations found in %s", dir)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Up applies every pending migration, in order, each in its own transaction.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.check(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.Migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			err = m.apply(ctx, conn, mig, true)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back the last steps applied migrations, newest first.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.check(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.Migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := m.Migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			err = m.apply(ctx, conn, mig, false)
+			if err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// Status lists every known migration and whether it has been applied. Drift is
+// reported as an error alongside the list.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.check(ctx, conn)
+		for _, mig := range m.Migrations {
+			at, ok := applied[mig.Version]
+			statuses = append(statuses, Status{Migration: mig, Applied: ok, AppliedAt: at.appliedAt})
+		}
+		return err
+	})
+	return statuses, err
+}
+
+// locked runs fn on a single connection while holding the dialect's lock, after
+// making sure schema_migrations exists.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.Dialect.Lock != nil {
+		err = m.Dialect.Lock(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("migrations: acquiring lock: %w", err)
+		}
+		if m.Dialect.Unlock != nil {
+			defer func() {
+				// the lock goes away with the session anyway, so a failure here is harmless
+				_ = m.Dialect.Unlock(context.Background(), conn)
+			}()
+		}
+	}
+
+	_, err = conn.ExecContext(ctx, `create table if not exists schema_migrations (
+		version integer primary key,
+		name varchar(255) not null,
+		checksum varchar(64) not null,
+		applied_at timestamp not null
+	)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// check returns the applied migrations, or a *DriftError if they disagree with
+// the binary.
+func (m *Migrator) check(ctx context.Context, conn *sql.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, "select version, checksum, applied_at from schema_migrations order by version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var version int
+		var a appliedMigration
+		err = rows.Scan(&version, &a.checksum, &a.appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = a
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	known := make(map[int]Migration, len(m.Migrations))
+	for _, mig := range m.Migrations {
+		known[mig.Version] = mig
+	}
+
+	drift := &DriftError{}
+	for version, a := range applied {
+		mig, ok := known[version]
+		switch {
+		case !ok:
+			drift.Unknown = append(drift.Unknown, version)
+		case mig.Checksum != a.checksum:
+			drift.Changed = append(drift.Changed, version)
+		}
+	}
+	if len(drift.Changed) > 0 || len(drift.Unknown) > 0 {
+		sort.Ints(drift.Changed)
+		sort.Ints(drift.Unknown)
+		return applied, drift
+	}
+
+	return applied, nil
+}
+
+// apply runs one migration in either direction and records the result.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p := m.Dialect.Placeholder
+	if up {
+		_, err = tx.ExecContext(ctx, mig.Up)
+		if err == nil {
+			_, err = tx.ExecContext(ctx,
+				fmt.Sprintf("insert into schema_migrations (version, name, checksum, applied_at) values (%s, %s, %s, %s)", p(1), p(2), p(3), p(4)),
+				mig.Version, mig.Name, mig.Checksum, time.Now().UTC())
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, mig.Down)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("delete from schema_migrations where version = %s", p(1)), mig.Version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migrations: %d_%s: %w", mig.Version, mig.Name, err)
+	}
+
+	return tx.Commit()
+}
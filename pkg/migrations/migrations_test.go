@@ -0,0 +1,172 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "modernc.org/sqlite"
+)
+
+func Test_Load(t *testing.T) {
+	var tests = []struct {
+		name          string
+		files         fstest.MapFS
+		expectedCount int
+		expectedErr   string
+	}{
+		{"valid", fstest.MapFS{
+			"m/0002_b.up.sql":   {Data: []byte("create table b ();")},
+			"m/0002_b.down.sql": {Data: []byte("drop table b;")},
+			"m/0001_a.up.sql":   {Data: []byte("create table a ();")},
+			"m/0001_a.down.sql": {Data: []byte("drop table a;")},
+		}, 2, ""},
+		{"missing down", fstest.MapFS{
+			"m/0001_a.up.sql": {Data: []byte("create table a ();")},
+		}, 0, "needs both an up and a down file"},
+		{"duplicate version", fstest.MapFS{
+			"m/0001_a.up.sql":   {Data: []byte("create table a ();")},
+			"m/0001_b.down.sql": {Data: []byte("drop table b;")},
+		}, 0, "is used by both"},
+		{"stray file", fstest.MapFS{
+			"m/README.md": {Data: []byte("hello")},
+		}, 0, "unexpected file"},
+		{"empty", fstest.MapFS{
+			"m/archive/0001_a.up.sql": {Data: []byte("create table a ();")},
+		}, 0, "no migrations found"},
+	}
+
+	for _, e := range tests {
+		migrations, err := Load(e.files, "m")
+		if e.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), e.expectedErr) {
+				t.Errorf("%s: expected error containing %q but got %v", e.name, e.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+		if len(migrations) != e.expectedCount {
+			t.Errorf("%s: expected %d migrations but got %d", e.name, e.expectedCount, len(migrations))
+		}
+		for i := 1; i < len(migrations); i++ {
+			if migrations[i-1].Version >= migrations[i].Version {
+				t.Errorf("%s: migrations are not sorted by version", e.name)
+			}
+		}
+	}
+}
+
+func Test_Load_checksum(t *testing.T) {
+	files := fstest.MapFS{
+		"m/0001_a.up.sql":   {Data: []byte("create table a ();")},
+		"m/0001_a.down.sql": {Data: []byte("drop table a;")},
+	}
+	before, _ := Load(files, "m")
+
+	// the down file doesn't take part in the checksum
+	files["m/0001_a.down.sql"] = &fstest.MapFile{Data: []byte("drop table if exists a;")}
+	same, _ := Load(files, "m")
+	if before[0].Checksum != same[0].Checksum {
+		t.Error("checksum changed when only the down file was edited")
+	}
+
+	files["m/0001_a.up.sql"] = &fstest.MapFile{Data: []byte("create table a (id integer);")}
+	after, _ := Load(files, "m")
+	if before[0].Checksum == after[0].Checksum {
+		t.Error("checksum did not change when the up file was edited")
+	}
+}
+
+func Test_embeddedMigrations(t *testing.T) {
+	for name, newMigrator := range map[string]func(*sql.DB) (*Migrator, error){"postgres": NewPostgres, "sqlite": NewSQLite} {
+		m, err := newMigrator(nil)
+		if err != nil {
+			t.Errorf("%s: embedded migrations do not load: %s", name, err)
+			continue
+		}
+
+		for i, mig := range m.Migrations {
+			if mig.Version != i+1 {
+				t.Errorf("%s: expected version %d but got %d (%s); versions should have no gaps", name, i+1, mig.Version, mig.Name)
+			}
+		}
+	}
+}
+
+func TestDriftError_Error(t *testing.T) {
+	err := &DriftError{Changed: []int{2}, Unknown: []int{7}}
+	if !strings.Contains(err.Error(), "[2]") || !strings.Contains(err.Error(), "[7]") {
+		t.Errorf("drift error does not list the versions: %s", err)
+	}
+}
+
+func TestMigrator_sqlite(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m, err := NewSQLite(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// running up twice is harmless
+	for i := 0; i < 2; i++ {
+		err = m.Up(ctx)
+		if err != nil {
+			t.Fatalf("up failed: %s", err)
+		}
+	}
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Errorf("status reports an error: %s", err)
+	}
+	for _, s := range statuses {
+		if !s.Applied || s.AppliedAt.IsZero() {
+			t.Errorf("migration %d_%s is not applied", s.Version, s.Name)
+		}
+	}
+
+	// editing an applied migration is drift
+	edited := *m
+	edited.Migrations = append([]Migration(nil), m.Migrations...)
+	edited.Migrations[0].Checksum = "edited"
+	var drift *DriftError
+	err = edited.Up(ctx)
+	if !errors.As(err, &drift) || len(drift.Changed) != 1 || drift.Changed[0] != m.Migrations[0].Version {
+		t.Errorf("expected drift for version %d but got %v", m.Migrations[0].Version, err)
+	}
+
+	// down everything, and the tables are gone
+	err = m.Down(ctx, len(m.Migrations))
+	if err != nil {
+		t.Fatalf("down failed: %s", err)
+	}
+	_, err = db.Exec("select count(*) from users")
+	if err == nil {
+		t.Error("users table still exists after migrating down")
+	}
+	statuses, _ = m.Status(ctx)
+	for _, s := range statuses {
+		if s.Applied {
+			t.Errorf("migration %d_%s is still applied", s.Version, s.Name)
+		}
+	}
+
+	// and back up again
+	err = m.Up(ctx)
+	if err != nil {
+		t.Errorf("up after down failed: %s", err)
+	}
+}
@@ -0,0 +1,2 @@
+drop table if exists user_images;
+drop table if exists users;
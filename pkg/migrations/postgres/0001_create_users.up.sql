@@ -0,0 +1,21 @@
+-- the schema as it was first dumped to sql/users.sql; "if not exists" lets databases
+-- created from that dump be brought under migration control
+
+create table if not exists users (
+    id integer generated always as identity primary key,
+    first_name character varying(255),
+    last_name character varying(255),
+    email character varying(255),
+    password character varying(60),
+    is_admin integer,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+create table if not exists user_images (
+    id integer generated always as identity primary key,
+    user_id integer references users(id) on update cascade on delete cascade,
+    file_name character varying(255),
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
@@ -0,0 +1,3 @@
+drop index if exists user_images_user_id_active_idx;
+delete from user_images where not is_active;
+alter table user_images drop column if exists is_active;
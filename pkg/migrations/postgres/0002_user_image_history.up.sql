@@ -0,0 +1,7 @@
+alter table user_images add column if not exists is_active boolean default false not null;
+
+-- until now a user only ever had one image, so it is the active one
+update user_images set is_active = true
+where id in (select max(id) from user_images group by user_id);
+
+create unique index if not exists user_images_user_id_active_idx on user_images (user_id) where is_active;
@@ -0,0 +1 @@
+alter table users add column if not exists avatar_visibility character varying(10) default 'public' not null;
@@ -0,0 +1,6 @@
+-- store addresses the way data.NormalizeEmail does from now on
+update users set email = lower(trim(email)) where email <> lower(trim(email));
+
+-- fails, and leaves everything as it was, if two users share an address once case is
+-- ignored; list them with: go run ./cmd/cli -action=duplicate-emails -dsn=...
+create unique index if not exists users_email_lower_idx on users (lower(email));
@@ -0,0 +1,2 @@
+-- fails while any argon2id hashes are left; reset those passwords first
+alter table users alter column password type character varying(60);
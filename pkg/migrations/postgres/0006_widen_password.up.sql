@@ -0,0 +1,3 @@
+-- argon2id hashes, with their parameters and salt, don't fit in the 60 characters
+-- that were enough for bcrypt
+alter table users alter column password type character varying(255);
@@ -0,0 +1,11 @@
+alter table users add column if not exists is_admin integer;
+
+update users set is_admin = case when exists (
+    select 1 from user_roles ur join roles r on r.id = ur.role_id
+    where ur.user_id = users.id and r.name = 'admin'
+) then 1 else 0 end;
+
+drop table if exists user_roles;
+drop table if exists role_permissions;
+drop table if exists permissions;
+drop table if exists roles;
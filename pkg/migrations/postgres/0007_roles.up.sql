@@ -0,0 +1,54 @@
+-- roles replace the is_admin flag: users have roles, and roles grant permissions
+create table if not exists roles (
+    id integer generated always as identity primary key,
+    name character varying(64) not null unique,
+    description character varying(255) default '' not null
+);
+
+create table if not exists permissions (
+    id integer generated always as identity primary key,
+    name character varying(64) not null unique,
+    description character varying(255) default '' not null
+);
+
+create table if not exists role_permissions (
+    role_id integer not null references roles(id) on delete cascade,
+    permission_id integer not null references permissions(id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists user_roles (
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    role_id integer not null references roles(id) on delete cascade,
+    primary key (user_id, role_id)
+);
+
+-- the permissions the code checks for; keep in step with data.KnownPermissions
+insert into permissions (name, description) values
+    ('users:read', 'List users, and see anyone''s profile and picture'),
+    ('users:write', 'Create and edit users, and reset their passwords'),
+    ('users:delete', 'Delete users'),
+    ('roles:read', 'List roles and what they grant'),
+    ('roles:write', 'Create roles, assign them and change what they grant'),
+    ('debug:read', 'See runtime counters')
+on conflict (name) do nothing;
+
+insert into roles (name, description) values ('admin', 'Can do everything')
+on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p where r.name = 'admin'
+on conflict do nothing;
+
+-- databases created from a newer sql/users.sql never had the flag
+do $$
+begin
+    if exists (select 1 from information_schema.columns where table_name = 'users' and column_name = 'is_admin') then
+        insert into user_roles (user_id, role_id)
+        select u.id, r.id from users u, roles r where u.is_admin = 1 and r.name = 'admin'
+        on conflict do nothing;
+
+        alter table users drop column is_admin;
+    end if;
+end
+$$;
@@ -0,0 +1,4 @@
+delete from permissions where name = 'audit:read';
+
+drop table if exists audit_events;
+drop function if exists audit_events_append_only();
@@ -0,0 +1,36 @@
+-- an append-only record of who did what to whom; actor and target ids aren't
+-- foreign keys, since events must outlive the users they mention
+create table if not exists audit_events (
+    id integer generated always as identity primary key,
+    occurred_at timestamp with time zone default now() not null,
+    actor_id integer default 0 not null,
+    action character varying(64) not null,
+    target_type character varying(64) default '' not null,
+    target_id character varying(255) default '' not null,
+    ip character varying(255) default '' not null,
+    user_agent character varying(512) default '' not null,
+    detail text default '' not null,
+    changes jsonb
+);
+
+create index if not exists audit_events_actor_id_idx on audit_events (actor_id);
+create index if not exists audit_events_target_idx on audit_events (target_type, target_id);
+create index if not exists audit_events_occurred_at_idx on audit_events (occurred_at);
+
+create or replace function audit_events_append_only() returns trigger as $$
+begin
+    raise exception 'audit events cannot be changed or deleted';
+end
+$$ language plpgsql;
+
+drop trigger if exists audit_events_append_only on audit_events;
+create trigger audit_events_append_only before update or delete on audit_events
+    for each row execute function audit_events_append_only();
+
+insert into permissions (name, description) values
+    ('audit:read', 'Search and export the audit log')
+on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p where r.name = 'admin' and p.name = 'audit:read'
+on conflict do nothing;
@@ -0,0 +1,2 @@
+alter table audit_events drop column if exists hash;
+alter table audit_events drop column if exists prev_hash;
@@ -0,0 +1,4 @@
+-- each event carries the hash of the one before it, so that editing or removing
+-- an event breaks every hash after it; events written before this have neither
+alter table audit_events add column if not exists prev_hash character varying(64) default '' not null;
+alter table audit_events add column if not exists hash character varying(64) default '' not null;
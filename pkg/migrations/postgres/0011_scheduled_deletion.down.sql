@@ -0,0 +1,3 @@
+drop index if exists users_delete_after_idx;
+
+alter table users drop column if exists delete_after;
@@ -0,0 +1,3 @@
+drop index if exists user_images_user_id_active_idx;
+drop table if exists user_images;
+drop table if exists users;
@@ -0,0 +1,22 @@
+create table if not exists users (
+    id integer primary key autoincrement,
+    first_name varchar(255),
+    last_name varchar(255),
+    email varchar(255),
+    password varchar(60),
+    is_admin integer,
+    avatar_visibility varchar(10) default 'public' not null,
+    created_at timestamp,
+    updated_at timestamp
+);
+
+create table if not exists user_images (
+    id integer primary key autoincrement,
+    user_id integer references users(id) on update cascade on delete cascade,
+    file_name varchar(255),
+    is_active boolean default false not null,
+    created_at timestamp,
+    updated_at timestamp
+);
+
+create unique index if not exists user_images_user_id_active_idx on user_images (user_id) where is_active;
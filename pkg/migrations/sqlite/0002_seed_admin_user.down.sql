@@ -0,0 +1 @@
+delete from users where email = 'admin@example.com';
@@ -0,0 +1,5 @@
+-- sqlite databases are for development and demos, so start them with the same
+-- admin@example.com / secret account that sql/users.sql gives the docker database
+insert into users (first_name, last_name, email, password, is_admin, created_at, updated_at)
+select 'Admin', 'User', 'admin@example.com', '$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK', 1, '2022-08-19 00:00:00', '2022-08-19 00:00:00'
+where not exists (select 1 from users where email = 'admin@example.com');
@@ -0,0 +1,3 @@
+-- bumped on every change to a user, so that UpdateUser can refuse to overwrite
+-- changes it hasn't seen
+alter table users add column version integer default 1 not null;
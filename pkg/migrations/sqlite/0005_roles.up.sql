@@ -0,0 +1,43 @@
+-- roles replace the is_admin flag: users have roles, and roles grant permissions
+create table if not exists roles (
+    id integer primary key autoincrement,
+    name varchar(64) not null unique,
+    description varchar(255) default '' not null
+);
+
+create table if not exists permissions (
+    id integer primary key autoincrement,
+    name varchar(64) not null unique,
+    description varchar(255) default '' not null
+);
+
+create table if not exists role_permissions (
+    role_id integer not null references roles(id) on delete cascade,
+    permission_id integer not null references permissions(id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists user_roles (
+    user_id integer not null references users(id) on update cascade on delete cascade,
+    role_id integer not null references roles(id) on delete cascade,
+    primary key (user_id, role_id)
+);
+
+-- the permissions the code checks for; keep in step with data.KnownPermissions
+insert into permissions (name, description) values
+    ('users:read', 'List users, and see anyone''s profile and picture'),
+    ('users:write', 'Create and edit users, and reset their passwords'),
+    ('users:delete', 'Delete users'),
+    ('roles:read', 'List roles and what they grant'),
+    ('roles:write', 'Create roles, assign them and change what they grant'),
+    ('debug:read', 'See runtime counters');
+
+insert into roles (name, description) values ('admin', 'Can do everything');
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p where r.name = 'admin';
+
+insert into user_roles (user_id, role_id)
+select u.id, r.id from users u, roles r where u.is_admin = 1 and r.name = 'admin';
+
+alter table users drop column is_admin;
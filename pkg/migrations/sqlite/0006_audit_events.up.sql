@@ -0,0 +1,34 @@
+-- an append-only record of who did what to whom; actor and target ids aren't
+-- foreign keys, since events must outlive the users they mention
+create table if not exists audit_events (
+    id integer primary key autoincrement,
+    occurred_at timestamp not null,
+    actor_id integer default 0 not null,
+    action varchar(64) not null,
+    target_type varchar(64) default '' not null,
+    target_id varchar(255) default '' not null,
+    ip varchar(255) default '' not null,
+    user_agent varchar(512) default '' not null,
+    detail text default '' not null,
+    changes text
+);
+
+create index if not exists audit_events_actor_id_idx on audit_events (actor_id);
+create index if not exists audit_events_target_idx on audit_events (target_type, target_id);
+create index if not exists audit_events_occurred_at_idx on audit_events (occurred_at);
+
+create trigger audit_events_no_update before update on audit_events
+begin
+    select raise(abort, 'audit events cannot be changed or deleted');
+end;
+
+create trigger audit_events_no_delete before delete on audit_events
+begin
+    select raise(abort, 'audit events cannot be changed or deleted');
+end;
+
+insert into permissions (name, description) values
+    ('audit:read', 'Search and export the audit log');
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p where r.name = 'admin' and p.name = 'audit:read';
@@ -0,0 +1,2 @@
+alter table audit_events drop column hash;
+alter table audit_events drop column prev_hash;
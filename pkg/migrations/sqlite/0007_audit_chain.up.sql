@@ -0,0 +1,4 @@
+-- each event carries the hash of the one before it, so that editing or removing
+-- an event breaks every hash after it; events written before this have neither
+alter table audit_events add column prev_hash varchar(64) default '' not null;
+alter table audit_events add column hash varchar(64) default '' not null;
@@ -0,0 +1,8 @@
+-- without the column, deleted users would come back to life
+delete from users where deleted_at is not null;
+
+drop index if exists users_deleted_at_idx;
+drop index if exists users_email_lower_live_idx;
+create unique index if not exists users_email_lower_idx on users (lower(email));
+
+alter table users drop column deleted_at;
@@ -0,0 +1,11 @@
+-- deleting a user only marks them deleted, so that an admin can restore them until
+-- they are purged for good
+alter table users add column deleted_at timestamp;
+
+-- addresses only have to be unique among live accounts, so that a deleted user's
+-- address can be used again; restoring them fails once it has been
+drop index if exists users_email_lower_idx;
+create unique index if not exists users_email_lower_live_idx on users (lower(email)) where deleted_at is null;
+
+-- finds the users due to be purged
+create index if not exists users_deleted_at_idx on users (deleted_at) where deleted_at is not null;
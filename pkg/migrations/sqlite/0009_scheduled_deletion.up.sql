@@ -0,0 +1,6 @@
+-- users who close their account are deleted once a cooling-off period is over, and
+-- can change their mind until then
+alter table users add column delete_after timestamp;
+
+-- finds the users whose cooling-off period is over
+create index if not exists users_delete_after_idx on users (delete_after) where delete_after is not null;
@@ -0,0 +1 @@
+delete from permissions where name = 'users:impersonate';
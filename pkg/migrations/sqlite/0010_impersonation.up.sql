@@ -0,0 +1,5 @@
+insert into permissions (name, description) values
+    ('users:impersonate', 'Log in as another user, to see what they see');
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p where r.name = 'admin' and p.name = 'users:impersonate';
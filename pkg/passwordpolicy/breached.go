@@ -0,0 +1,173 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachedFile looks passwords up in a local copy of the Have I Been Pwned
+// password list, so no password, or part of its hash, leaves the server.
+//
+// The copy is in one of the two layouts the HIBP downloader writes. As a single
+// SHA-1 file, it is the range API's responses with each hash prefix put back, one
+// HASH:COUNT line per password, sorted by hash. As a directory, it is the range
+// API's responses as they are: a file per 5 character hash prefix, named PREFIX.txt,
+// with a SUFFIX:COUNT line for each of the hashes that start with it, sorted by
+// suffix. Either way it is far too big to load, so Count binary searches it on disk.
+type BreachedFile struct {
+	// the single file, or nil for a directory
+	f    *os.File
+	size int64
+	// the directory of range files, or "" for a single file
+	dir string
+}
+
+// rangePrefixLength is the length of the hash prefixes that range files are named after.
+const rangePrefixLength = 5
+
+// OpenBreachedFile opens a breached password file, or a directory of range files.
+// The caller should Close it.
+func OpenBreachedFile(path string) (*BreachedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if info.IsDir() {
+		_ = f.Close()
+		return &BreachedFile{dir: path}, nil
+	}
+
+	return &BreachedFile{f: f, size: info.Size()}, nil
+}
+
+// Close closes the file.
+func (b *BreachedFile) Close() error {
+	if b.f == nil {
+		return nil
+	}
+	return b.f.Close()
+}
+
+// Count returns the number of breaches password was seen in, or zero if it isn't
+// in the file.
+func (b *BreachedFile) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	want := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	if b.f != nil {
+		return search(b.f, b.size, want)
+	}
+
+	// a prefix nobody's password has has no file
+	f, err := os.Open(filepath.Join(b.dir, want[:rangePrefixLength]+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return search(f, info.Size(), want[rangePrefixLength:])
+}
+
+// search binary searches the first size bytes of f, a sorted list of HASH:COUNT
+// lines, for the line with hash want, and returns its count, or zero if there is
+// none.
+func search(f *os.File, size int64, want string) (int, error) {
+	// the line we want, if it's there, starts somewhere in [lo, hi)
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineAfter(f, size, mid)
+		if err != nil {
+			return 0, err
+		}
+		if start >= hi || line == "" {
+			// no line starts in [mid, hi)
+			hi = mid
+			continue
+		}
+
+		hash, count, err := parseBreachedLine(line, len(want))
+		if err != nil {
+			return 0, fmt.Errorf("%s at byte %d: %w", f.Name(), start, err)
+		}
+
+		switch {
+		case hash == want:
+			return count, nil
+		case hash < want:
+			lo = start + int64(len(line))
+		default:
+			hi = mid
+		}
+	}
+
+	return 0, nil
+}
+
+// lineAfter returns the first line of the first size bytes of f that starts at or
+// after offset, with its line ending, and where it starts. line is empty if there
+// isn't one.
+func lineAfter(f *os.File, size, offset int64) (int64, string, error) {
+	start := offset
+	if offset > 0 {
+		// we may be in the middle of a line; skip to the end of it, unless the
+		// previous byte shows we're at the start of one
+		start = offset - 1
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, start, size-start))
+	if offset > 0 {
+		skipped, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		start += int64(len(skipped))
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, "", err
+	}
+	return start, line, nil
+}
+
+// parseBreachedLine splits a HASH:COUNT line, whose hash, or hash suffix, is
+// hashLength long.
+func parseBreachedLine(line string, hashLength int) (string, int, error) {
+	hash, count, ok := strings.Cut(strings.TrimRight(line, "\r\n"), ":")
+	if !ok || len(hash) != hashLength {
+		return "", 0, fmt.Errorf("malformed line %q", line)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed count in line %q", line)
+	}
+
+	return strings.ToUpper(hash), n, nil
+}
@@ -0,0 +1,194 @@
+package passwordpolicy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeBreachedFile writes a breached password file listing passwords, each seen
+// as many times as its length, and returns its path.
+func writeBreachedFile(t *testing.T, passwords []string, ending string) string {
+	t.Helper()
+
+	var lines []string
+	for _, p := range passwords {
+		sum := sha1.Sum([]byte(p))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), len(p)))
+	}
+	sort.Strings(lines)
+
+	content := strings.Join(lines, "\r\n")
+	if len(lines) > 0 {
+		content += ending
+	}
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords-sha1.txt")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeBreachedRanges writes a directory of range files listing passwords, each
+// seen as many times as its length, and returns its path.
+func writeBreachedRanges(t *testing.T, passwords []string) string {
+	t.Helper()
+
+	ranges := make(map[string][]string)
+	for _, p := range passwords {
+		sum := sha1.Sum([]byte(p))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		ranges[hash[:5]] = append(ranges[hash[:5]], fmt.Sprintf("%s:%d", hash[5:], len(p)))
+	}
+
+	dir := t.TempDir()
+	for prefix, lines := range ranges {
+		sort.Strings(lines)
+		err := os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(strings.Join(lines, "\r\n")), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestBreachedFile_Count(t *testing.T) {
+	var passwords []string
+	for i := 0; i < 1000; i++ {
+		passwords = append(passwords, fmt.Sprintf("password%d", i))
+	}
+
+	for _, ending := range []string{"", "\r\n"} {
+		b, err := OpenBreachedFile(writeBreachedFile(t, passwords, ending))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every password in the file is found, wherever it is
+		for _, p := range passwords {
+			count, err := b.Count(p)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", p, err)
+			}
+			if count != len(p) {
+				t.Errorf("%s: expected count %d but got %d", p, len(p), count)
+			}
+		}
+
+		for _, p := range []string{"", "password", "password1000", "purple monkey dishwasher"} {
+			count, err := b.Count(p)
+			if err != nil || count != 0 {
+				t.Errorf("%q: expected not to be found but got %d, %v", p, count, err)
+			}
+		}
+
+		_ = b.Close()
+	}
+}
+
+func TestBreachedFile_Count_edges(t *testing.T) {
+	var tests = []struct {
+		name      string
+		passwords []string
+	}{
+		{"empty", nil},
+		{"one line", []string{"secret"}},
+		{"two lines", []string{"secret", "password"}},
+	}
+
+	for _, e := range tests {
+		b, err := OpenBreachedFile(writeBreachedFile(t, e.passwords, "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range []string{"secret", "password", "other"} {
+			expected := 0
+			for _, listed := range e.passwords {
+				if listed == p {
+					expected = len(p)
+				}
+			}
+
+			count, err := b.Count(p)
+			if err != nil || count != expected {
+				t.Errorf("%s, %s: expected %d but got %d, %v", e.name, p, expected, count, err)
+			}
+		}
+
+		_ = b.Close()
+	}
+}
+
+func TestBreachedFile_Count_ranges(t *testing.T) {
+	// enough passwords for some prefixes to be shared
+	var passwords []string
+	for i := 0; i < 2000; i++ {
+		passwords = append(passwords, fmt.Sprintf("password%d", i))
+	}
+
+	b, err := OpenBreachedFile(writeBreachedRanges(t, passwords))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, p := range passwords {
+		count, err := b.Count(p)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", p, err)
+		}
+		if count != len(p) {
+			t.Errorf("%s: expected count %d but got %d", p, len(p), count)
+		}
+	}
+
+	for _, p := range []string{"", "password", "password2000", "purple monkey dishwasher"} {
+		count, err := b.Count(p)
+		if err != nil || count != 0 {
+			t.Errorf("%q: expected not to be found but got %d, %v", p, count, err)
+		}
+	}
+}
+
+func TestBreachedFile_Count_malformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pwned-passwords-sha1.txt")
+	_ = os.WriteFile(path, []byte("this is not a hash list\n"), 0644)
+
+	b, err := OpenBreachedFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	_, err = b.Count("secret")
+	if err == nil {
+		t.Error("expected an error for a malformed file")
+	}
+
+	// a full hash where a range file has a suffix
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("secret"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	_ = os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(hash+":1\n"), 0644)
+	ranges, err := OpenBreachedFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ranges.Count("secret")
+	if err == nil {
+		t.Error("expected an error for a malformed range file")
+	}
+
+	_, err = OpenBreachedFile(filepath.Join(t.TempDir(), "missing.txt"))
+	if err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,132 @@
+// Package passwordpolicy decides whether a password is good enough to be set.
+package passwordpolicy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The rules a password can break, as reported in Violation.Rule.
+const (
+	RuleMinLength = "min_length"
+	RuleMaxLength = "max_length"
+	RuleContext   = "context"
+	RuleStrength  = "strength"
+	RuleBreached  = "breached"
+)
+
+// Violation is one rule a password breaks. Message completes a sentence that
+// starts with "password".
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Violations is the error Policy.Check returns for a password that breaks rules.
+type Violations []Violation
+
+func (v Violations) Error() string {
+	messages := make([]string, len(v))
+	for i, violation := range v {
+		messages[i] = violation.Message
+	}
+	return "password " + strings.Join(messages, "; ")
+}
+
+// BreachChecker knows which passwords have been leaked.
+type BreachChecker interface {
+	// Count returns how many times password has been seen in data breaches.
+	Count(password string) (int, error)
+}
+
+// Policy is the set of rules new passwords must follow. Zero values turn a rule off.
+type Policy struct {
+	// MinLength is the fewest characters a password may have.
+	MinLength int
+	// MaxLength is the most bytes a password may have. bcrypt ignores anything
+	// after 72, so longer passwords would be silently cut short.
+	MaxLength int
+	// MinScore is the lowest acceptable Score, from 0 to 4.
+	MinScore int
+	// Breached, if set, turns down passwords that have been leaked.
+	Breached BreachChecker
+}
+
+// Default is the policy used unless configured otherwise. It has no breach check,
+// because that needs a copy of the breached password list.
+var Default = Policy{MinLength: 8, MaxLength: 72, MinScore: 3}
+
+// Check returns Violations listing every rule password breaks, or nil if it breaks
+// none. userInputs are things about the user, like their name and email address,
+// that mustn't appear in the password. Any other error means the breach check
+// couldn't be done.
+func (p Policy) Check(password string, userInputs ...string) error {
+	var violations Violations
+
+	if p.MinLength > 0 && len([]rune(password)) < p.MinLength {
+		violations = append(violations, Violation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("must be at least %d characters long", p.MinLength),
+		})
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, Violation{
+			Rule:    RuleMaxLength,
+			Message: fmt.Sprintf("must be at most %d bytes long", p.MaxLength),
+		})
+	}
+	if containsContext(password, userInputs) {
+		violations = append(violations, Violation{
+			Rule:    RuleContext,
+			Message: "must not contain your name or email address",
+		})
+	}
+	if p.MinScore > 0 && Score(password, userInputs...) < p.MinScore {
+		violations = append(violations, Violation{
+			Rule:    RuleStrength,
+			Message: "is too easy to guess; try a longer one, or a few unrelated words",
+		})
+	}
+
+	if p.Breached != nil {
+		count, err := p.Breached.Count(password)
+		if err != nil {
+			return fmt.Errorf("checking for breached password: %w", err)
+		}
+		if count > 0 {
+			violations = append(violations, Violation{
+				Rule:    RuleBreached,
+				Message: "has appeared in a data breach, so attackers will try it",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return violations
+	}
+	return nil
+}
+
+// containsContext reports whether password contains any of the words in
+// userInputs, ignoring case and common substitutions.
+func containsContext(password string, userInputs []string) bool {
+	words := contextWords(userInputs)
+	if len(words) == 0 {
+		return false
+	}
+
+	lower := []rune(strings.ToLower(password))
+	variants := []string{string(lower)}
+	for _, table := range leet {
+		variants = append(variants, string(unleet(lower, table)))
+	}
+
+	for _, word := range words {
+		for _, variant := range variants {
+			if strings.Contains(variant, word) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package passwordpolicy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// breaches is a BreachChecker for tests.
+type breaches map[string]int
+
+func (b breaches) Count(password string) (int, error) {
+	if password == "fail" {
+		return 0, errors.New("breach list unavailable")
+	}
+	return b[password], nil
+}
+
+func TestPolicy_Check(t *testing.T) {
+	policy := Default
+	policy.Breached = breaches{"correct horse battery staple": 42}
+
+	var tests = []struct {
+		name     string
+		password string
+		rules    []string
+	}{
+		{"good", "purple monkey dishwasher", nil},
+		{"too short", "kP9#vL2", []string{RuleMinLength, RuleStrength}},
+		{"too long", strings.Repeat("kP9#vL2!qZ", 8), []string{RuleMaxLength}},
+		{"multibyte characters count as one", "ÄÖÜäöüßé", []string{RuleStrength}},
+		{"name", "purple jack dishwasher", []string{RuleContext}},
+		{"name with substitutions", "purple J4CK dishwasher", []string{RuleContext}},
+		{"email domain", "purple example dishwasher", []string{RuleContext}},
+		{"common", "password", []string{RuleStrength}},
+		{"breached", "correct horse battery staple", []string{RuleBreached}},
+	}
+
+	for _, e := range tests {
+		err := policy.Check(e.password, "Jack", "Smith", "jack@example.com")
+
+		var rules []string
+		var violations Violations
+		if errors.As(err, &violations) {
+			for _, v := range violations {
+				rules = append(rules, v.Rule)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+
+		if strings.Join(rules, ",") != strings.Join(e.rules, ",") {
+			t.Errorf("%s: expected violations %v but got %v", e.name, e.rules, rules)
+		}
+	}
+}
+
+func TestPolicy_Check_errors(t *testing.T) {
+	policy := Policy{Breached: breaches{}}
+
+	err := policy.Check("fail")
+	var violations Violations
+	if err == nil || errors.As(err, &violations) {
+		t.Errorf("expected the breach check's error but got %v", err)
+	}
+
+	// the zero policy allows anything
+	if err := (Policy{}).Check(""); err != nil {
+		t.Errorf("expected no error from the zero policy but got %s", err)
+	}
+}
+
+func TestViolations_Error(t *testing.T) {
+	err := Violations{
+		{Rule: RuleMinLength, Message: "must be at least 8 characters long"},
+		{Rule: RuleStrength, Message: "is too easy to guess"},
+	}
+
+	expected := "password must be at least 8 characters long; is too easy to guess"
+	if err.Error() != expected {
+		t.Errorf("expected %q but got %q", expected, err.Error())
+	}
+}
@@ -0,0 +1,410 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"embed"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The estimate follows zxcvbn: it looks for the patterns people use, like common
+// passwords and words, keyboard rows, sequences, repeats and years, and works out
+// the fewest guesses an attacker who tries those patterns first would need.
+// Anything that doesn't fit a pattern costs ten guesses a character.
+
+//go:embed words/*.txt
+var wordFiles embed.FS
+
+// dictionaries map each word to its rank, so that more common words are cheaper
+var dictionaries = []map[string]int{
+	loadWords("words/passwords.txt"),
+	loadWords("words/english.txt"),
+}
+
+func loadWords(name string) map[string]int {
+	f, err := wordFiles.Open(name)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	words := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if _, ok := words[word]; !ok {
+			words[word] = len(words) + 1
+		}
+	}
+	return words
+}
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+// leet undoes the substitutions people make to dress up a word. 1 is tried as
+// both i and l.
+var leet = []map[rune]rune{
+	{'4': 'a', '@': 'a', '3': 'e', '1': 'i', '!': 'i', '|': 'i', '0': 'o', '5': 's', '$': 's', '7': 't', '+': 't'},
+	{'4': 'a', '@': 'a', '3': 'e', '1': 'l', '!': 'i', '|': 'l', '0': 'o', '5': 's', '$': 's', '7': 't', '+': 't'},
+}
+
+const (
+	bruteforceCardinality = 10
+	minMatchGuesses       = 50
+	// longer passwords are only estimated up to here; the rest is brute force
+	maxEstimated = 100
+)
+
+// match is a pattern found in runes [i, j) of the password.
+type match struct {
+	i, j    int
+	guesses float64
+}
+
+// Guesses estimates how many guesses it would take to find password. userInputs
+// are words the attacker may know, like the user's name.
+func Guesses(password string, userInputs ...string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 1
+	}
+
+	// the attacker may try the inputs whole, as well as the words in them
+	var words []string
+	for _, input := range userInputs {
+		words = append(words, strings.ToLower(strings.TrimSpace(input)))
+	}
+	words = append(words, contextWords(userInputs)...)
+
+	inputs := make(map[string]int)
+	for _, word := range words {
+		if _, ok := inputs[word]; !ok {
+			inputs[word] = len(inputs) + 1
+		}
+	}
+
+	if len(runes) <= maxEstimated {
+		return estimate(runes, inputs)
+	}
+	return estimate(runes[:maxEstimated], inputs) * math.Pow(bruteforceCardinality, float64(len(runes)-maxEstimated))
+}
+
+// Score turns Guesses into zxcvbn's scale: 0 is too guessable, 1 very guessable,
+// 2 somewhat guessable, 3 safely unguessable and 4 very unguessable.
+func Score(password string, userInputs ...string) int {
+	guesses := Guesses(password, userInputs...)
+	switch {
+	case guesses < 1e3+5:
+		return 0
+	case guesses < 1e6+5:
+		return 1
+	case guesses < 1e8+5:
+		return 2
+	case guesses < 1e10+5:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// estimate finds the cheapest way to cover runes with matches and brute force.
+// Like zxcvbn, it charges for the order of the matches, l! for l of them, and
+// makes every match of two or more runes, short of the whole password, cost at
+// least minMatchGuesses, so that a few short, common words don't add up to nothing.
+func estimate(runes []rune, inputs map[string]int) float64 {
+	n := len(runes)
+
+	var matches []match
+	matches = append(matches, dictionaryMatches(runes, inputs)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, repeatMatches(runes, inputs)...)
+	matches = append(matches, yearMatches(runes)...)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j <= n; j++ {
+			matches = append(matches, match{i, j, math.Pow(bruteforceCardinality, float64(j-i))})
+		}
+	}
+
+	ending := make([][]match, n+1)
+	for _, m := range matches {
+		if m.j-m.i > 1 && m.j-m.i < n {
+			m.guesses = math.Max(m.guesses, minMatchGuesses)
+		}
+		ending[m.j] = append(ending[m.j], m)
+	}
+
+	// best[j][l] is the fewest guesses for the first j runes in l matches
+	best := make([][]float64, n+1)
+	for j := range best {
+		best[j] = make([]float64, n+1)
+		for l := range best[j] {
+			best[j][l] = math.Inf(1)
+		}
+	}
+	best[0][0] = 1
+	for j := 1; j <= n; j++ {
+		for _, m := range ending[j] {
+			for l := 1; l <= j; l++ {
+				best[j][l] = math.Min(best[j][l], best[m.i][l-1]*m.guesses)
+			}
+		}
+	}
+
+	guesses := math.Inf(1)
+	factorial := 1.0
+	for l := 1; l <= n; l++ {
+		factorial *= float64(l)
+		guesses = math.Min(guesses, best[n][l]*factorial)
+	}
+	return guesses
+}
+
+func dictionaryMatches(runes []rune, inputs map[string]int) []match {
+	lower := []rune(strings.ToLower(string(runes)))
+	if len(lower) != len(runes) {
+		// a few runes change length when lowered; don't bother with them
+		return nil
+	}
+
+	variants := [][]rune{lower}
+	for _, table := range leet {
+		variants = append(variants, unleet(lower, table))
+	}
+
+	dicts := append([]map[string]int{inputs}, dictionaries...)
+
+	var matches []match
+	for i := range runes {
+		for j := i + 3; j <= len(runes); j++ {
+			guesses := math.Inf(1)
+			for v, variant := range variants {
+				word := string(variant[i:j])
+				if v > 0 && word == string(lower[i:j]) {
+					continue
+				}
+				factor := uppercaseVariations(runes[i:j])
+				if v > 0 {
+					factor *= 2
+				}
+				for _, dict := range dicts {
+					if rank, ok := dict[word]; ok {
+						guesses = math.Min(guesses, float64(rank)*factor)
+					}
+					if rank, ok := dict[reverse(word)]; ok {
+						guesses = math.Min(guesses, float64(rank)*factor*2)
+					}
+				}
+			}
+			if !math.IsInf(guesses, 1) {
+				matches = append(matches, match{i, j, guesses})
+			}
+		}
+	}
+	return matches
+}
+
+func unleet(runes []rune, table map[rune]rune) []rune {
+	out := make([]rune, len(runes))
+	for i, r := range runes {
+		if s, ok := table[r]; ok {
+			r = s
+		}
+		out[i] = r
+	}
+	return out
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// uppercaseVariations is how many ways the word could have been capitalized, with
+// the usual ways counting as only two.
+func uppercaseVariations(runes []rune) float64 {
+	var upper, lower int
+	for _, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+
+	switch {
+	case upper == 0:
+		return 1
+	case lower == 0,
+		upper == 1 && unicode.IsUpper(runes[0]),
+		upper == 1 && unicode.IsUpper(runes[len(runes)-1]):
+		return 2
+	}
+
+	var variations float64
+	for k := 1; k <= min(upper, lower); k++ {
+		variations += binomial(upper+lower, k)
+	}
+	return variations
+}
+
+func binomial(n, k int) float64 {
+	result := 1.0
+	for i := 1; i <= k; i++ {
+		result = result * float64(n-k+i) / float64(i)
+	}
+	return result
+}
+
+// keyboardMatches finds runs of four or more neighbouring keys on one row.
+func keyboardMatches(runes []rune) []match {
+	lower := []rune(strings.ToLower(string(runes)))
+	if len(lower) != len(runes) {
+		return nil
+	}
+
+	var matches []match
+	for i := range lower {
+		for j := i + 4; j <= len(lower); j++ {
+			s := string(lower[i:j])
+			for _, row := range keyboardRows {
+				switch {
+				case strings.Contains(row, s):
+					matches = append(matches, match{i, j, 47 * float64(j-i)})
+				case strings.Contains(row, reverse(s)):
+					matches = append(matches, match{i, j, 47 * float64(j-i) * 2})
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// sequenceMatches finds runs like abc, 9753 or XYZ: three or more letters of the
+// same case, or digits, a fixed small step apart.
+func sequenceMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i+2 < len(runes); {
+		delta := runes[i+1] - runes[i]
+		j := i + 1
+		for j < len(runes) && runes[j]-runes[j-1] == delta && sameClass(runes[i], runes[j]) {
+			j++
+		}
+
+		if j-i >= 3 && delta != 0 && delta >= -5 && delta <= 5 {
+			var base float64
+			switch first := runes[i]; {
+			case strings.ContainsRune("aAzZ019", first):
+				base = 4
+			case unicode.IsDigit(first):
+				base = 10
+			default:
+				base = 26
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			matches = append(matches, match{i, j, base * float64(j-i)})
+			i = j - 1
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+func sameClass(a, b rune) bool {
+	switch {
+	case a >= '0' && a <= '9':
+		return b >= '0' && b <= '9'
+	case a >= 'a' && a <= 'z':
+		return b >= 'a' && b <= 'z'
+	case a >= 'A' && a <= 'Z':
+		return b >= 'A' && b <= 'Z'
+	}
+	return false
+}
+
+// repeatMatches finds a chunk said more than once, like aaa or abcabc, which costs
+// as much as the chunk times the number of repeats. Only the shortest chunk that
+// repeats from each position is tried.
+func repeatMatches(runes []rune, inputs map[string]int) []match {
+	var matches []match
+	for i := range runes {
+		for size := 1; i+2*size <= len(runes); size++ {
+			unit := runes[i : i+size]
+			repeats := 1
+			for end := i + size; end+size <= len(runes) && string(runes[end:end+size]) == string(unit); end += size {
+				repeats++
+			}
+			if repeats < 2 || size*repeats < 3 {
+				continue
+			}
+			matches = append(matches, match{i, i + size*repeats, estimate(unit, inputs) * float64(repeats)})
+			break
+		}
+	}
+	return matches
+}
+
+// yearMatches finds recent years, which people like to add to the end of words.
+func yearMatches(runes []rune) []match {
+	now := time.Now().Year()
+
+	var matches []match
+	for i := 0; i+4 <= len(runes); i++ {
+		year := 0
+		for _, r := range runes[i : i+4] {
+			if r < '0' || r > '9' {
+				year = -1
+				break
+			}
+			year = year*10 + int(r-'0')
+		}
+		if year >= 1900 && year <= now+20 {
+			matches = append(matches, match{i, i + 4, math.Max(math.Abs(float64(now-year)), 20)})
+		}
+	}
+	return matches
+}
+
+// contextWords splits things about the user into the lower case words an
+// attacker would try: names, and the parts of an email address other than the
+// top level domain. Words shorter than three characters are left out.
+func contextWords(userInputs []string) []string {
+	var words []string
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+		if at := strings.LastIndex(input, "@"); at >= 0 {
+			domain := input[at+1:]
+			if dot := strings.LastIndex(domain, "."); dot >= 0 {
+				domain = domain[:dot]
+			}
+			input = input[:at] + " " + domain
+		}
+
+		fields := strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, field := range fields {
+			if len([]rune(field)) >= 3 {
+				words = append(words, field)
+			}
+		}
+	}
+	return words
+}
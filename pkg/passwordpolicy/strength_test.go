@@ -0,0 +1,57 @@
+package passwordpolicy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScore(t *testing.T) {
+	var tests = []struct {
+		name       string
+		password   string
+		userInputs []string
+		minScore   int
+		maxScore   int
+	}{
+		{"empty", "", nil, 0, 0},
+		{"common password", "secret", nil, 0, 0},
+		{"substitutions", "P@ssw0rd", nil, 0, 0},
+		{"capitalized with digit", "Password1", nil, 0, 0},
+		{"keyboard row", "zxcvbnm,./", nil, 0, 0},
+		{"sequence", "abcdefgh", nil, 0, 0},
+		{"repeated character", "aaaaaaaaaaaa", nil, 0, 0},
+		{"repeated chunk", "abcabcabcabc", nil, 0, 0},
+		{"reversed word", "drowssap", nil, 0, 0},
+		{"word and year", "sunshine2024", nil, 0, 1},
+		{"name and year", "jacksmith1990", []string{"Jack", "Smith"}, 0, 1},
+		{"email address", "jack@example.com", []string{"jack@example.com"}, 0, 1},
+		{"random", "kP9#vL2!qZ", nil, 3, 4},
+		{"long random", "Tr0ub4dor&3x", nil, 4, 4},
+		{"passphrase", "correct horse battery staple", nil, 4, 4},
+		{"very long", strings.Repeat("kP9#vL2!qZ", 20), nil, 4, 4},
+	}
+
+	for _, e := range tests {
+		score := Score(e.password, e.userInputs...)
+		if score < e.minScore || score > e.maxScore {
+			t.Errorf("%s: expected a score from %d to %d but got %d", e.name, e.minScore, e.maxScore, score)
+		}
+	}
+}
+
+func TestGuesses_userInputs(t *testing.T) {
+	// the same password is weaker once the attacker knows who it belongs to
+	without := Guesses("smithjack77")
+	with := Guesses("smithjack77", "Jack", "Smith")
+	if with >= without {
+		t.Errorf("expected fewer guesses with user inputs: %e without, %e with", without, with)
+	}
+}
+
+func Test_contextWords(t *testing.T) {
+	words := contextWords([]string{"Mary-Jane", "O'Neil", "mj.oneil+web@Example.co.uk", "Al"})
+	expected := "mary jane neil oneil web example"
+	if strings.Join(words, " ") != expected {
+		t.Errorf("expected %q but got %q", expected, strings.Join(words, " "))
+	}
+}
@@ -0,0 +1,152 @@
+// Package cacherepo keeps recently read users in memory, in front of another
+// repository.DatabaseRepo.
+package cacherepo
+
+import (
+	"context"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts how well the cache is doing.
+type Stats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Size   int    `json:"size"`
+}
+
+// CachedRepo is a DatabaseRepo that answers GetUser and GetUserByEmail from memory
+// when it can. Every other method goes to the repository it wraps, and any of them
+// that can change what GetUser returns drops that user from the cache afterwards.
+//
+// Writes made through other CachedRepos, or straight to the database, aren't seen
+// until the entry expires, unless the instances share invalidations with
+// ListenPostgres.
+type CachedRepo struct {
+	writes
+
+	cache  *lru
+	hits   atomic.Uint64
+	misses atomic.Uint64
+
+	// notify, if set, tells other instances about a changed user, or with "*", that
+	// they should purge
+	notify atomic.Pointer[func(payload string)]
+}
+
+// New returns a CachedRepo in front of repo, which holds up to size lookups, each
+// for at most ttl. A ttl of zero means entries only leave the cache when they are
+// evicted or invalidated.
+func New(repo repository.DatabaseRepo, size int, ttl time.Duration) *CachedRepo {
+	c := &CachedRepo{cache: newLRU(size, ttl)}
+	c.writes = writes{DatabaseRepo: repo, changed: c.Invalidate, purged: c.InvalidateAll}
+	return c
+}
+
+// Stats returns the number of cache hits and misses so far, and the current size.
+func (c *CachedRepo) Stats() Stats {
+	return Stats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   c.cache.len(),
+	}
+}
+
+// Invalidate drops the user with id from the cache, and from the caches of other
+// instances if they are listening.
+func (c *CachedRepo) Invalidate(id int) {
+	c.cache.remove(id)
+	if notify := c.notify.Load(); notify != nil {
+		(*notify)(strconv.Itoa(id))
+	}
+}
+
+// InvalidateAll empties the cache, and the caches of other instances if they are
+// listening. It is for writes that change many users at once.
+func (c *CachedRepo) InvalidateAll() {
+	c.cache.purge()
+	if notify := c.notify.Load(); notify != nil {
+		(*notify)(purgePayload)
+	}
+}
+
+// Purge empties the cache.
+func (c *CachedRepo) Purge() {
+	c.cache.purge()
+}
+
+// GetUser returns one user by id, from the cache if possible.
+func (c *CachedRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	return c.lookup(ctx, "id:"+strconv.Itoa(id), func() (*data.User, error) {
+		return c.DatabaseRepo.GetUser(ctx, id)
+	})
+}
+
+// GetUserByEmail returns one user by email address, from the cache if possible.
+func (c *CachedRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	normalized, err := data.NormalizeEmail(email)
+	if err != nil {
+		// let the repository decide what to say about it
+		return c.DatabaseRepo.GetUserByEmail(ctx, email)
+	}
+
+	return c.lookup(ctx, "email:"+normalized, func() (*data.User, error) {
+		return c.DatabaseRepo.GetUserByEmail(ctx, normalized)
+	})
+}
+
+// lookup returns a copy of the user cached under key, or calls read and caches what
+// it returns. Errors, not found included, are never cached.
+func (c *CachedRepo) lookup(ctx context.Context, key string, read func() (*data.User, error)) (*data.User, error) {
+	// behave like the database would, even when it isn't asked
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if u, ok := c.cache.get(key); ok {
+		c.hits.Add(1)
+		u.Roles, u.Permissions = slices.Clone(u.Roles), slices.Clone(u.Permissions)
+		return &u, nil
+	}
+	c.misses.Add(1)
+
+	gen := c.cache.generation()
+	u, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	cached := *u
+	cached.Roles, cached.Permissions = slices.Clone(u.Roles), slices.Clone(u.Permissions)
+	c.cache.add(key, cached, gen)
+	return u, nil
+}
+
+// WithTx runs fn in a transaction on the wrapped repository. Lookups inside it
+// skip the cache, so that they see the transaction's own writes; the users it
+// changes are invalidated once it is over, whether or not it committed.
+func (c *CachedRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	var changed []int
+	var purged bool
+	err := c.DatabaseRepo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		return fn(&writes{
+			DatabaseRepo: tx,
+			changed:      func(id int) { changed = append(changed, id) },
+			purged:       func() { purged = true },
+		})
+	})
+
+	if purged {
+		c.InvalidateAll()
+		return err
+	}
+	for _, id := range changed {
+		c.Invalidate(id)
+	}
+
+	return err
+}
@@ -0,0 +1,228 @@
+package cacherepo
+
+import (
+	"context"
+	"errors"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"personal-projects/webapp/pkg/repository/dbrepo"
+	"personal-projects/webapp/pkg/repository/repositorytest"
+	"testing"
+	"time"
+)
+
+// newTestRepo returns a cache in front of a memory repository holding the test
+// fixtures, and the memory repository, for changing things behind its back.
+func newTestRepo(t *testing.T) (*CachedRepo, *dbrepo.MemoryDBRepo) {
+	t.Helper()
+
+	db, err := dbrepo.NewMemoryDBRepo(dbrepo.TestFixtures())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(db, 10, time.Minute), db
+}
+
+// rename changes the admin's first name without going through the cache.
+func rename(t *testing.T, db repository.DatabaseRepo, firstName string) {
+	t.Helper()
+
+	u, _ := db.GetUser(context.Background(), 1)
+	u.FirstName = firstName
+	err := db.UpdateUser(context.Background(), *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedRepoConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.DatabaseRepo {
+		// just the roles and permissions the migrations create
+		f := dbrepo.TestFixtures()
+		db, err := dbrepo.NewMemoryDBRepo(dbrepo.Fixtures{Permissions: f.Permissions, Roles: f.Roles})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return New(db, 10, time.Minute)
+	})
+}
+
+func TestCachedRepo_lookups(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newTestRepo(t)
+
+	u, err := repo.GetUser(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rename(t, db, "Changed")
+
+	// the second lookup comes from the cache, so it doesn't see the change
+	u, _ = repo.GetUser(ctx, 1)
+	if u.FirstName != "Admin" {
+		t.Errorf("expected the cached first name Admin but got %s", u.FirstName)
+	}
+
+	// what comes back is a copy
+	u.FirstName = "Modified"
+	u.Roles[0] = "modified"
+	u, _ = repo.GetUser(ctx, 1)
+	if u.FirstName != "Admin" || u.Roles[0] != data.RoleAdmin {
+		t.Errorf("changing a returned user changed the cache: got %s and %v", u.FirstName, u.Roles)
+	}
+
+	// lookups by email are cached separately, under the normalized address
+	_, _ = repo.GetUserByEmail(ctx, "admin@example.com")
+	u, _ = repo.GetUserByEmail(ctx, " ADMIN@example.com")
+	if u.FirstName != "Changed" {
+		t.Errorf("expected Changed by email but got %s", u.FirstName)
+	}
+
+	// failures aren't cached
+	_, err = repo.GetUser(ctx, 100)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected repository.ErrNotFound but got %v", err)
+	}
+	_, _ = repo.GetUser(ctx, 100)
+
+	stats := repo.Stats()
+	if stats.Hits != 3 || stats.Misses != 4 || stats.Size != 2 {
+		t.Errorf("expected 3 hits, 4 misses and 2 entries but got %+v", stats)
+	}
+}
+
+func TestCachedRepo_invalidation(t *testing.T) {
+	// the fixture's version, after rename
+	const version = 2
+
+	var tests = []struct {
+		name  string
+		write func(ctx context.Context, repo repository.DatabaseRepo) error
+	}{
+		{"UpdateUser", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			// fails, because the version is stale, but still invalidates
+			return repo.UpdateUser(ctx, data.User{ID: 1, Email: "admin@example.com"})
+		}},
+		{"UpdateAvatarVisibility", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.UpdateAvatarVisibility(ctx, 1, data.AvatarPrivate, version)
+		}},
+		{"DeleteUser", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.DeleteUser(ctx, 1, version)
+		}},
+		{"ScheduleDeletion", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			after := time.Now().Add(time.Hour)
+			return repo.ScheduleDeletion(ctx, 1, &after)
+		}},
+		{"DeleteScheduledUsers", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			// nobody is due, but we can't know that beforehand
+			_, err := repo.DeleteScheduledUsers(ctx, time.Now())
+			return err
+		}},
+		{"RestoreUser", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			// fails, because the user isn't deleted, but still invalidates
+			return repo.RestoreUser(ctx, 1)
+		}},
+		{"ResetPassword", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.ResetPassword(ctx, 1, "password")
+		}},
+		{"InsertUserImage", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			_, err := repo.InsertUserImage(ctx, data.UserImage{UserID: 1, FileName: "new.png"})
+			return err
+		}},
+		{"SetActiveUserImage", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.SetActiveUserImage(ctx, 1, 1)
+		}},
+		{"DeleteUserImage", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.DeleteUserImage(ctx, 1, 1)
+		}},
+		{"AssignRole", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			// already assigned, so nothing changes, but it still invalidates
+			return repo.AssignRole(ctx, 1, data.RoleAdmin)
+		}},
+		{"RevokeRole", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.RevokeRole(ctx, 1, data.RoleAdmin)
+		}},
+		{"GrantPermission", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.GrantPermission(ctx, data.RoleAdmin, data.PermUsersRead)
+		}},
+		{"RevokePermission", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.RevokePermission(ctx, data.RoleAdmin, data.PermUsersRead)
+		}},
+		{"WithTx", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+				return tx.UpdateAvatarVisibility(ctx, 1, data.AvatarPrivate, version)
+			})
+		}},
+		{"WithTx, GrantPermission", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+				return tx.GrantPermission(ctx, data.RoleAdmin, data.PermUsersRead)
+			})
+		}},
+		{"nested WithTx", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+				return tx.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+					return tx.UpdateAvatarVisibility(ctx, 1, data.AvatarPrivate, version)
+				})
+			})
+		}},
+		{"rolled back WithTx", func(ctx context.Context, repo repository.DatabaseRepo) error {
+			return repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+				_ = tx.UpdateAvatarVisibility(ctx, 1, data.AvatarPrivate, version)
+				return errors.New("roll back")
+			})
+		}},
+	}
+
+	for _, e := range tests {
+		ctx := context.Background()
+		repo, db := newTestRepo(t)
+
+		_, _ = repo.GetUser(ctx, 1)
+		_, _ = repo.GetUserByEmail(ctx, "admin@example.com")
+		rename(t, db, "Changed")
+
+		_ = e.write(ctx, repo)
+
+		if repo.Stats().Size != 0 {
+			t.Errorf("%s: expected the cache to be empty but it has %d entries", e.name, repo.Stats().Size)
+		}
+		if u, err := repo.GetUser(ctx, 1); err == nil && u.FirstName != "Changed" {
+			t.Errorf("%s: expected the user to be read again, but got the cached %s", e.name, u.FirstName)
+		}
+	}
+}
+
+func TestCachedRepo_WithTx(t *testing.T) {
+	ctx := context.Background()
+	repo, _ := newTestRepo(t)
+
+	_, _ = repo.GetUser(ctx, 1)
+
+	err := repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		err := tx.UpdateAvatarVisibility(ctx, 1, data.AvatarPrivate, 1)
+		if err != nil {
+			return err
+		}
+
+		// the transaction sees its own write, not the cache
+		u, err := tx.GetUser(ctx, 1)
+		if err != nil {
+			return err
+		}
+		if u.AvatarVisibility != data.AvatarPrivate {
+			t.Errorf("expected %s inside the transaction but got %s", data.AvatarPrivate, u.AvatarVisibility)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := repo.GetUser(ctx, 1)
+	if u.AvatarVisibility != data.AvatarPrivate {
+		t.Errorf("expected %s after the transaction but got %s", data.AvatarPrivate, u.AvatarVisibility)
+	}
+	if stats := repo.Stats(); stats.Hits != 0 || stats.Misses != 2 {
+		t.Errorf("expected 0 hits and 2 misses but got %+v", stats)
+	}
+}
@@ -0,0 +1,133 @@
+package cacherepo
+
+import (
+	"container/list"
+	"personal-projects/webapp/pkg/data"
+	"sync"
+	"time"
+)
+
+// entry is one cached user, under one of the keys it can be looked up by.
+type entry struct {
+	key     string
+	user    data.User
+	expires time.Time
+}
+
+// lru is a size-bounded cache of users, least recently used first out, whose
+// entries also expire after a fixed time. It is safe for concurrent use.
+type lru struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	now   func() time.Time
+	order *list.List               // most recently used at the front
+	items map[string]*list.Element // by key
+	keys  map[int]map[string]bool  // the keys each user id is cached under
+
+	// gen is bumped by every removal, so that a lookup which started before a user
+	// was changed can tell not to cache what it read
+	gen uint64
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{
+		size:  size,
+		ttl:   ttl,
+		now:   time.Now,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+		keys:  make(map[int]map[string]bool),
+	}
+}
+
+// get returns the user cached under key, if there is one and it hasn't expired.
+func (c *lru) get(key string) (data.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return data.User{}, false
+	}
+
+	e := el.Value.(*entry)
+	if c.ttl > 0 && !c.now().Before(e.expires) {
+		c.removeElement(el)
+		return data.User{}, false
+	}
+
+	c.order.MoveToFront(el)
+	return e.user, true
+}
+
+// generation returns a token to pass to add once the user has been read.
+func (c *lru) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// add caches u under key, unless something has been removed since gen was taken,
+// in which case u may already be out of date.
+func (c *lru) add(key string, u data.User, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+
+	el := c.order.PushFront(&entry{key: key, user: u, expires: c.now().Add(c.ttl)})
+	c.items[key] = el
+	if c.keys[u.ID] == nil {
+		c.keys[u.ID] = make(map[string]bool)
+	}
+	c.keys[u.ID][key] = true
+
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// remove drops everything cached for the user with id.
+func (c *lru) remove(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for key := range c.keys[id] {
+		c.removeElement(c.items[key])
+	}
+}
+
+// purge empties the cache.
+func (c *lru) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	c.keys = make(map[int]map[string]bool)
+}
+
+// len returns the number of entries, expired or not.
+func (c *lru) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *lru) removeElement(el *list.Element) {
+	e := c.order.Remove(el).(*entry)
+	delete(c.items, e.key)
+	delete(c.keys[e.user.ID], e.key)
+	if len(c.keys[e.user.ID]) == 0 {
+		delete(c.keys, e.user.ID)
+	}
+}
@@ -0,0 +1,86 @@
+package cacherepo
+
+import (
+	"personal-projects/webapp/pkg/data"
+	"testing"
+	"time"
+)
+
+func Test_lru_eviction(t *testing.T) {
+	c := newLRU(2, 0)
+
+	c.add("id:1", data.User{ID: 1}, c.generation())
+	c.add("id:2", data.User{ID: 2}, c.generation())
+	_, _ = c.get("id:1")
+	c.add("id:3", data.User{ID: 3}, c.generation())
+
+	// 2 was used least recently
+	var tests = []struct {
+		key    string
+		cached bool
+	}{
+		{"id:1", true},
+		{"id:2", false},
+		{"id:3", true},
+	}
+
+	for _, e := range tests {
+		if _, ok := c.get(e.key); ok != e.cached {
+			t.Errorf("%s: expected cached to be %t", e.key, e.cached)
+		}
+	}
+	if c.len() != 2 {
+		t.Errorf("expected 2 entries but got %d", c.len())
+	}
+}
+
+func Test_lru_ttl(t *testing.T) {
+	now := time.Now()
+	c := newLRU(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.add("id:1", data.User{ID: 1}, c.generation())
+
+	now = now.Add(59 * time.Second)
+	if _, ok := c.get("id:1"); !ok {
+		t.Error("entry expired early")
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := c.get("id:1"); ok {
+		t.Error("entry did not expire")
+	}
+	if c.len() != 0 {
+		t.Errorf("expired entry was not removed; %d entries left", c.len())
+	}
+}
+
+func Test_lru_remove(t *testing.T) {
+	c := newLRU(10, 0)
+
+	c.add("id:1", data.User{ID: 1}, c.generation())
+	c.add("email:admin@example.com", data.User{ID: 1}, c.generation())
+	c.add("id:2", data.User{ID: 2}, c.generation())
+
+	c.remove(1)
+	if c.len() != 1 {
+		t.Errorf("expected only user 2 to be left but got %d entries", c.len())
+	}
+	if _, ok := c.get("id:2"); !ok {
+		t.Error("user 2 was removed too")
+	}
+
+	// a read that started before the removal might have seen the old row
+	gen := c.generation()
+	c.remove(2)
+	c.add("id:2", data.User{ID: 2}, gen)
+	if _, ok := c.get("id:2"); ok {
+		t.Error("a user read before a removal was cached")
+	}
+
+	c.add("id:2", data.User{ID: 2}, c.generation())
+	c.purge()
+	if c.len() != 0 {
+		t.Errorf("expected an empty cache after purge but got %d entries", c.len())
+	}
+}
@@ -0,0 +1,98 @@
+package cacherepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// Channel is the Postgres notification channel instances invalidate users on. The
+// payload is the user's id, or purgePayload to empty the whole cache.
+const Channel = "user_cache_invalidate"
+
+const purgePayload = "*"
+
+// notifyTimeout limits how long a write waits to tell other instances about it.
+const notifyTimeout = 2 * time.Second
+
+// ListenPostgres shares invalidations with every other CachedRepo listening on db:
+// each user this one invalidates is announced with NOTIFY, and each one announced
+// by the others is dropped from this cache. It blocks until ctx is done,
+// reconnecting if the connection drops; since notifications sent in the meantime
+// are lost, the whole cache is purged every time it starts listening.
+//
+// db must use the pgx driver.
+func (c *CachedRepo) ListenPostgres(ctx context.Context, db *sql.DB) {
+	notify := func(payload string) {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+
+		_, err := db.ExecContext(ctx, "select pg_notify($1, $2)", Channel, payload)
+		if err != nil {
+			log.Println("could not announce cache invalidation:", err)
+		}
+	}
+	c.notify.Store(&notify)
+	defer c.notify.Store(nil)
+
+	for {
+		err := c.listen(ctx, db)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("cache invalidation listener stopped, restarting:", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// listen holds one connection in LISTEN until ctx is done or the connection fails.
+func (c *CachedRepo) listen(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		sc, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("LISTEN needs the pgx driver, not %T", driverConn)
+		}
+		pc := sc.Conn()
+
+		_, err := pc.Exec(ctx, "listen "+Channel)
+		if err != nil {
+			return err
+		}
+		c.Purge()
+
+		for {
+			n, err := pc.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+
+			if n.Payload == purgePayload {
+				c.Purge()
+				continue
+			}
+
+			id, err := strconv.Atoi(n.Payload)
+			if err != nil {
+				log.Printf("ignoring cache invalidation for user %q", n.Payload)
+				continue
+			}
+			c.cache.remove(id)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package cacherepo
+
+import (
+	"context"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"time"
+)
+
+// writes passes every call to the repository it wraps, and afterwards calls changed
+// with the id of any user whose GetUser result the call may have changed, or purged
+// if it may have changed any number of them. Failed calls count too, since we can't
+// tell how far they got.
+type writes struct {
+	repository.DatabaseRepo
+	changed func(id int)
+	purged  func()
+}
+
+func (w *writes) UpdateUser(ctx context.Context, u data.User) error {
+	defer w.changed(u.ID)
+	return w.DatabaseRepo.UpdateUser(ctx, u)
+}
+
+func (w *writes) UpdateAvatarVisibility(ctx context.Context, userID int, visibility string, version int) error {
+	defer w.changed(userID)
+	return w.DatabaseRepo.UpdateAvatarVisibility(ctx, userID, visibility, version)
+}
+
+func (w *writes) DeleteUser(ctx context.Context, id, version int) error {
+	defer w.changed(id)
+	return w.DatabaseRepo.DeleteUser(ctx, id, version)
+}
+
+func (w *writes) ScheduleDeletion(ctx context.Context, id int, after *time.Time) error {
+	defer w.changed(id)
+	return w.DatabaseRepo.ScheduleDeletion(ctx, id, after)
+}
+
+// a scheduled run may delete any number of users
+func (w *writes) DeleteScheduledUsers(ctx context.Context, due time.Time) ([]int, error) {
+	defer w.purged()
+	return w.DatabaseRepo.DeleteScheduledUsers(ctx, due)
+}
+
+func (w *writes) RestoreUser(ctx context.Context, id int) error {
+	defer w.changed(id)
+	return w.DatabaseRepo.RestoreUser(ctx, id)
+}
+
+func (w *writes) ResetPassword(ctx context.Context, id int, password string) error {
+	defer w.changed(id)
+	return w.DatabaseRepo.ResetPassword(ctx, id, password)
+}
+
+func (w *writes) RehashPassword(ctx context.Context, id int, oldHash, password string) error {
+	defer w.changed(id)
+	return w.DatabaseRepo.RehashPassword(ctx, id, oldHash, password)
+}
+
+// the images calls change the user's profile picture
+
+func (w *writes) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	defer w.changed(i.UserID)
+	return w.DatabaseRepo.InsertUserImage(ctx, i)
+}
+
+func (w *writes) SetActiveUserImage(ctx context.Context, userID, imageID int) error {
+	defer w.changed(userID)
+	return w.DatabaseRepo.SetActiveUserImage(ctx, userID, imageID)
+}
+
+func (w *writes) DeleteUserImage(ctx context.Context, userID, imageID int) error {
+	defer w.changed(userID)
+	return w.DatabaseRepo.DeleteUserImage(ctx, userID, imageID)
+}
+
+// a user's permissions come from their roles
+
+func (w *writes) AssignRole(ctx context.Context, userID int, role string) error {
+	defer w.changed(userID)
+	return w.DatabaseRepo.AssignRole(ctx, userID, role)
+}
+
+func (w *writes) RevokeRole(ctx context.Context, userID int, role string) error {
+	defer w.changed(userID)
+	return w.DatabaseRepo.RevokeRole(ctx, userID, role)
+}
+
+// changing what a role grants changes every user with the role
+
+func (w *writes) GrantPermission(ctx context.Context, role, permission string) error {
+	defer w.purged()
+	return w.DatabaseRepo.GrantPermission(ctx, role, permission)
+}
+
+func (w *writes) RevokePermission(ctx context.Context, role, permission string) error {
+	defer w.purged()
+	return w.DatabaseRepo.RevokePermission(ctx, role, permission)
+}
+
+// WithTx keeps reporting the changes made by nested transactions.
+func (w *writes) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	return w.DatabaseRepo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		return fn(&writes{DatabaseRepo: tx, changed: w.changed, purged: w.purged})
+	})
+}
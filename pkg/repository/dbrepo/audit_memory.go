@@ -0,0 +1,101 @@
+package dbrepo
+
+import (
+	"context"
+	"maps"
+	"personal-projects/webapp/pkg/auditchain"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"time"
+)
+
+// InsertAuditEvent appends e to the audit log, chained to the event before it, and
+// returns its id. Events without a time happen now.
+func (m *MemoryDBRepo) InsertAuditEvent(ctx context.Context, e data.AuditEvent) (int, error) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC().Round(auditchain.Precision)
+	e.Changes = maps.Clone(e.Changes)
+
+	var newID int
+	err := m.write(ctx, func(d *memoryData) error {
+		e.PrevHash = ""
+		if n := len(d.auditEvents); n > 0 {
+			e.PrevHash = d.auditEvents[n-1].Hash
+		}
+		var err error
+		e.Hash, err = auditchain.Hash(e.PrevHash, e)
+		if err != nil {
+			return err
+		}
+
+		newID = d.nextAuditID
+		d.nextAuditID++
+		e.ID = newID
+		d.auditEvents = append(d.auditEvents, e)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AuditEvents returns the events that match filter, oldest first.
+func (m *MemoryDBRepo) AuditEvents(ctx context.Context, filter data.AuditFilter) ([]*data.AuditEvent, error) {
+	var events []*data.AuditEvent
+	err := m.read(ctx, func(d *memoryData) error {
+		for _, e := range d.auditEvents {
+			if filter.Limit > 0 && len(events) == filter.Limit {
+				break
+			}
+			if !auditMatches(e, filter) {
+				continue
+			}
+			event := e
+			event.Changes = maps.Clone(e.Changes)
+			events = append(events, &event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// LastAuditEvent returns the latest event, or repository.ErrNotFound if there are none.
+func (m *MemoryDBRepo) LastAuditEvent(ctx context.Context) (*data.AuditEvent, error) {
+	var event data.AuditEvent
+	err := m.read(ctx, func(d *memoryData) error {
+		n := len(d.auditEvents)
+		if n == 0 {
+			return repository.ErrNotFound
+		}
+		event = d.auditEvents[n-1]
+		event.Changes = maps.Clone(event.Changes)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+func auditMatches(e data.AuditEvent, filter data.AuditFilter) bool {
+	switch {
+	case filter.ActorID != 0 && e.ActorID != filter.ActorID,
+		filter.Action != "" && e.Action != filter.Action,
+		filter.TargetType != "" && e.TargetType != filter.TargetType,
+		filter.TargetID != "" && e.TargetID != filter.TargetID,
+		!filter.Since.IsZero() && e.Time.Before(filter.Since),
+		!filter.Until.IsZero() && !e.Time.Before(filter.Until),
+		e.ID <= filter.AfterID:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"personal-projects/webapp/pkg/auditchain"
+	"personal-projects/webapp/pkg/data"
+	"strings"
+	"time"
+)
+
+// InsertAuditEvent appends e to the audit log, chained to the event before it, and
+// returns its id. Events without a time happen now.
+func (m *sqlDBRepo) InsertAuditEvent(ctx context.Context, e data.AuditEvent) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC().Round(auditchain.Precision)
+
+	var changes []byte
+	if len(e.Changes) > 0 {
+		var err error
+		changes, err = json.Marshal(e.Changes)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var newID int
+	err := m.withTx(ctx, func(tx *sqlDBRepo) error {
+		// one writer at a time, so that no two events follow the same one; sqlite has
+		// one writer at a time anyway, and if another one writes between the select and
+		// the insert, the transaction fails to get the write lock and runs again
+		if lock := tx.dialect.lockAuditEvents; lock != "" {
+			_, err := tx.q().ExecContext(ctx, lock)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.q().QueryRowContext(ctx, `select hash from audit_events order by id desc limit 1`).Scan(&e.PrevHash)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		e.Hash, err = auditchain.Hash(e.PrevHash, e)
+		if err != nil {
+			return err
+		}
+
+		stmt := `insert into audit_events (occurred_at, actor_id, action, target_type, target_id, ip, user_agent, detail, changes, prev_hash, hash)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+
+		return tx.q().QueryRowContext(ctx, stmt,
+			e.Time,
+			e.ActorID,
+			e.Action,
+			e.TargetType,
+			e.TargetID,
+			e.IP,
+			e.UserAgent,
+			e.Detail,
+			changes,
+			e.PrevHash,
+			e.Hash,
+		).Scan(&newID)
+	})
+	if err != nil {
+		return 0, m.translate(err)
+	}
+
+	return newID, nil
+}
+
+// AuditEvents returns the events that match filter, oldest first.
+func (m *sqlDBRepo) AuditEvents(ctx context.Context, filter data.AuditFilter) ([]*data.AuditEvent, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	where, args := auditWhere(filter)
+	query := `select ` + auditColumns + ` from audit_events ` + where + ` order by id`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" limit %d", filter.Limit)
+	}
+
+	rows, err := m.q().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, m.translate(err)
+	}
+	defer rows.Close()
+
+	var events []*data.AuditEvent
+	for rows.Next() {
+		e, err := scanAuditEvent(rows.Scan)
+		if err != nil {
+			return nil, m.translate(err)
+		}
+		events = append(events, e)
+	}
+
+	return events, m.translate(rows.Err())
+}
+
+// LastAuditEvent returns the latest event, or repository.ErrNotFound if there are none.
+func (m *sqlDBRepo) LastAuditEvent(ctx context.Context) (*data.AuditEvent, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + auditColumns + ` from audit_events order by id desc limit 1`
+	e, err := scanAuditEvent(m.q().QueryRowContext(ctx, query).Scan)
+	if err != nil {
+		return nil, m.translate(err)
+	}
+	return e, nil
+}
+
+// auditColumns are the columns scanAuditEvent reads.
+const auditColumns = `id, occurred_at, actor_id, action, target_type, target_id, ip, user_agent, detail, changes, prev_hash, hash`
+
+// auditWhere turns filter into a where clause, with $n placeholders, and its
+// arguments. Both dialects understand it.
+func auditWhere(filter data.AuditFilter) (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.ActorID != 0 {
+		add("actor_id = $%d", filter.ActorID)
+	}
+	if filter.Action != "" {
+		add("action = $%d", filter.Action)
+	}
+	if filter.TargetType != "" {
+		add("target_type = $%d", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		add("target_id = $%d", filter.TargetID)
+	}
+	if !filter.Since.IsZero() {
+		add("occurred_at >= $%d", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		add("occurred_at < $%d", filter.Until.UTC())
+	}
+	if filter.AfterID != 0 {
+		add("id > $%d", filter.AfterID)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "where " + strings.Join(conds, " and "), args
+}
+
+// scanAuditEvent reads a row of auditColumns.
+func scanAuditEvent(scan func(dest ...any) error) (*data.AuditEvent, error) {
+	var e data.AuditEvent
+	var changes []byte
+	err := scan(
+		&e.ID,
+		&e.Time,
+		&e.ActorID,
+		&e.Action,
+		&e.TargetType,
+		&e.TargetID,
+		&e.IP,
+		&e.UserAgent,
+		&e.Detail,
+		&changes,
+		&e.PrevHash,
+		&e.Hash,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) > 0 {
+		err = json.Unmarshal(changes, &e.Changes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.Time = e.Time.UTC()
+	return &e, nil
+}
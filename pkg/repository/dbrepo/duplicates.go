@@ -0,0 +1,62 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+)
+
+// DuplicateEmail is a set of users whose email addresses are the same once case and
+// surrounding space are ignored.
+type DuplicateEmail struct {
+	Email string
+	Users []DuplicateEmailUser
+}
+
+// DuplicateEmailUser is one of the users sharing a DuplicateEmail.
+type DuplicateEmailUser struct {
+	ID        int
+	Email     string
+	FirstName string
+	LastName  string
+}
+
+// FindDuplicateEmails lists the users that stop the unique email index from being
+// created, so that they can be merged or renamed by hand first. The query is plain
+// enough to run on both Postgres and sqlite, before or after the migrations.
+func FindDuplicateEmails(ctx context.Context, db *sql.DB) ([]DuplicateEmail, error) {
+	query := `
+		select
+			lower(trim(u.email)), u.id, u.email, coalesce(u.first_name, ''), coalesce(u.last_name, '')
+		from
+			users u
+		where
+			lower(trim(u.email)) in (
+				select lower(trim(email)) from users group by lower(trim(email)) having count(*) > 1
+			)
+		order by 1, u.id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var duplicates []DuplicateEmail
+
+	for rows.Next() {
+		var email string
+		var user DuplicateEmailUser
+		err := rows.Scan(&email, &user.ID, &user.Email, &user.FirstName, &user.LastName)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(duplicates) == 0 || duplicates[len(duplicates)-1].Email != email {
+			duplicates = append(duplicates, DuplicateEmail{Email: email})
+		}
+		last := &duplicates[len(duplicates)-1]
+		last.Users = append(last.Users, user)
+	}
+
+	return duplicates, rows.Err()
+}
@@ -0,0 +1,77 @@
+package dbrepo
+
+import (
+	"context"
+	"path/filepath"
+	"personal-projects/webapp/pkg/migrations"
+	"testing"
+)
+
+func TestFindDuplicateEmails(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("could not open sqlite database: %s", err)
+	}
+	defer db.Close()
+
+	m, err := migrations.NewSQLite(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Up(ctx)
+	if err != nil {
+		t.Fatalf("could not migrate sqlite database: %s", err)
+	}
+
+	duplicates, err := FindDuplicateEmails(ctx, db)
+	if err != nil {
+		t.Fatalf("error finding duplicates: %s", err)
+	}
+	if len(duplicates) != 0 {
+		t.Errorf("expected no duplicates in a new database but got %v", duplicates)
+	}
+
+	// go back to before the unique index, when duplicates could be stored
+	steps := 0
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		steps++
+		if m.Migrations[i].Name == "unique_email" {
+			break
+		}
+	}
+	err = m.Down(ctx, steps)
+	if err != nil {
+		t.Fatalf("could not roll back the unique email index: %s", err)
+	}
+
+	_, err = db.ExecContext(ctx, `insert into users (first_name, last_name, email) values
+		('Jack', 'Smith', 'jack@smith.com'),
+		('Jill', 'Smith', 'jill@smith.com'),
+		('Jack', 'Smith', 'Jack@Smith.com '),
+		('Other', 'Admin', 'ADMIN@example.com')`)
+	if err != nil {
+		t.Fatalf("could not insert users: %s", err)
+	}
+
+	duplicates, err = FindDuplicateEmails(ctx, db)
+	if err != nil {
+		t.Fatalf("error finding duplicates: %s", err)
+	}
+	if len(duplicates) != 2 {
+		t.Fatalf("expected 2 duplicated addresses but got %d: %v", len(duplicates), duplicates)
+	}
+	if duplicates[0].Email != "admin@example.com" || len(duplicates[0].Users) != 2 || duplicates[0].Users[1].Email != "ADMIN@example.com" {
+		t.Errorf("unexpected first duplicate: %+v", duplicates[0])
+	}
+	if duplicates[1].Email != "jack@smith.com" || len(duplicates[1].Users) != 2 || duplicates[1].Users[0].ID >= duplicates[1].Users[1].ID {
+		t.Errorf("unexpected second duplicate: %+v", duplicates[1])
+	}
+
+	// and the migration refuses to run until they are sorted out
+	err = m.Up(ctx)
+	if err == nil {
+		t.Error("expected the unique email index migration to fail while there are duplicates")
+	}
+}
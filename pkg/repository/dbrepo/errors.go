@@ -0,0 +1,114 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"errors"
+	"personal-projects/webapp/pkg/repository"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"modernc.org/sqlite"
+)
+
+// expectRows returns repository.ErrNotFound if a statement did not change any rows.
+func expectRows(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+// translated reports whether err has already been turned into a repository error.
+func translated(err error) bool {
+	return errors.Is(err, repository.ErrNotFound) ||
+		errors.Is(err, repository.ErrDuplicateEmail) ||
+		errors.Is(err, repository.ErrConflict)
+}
+
+// constraintKind decides between ErrDuplicateEmail and ErrConflict for a unique
+// constraint, going by its name.
+func constraintKind(constraint string) error {
+	if strings.Contains(constraint, "email") {
+		return repository.ErrDuplicateEmail
+	}
+	return repository.ErrConflict
+}
+
+// pgError turns the errors Postgres reports into the ones every DatabaseRepo uses.
+// Anything else is returned as is.
+func pgError(err error) error {
+	if err == nil || translated(err) {
+		return err
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrNotFound
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	switch pgErr.Code {
+	case "23505": // unique_violation
+		return &repository.ConstraintError{Kind: constraintKind(pgErr.ConstraintName), Constraint: pgErr.ConstraintName, Err: err}
+	case "23503": // foreign_key_violation
+		return &repository.ConstraintError{Kind: repository.ErrNotFound, Constraint: pgErr.ConstraintName, Err: err}
+	case "23P01", "40001", "40P01": // exclusion_violation, serialization_failure, deadlock_detected
+		return &repository.ConstraintError{Kind: repository.ErrConflict, Constraint: pgErr.ConstraintName, Err: err}
+	}
+
+	return err
+}
+
+// sqlite result codes; the driver reports extended codes, which keep the primary
+// code in the low byte
+const (
+	sqliteBusy                 = 5
+	sqliteLocked               = 6
+	sqliteConstraint           = 19
+	sqliteConstraintForeignKey = 787
+	sqliteConstraintPrimaryKey = 1555
+	sqliteConstraintUnique     = 2067
+)
+
+// sqliteError turns the errors sqlite reports into the ones every DatabaseRepo uses.
+// Anything else is returned as is.
+func sqliteError(err error) error {
+	if err == nil || translated(err) {
+		return err
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrNotFound
+	}
+
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	switch sqliteErr.Code() & 0xff {
+	case sqliteBusy, sqliteLocked:
+		return &repository.ConstraintError{Kind: repository.ErrConflict, Err: err}
+	case sqliteConstraint:
+		// sqlite names the columns or index rather than the constraint, after the last colon
+		msg := sqliteErr.Error()
+		constraint := strings.TrimSpace(msg[strings.LastIndex(msg, ":")+1:])
+		if i := strings.LastIndex(constraint, " ("); i >= 0 {
+			constraint = constraint[:i]
+		}
+
+		switch sqliteErr.Code() {
+		case sqliteConstraintUnique, sqliteConstraintPrimaryKey:
+			return &repository.ConstraintError{Kind: constraintKind(constraint), Constraint: constraint, Err: err}
+		case sqliteConstraintForeignKey:
+			return &repository.ConstraintError{Kind: repository.ErrNotFound, Err: err}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,88 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"personal-projects/webapp/pkg/repository"
+	"testing"
+
+	"github.com/jackc/pgconn"
+)
+
+func Test_pgError(t *testing.T) {
+	var tests = []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"no rows", sql.ErrNoRows, repository.ErrNotFound},
+		{"wrapped no rows", fmt.Errorf("scanning: %w", sql.ErrNoRows), repository.ErrNotFound},
+		{"duplicate email", &pgconn.PgError{Code: "23505", ConstraintName: "users_email_idx"}, repository.ErrDuplicateEmail},
+		{"other unique violation", &pgconn.PgError{Code: "23505", ConstraintName: "user_images_user_id_active_idx"}, repository.ErrConflict},
+		{"foreign key violation", &pgconn.PgError{Code: "23503", ConstraintName: "user_images_user_id_fkey"}, repository.ErrNotFound},
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, repository.ErrConflict},
+		{"already translated", repository.ErrConflict, repository.ErrConflict},
+	}
+
+	for _, e := range tests {
+		err := pgError(e.err)
+		if !errors.Is(err, e.expected) {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, err)
+		}
+	}
+
+	// the driver's error is still there for anyone who wants the details
+	var pgErr *pgconn.PgError
+	if !errors.As(pgError(&pgconn.PgError{Code: "23505"}), &pgErr) {
+		t.Error("translated error does not wrap the *pgconn.PgError")
+	}
+
+	// and errors we know nothing about are left alone
+	other := errors.New("boom")
+	if pgError(other) != other || pgError(nil) != nil {
+		t.Error("untranslatable errors should be returned as they are")
+	}
+}
+
+func Test_sqliteError(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "errors.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.ExecContext(ctx, `
+		create table users (id integer primary key, email varchar(255) unique, name varchar(255) unique);
+		create table user_images (id integer primary key, user_id integer references users(id));
+		insert into users (id, email, name) values (1, 'a@example.com', 'a');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		stmt     string
+		expected error
+	}{
+		{"duplicate email", "insert into users (id, email) values (2, 'a@example.com')", repository.ErrDuplicateEmail},
+		{"other unique violation", "insert into users (id, name) values (2, 'a')", repository.ErrConflict},
+		{"duplicate primary key", "insert into users (id) values (1)", repository.ErrConflict},
+		{"foreign key violation", "insert into user_images (user_id) values (100)", repository.ErrNotFound},
+	}
+
+	for _, e := range tests {
+		_, err := db.ExecContext(ctx, e.stmt)
+		if !errors.Is(sqliteError(err), e.expected) {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, sqliteError(err))
+		}
+	}
+
+	err = db.QueryRowContext(ctx, "select id from users where id = 100").Scan(new(int))
+	if !errors.Is(sqliteError(err), repository.ErrNotFound) {
+		t.Errorf("no rows: expected %v but got %v", repository.ErrNotFound, sqliteError(err))
+	}
+}
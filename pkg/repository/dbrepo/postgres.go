@@ -0,0 +1,35 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgconn"
+)
+
+// PostgresDBRepo keeps users in Postgres.
+type PostgresDBRepo struct {
+	sqlDBRepo
+}
+
+// NewPostgresDBRepo returns a repository for the Postgres database db.
+func NewPostgresDBRepo(db *sql.DB) *PostgresDBRepo {
+	return &PostgresDBRepo{sqlDBRepo{DB: db, dialect: postgresDialect}}
+}
+
+var postgresDialect = &dialect{
+	translate:       pgError,
+	retryable:       pgRetryable,
+	forUpdate:       " for update",
+	lockAuditEvents: `lock table audit_events in share row exclusive mode`,
+}
+
+// pgRetryable reports whether err is a serialization failure or a deadlock.
+func pgRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// serialization_failure and deadlock_detected
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
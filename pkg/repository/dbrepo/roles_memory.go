@@ -0,0 +1,156 @@
+package dbrepo
+
+import (
+	"context"
+	"fmt"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"slices"
+	"sort"
+)
+
+// AllRoles returns every role, with the permissions it grants, sorted by name.
+func (m *MemoryDBRepo) AllRoles(ctx context.Context) ([]*data.Role, error) {
+	var roles []*data.Role
+	err := m.read(ctx, func(d *memoryData) error {
+		for _, r := range d.roles {
+			role := r
+			role.Permissions = slices.Clone(r.Permissions)
+			if role.Permissions == nil {
+				role.Permissions = []string{}
+			}
+			roles = append(roles, &role)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(roles, func(a, b int) bool {
+		return roles[a].Name < roles[b].Name
+	})
+
+	return roles, nil
+}
+
+// AllPermissions returns every permission there is, sorted by name.
+func (m *MemoryDBRepo) AllPermissions(ctx context.Context) ([]*data.Permission, error) {
+	var permissions []*data.Permission
+	err := m.read(ctx, func(d *memoryData) error {
+		for _, p := range d.permissions {
+			permission := p
+			permissions = append(permissions, &permission)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(permissions, func(a, b int) bool {
+		return permissions[a].Name < permissions[b].Name
+	})
+
+	return permissions, nil
+}
+
+// InsertRole creates a role that grants role.Permissions, and returns its id. It
+// returns repository.ErrConflict if there is already a role with the name, and
+// repository.ErrNotFound if one of the permissions doesn't exist.
+func (m *MemoryDBRepo) InsertRole(ctx context.Context, role data.Role) (int, error) {
+	var newID int
+	err := m.write(ctx, func(d *memoryData) error {
+		if _, exists := d.roles[role.Name]; exists {
+			return &repository.ConstraintError{
+				Kind:       repository.ErrConflict,
+				Constraint: "roles_name_key",
+				Err:        fmt.Errorf("a role named %s already exists", role.Name),
+			}
+		}
+		for _, p := range role.Permissions {
+			if _, ok := d.permissions[p]; !ok {
+				return repository.ErrNotFound
+			}
+		}
+
+		newID = d.nextRoleID
+		d.nextRoleID++
+		d.roles[role.Name] = data.Role{
+			ID:          newID,
+			Name:        role.Name,
+			Description: role.Description,
+			Permissions: sortedSet(role.Permissions),
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AssignRole gives a user a role; giving it again changes nothing. It returns
+// repository.ErrNotFound if there is no such user or role.
+func (m *MemoryDBRepo) AssignRole(ctx context.Context, userID int, role string) error {
+	return m.write(ctx, func(d *memoryData) error {
+		if _, ok := d.roles[role]; !ok {
+			return repository.ErrNotFound
+		}
+		if _, ok := d.users[userID]; !ok {
+			return repository.ErrNotFound
+		}
+		d.userRoles[userID] = sortedSet(append(d.userRoles[userID], role))
+		return nil
+	})
+}
+
+// RevokeRole takes a role away from a user. It returns repository.ErrNotFound if the
+// user doesn't have it.
+func (m *MemoryDBRepo) RevokeRole(ctx context.Context, userID int, role string) error {
+	return m.write(ctx, func(d *memoryData) error {
+		roles := d.userRoles[userID]
+		i := slices.Index(roles, role)
+		if i < 0 {
+			return repository.ErrNotFound
+		}
+		d.userRoles[userID] = slices.Delete(slices.Clone(roles), i, i+1)
+		return nil
+	})
+}
+
+// GrantPermission lets everyone with a role do something; granting it again changes
+// nothing. It returns repository.ErrNotFound if there is no such role or permission.
+func (m *MemoryDBRepo) GrantPermission(ctx context.Context, role, permission string) error {
+	return m.write(ctx, func(d *memoryData) error {
+		r, ok := d.roles[role]
+		if !ok {
+			return repository.ErrNotFound
+		}
+		if _, ok := d.permissions[permission]; !ok {
+			return repository.ErrNotFound
+		}
+		r.Permissions = sortedSet(append(slices.Clone(r.Permissions), permission))
+		d.roles[role] = r
+		return nil
+	})
+}
+
+// RevokePermission stops a role from granting a permission. It returns
+// repository.ErrNotFound if the role doesn't grant it.
+func (m *MemoryDBRepo) RevokePermission(ctx context.Context, role, permission string) error {
+	return m.write(ctx, func(d *memoryData) error {
+		r, ok := d.roles[role]
+		if !ok {
+			return repository.ErrNotFound
+		}
+		i := slices.Index(r.Permissions, permission)
+		if i < 0 {
+			return repository.ErrNotFound
+		}
+		r.Permissions = slices.Delete(slices.Clone(r.Permissions), i, i+1)
+		d.roles[role] = r
+		return nil
+	})
+}
@@ -0,0 +1,242 @@
+package dbrepo
+
+import (
+	"context"
+	"personal-projects/webapp/pkg/data"
+)
+
+// fillRoles sets the roles of users, and the permissions those roles grant.
+func (m *sqlDBRepo) fillRoles(ctx context.Context, users ...*data.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*data.User, len(users))
+	for _, u := range users {
+		u.Roles, u.Permissions = []string{}, []string{}
+		byID[u.ID] = u
+	}
+
+	// a single user is the common case, so only fetch everyone's when asked for everyone
+	where, args := "", []any{}
+	if len(users) == 1 {
+		where, args = "where ur.user_id = $1", []any{users[0].ID}
+	}
+
+	queries := []struct {
+		query string
+		add   func(u *data.User, name string)
+	}{
+		{`select ur.user_id, r.name from user_roles ur
+			join roles r on r.id = ur.role_id ` + where + ` order by r.name`,
+			func(u *data.User, name string) { u.Roles = append(u.Roles, name) }},
+		{`select distinct ur.user_id, p.name from user_roles ur
+			join role_permissions rp on rp.role_id = ur.role_id
+			join permissions p on p.id = rp.permission_id ` + where + ` order by p.name`,
+			func(u *data.User, name string) { u.Permissions = append(u.Permissions, name) }},
+	}
+
+	for _, q := range queries {
+		rows, err := m.q().QueryContext(ctx, q.query, args...)
+		if err != nil {
+			return m.translate(err)
+		}
+
+		for rows.Next() {
+			var userID int
+			var name string
+			err = rows.Scan(&userID, &name)
+			if err != nil {
+				rows.Close()
+				return m.translate(err)
+			}
+			if u, ok := byID[userID]; ok {
+				q.add(u, name)
+			}
+		}
+		rows.Close()
+
+		err = rows.Err()
+		if err != nil {
+			return m.translate(err)
+		}
+	}
+
+	return nil
+}
+
+// AllRoles returns every role, with the permissions it grants, sorted by name.
+func (m *sqlDBRepo) AllRoles(ctx context.Context) ([]*data.Role, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.q().QueryContext(ctx, `select id, name, description from roles order by name`)
+	if err != nil {
+		return nil, m.translate(err)
+	}
+	defer rows.Close()
+
+	var roles []*data.Role
+	byID := make(map[int]*data.Role)
+	for rows.Next() {
+		role := data.Role{Permissions: []string{}}
+		err := rows.Scan(&role.ID, &role.Name, &role.Description)
+		if err != nil {
+			return nil, m.translate(err)
+		}
+		roles = append(roles, &role)
+		byID[role.ID] = &role
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, m.translate(err)
+	}
+
+	query := `select rp.role_id, p.name from role_permissions rp
+		join permissions p on p.id = rp.permission_id order by p.name`
+
+	grants, err := m.q().QueryContext(ctx, query)
+	if err != nil {
+		return nil, m.translate(err)
+	}
+	defer grants.Close()
+
+	for grants.Next() {
+		var roleID int
+		var name string
+		err := grants.Scan(&roleID, &name)
+		if err != nil {
+			return nil, m.translate(err)
+		}
+		if role, ok := byID[roleID]; ok {
+			role.Permissions = append(role.Permissions, name)
+		}
+	}
+
+	return roles, m.translate(grants.Err())
+}
+
+// AllPermissions returns every permission there is, sorted by name.
+func (m *sqlDBRepo) AllPermissions(ctx context.Context) ([]*data.Permission, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.q().QueryContext(ctx, `select id, name, description from permissions order by name`)
+	if err != nil {
+		return nil, m.translate(err)
+	}
+	defer rows.Close()
+
+	var permissions []*data.Permission
+	for rows.Next() {
+		var p data.Permission
+		err := rows.Scan(&p.ID, &p.Name, &p.Description)
+		if err != nil {
+			return nil, m.translate(err)
+		}
+		permissions = append(permissions, &p)
+	}
+
+	return permissions, m.translate(rows.Err())
+}
+
+// InsertRole creates a role that grants role.Permissions, and returns its id. It
+// returns repository.ErrConflict if there is already a role with the name, and
+// repository.ErrNotFound if one of the permissions doesn't exist.
+func (m *sqlDBRepo) InsertRole(ctx context.Context, role data.Role) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+	err := m.withTx(ctx, func(tx *sqlDBRepo) error {
+		stmt := `insert into roles (name, description) values ($1, $2) returning id`
+		err := tx.q().QueryRowContext(ctx, stmt, role.Name, role.Description).Scan(&newID)
+		if err != nil {
+			return err
+		}
+
+		for _, permission := range role.Permissions {
+			err = tx.GrantPermission(ctx, role.Name, permission)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, m.translate(err)
+	}
+
+	return newID, nil
+}
+
+// AssignRole gives a user a role; giving it again changes nothing. It returns
+// repository.ErrNotFound if there is no such user or role.
+func (m *sqlDBRepo) AssignRole(ctx context.Context, userID int, role string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var roleID int
+	err := m.q().QueryRowContext(ctx, `select id from roles where name = $1`, role).Scan(&roleID)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	stmt := `insert into user_roles (user_id, role_id) values ($1, $2) on conflict do nothing`
+	_, err = m.q().ExecContext(ctx, stmt, userID, roleID)
+	return m.translate(err)
+}
+
+// RevokeRole takes a role away from a user. It returns repository.ErrNotFound if the
+// user doesn't have it.
+func (m *sqlDBRepo) RevokeRole(ctx context.Context, userID int, role string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `delete from user_roles where user_id = $1 and role_id = (select id from roles where name = $2)`
+	result, err := m.q().ExecContext(ctx, stmt, userID, role)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	return expectRows(result)
+}
+
+// GrantPermission lets everyone with a role do something; granting it again changes
+// nothing. It returns repository.ErrNotFound if there is no such role or permission.
+func (m *sqlDBRepo) GrantPermission(ctx context.Context, role, permission string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var roleID, permissionID int
+	err := m.q().QueryRowContext(ctx, `select id from roles where name = $1`, role).Scan(&roleID)
+	if err != nil {
+		return m.translate(err)
+	}
+	err = m.q().QueryRowContext(ctx, `select id from permissions where name = $1`, permission).Scan(&permissionID)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	stmt := `insert into role_permissions (role_id, permission_id) values ($1, $2) on conflict do nothing`
+	_, err = m.q().ExecContext(ctx, stmt, roleID, permissionID)
+	return m.translate(err)
+}
+
+// RevokePermission stops a role from granting a permission. It returns
+// repository.ErrNotFound if the role doesn't grant it.
+func (m *sqlDBRepo) RevokePermission(ctx context.Context, role, permission string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `delete from role_permissions
+		where role_id = (select id from roles where name = $1)
+		and permission_id = (select id from permissions where name = $2)`
+	result, err := m.q().ExecContext(ctx, stmt, role, permission)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	return expectRows(result)
+}
@@ -0,0 +1,62 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+
+	// also registers the "sqlite" driver
+	"modernc.org/sqlite"
+)
+
+// SQLiteDBRepo keeps everything in a single sqlite file, for development and demos.
+// The database should be opened with OpenSQLite, so that foreign keys are enforced
+// and deleting a user also deletes their images.
+type SQLiteDBRepo struct {
+	sqlDBRepo
+}
+
+// NewSQLiteDBRepo returns a repository for the sqlite database db.
+func NewSQLiteDBRepo(db *sql.DB) *SQLiteDBRepo {
+	return &SQLiteDBRepo{sqlDBRepo{DB: db, dialect: sqliteDialect}}
+}
+
+var sqliteDialect = &dialect{
+	translate: sqliteError,
+	retryable: sqliteRetryable,
+}
+
+// OpenSQLite opens (creating it if needed) the sqlite database in the file at path,
+// with the settings SQLiteDBRepo relies on: foreign keys are enforced, writers wait
+// for each other instead of failing straight away, and times are stored in a format
+// sqlite's own date functions understand.
+func OpenSQLite(path string) (*sql.DB, error) {
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Set("_time_format", "sqlite")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return db, nil
+}
+
+// sqliteRetryable reports whether err means the transaction could not get hold of
+// the database.
+func sqliteRetryable(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code() & 0xff
+	return code == sqliteBusy || code == sqliteLocked
+}
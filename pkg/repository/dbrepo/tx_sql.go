@@ -0,0 +1,112 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"personal-projects/webapp/pkg/repository"
+	"time"
+)
+
+// maxTxAttempts is how many times WithTx runs a transaction that keeps losing races
+// with other ones.
+const maxTxAttempts = 3
+
+// querier is implemented by both *sql.DB and *sql.Tx, so that repository methods
+// work the same inside and outside a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// q returns the transaction this repository is bound to, or the database if there is none.
+func (m *sqlDBRepo) q() querier {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+// WithTx runs fn in a transaction. Every method called on the repository passed to
+// fn is part of that transaction, which is committed if fn returns nil and rolled
+// back otherwise. Calling WithTx on a repository that is already in a transaction
+// creates a savepoint, so that an inner failure only undoes the inner work. A top
+// level transaction that loses a race with another one, by a serialization failure
+// or a deadlock in Postgres, or by not getting the write lock in sqlite, is retried,
+// so fn must be safe to run more than once; if it still fails, the error matches
+// repository.ErrConflict.
+func (m *sqlDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	return m.translate(m.withTx(ctx, func(tx *sqlDBRepo) error {
+		return fn(tx)
+	}))
+}
+
+func (m *sqlDBRepo) withTx(ctx context.Context, fn func(tx *sqlDBRepo) error) error {
+	if m.tx != nil {
+		return m.savepoint(ctx, fn)
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = m.runTx(ctx, fn)
+		if err == nil || !m.dialect.retryable(err) {
+			return err
+		}
+
+		// back off a little before trying again, unless the caller has given up
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		}
+	}
+
+	return err
+}
+
+// runTx runs fn in a new transaction.
+func (m *sqlDBRepo) runTx(ctx context.Context, fn func(tx *sqlDBRepo) error) error {
+	tx, err := m.DB.BeginTx(ctx, m.TxOptions)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	txRepo := *m
+	txRepo.tx = tx
+	txRepo.depth = 1
+
+	err = fn(&txRepo)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// savepoint runs fn inside a savepoint of the current transaction.
+func (m *sqlDBRepo) savepoint(ctx context.Context, fn func(tx *sqlDBRepo) error) error {
+	name := fmt.Sprintf("sp_%d", m.depth)
+
+	_, err := m.tx.ExecContext(ctx, "savepoint "+name)
+	if err != nil {
+		return err
+	}
+
+	inner := *m
+	inner.depth = m.depth + 1
+
+	err = fn(&inner)
+	if err != nil {
+		_, rollbackErr := m.tx.ExecContext(ctx, "rollback to savepoint "+name)
+		if rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+		return err
+	}
+
+	_, err = m.tx.ExecContext(ctx, "release savepoint "+name)
+	return err
+}
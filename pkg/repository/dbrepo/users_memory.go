@@ -0,0 +1,910 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fixtures is the content a MemoryDBRepo is seeded with. Passwords are stored as
+// given, so they should already be hashes data.Passwords understands, just like the
+// rows in sql/users.sql.
+// Users are given the roles named in their Roles field.
+type Fixtures struct {
+	Users       []data.User
+	Images      []data.UserImage
+	Permissions []data.Permission
+	Roles       []data.Role
+}
+
+// TestFixtures returns the data the web and api tests expect: an admin user with id 1
+// and password "secret", whose profile picture is img.png, and the admin role and
+// permissions the migrations create.
+func TestFixtures() Fixtures {
+	now := time.Now()
+	return Fixtures{
+		Users: []data.User{
+			{
+				ID:               1,
+				FirstName:        "Admin",
+				LastName:         "User",
+				Email:            "admin@example.com",
+				Password:         "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK",
+				AvatarVisibility: data.AvatarPublic,
+				Version:          1,
+				CreatedAt:        now,
+				UpdatedAt:        now,
+				Roles:            []string{data.RoleAdmin},
+			},
+		},
+		Images: []data.UserImage{
+			{ID: 1, UserID: 1, FileName: "img.png", IsActive: true, CreatedAt: now, UpdatedAt: now},
+		},
+		Permissions: data.KnownPermissions,
+		Roles:       []data.Role{adminRole()},
+	}
+}
+
+// adminRole is the role the migrations turn is_admin into.
+func adminRole() data.Role {
+	role := data.Role{Name: data.RoleAdmin, Description: "Can do everything"}
+	for _, p := range data.KnownPermissions {
+		role.Permissions = append(role.Permissions, p.Name)
+	}
+	return role
+}
+
+// memoryData is everything a MemoryDBRepo stores.
+type memoryData struct {
+	users       map[int]data.User
+	images      map[int]data.UserImage
+	nextUserID  int
+	nextImageID int
+
+	// roles and permissions are keyed by name; the users' own Roles and
+	// Permissions fields are left empty, and filled in from userRoles when read
+	permissions      map[string]data.Permission
+	roles            map[string]data.Role
+	userRoles        map[int][]string
+	nextRoleID       int
+	nextPermissionID int
+
+	// auditEvents are in the order they were inserted, which is also id order
+	auditEvents []data.AuditEvent
+	nextAuditID int
+}
+
+func newMemoryData() *memoryData {
+	return &memoryData{
+		users:            make(map[int]data.User),
+		images:           make(map[int]data.UserImage),
+		nextUserID:       1,
+		nextImageID:      1,
+		permissions:      make(map[string]data.Permission),
+		roles:            make(map[string]data.Role),
+		userRoles:        make(map[int][]string),
+		nextRoleID:       1,
+		nextPermissionID: 1,
+		nextAuditID:      1,
+	}
+}
+
+func (d *memoryData) clone() *memoryData {
+	c := &memoryData{
+		users:            make(map[int]data.User, len(d.users)),
+		images:           make(map[int]data.UserImage, len(d.images)),
+		nextUserID:       d.nextUserID,
+		nextImageID:      d.nextImageID,
+		permissions:      make(map[string]data.Permission, len(d.permissions)),
+		roles:            make(map[string]data.Role, len(d.roles)),
+		userRoles:        make(map[int][]string, len(d.userRoles)),
+		nextRoleID:       d.nextRoleID,
+		nextPermissionID: d.nextPermissionID,
+		// events are never changed, so they can be shared
+		auditEvents: slices.Clip(d.auditEvents),
+		nextAuditID: d.nextAuditID,
+	}
+	for id, u := range d.users {
+		c.users[id] = u
+	}
+	for id, i := range d.images {
+		c.images[id] = i
+	}
+	for name, p := range d.permissions {
+		c.permissions[name] = p
+	}
+	for name, r := range d.roles {
+		r.Permissions = slices.Clone(r.Permissions)
+		c.roles[name] = r
+	}
+	for id, roles := range d.userRoles {
+		c.userRoles[id] = slices.Clone(roles)
+	}
+	return c
+}
+
+// MemoryDBRepo keeps users and images in memory. It behaves like PostgresDBRepo,
+// constraints included, which makes it suitable for handler tests. It is safe for
+// concurrent use; the zero value is an empty database.
+type MemoryDBRepo struct {
+	mu   sync.RWMutex
+	data *memoryData
+}
+
+// NewMemoryDBRepo returns a MemoryDBRepo seeded with f.
+func NewMemoryDBRepo(f Fixtures) (*MemoryDBRepo, error) {
+	m := &MemoryDBRepo{}
+	err := m.Seed(f)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Seed replaces everything in the repository with f. Users, images, roles and
+// permissions without an id are given the next free one, and users without a
+// version start at 1.
+func (m *MemoryDBRepo) Seed(f Fixtures) error {
+	d := newMemoryData()
+
+	for _, p := range f.Permissions {
+		if p.ID == 0 {
+			p.ID = d.nextPermissionID
+		}
+		if _, exists := d.permissions[p.Name]; exists {
+			return fmt.Errorf("duplicate permission %s", p.Name)
+		}
+		d.permissions[p.Name] = p
+		if p.ID >= d.nextPermissionID {
+			d.nextPermissionID = p.ID + 1
+		}
+	}
+
+	for _, r := range f.Roles {
+		if r.ID == 0 {
+			r.ID = d.nextRoleID
+		}
+		if _, exists := d.roles[r.Name]; exists {
+			return fmt.Errorf("duplicate role %s", r.Name)
+		}
+		for _, p := range r.Permissions {
+			if _, ok := d.permissions[p]; !ok {
+				return fmt.Errorf("role %s grants permission %s, which does not exist", r.Name, p)
+			}
+		}
+		r.Permissions = sortedSet(r.Permissions)
+		d.roles[r.Name] = r
+		if r.ID >= d.nextRoleID {
+			d.nextRoleID = r.ID + 1
+		}
+	}
+
+	for _, u := range f.Users {
+		if u.ID == 0 {
+			u.ID = d.nextUserID
+		}
+		if _, exists := d.users[u.ID]; exists {
+			return fmt.Errorf("duplicate user id %d", u.ID)
+		}
+		if u.DeletedAt == nil && d.emailTaken(u.Email, 0) {
+			return fmt.Errorf("duplicate email address %s", u.Email)
+		}
+		if u.AvatarVisibility == "" {
+			u.AvatarVisibility = data.AvatarPublic
+		}
+		if u.Version == 0 {
+			u.Version = 1
+		}
+		u.ProfilePic = data.UserImage{}
+		for _, r := range u.Roles {
+			if _, ok := d.roles[r]; !ok {
+				return fmt.Errorf("user %d has role %s, which does not exist", u.ID, r)
+			}
+		}
+		if len(u.Roles) > 0 {
+			d.userRoles[u.ID] = sortedSet(u.Roles)
+		}
+		u.Roles, u.Permissions = nil, nil
+		d.users[u.ID] = u
+		if u.ID >= d.nextUserID {
+			d.nextUserID = u.ID + 1
+		}
+	}
+
+	for _, i := range f.Images {
+		if i.ID == 0 {
+			i.ID = d.nextImageID
+		}
+		if _, exists := d.images[i.ID]; exists {
+			return fmt.Errorf("duplicate image id %d", i.ID)
+		}
+		if _, ok := d.users[i.UserID]; !ok {
+			return fmt.Errorf("image %d belongs to user %d, who does not exist", i.ID, i.UserID)
+		}
+		if i.IsActive && d.activeImage(i.UserID) != nil {
+			return fmt.Errorf("user %d has more than one active image", i.UserID)
+		}
+		d.images[i.ID] = i
+		if i.ID >= d.nextImageID {
+			d.nextImageID = i.ID + 1
+		}
+	}
+
+	m.mu.Lock()
+	m.data = d
+	m.mu.Unlock()
+
+	return nil
+}
+
+// read runs fn with the data locked for reading, unless ctx is already done.
+func (m *MemoryDBRepo) read(ctx context.Context, fn func(d *memoryData) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.data == nil {
+		return fn(newMemoryData())
+	}
+	return fn(m.data)
+}
+
+// write runs fn with the data locked for writing, unless ctx is already done.
+func (m *MemoryDBRepo) write(ctx context.Context, fn func(d *memoryData) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		m.data = newMemoryData()
+	}
+	return fn(m.data)
+}
+
+func (m *MemoryDBRepo) Connection() *sql.DB {
+	return nil
+}
+
+// activeImage returns the user's active image, if they have one.
+func (d *memoryData) activeImage(userID int) *data.UserImage {
+	for _, i := range d.images {
+		if i.UserID == userID && i.IsActive {
+			return &i
+		}
+	}
+	return nil
+}
+
+// newestImage returns the user's most recently uploaded image, if they have one.
+func (d *memoryData) newestImage(userID int) *data.UserImage {
+	images := d.userImages(userID)
+	if len(images) == 0 {
+		return nil
+	}
+	return images[0]
+}
+
+// userImages returns copies of the user's images, newest first.
+func (d *memoryData) userImages(userID int) []*data.UserImage {
+	var images []*data.UserImage
+	for _, i := range d.images {
+		if i.UserID == userID {
+			image := i
+			images = append(images, &image)
+		}
+	}
+	sort.Slice(images, func(a, b int) bool {
+		if !images[a].CreatedAt.Equal(images[b].CreatedAt) {
+			return images[a].CreatedAt.After(images[b].CreatedAt)
+		}
+		return images[a].ID > images[b].ID
+	})
+	return images
+}
+
+// emailTaken reports whether a live user other than exceptID has the address,
+// ignoring case, as the unique index on lower(email) does.
+func (d *memoryData) emailTaken(email string, exceptID int) bool {
+	for _, u := range d.users {
+		if u.ID != exceptID && u.DeletedAt == nil && strings.EqualFold(u.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// liveUser returns the user with the id, unless there is none or they have been deleted.
+func (d *memoryData) liveUser(id int) (data.User, bool) {
+	u, ok := d.users[id]
+	if !ok || u.DeletedAt != nil {
+		return data.User{}, false
+	}
+	return u, true
+}
+
+// user returns a copy of a user with their profile picture, roles and permissions
+// filled in, as GetUser does.
+func (d *memoryData) user(u data.User) *data.User {
+	if i := d.activeImage(u.ID); i != nil {
+		u.ProfilePic = data.UserImage{ID: i.ID, FileName: i.FileName}
+	} else {
+		u.ProfilePic = data.UserImage{}
+	}
+	u.DeleteAfter = copyTime(u.DeleteAfter)
+	d.fillRoles(&u)
+	return &u
+}
+
+// copyTime returns a copy of t, so that callers can't change what is stored.
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// fillRoles sets the user's roles, and the permissions those roles grant.
+func (d *memoryData) fillRoles(u *data.User) {
+	u.Roles = append([]string{}, d.userRoles[u.ID]...)
+
+	var permissions []string
+	for _, r := range u.Roles {
+		permissions = append(permissions, d.roles[r].Permissions...)
+	}
+	u.Permissions = sortedSet(permissions)
+}
+
+// sortedSet returns a sorted copy of names, without duplicates. It is never nil.
+func sortedSet(names []string) []string {
+	set := append([]string{}, names...)
+	slices.Sort(set)
+	return slices.Compact(set)
+}
+
+// AllUsers returns all users, except deleted ones, as a slice of *data.User
+func (m *MemoryDBRepo) AllUsers(ctx context.Context) ([]*data.User, error) {
+	var users []*data.User
+	err := m.read(ctx, func(d *memoryData) error {
+		for _, u := range d.users {
+			if u.DeletedAt != nil {
+				continue
+			}
+			user := u
+			user.ProfilePic = data.UserImage{}
+			user.DeleteAfter = copyTime(u.DeleteAfter)
+			d.fillRoles(&user)
+			users = append(users, &user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(users, func(a, b int) bool {
+		if users[a].LastName != users[b].LastName {
+			return users[a].LastName < users[b].LastName
+		}
+		return users[a].ID < users[b].ID
+	})
+
+	return users, nil
+}
+
+// SearchUsers returns a page of the users, except deleted ones, whose name or email
+// address contains q, ignoring case, sorted by last name; and how many there are in
+// all. An empty q matches everyone.
+func (m *MemoryDBRepo) SearchUsers(ctx context.Context, q string, limit, offset int) ([]*data.User, int, error) {
+	users, err := m.AllUsers(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	q = strings.ToLower(q)
+	var found []*data.User
+	for _, u := range users {
+		if strings.Contains(strings.ToLower(u.Email), q) || strings.Contains(strings.ToLower(u.FirstName+" "+u.LastName), q) {
+			found = append(found, u)
+		}
+	}
+
+	start := min(offset, len(found))
+	end := min(start+limit, len(found))
+	return found[start:end], len(found), nil
+}
+
+// GetUser returns one user by id, or repository.ErrNotFound
+func (m *MemoryDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	var user *data.User
+	err := m.read(ctx, func(d *memoryData) error {
+		u, ok := d.liveUser(id)
+		if !ok {
+			return repository.ErrNotFound
+		}
+		user = d.user(u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GetUserByEmail returns one user by email address, ignoring case, or repository.ErrNotFound
+func (m *MemoryDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	email, err := data.NormalizeEmail(email)
+	if err != nil {
+		// nobody can have signed up with it
+		return nil, repository.ErrNotFound
+	}
+
+	var user *data.User
+	err = m.read(ctx, func(d *memoryData) error {
+		for _, u := range d.users {
+			if u.DeletedAt == nil && strings.ToLower(u.Email) == email {
+				user = d.user(u)
+				return nil
+			}
+		}
+		return repository.ErrNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// UpdateUser updates one user in the database, as long as it is still at u.Version.
+// It returns repository.ErrModified if the user has changed since then,
+// repository.ErrNotFound if there is no such user, and data.ErrInvalidEmail or
+// repository.ErrDuplicateEmail if the new address can't be used.
+func (m *MemoryDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+	email, err := data.NormalizeEmail(u.Email)
+	if err != nil {
+		return err
+	}
+
+	return m.write(ctx, func(d *memoryData) error {
+		existing, ok := d.liveUser(u.ID)
+		if !ok {
+			return repository.ErrNotFound
+		}
+		if existing.Version != u.Version {
+			return repository.ErrModified
+		}
+		if d.emailTaken(email, u.ID) {
+			return &repository.ConstraintError{
+				Kind:       repository.ErrDuplicateEmail,
+				Constraint: "users_email_lower_live_idx",
+				Err:        fmt.Errorf("a user with email address %s already exists", email),
+			}
+		}
+		existing.Email = email
+		existing.FirstName = u.FirstName
+		existing.LastName = u.LastName
+		existing.UpdatedAt = time.Now()
+		existing.Version++
+		d.users[u.ID] = existing
+		return nil
+	})
+}
+
+// DeleteUser marks one user as deleted, by id, as long as they are still at version.
+// They are left out of everything but DeletedUsers from then on, and keep their
+// images until PurgeDeletedUsers removes them for good. Any deletion they had
+// scheduled is settled. It returns repository.ErrModified if the user has changed
+// since, and repository.ErrNotFound if there is no such user.
+func (m *MemoryDBRepo) DeleteUser(ctx context.Context, id, version int) error {
+	return m.write(ctx, func(d *memoryData) error {
+		u, ok := d.liveUser(id)
+		if !ok {
+			return repository.ErrNotFound
+		}
+		if u.Version != version {
+			return repository.ErrModified
+		}
+		d.deleteUser(u)
+		return nil
+	})
+}
+
+// deleteUser marks u as deleted, as DeleteUser does.
+func (d *memoryData) deleteUser(u data.User) {
+	now := time.Now().UTC()
+	u.DeletedAt = &now
+	u.DeleteAfter = nil
+	u.UpdatedAt = now
+	u.Version++
+	d.users[u.ID] = u
+}
+
+// ScheduleDeletion sets when DeleteScheduledUsers will delete a user; nil calls
+// the deletion off. It returns repository.ErrNotFound if there is no such user.
+func (m *MemoryDBRepo) ScheduleDeletion(ctx context.Context, id int, after *time.Time) error {
+	return m.write(ctx, func(d *memoryData) error {
+		u, ok := d.liveUser(id)
+		if !ok {
+			return repository.ErrNotFound
+		}
+		u.DeleteAfter = copyTime(after)
+		if u.DeleteAfter != nil {
+			*u.DeleteAfter = u.DeleteAfter.UTC()
+		}
+		u.UpdatedAt = time.Now()
+		u.Version++
+		d.users[id] = u
+		return nil
+	})
+}
+
+// DeleteScheduledUsers deletes the users whose deletion was scheduled for due or
+// earlier, as DeleteUser would, and returns their ids in order.
+func (m *MemoryDBRepo) DeleteScheduledUsers(ctx context.Context, due time.Time) ([]int, error) {
+	var ids []int
+	err := m.write(ctx, func(d *memoryData) error {
+		for id, u := range d.users {
+			if u.DeletedAt != nil || u.DeleteAfter == nil || u.DeleteAfter.After(due) {
+				continue
+			}
+			d.deleteUser(u)
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// DeletedUsers returns the users that have been deleted but not purged, most
+// recently deleted first.
+func (m *MemoryDBRepo) DeletedUsers(ctx context.Context) ([]*data.User, error) {
+	var users []*data.User
+	err := m.read(ctx, func(d *memoryData) error {
+		for _, u := range d.users {
+			if u.DeletedAt == nil {
+				continue
+			}
+			user := u
+			deletedAt := *u.DeletedAt
+			user.DeletedAt = &deletedAt
+			user.ProfilePic = data.UserImage{}
+			d.fillRoles(&user)
+			users = append(users, &user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(users, func(a, b int) bool {
+		if !users[a].DeletedAt.Equal(*users[b].DeletedAt) {
+			return users[a].DeletedAt.After(*users[b].DeletedAt)
+		}
+		return users[a].ID > users[b].ID
+	})
+
+	return users, nil
+}
+
+// RestoreUser brings back a deleted user, images and all. It returns
+// repository.ErrNotFound if there is no such deleted user, and
+// repository.ErrDuplicateEmail if someone else has their address by now.
+func (m *MemoryDBRepo) RestoreUser(ctx context.Context, id int) error {
+	return m.write(ctx, func(d *memoryData) error {
+		u, ok := d.users[id]
+		if !ok || u.DeletedAt == nil {
+			return repository.ErrNotFound
+		}
+		if d.emailTaken(u.Email, id) {
+			return &repository.ConstraintError{
+				Kind:       repository.ErrDuplicateEmail,
+				Constraint: "users_email_lower_live_idx",
+				Err:        fmt.Errorf("a user with email address %s already exists", u.Email),
+			}
+		}
+		u.DeletedAt = nil
+		u.UpdatedAt = time.Now()
+		u.Version++
+		d.users[id] = u
+		return nil
+	})
+}
+
+// PurgeDeletedUsers removes the users deleted before deletedBefore for good, along
+// with their images, and returns them with the file names of those images.
+func (m *MemoryDBRepo) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) ([]data.PurgedUser, error) {
+	var purged []data.PurgedUser
+	err := m.write(ctx, func(d *memoryData) error {
+		for id, u := range d.users {
+			if u.DeletedAt == nil || !u.DeletedAt.Before(deletedBefore) {
+				continue
+			}
+
+			p := data.PurgedUser{ID: id}
+			images := d.userImages(id)
+			for i := len(images) - 1; i >= 0; i-- {
+				p.FileNames = append(p.FileNames, images[i].FileName)
+				delete(d.images, images[i].ID)
+			}
+			purged = append(purged, p)
+
+			delete(d.users, id)
+			delete(d.userRoles, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(purged, func(a, b int) bool {
+		return purged[a].ID < purged[b].ID
+	})
+
+	return purged, nil
+}
+
+// UpdateAvatarVisibility changes who may see a user's profile picture, as long as
+// they are still at version. It returns repository.ErrModified if the user has
+// changed since, and repository.ErrNotFound if there is no such user.
+func (m *MemoryDBRepo) UpdateAvatarVisibility(ctx context.Context, userID int, visibility string, version int) error {
+	return m.write(ctx, func(d *memoryData) error {
+		u, ok := d.liveUser(userID)
+		if !ok {
+			return repository.ErrNotFound
+		}
+		if u.Version != version {
+			return repository.ErrModified
+		}
+		u.AvatarVisibility = visibility
+		u.UpdatedAt = time.Now()
+		u.Version++
+		d.users[userID] = u
+		return nil
+	})
+}
+
+// InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
+// The email address is normalized first; data.ErrInvalidEmail or
+// repository.ErrDuplicateEmail are returned if it can't be used.
+func (m *MemoryDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+	email, err := data.NormalizeEmail(user.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := data.Passwords.Hash(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	err = m.write(ctx, func(d *memoryData) error {
+		if d.emailTaken(email, 0) {
+			return &repository.ConstraintError{
+				Kind:       repository.ErrDuplicateEmail,
+				Constraint: "users_email_lower_live_idx",
+				Err:        fmt.Errorf("a user with email address %s already exists", email),
+			}
+		}
+		newID = d.nextUserID
+		d.nextUserID++
+		d.users[newID] = data.User{
+			ID:               newID,
+			Email:            email,
+			FirstName:        user.FirstName,
+			LastName:         user.LastName,
+			Password:         hashedPassword,
+			AvatarVisibility: data.AvatarPublic,
+			Version:          1,
+			CreatedAt:        time.Now(),
+			UpdatedAt:        time.Now(),
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// ResetPassword is the method we will use to change a user's password. It returns
+// repository.ErrNotFound if there is no such user.
+func (m *MemoryDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+	hashedPassword, err := data.Passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	return m.write(ctx, func(d *memoryData) error {
+		u, ok := d.liveUser(id)
+		if !ok {
+			return repository.ErrNotFound
+		}
+		u.Password = hashedPassword
+		u.Version++
+		d.users[id] = u
+		return nil
+	})
+}
+
+// RehashPassword replaces the user's password hash with a new one, made with the
+// current data.Passwords hasher, as long as the stored hash is still oldHash. Unlike
+// ResetPassword it leaves the user's version alone. It returns
+// repository.ErrModified if the hash has changed, and repository.ErrNotFound if
+// there is no such user.
+func (m *MemoryDBRepo) RehashPassword(ctx context.Context, id int, oldHash, password string) error {
+	hashedPassword, err := data.Passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	return m.write(ctx, func(d *memoryData) error {
+		u, ok := d.liveUser(id)
+		if !ok {
+			return repository.ErrNotFound
+		}
+		if u.Password != oldHash {
+			return repository.ErrModified
+		}
+		u.Password = hashedPassword
+		d.users[id] = u
+		return nil
+	})
+}
+
+// InsertUserImage inserts a user profile image, and makes it the user's active image.
+// It returns repository.ErrNotFound if there is no such user.
+func (m *MemoryDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	var newID int
+	err := m.write(ctx, func(d *memoryData) error {
+		if _, ok := d.users[i.UserID]; !ok {
+			return &repository.ConstraintError{
+				Kind:       repository.ErrNotFound,
+				Constraint: "user_images_user_id_fkey",
+				Err:        fmt.Errorf("user %d does not exist", i.UserID),
+			}
+		}
+
+		if active := d.activeImage(i.UserID); active != nil {
+			active.IsActive = false
+			active.UpdatedAt = time.Now()
+			d.images[active.ID] = *active
+		}
+
+		newID = d.nextImageID
+		d.nextImageID++
+		d.images[newID] = data.UserImage{
+			ID:        newID,
+			UserID:    i.UserID,
+			FileName:  i.FileName,
+			IsActive:  true,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AllUserImages returns every profile image a user has uploaded, newest first, or
+// none if the user has been deleted.
+func (m *MemoryDBRepo) AllUserImages(ctx context.Context, userID int) ([]*data.UserImage, error) {
+	var images []*data.UserImage
+	err := m.read(ctx, func(d *memoryData) error {
+		if _, ok := d.liveUser(userID); !ok {
+			return nil
+		}
+		images = d.userImages(userID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// SetActiveUserImage makes one of a user's previously uploaded images their
+// profile picture. It returns repository.ErrNotFound if the image does not belong to the user.
+func (m *MemoryDBRepo) SetActiveUserImage(ctx context.Context, userID, imageID int) error {
+	return m.write(ctx, func(d *memoryData) error {
+		image, ok := d.images[imageID]
+		if !ok || image.UserID != userID {
+			return repository.ErrNotFound
+		}
+
+		if active := d.activeImage(userID); active != nil {
+			active.IsActive = false
+			active.UpdatedAt = time.Now()
+			d.images[active.ID] = *active
+		}
+
+		image.IsActive = true
+		image.UpdatedAt = time.Now()
+		d.images[imageID] = image
+		return nil
+	})
+}
+
+// DeleteUserImage deletes one of a user's images. If the deleted image was the
+// active one, the most recently uploaded remaining image becomes active. It returns
+// repository.ErrNotFound if the image does not belong to the user.
+func (m *MemoryDBRepo) DeleteUserImage(ctx context.Context, userID, imageID int) error {
+	return m.write(ctx, func(d *memoryData) error {
+		image, ok := d.images[imageID]
+		if !ok || image.UserID != userID {
+			return repository.ErrNotFound
+		}
+		delete(d.images, imageID)
+
+		if image.IsActive {
+			if newest := d.newestImage(userID); newest != nil {
+				newest.IsActive = true
+				newest.UpdatedAt = time.Now()
+				d.images[newest.ID] = *newest
+			}
+		}
+		return nil
+	})
+}
+
+// CountUserImagesByFileName returns how many images, of any user, deleted or not,
+// are stored in the file fileName, so that the file is only removed once none is.
+func (m *MemoryDBRepo) CountUserImagesByFileName(ctx context.Context, fileName string) (int, error) {
+	var count int
+	err := m.read(ctx, func(d *memoryData) error {
+		for _, image := range d.images {
+			if image.FileName == fileName {
+				count++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// WithTx runs fn against a copy of the data, which replaces the original if fn
+// returns nil. Everyone else waits until fn is done, so transactions are serializable
+// and never need to be retried. Nested calls work like savepoints.
+func (m *MemoryDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	return m.write(ctx, func(d *memoryData) error {
+		tx := &MemoryDBRepo{data: d.clone()}
+
+		err := fn(tx)
+		if err != nil {
+			return err
+		}
+
+		*d = *tx.data
+		return nil
+	})
+}
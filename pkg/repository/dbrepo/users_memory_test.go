@@ -0,0 +1,144 @@
+package dbrepo
+
+import (
+	"context"
+	"errors"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"personal-projects/webapp/pkg/repository/repositorytest"
+	"sync"
+	"testing"
+)
+
+func TestMemoryDBRepoConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.DatabaseRepo {
+		repo, err := NewMemoryDBRepo(Fixtures{Permissions: data.KnownPermissions, Roles: []data.Role{adminRole()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	})
+}
+
+func TestMemoryDBRepoSeed(t *testing.T) {
+	var tests = []struct {
+		name        string
+		fixtures    Fixtures
+		expectedErr bool
+	}{
+		{"test fixtures", TestFixtures(), false},
+		{"empty", Fixtures{}, false},
+		{"ids assigned", Fixtures{Users: []data.User{{Email: "a@example.com"}, {Email: "b@example.com"}}}, false},
+		{"duplicate user", Fixtures{Users: []data.User{{ID: 1}, {ID: 1}}}, true},
+		{"duplicate email", Fixtures{Users: []data.User{{Email: "a@example.com"}, {Email: "A@Example.com"}}}, true},
+		{"image without user", Fixtures{Images: []data.UserImage{{ID: 1, UserID: 1}}}, true},
+		{"missing role", Fixtures{Users: []data.User{{ID: 1, Roles: []string{data.RoleAdmin}}}}, true},
+		{"missing permission", Fixtures{Roles: []data.Role{{Name: "editor", Permissions: []string{data.PermUsersWrite}}}}, true},
+		{"duplicate role", Fixtures{Roles: []data.Role{{Name: "editor"}, {Name: "editor"}}}, true},
+		{"two active images", Fixtures{
+			Users:  []data.User{{ID: 1}},
+			Images: []data.UserImage{{UserID: 1, IsActive: true}, {UserID: 1, IsActive: true}},
+		}, true},
+	}
+
+	for _, e := range tests {
+		_, err := NewMemoryDBRepo(e.fixtures)
+		if e.expectedErr && err == nil {
+			t.Errorf("%s: expected an error but got none", e.name)
+		}
+		if !e.expectedErr && err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+	}
+
+	// seeded ids are not handed out again
+	repo, _ := NewMemoryDBRepo(TestFixtures())
+	id, _ := repo.InsertUser(context.Background(), data.User{Email: "jack@smith.com"})
+	if id != 2 {
+		t.Errorf("expected the next user id to be 2 but got %d", id)
+	}
+}
+
+func TestMemoryDBRepoCopies(t *testing.T) {
+	ctx := context.Background()
+	repo, _ := NewMemoryDBRepo(TestFixtures())
+
+	// what the repository hands out can be changed without changing what it stores
+	admin, _ := repo.GetUser(ctx, 1)
+	admin.FirstName = "Changed"
+	images, _ := repo.AllUserImages(ctx, 1)
+	images[0].FileName = "changed.png"
+
+	admin, _ = repo.GetUser(ctx, 1)
+	if admin.FirstName != "Admin" || admin.ProfilePic.FileName != "img.png" {
+		t.Error("changing a returned value changed the stored one")
+	}
+}
+
+func TestMemoryDBRepoWithTx(t *testing.T) {
+	ctx := context.Background()
+	repo, _ := NewMemoryDBRepo(TestFixtures())
+
+	err := repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		_ = tx.DeleteUser(ctx, 1, 1)
+
+		// a failing nested transaction only undoes its own work
+		_ = tx.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+			_, _ = tx.InsertUserImage(ctx, data.UserImage{UserID: 1, FileName: "new.png"})
+			return errors.New("roll back to savepoint")
+		})
+		return errors.New("roll back")
+	})
+	if err == nil {
+		t.Error("expected the error returned by fn")
+	}
+
+	user, err := repo.GetUser(ctx, 1)
+	if err != nil {
+		t.Fatal("user deleted in a rolled back transaction is gone")
+	}
+	if user.ProfilePic.FileName != "img.png" {
+		t.Errorf("expected profile pic img.png but got %s", user.ProfilePic.FileName)
+	}
+
+	err = repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		return tx.UpdateAvatarVisibility(ctx, 1, data.AvatarPrivate, 1)
+	})
+	if err != nil {
+		t.Errorf("transaction failed: %s", err)
+	}
+	user, _ = repo.GetUser(ctx, 1)
+	if user.AvatarVisibility != data.AvatarPrivate {
+		t.Error("change made in a committed transaction is missing")
+	}
+}
+
+func TestMemoryDBRepoConcurrency(t *testing.T) {
+	ctx := context.Background()
+	repo := &MemoryDBRepo{}
+	id, _ := repo.InsertUser(ctx, data.User{Email: "admin@example.com"})
+
+	// run with -race to make this meaningful
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "img.png"})
+			_, _ = repo.GetUser(ctx, id)
+			_, _ = repo.AllUserImages(ctx, id)
+		}()
+	}
+	wg.Wait()
+
+	images, _ := repo.AllUserImages(ctx, id)
+	active := 0
+	for _, i := range images {
+		if i.IsActive {
+			active++
+		}
+	}
+	if len(images) != 20 || active != 1 {
+		t.Errorf("expected 20 images with one active, but got %d with %d active", len(images), active)
+	}
+}
@@ -3,16 +3,21 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/migrations"
 	"personal-projects/webapp/pkg/repository"
+	"personal-projects/webapp/pkg/repository/cacherepo"
+	"personal-projects/webapp/pkg/repository/repositorytest"
 	"testing"
 	"time"
 
-	_ "github.com/jackc/pgconn"
+	"github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/ory/dockertest/v3"
@@ -80,13 +85,13 @@ func TestMain(m *testing.M) {
 		log.Fatalf("could not connect to database: %s", err)
 	}
 
-	// populate the database with empty tables
+	// build the schema from the migrations
 	err = createTables()
 	if err != nil {
 		log.Fatalf("error creating tables: %s", err)
 	}
 
-	testRepo = &PostgresDBRepo{testDB}
+	testRepo = NewPostgresDBRepo(testDB)
 
 	// run tests
 	code := m.Run()
@@ -100,13 +105,13 @@ func TestMain(m *testing.M) {
 }
 
 func createTables() error {
-	tableSQL, err := os.ReadFile("./testdata/users.sql")
+	m, err := migrations.NewPostgres(testDB)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
 
-	_, err = testDB.Exec(string(tableSQL))
+	err = m.Up(context.Background())
 	if err != nil {
 		fmt.Println(err)
 		return err
@@ -128,12 +133,11 @@ func TestPostgresDBRepoInsertUser(t *testing.T) {
 		LastName:  "User",
 		Email:     "admin@example.com",
 		Password:  "secret",
-		IsAdmin:   1,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
 
-	id, err := testRepo.InsertUser(testUser)
+	id, err := testRepo.InsertUser(context.Background(), testUser)
 	if err != nil {
 		t.Errorf("insert user returned an error: %s", err)
 	}
@@ -143,7 +147,7 @@ func TestPostgresDBRepoInsertUser(t *testing.T) {
 }
 
 func TestPostgresDBRepoAllUsers(t *testing.T) {
-	users, err := testRepo.AllUsers()
+	users, err := testRepo.AllUsers(context.Background())
 	if err != nil {
 		t.Errorf("all users reports an error: %s", err)
 	}
@@ -157,13 +161,12 @@ func TestPostgresDBRepoAllUsers(t *testing.T) {
 		LastName:  "User",
 		Email:     "jack@smith.com",
 		Password:  "secret",
-		IsAdmin:   1,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
-	_, _ = testRepo.InsertUser(testUser)
+	_, _ = testRepo.InsertUser(context.Background(), testUser)
 
-	users, err = testRepo.AllUsers()
+	users, err = testRepo.AllUsers(context.Background())
 	if err != nil {
 		t.Errorf("all users reports an error: %s", err)
 	}
@@ -173,7 +176,7 @@ func TestPostgresDBRepoAllUsers(t *testing.T) {
 	}
 }
 func TestPostgresDBRepoGetUser(t *testing.T) {
-	user, err := testRepo.GetUser(1)
+	user, err := testRepo.GetUser(context.Background(), 1)
 	if err != nil {
 		t.Errorf("error getting user by id: %s", err)
 	}
@@ -181,14 +184,14 @@ func TestPostgresDBRepoGetUser(t *testing.T) {
 		t.Errorf("wrong email returned by GetUser; expected admin@example.com but got %s", user.Email)
 	}
 
-	_, err = testRepo.GetUser(3)
+	_, err = testRepo.GetUser(context.Background(), 3)
 	if err == nil {
 		t.Errorf("no error reported when getting non existent user by id")
 	}
 }
 
 func TestPostgresDBRepoGetUserByEmail(t *testing.T) {
-	user, err := testRepo.GetUserByEmail("jack@smith.com")
+	user, err := testRepo.GetUserByEmail(context.Background(), "jack@smith.com")
 	if err != nil {
 		t.Errorf("error getting user by id: %s", err)
 	}
@@ -198,38 +201,39 @@ func TestPostgresDBRepoGetUserByEmail(t *testing.T) {
 }
 
 func TestPostgresDBRepoUpdateUser(t *testing.T) {
-	user, _ := testRepo.GetUser(2)
+	user, _ := testRepo.GetUser(context.Background(), 2)
 	user.FirstName = "Jane"
 	user.Email = "jane@smith.com"
 
-	err := testRepo.UpdateUser(*user)
+	err := testRepo.UpdateUser(context.Background(), *user)
 	if err != nil {
 		t.Errorf("error updating user: %s", err)
 	}
-	user, _ = testRepo.GetUser(2)
+	user, _ = testRepo.GetUser(context.Background(), 2)
 	if user.FirstName != "Jane" || user.Email != "jane@smith.com" {
 		t.Errorf("expected updated record to have first name Jane and email jane@smith.com, but got %s %s", user.FirstName, user.Email)
 	}
 }
 
 func TestPostgresDBRepoDeleteUser(t *testing.T) {
-	err := testRepo.DeleteUser(2)
+	user, _ := testRepo.GetUser(context.Background(), 2)
+	err := testRepo.DeleteUser(context.Background(), 2, user.Version)
 	if err != nil {
 		t.Errorf("error deleting user id 2: %s", err)
 	}
 
-	_, err = testRepo.GetUser(2)
+	_, err = testRepo.GetUser(context.Background(), 2)
 	if err == nil {
 		t.Errorf("retrieved user id 2, who should have been deleted")
 	}
 }
 
 func TestPostgresDBRepoResetPassword(t *testing.T) {
-	err := testRepo.ResetPassword(1, "password")
+	err := testRepo.ResetPassword(context.Background(), 1, "password")
 	if err != nil {
 		t.Errorf("error resetting user's password: %s", err)
 	}
-	user, _ := testRepo.GetUser(1)
+	user, _ := testRepo.GetUser(context.Background(), 1)
 	matches, err := user.PasswordMatches("password")
 	if err != nil {
 		t.Errorf("error matching user's password: %s", err)
@@ -246,7 +250,7 @@ func TestPostgresDBRepoInsertUserImage(t *testing.T) {
 	image.CreatedAt = time.Now()
 	image.UpdatedAt = time.Now()
 
-	newID, err := testRepo.InsertUserImage(image)
+	newID, err := testRepo.InsertUserImage(context.Background(), image)
 	if err != nil {
 		t.Errorf("inserting user image failed: %s", err)
 	}
@@ -254,8 +258,296 @@ func TestPostgresDBRepoInsertUserImage(t *testing.T) {
 		t.Errorf("got wrong for image; should be 1 but got %d", newID)
 	}
 	image.UserID = 100
-	_, err = testRepo.InsertUserImage(image)
+	_, err = testRepo.InsertUserImage(context.Background(), image)
 	if err == nil {
 		t.Errorf("inserted a user image with non-existent user id")
 	}
 }
+
+func TestPostgresDBRepoUserImageHistory(t *testing.T) {
+	var image data.UserImage
+	image.UserID = 1
+	image.FileName = "second.jpg"
+
+	secondID, err := testRepo.InsertUserImage(context.Background(), image)
+	if err != nil {
+		t.Fatalf("inserting second user image failed: %s", err)
+	}
+
+	images, err := testRepo.AllUserImages(context.Background(), 1)
+	if err != nil {
+		t.Errorf("all user images reports an error: %s", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("all user images reports wrong size; expected 2, but got %d", len(images))
+	}
+	if images[0].ID != secondID || !images[0].IsActive || images[1].IsActive {
+		t.Errorf("expected newest image %d to be the only active one", secondID)
+	}
+
+	user, _ := testRepo.GetUser(context.Background(), 1)
+	if user.ProfilePic.FileName != "second.jpg" {
+		t.Errorf("expected profile pic second.jpg but got %s", user.ProfilePic.FileName)
+	}
+
+	// switch back to the first image
+	err = testRepo.SetActiveUserImage(context.Background(), 1, images[1].ID)
+	if err != nil {
+		t.Errorf("setting active user image failed: %s", err)
+	}
+	user, _ = testRepo.GetUser(context.Background(), 1)
+	if user.ProfilePic.FileName != "test.jpg" {
+		t.Errorf("expected profile pic test.jpg but got %s", user.ProfilePic.FileName)
+	}
+
+	err = testRepo.SetActiveUserImage(context.Background(), 2, images[1].ID)
+	if err == nil {
+		t.Error("activated an image that belongs to another user")
+	}
+
+	// deleting the active image promotes the remaining one
+	err = testRepo.DeleteUserImage(context.Background(), 1, images[1].ID)
+	if err != nil {
+		t.Errorf("deleting user image failed: %s", err)
+	}
+	user, _ = testRepo.GetUser(context.Background(), 1)
+	if user.ProfilePic.ID != secondID {
+		t.Errorf("expected image %d to become active, but got %d", secondID, user.ProfilePic.ID)
+	}
+
+	err = testRepo.DeleteUserImage(context.Background(), 1, images[1].ID)
+	if err == nil {
+		t.Error("deleted an image that does not exist")
+	}
+}
+
+func TestPostgresDBRepoUpdateAvatarVisibility(t *testing.T) {
+	user, _ := testRepo.GetUser(context.Background(), 1)
+	if user.AvatarVisibility != data.AvatarPublic {
+		t.Errorf("expected default avatar visibility public but got %s", user.AvatarVisibility)
+	}
+
+	err := testRepo.UpdateAvatarVisibility(context.Background(), 1, data.AvatarPrivate, user.Version)
+	if err != nil {
+		t.Errorf("error updating avatar visibility: %s", err)
+	}
+
+	user, _ = testRepo.GetUser(context.Background(), 1)
+	if user.AvatarVisibility != data.AvatarPrivate {
+		t.Errorf("expected avatar visibility private but got %s", user.AvatarVisibility)
+	}
+}
+
+func TestPostgresDBRepoCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := testRepo.GetUser(ctx, 1)
+	if err == nil {
+		t.Error("expected an error when querying with a cancelled context")
+	}
+
+	// the repository timeout applies on top of the caller's context
+	slowRepo := NewPostgresDBRepo(testDB)
+	slowRepo.Timeout = time.Millisecond
+	ctx, cancel = slowRepo.withTimeout(context.Background())
+	defer cancel()
+	_, err = testDB.ExecContext(ctx, "select pg_sleep(1)")
+	if err == nil {
+		t.Error("expected the query to be cut short by the repository timeout")
+	}
+}
+
+func TestPostgresDBRepoWithTx(t *testing.T) {
+	ctx := context.Background()
+	testUser := data.User{
+		FirstName: "Tx",
+		LastName:  "User",
+		Email:     "tx@example.com",
+		Password:  "secret",
+	}
+
+	// a failing transaction leaves nothing behind
+	err := testRepo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		_, err := repo.InsertUser(ctx, testUser)
+		if err != nil {
+			return err
+		}
+		return errors.New("roll back")
+	})
+	if err == nil {
+		t.Error("expected the error returned by fn")
+	}
+	_, err = testRepo.GetUserByEmail(ctx, "tx@example.com")
+	if err == nil {
+		t.Error("user inserted in a rolled back transaction exists")
+	}
+
+	// a failing savepoint only undoes the inner work
+	var id int
+	err = testRepo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		var err error
+		id, err = repo.InsertUser(ctx, testUser)
+		if err != nil {
+			return err
+		}
+
+		innerErr := repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+			_, err := repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "tx.jpg"})
+			if err != nil {
+				return err
+			}
+			return errors.New("roll back to savepoint")
+		})
+		if innerErr == nil {
+			t.Error("expected the error returned by the inner fn")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("transaction failed: %s", err)
+	}
+
+	user, err := testRepo.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("user inserted in a committed transaction does not exist: %s", err)
+	}
+	if user.ProfilePic.FileName != "" {
+		t.Errorf("image inserted in a rolled back savepoint exists: %s", user.ProfilePic.FileName)
+	}
+
+	_ = testRepo.DeleteUser(ctx, id, user.Version)
+}
+
+func Test_retryable(t *testing.T) {
+	var tests = []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"deadlock", fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "40P01"}), true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"other error", errors.New("boom"), false},
+	}
+
+	for _, e := range tests {
+		if pgRetryable(e.err) != e.expected {
+			t.Errorf("%s: expected %t", e.name, e.expected)
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	// runners started together must wait for each other on the advisory lock, and
+	// find nothing left to do
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			m, err := migrations.NewPostgres(testDB)
+			if err == nil {
+				err = m.Up(ctx)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("concurrent migration failed: %s", err)
+		}
+	}
+
+	m, _ := migrations.NewPostgres(testDB)
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Errorf("status reports an error: %s", err)
+	}
+	for _, s := range statuses {
+		if !s.Applied {
+			t.Errorf("migration %d_%s is not applied", s.Version, s.Name)
+		}
+	}
+
+	// pretend the last migration was edited after it ran
+	last := len(m.Migrations) - 1
+	m.Migrations[last].Checksum = "edited"
+	err = m.Up(ctx)
+	var drift *migrations.DriftError
+	if !errors.As(err, &drift) {
+		t.Fatalf("expected a drift error but got %v", err)
+	}
+	if len(drift.Changed) != 1 || drift.Changed[0] != m.Migrations[last].Version {
+		t.Errorf("wrong versions reported as changed: %v", drift.Changed)
+	}
+
+	// and a binary that is older than the database
+	m, _ = migrations.NewPostgres(testDB)
+	m.Migrations = m.Migrations[:last]
+	_, err = m.Status(ctx)
+	if !errors.As(err, &drift) || len(drift.Unknown) != 1 {
+		t.Errorf("expected one unknown version but got %v", err)
+	}
+}
+
+func TestPostgresDBRepoConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.DatabaseRepo {
+		_, err := testDB.Exec("truncate users, user_images, audit_events restart identity cascade; delete from roles where name <> 'admin'")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewPostgresDBRepo(testDB)
+	})
+}
+
+func TestCachedRepoListenPostgres(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id, err := testRepo.InsertUser(ctx, data.User{FirstName: "Cache", LastName: "Test", Email: "cache@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two instances of the app, sharing the database
+	a := cacherepo.New(NewPostgresDBRepo(testDB), 10, time.Minute)
+	b := cacherepo.New(NewPostgresDBRepo(testDB), 10, time.Minute)
+	go a.ListenPostgres(ctx, testDB)
+	go b.ListenPostgres(ctx, testDB)
+
+	// a write through b empties a's cache, once both are listening
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, _ = a.GetUser(ctx, id)
+		u, _ := b.GetUser(ctx, id)
+		err = b.UpdateAvatarVisibility(ctx, id, data.AvatarUsers, u.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		if a.Stats().Size == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("user was not invalidated in the other instance")
+		}
+	}
+}
+
+func TestPostgresDBRepoAuditAppendOnly(t *testing.T) {
+	id, err := testRepo.InsertAuditEvent(context.Background(), data.AuditEvent{Action: data.AuditLogin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = testDB.Exec("update audit_events set action = 'nothing' where id = $1", id)
+	if err == nil {
+		t.Error("expected changing an audit event to fail")
+	}
+	_, err = testDB.Exec("delete from audit_events where id = $1", id)
+	if err == nil {
+		t.Error("expected deleting an audit event to fail")
+	}
+}
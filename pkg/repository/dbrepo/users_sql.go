@@ -0,0 +1,783 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"sort"
+	"strings"
+	"time"
+)
+
+const dbTimeout = time.Second * 3
+
+// sqlDBRepo is the repository PostgresDBRepo and SQLiteDBRepo share. The SQL, with
+// $n placeholders, is the same for both; dialect covers what isn't.
+type sqlDBRepo struct {
+	DB *sql.DB
+	// Timeout limits how long each query may run, on top of any deadline the caller's
+	// context already has. Zero means dbTimeout; a negative value means no limit.
+	Timeout time.Duration
+	// TxOptions are used when WithTx starts a transaction; nil means the database defaults.
+	TxOptions *sql.TxOptions
+
+	dialect *dialect
+
+	// set on the copies of the repository handed out by WithTx
+	tx    *sql.Tx
+	depth int
+}
+
+// dialect is what sqlDBRepo needs to know about the database it is connected to.
+type dialect struct {
+	// translate turns the database's errors into the ones every DatabaseRepo uses
+	translate func(err error) error
+	// retryable reports whether a transaction failed because it lost a race with
+	// another one, and may succeed if it is run again
+	retryable func(err error) bool
+	// forUpdate is appended to selects whose rows must stay as they are until the
+	// transaction ends
+	forUpdate string
+	// lockAuditEvents, if set, makes writers of audit events wait for each other
+	lockAuditEvents string
+}
+
+// translate turns the errors the database reports into the ones every DatabaseRepo
+// uses. Anything else is returned as is.
+func (m *sqlDBRepo) translate(err error) error {
+	return m.dialect.translate(err)
+}
+
+func (m *sqlDBRepo) Connection() *sql.DB {
+	return m.DB
+}
+
+// withTimeout applies the per-query timeout policy to ctx.
+func (m *sqlDBRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	switch {
+	case m.Timeout < 0:
+		return context.WithCancel(ctx)
+	case m.Timeout == 0:
+		return context.WithTimeout(ctx, dbTimeout)
+	default:
+		return context.WithTimeout(ctx, m.Timeout)
+	}
+}
+
+// AllUsers returns all users, except deleted ones, as a slice of *data.User
+func (m *sqlDBRepo) AllUsers(ctx context.Context) ([]*data.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	return m.queryUsers(ctx, `select `+userListColumns+` from users where deleted_at is null order by last_name`)
+}
+
+// SearchUsers returns a page of the users, except deleted ones, whose name or email
+// address contains q, ignoring case, sorted by last name; and how many there are in
+// all. An empty q matches everyone.
+func (m *sqlDBRepo) SearchUsers(ctx context.Context, q string, limit, offset int) ([]*data.User, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	where := `where deleted_at is null`
+	var args []any
+	if q != "" {
+		where += ` and (lower(email) like $1 escape '\' or lower(first_name || ' ' || last_name) like $1 escape '\')`
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(q))+"%")
+	}
+
+	var total int
+	err := m.q().QueryRowContext(ctx, `select count(*) from users `+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, m.translate(err)
+	}
+
+	query := fmt.Sprintf(`select %s from users %s order by last_name, id limit $%d offset $%d`,
+		userListColumns, where, len(args)+1, len(args)+2)
+	users, err := m.queryUsers(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+// likeEscaper escapes the wildcards of a like pattern, for "escape '\'".
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// userListColumns are the columns queryUsers reads.
+const userListColumns = `id, email, first_name, last_name, password, avatar_visibility, version, created_at, updated_at, delete_after`
+
+// queryUsers runs a query for userListColumns, and returns the users with their roles.
+func (m *sqlDBRepo) queryUsers(ctx context.Context, query string, args ...any) ([]*data.User, error) {
+	rows, err := m.q().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, m.translate(err)
+	}
+	defer rows.Close()
+
+	var users []*data.User
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.AvatarVisibility,
+			&user.Version,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.DeleteAfter,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, m.translate(err)
+		}
+
+		users = append(users, &user)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, m.translate(err)
+	}
+
+	err = m.fillRoles(ctx, users...)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// GetUser returns one user by id, or repository.ErrNotFound
+func (m *sqlDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select 
+			u.id, u.email, u.first_name, u.last_name, u.password, u.avatar_visibility, u.version, u.created_at, u.updated_at,
+			u.delete_after, coalesce(ui.id, 0), coalesce(ui.file_name, '')
+		from 
+			users u
+			left join user_images ui on (ui.user_id = u.id and ui.is_active = true)
+		where 
+		    u.id = $1 and u.deleted_at is null`
+
+	var user data.User
+	row := m.q().QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.AvatarVisibility,
+		&user.Version,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.DeleteAfter,
+		&user.ProfilePic.ID,
+		&user.ProfilePic.FileName,
+	)
+
+	if err != nil {
+		return nil, m.translate(err)
+	}
+
+	err = m.fillRoles(ctx, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetUserByEmail returns one user by email address, ignoring case, or repository.ErrNotFound
+func (m *sqlDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	email, err := data.NormalizeEmail(email)
+	if err != nil {
+		// nobody can have signed up with it
+		return nil, repository.ErrNotFound
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select 
+			u.id, u.email, u.first_name, u.last_name, u.password, u.avatar_visibility, u.version, u.created_at, u.updated_at,
+			u.delete_after, coalesce(ui.id, 0), coalesce(ui.file_name, '')
+		from 
+			users u
+			left join user_images ui on (ui.user_id = u.id and ui.is_active = true)
+		where 
+		    lower(u.email) = $1 and u.deleted_at is null`
+
+	var user data.User
+	row := m.q().QueryRowContext(ctx, query, email)
+
+	err = row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.AvatarVisibility,
+		&user.Version,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.DeleteAfter,
+		&user.ProfilePic.ID,
+		&user.ProfilePic.FileName,
+	)
+
+	if err != nil {
+		return nil, m.translate(err)
+	}
+
+	err = m.fillRoles(ctx, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// UpdateUser updates one user in the database, as long as it is still at u.Version.
+// It returns repository.ErrModified if the user has changed since then,
+// repository.ErrNotFound if there is no such user, and data.ErrInvalidEmail or
+// repository.ErrDuplicateEmail if the new address can't be used.
+func (m *sqlDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+	email, err := data.NormalizeEmail(u.Email)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update users set
+		email = $1,
+		first_name = $2,
+		last_name = $3,
+		updated_at = $4,
+		version = version + 1
+		where id = $5 and version = $6 and deleted_at is null
+	`
+
+	result, err := m.q().ExecContext(ctx, stmt,
+		email,
+		u.FirstName,
+		u.LastName,
+		time.Now(),
+		u.ID,
+		u.Version,
+	)
+
+	if err != nil {
+		return m.translate(err)
+	}
+
+	err = expectRows(result)
+	if errors.Is(err, repository.ErrNotFound) {
+		return m.notUpdated(ctx, u.ID)
+	}
+
+	return err
+}
+
+// notUpdated explains why a conditional update of user id changed nothing: either
+// the user is gone or deleted, or they no longer match the condition.
+func (m *sqlDBRepo) notUpdated(ctx context.Context, id int) error {
+	var exists bool
+	err := m.q().QueryRowContext(ctx, `select exists (select 1 from users where id = $1 and deleted_at is null)`, id).Scan(&exists)
+	if err != nil {
+		return m.translate(err)
+	}
+	if exists {
+		return repository.ErrModified
+	}
+	return repository.ErrNotFound
+}
+
+// DeleteUser marks one user as deleted, by id, as long as they are still at version.
+// They are left out of everything but DeletedUsers from then on, and keep their
+// images until PurgeDeletedUsers removes them for good. Any deletion they had
+// scheduled is settled. It returns repository.ErrModified if the user has changed
+// since, and repository.ErrNotFound if there is no such user.
+func (m *sqlDBRepo) DeleteUser(ctx context.Context, id, version int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update users set deleted_at = $1, delete_after = null, updated_at = $2, version = version + 1
+		where id = $3 and version = $4 and deleted_at is null`
+
+	result, err := m.q().ExecContext(ctx, stmt, time.Now().UTC(), time.Now(), id, version)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	err = expectRows(result)
+	if errors.Is(err, repository.ErrNotFound) {
+		return m.notUpdated(ctx, id)
+	}
+
+	return err
+}
+
+// ScheduleDeletion sets when DeleteScheduledUsers will delete a user; nil calls
+// the deletion off. It returns repository.ErrNotFound if there is no such user.
+func (m *sqlDBRepo) ScheduleDeletion(ctx context.Context, id int, after *time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	if after != nil {
+		utc := after.UTC()
+		after = &utc
+	}
+
+	stmt := `update users set delete_after = $1, updated_at = $2, version = version + 1 where id = $3 and deleted_at is null`
+
+	result, err := m.q().ExecContext(ctx, stmt, after, time.Now(), id)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	return expectRows(result)
+}
+
+// DeleteScheduledUsers deletes the users whose deletion was scheduled for due or
+// earlier, as DeleteUser would, and returns their ids in order.
+func (m *sqlDBRepo) DeleteScheduledUsers(ctx context.Context, due time.Time) ([]int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update users set deleted_at = $1, delete_after = null, updated_at = $2, version = version + 1
+		where delete_after <= $3 and deleted_at is null
+		returning id`
+
+	rows, err := m.q().QueryContext(ctx, stmt, time.Now().UTC(), time.Now(), due.UTC())
+	if err != nil {
+		return nil, m.translate(err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, m.translate(err)
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, m.translate(err)
+	}
+
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// DeletedUsers returns the users that have been deleted but not purged, most
+// recently deleted first.
+func (m *sqlDBRepo) DeletedUsers(ctx context.Context) ([]*data.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select id, email, first_name, last_name, password, avatar_visibility, version, created_at, updated_at, deleted_at
+	from users where deleted_at is not null order by deleted_at desc, id desc`
+
+	rows, err := m.q().QueryContext(ctx, query)
+	if err != nil {
+		return nil, m.translate(err)
+	}
+	defer rows.Close()
+
+	var users []*data.User
+
+	for rows.Next() {
+		var user data.User
+		var deletedAt time.Time
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.AvatarVisibility,
+			&user.Version,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&deletedAt,
+		)
+		if err != nil {
+			return nil, m.translate(err)
+		}
+
+		deletedAt = deletedAt.UTC()
+		user.DeletedAt = &deletedAt
+		users = append(users, &user)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, m.translate(err)
+	}
+
+	err = m.fillRoles(ctx, users...)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// RestoreUser brings back a deleted user, images and all. It returns
+// repository.ErrNotFound if there is no such deleted user, and
+// repository.ErrDuplicateEmail if someone else has their address by now.
+func (m *sqlDBRepo) RestoreUser(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update users set deleted_at = null, updated_at = $1, version = version + 1 where id = $2 and deleted_at is not null`
+
+	result, err := m.q().ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	return expectRows(result)
+}
+
+// PurgeDeletedUsers removes the users deleted before deletedBefore for good, along
+// with their images, and returns them with the file names of those images.
+func (m *sqlDBRepo) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) ([]data.PurgedUser, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var purged []data.PurgedUser
+	err := m.withTx(ctx, func(tx *sqlDBRepo) error {
+		purged = nil
+
+		// locked, so that they can't be restored while their images are collected; in
+		// sqlite, which can't lock rows, a restore before the delete makes the
+		// transaction fail to get the write lock and run again
+		query := `select id from users where deleted_at < $1 order by id` + m.dialect.forUpdate
+		rows, err := tx.q().QueryContext(ctx, query, deletedBefore.UTC())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		byID := make(map[int]int)
+		for rows.Next() {
+			var u data.PurgedUser
+			err = rows.Scan(&u.ID)
+			if err != nil {
+				return err
+			}
+			byID[u.ID] = len(purged)
+			purged = append(purged, u)
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+		rows.Close()
+
+		if len(purged) == 0 {
+			return nil
+		}
+
+		query = `select user_id, file_name from user_images
+			where user_id in (select id from users where deleted_at < $1) order by id`
+		rows, err = tx.q().QueryContext(ctx, query, deletedBefore.UTC())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var userID int
+			var fileName string
+			err = rows.Scan(&userID, &fileName)
+			if err != nil {
+				return err
+			}
+			u := &purged[byID[userID]]
+			u.FileNames = append(u.FileNames, fileName)
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		// their images go with them
+		_, err = tx.q().ExecContext(ctx, `delete from users where deleted_at < $1`, deletedBefore.UTC())
+		return err
+	})
+	if err != nil {
+		return nil, m.translate(err)
+	}
+
+	return purged, nil
+}
+
+// UpdateAvatarVisibility changes who may see a user's profile picture, as long as
+// they are still at version. It returns repository.ErrModified if the user has
+// changed since, and repository.ErrNotFound if there is no such user.
+func (m *sqlDBRepo) UpdateAvatarVisibility(ctx context.Context, userID int, visibility string, version int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update users set avatar_visibility = $1, updated_at = $2, version = version + 1
+		where id = $3 and version = $4 and deleted_at is null`
+
+	result, err := m.q().ExecContext(ctx, stmt, visibility, time.Now(), userID, version)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	err = expectRows(result)
+	if errors.Is(err, repository.ErrNotFound) {
+		return m.notUpdated(ctx, userID)
+	}
+
+	return err
+}
+
+// InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
+// The email address is normalized first; data.ErrInvalidEmail or
+// repository.ErrDuplicateEmail are returned if it can't be used.
+func (m *sqlDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+	email, err := data.NormalizeEmail(user.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	hashedPassword, err := data.Passwords.Hash(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into users (email, first_name, last_name, password, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err = m.q().QueryRowContext(ctx, stmt,
+		email,
+		user.FirstName,
+		user.LastName,
+		hashedPassword,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, m.translate(err)
+	}
+
+	return newID, nil
+}
+
+// ResetPassword is the method we will use to change a user's password. It returns
+// repository.ErrNotFound if there is no such user.
+func (m *sqlDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	hashedPassword, err := data.Passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update users set password = $1, version = version + 1 where id = $2 and deleted_at is null`
+	result, err := m.q().ExecContext(ctx, stmt, hashedPassword, id)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	return expectRows(result)
+}
+
+// RehashPassword replaces the user's password hash with a new one, made with the
+// current data.Passwords hasher, as long as the stored hash is still oldHash. It is
+// meant for upgrading a hash after a successful login, so unlike ResetPassword it
+// leaves the user's version alone. It returns repository.ErrModified if the hash has
+// changed, and repository.ErrNotFound if there is no such user.
+func (m *sqlDBRepo) RehashPassword(ctx context.Context, id int, oldHash, password string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	hashedPassword, err := data.Passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update users set password = $1 where id = $2 and password = $3 and deleted_at is null`
+	result, err := m.q().ExecContext(ctx, stmt, hashedPassword, id, oldHash)
+	if err != nil {
+		return m.translate(err)
+	}
+
+	err = expectRows(result)
+	if errors.Is(err, repository.ErrNotFound) {
+		return m.notUpdated(ctx, id)
+	}
+
+	return err
+}
+
+// InsertUserImage inserts a user profile image into the database, and makes it
+// the user's active image. Previously uploaded images are kept, so that the user
+// can switch back to them later. It returns repository.ErrNotFound if there is no
+// such user.
+func (m *sqlDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+	err := m.withTx(ctx, func(tx *sqlDBRepo) error {
+		stmt := `update user_images set is_active = false, updated_at = $1 where user_id = $2 and is_active = true`
+		_, err := tx.q().ExecContext(ctx, stmt, time.Now(), i.UserID)
+		if err != nil {
+			return err
+		}
+
+		stmt = `insert into user_images (user_id, file_name, is_active, created_at, updated_at)
+			values ($1, $2, true, $3, $4) returning id`
+
+		return tx.q().QueryRowContext(ctx, stmt,
+			i.UserID,
+			i.FileName,
+			time.Now(),
+			time.Now(),
+		).Scan(&newID)
+	})
+
+	if err != nil {
+		return 0, m.translate(err)
+	}
+
+	return newID, nil
+}
+
+// AllUserImages returns every profile image a user has uploaded, newest first, or
+// none if the user has been deleted.
+func (m *sqlDBRepo) AllUserImages(ctx context.Context, userID int) ([]*data.UserImage, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ui.id, ui.user_id, ui.file_name, ui.is_active, ui.created_at, ui.updated_at
+	from user_images ui join users u on (u.id = ui.user_id and u.deleted_at is null)
+	where ui.user_id = $1 order by ui.created_at desc, ui.id desc`
+
+	rows, err := m.q().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, m.translate(err)
+	}
+	defer rows.Close()
+
+	var images []*data.UserImage
+
+	for rows.Next() {
+		var image data.UserImage
+		err := rows.Scan(
+			&image.ID,
+			&image.UserID,
+			&image.FileName,
+			&image.IsActive,
+			&image.CreatedAt,
+			&image.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, m.translate(err)
+		}
+
+		images = append(images, &image)
+	}
+
+	return images, rows.Err()
+}
+
+// SetActiveUserImage makes one of a user's previously uploaded images their
+// profile picture. It returns repository.ErrNotFound if the image does not belong
+// to the user.
+func (m *sqlDBRepo) SetActiveUserImage(ctx context.Context, userID, imageID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	return m.translate(m.withTx(ctx, func(tx *sqlDBRepo) error {
+		stmt := `update user_images set is_active = false, updated_at = $1 where user_id = $2 and is_active = true`
+		_, err := tx.q().ExecContext(ctx, stmt, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		stmt = `update user_images set is_active = true, updated_at = $1 where id = $2 and user_id = $3`
+		result, err := tx.q().ExecContext(ctx, stmt, time.Now(), imageID, userID)
+		if err != nil {
+			return err
+		}
+
+		return expectRows(result)
+	}))
+}
+
+// DeleteUserImage deletes one of a user's images. If the deleted image was the
+// active one, the most recently uploaded remaining image becomes active. It returns
+// repository.ErrNotFound if the image does not belong to the user.
+func (m *sqlDBRepo) DeleteUserImage(ctx context.Context, userID, imageID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	return m.translate(m.withTx(ctx, func(tx *sqlDBRepo) error {
+		var wasActive bool
+		stmt := `delete from user_images where id = $1 and user_id = $2 returning is_active`
+		err := tx.q().QueryRowContext(ctx, stmt, imageID, userID).Scan(&wasActive)
+		if err != nil {
+			return err
+		}
+
+		if wasActive {
+			stmt = `update user_images set is_active = true, updated_at = $1 where id = (
+				select id from user_images where user_id = $2 order by created_at desc, id desc limit 1
+			)`
+			_, err = tx.q().ExecContext(ctx, stmt, time.Now(), userID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}))
+}
+
+// CountUserImagesByFileName returns how many images, of any user, deleted or not,
+// are stored in the file fileName, so that the file is only removed once none is.
+func (m *sqlDBRepo) CountUserImagesByFileName(ctx context.Context, fileName string) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var count int
+	err := m.q().QueryRowContext(ctx, `select count(*) from user_images where file_name = $1`, fileName).Scan(&count)
+	if err != nil {
+		return 0, m.translate(err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,117 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/migrations"
+	"personal-projects/webapp/pkg/repository"
+	"personal-projects/webapp/pkg/repository/repositorytest"
+	"testing"
+)
+
+// newSQLiteTestRepo returns a repository backed by a fresh, migrated database file.
+func newSQLiteTestRepo(t *testing.T) *SQLiteDBRepo {
+	t.Helper()
+
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("could not open sqlite database: %s", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	m, err := migrations.NewSQLite(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Up(context.Background())
+	if err != nil {
+		t.Fatalf("could not migrate sqlite database: %s", err)
+	}
+
+	return NewSQLiteDBRepo(db)
+}
+
+func TestSQLiteDBRepoConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.DatabaseRepo {
+		repo := newSQLiteTestRepo(t)
+
+		// start without the seeded admin user
+		_, err := repo.DB.Exec("delete from users; delete from sqlite_sequence where name not in ('roles', 'permissions')")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	})
+}
+
+func TestSQLiteDBRepoSeededAdmin(t *testing.T) {
+	repo := newSQLiteTestRepo(t)
+
+	admin, err := repo.GetUserByEmail(context.Background(), "admin@example.com")
+	if err != nil {
+		t.Fatalf("seeded admin user is missing: %s", err)
+	}
+	if ok, _ := admin.PasswordMatches("secret"); !ok || !admin.HasRole(data.RoleAdmin) || !admin.Can(data.PermUsersWrite) {
+		t.Error("seeded admin user should be an admin with password secret")
+	}
+}
+
+func Test_sqliteRetryable(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "busy.db")
+
+	// hold the write lock on one connection, and try to write on another that won't wait
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn, _ := db.Conn(ctx)
+	defer conn.Close()
+	_, _ = conn.ExecContext(ctx, "create table t (id integer)")
+	_, _ = conn.ExecContext(ctx, "begin immediate")
+	defer conn.ExecContext(ctx, "rollback")
+
+	impatient, _ := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(0)")
+	defer impatient.Close()
+	_, busyErr := impatient.ExecContext(ctx, "insert into t (id) values (1)")
+
+	var tests = []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"database is locked", busyErr, true},
+		{"wrapped", fmt.Errorf("wrapped: %w", busyErr), true},
+		{"other error", errors.New("boom"), false},
+		{"nil", nil, false},
+	}
+
+	for _, e := range tests {
+		if sqliteRetryable(e.err) != e.expected {
+			t.Errorf("%s: expected %t for %v", e.name, e.expected, e.err)
+		}
+	}
+}
+
+func TestSQLiteDBRepoAuditAppendOnly(t *testing.T) {
+	repo := newSQLiteTestRepo(t)
+
+	id, err := repo.InsertAuditEvent(context.Background(), data.AuditEvent{Action: data.AuditLogin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo.DB.Exec("update audit_events set action = 'nothing' where id = ?", id)
+	if err == nil {
+		t.Error("expected changing an audit event to fail")
+	}
+	_, err = repo.DB.Exec("delete from audit_events where id = ?", id)
+	if err == nil {
+		t.Error("expected deleting an audit event to fail")
+	}
+}
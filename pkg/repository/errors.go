@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Every DatabaseRepo reports these conditions the same way, whatever the database
+// underneath, so that handlers can tell them apart with errors.Is.
+var (
+	// ErrNotFound means the row asked for, or one a write refers to, does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicateEmail means another user already has the email address.
+	ErrDuplicateEmail = errors.New("email address is already in use")
+	// ErrConflict means the write clashed with the current state of the data, or with
+	// a concurrent write, and may succeed if it is made again.
+	ErrConflict = errors.New("conflict")
+	// ErrModified means the row has changed since the version the caller read, so
+	// writing it would overwrite someone else's changes. Read it again before retrying.
+	ErrModified = errors.New("modified by someone else")
+)
+
+// ConstraintError is returned when a write breaks one of the database's rules. It
+// matches Kind with errors.Is, and the driver's own error with errors.As.
+type ConstraintError struct {
+	// Kind is ErrNotFound, ErrDuplicateEmail or ErrConflict.
+	Kind error
+	// Constraint is the name of the database constraint, if the database reported it.
+	Constraint string
+	// Err is the error returned by the driver.
+	Err error
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Constraint == "" {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s (%s): %s", e.Kind, e.Constraint, e.Err)
+}
+
+func (e *ConstraintError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
@@ -1,18 +1,43 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"personal-projects/webapp/pkg/data"
+	"time"
 )
 
 type DatabaseRepo interface {
 	Connection() *sql.DB
-	AllUsers() ([]*data.User, error)
-	GetUser(id int) (*data.User, error)
-	GetUserByEmail(email string) (*data.User, error)
-	UpdateUser(u data.User) error
-	DeleteUser(id int) error
-	InsertUser(user data.User) (int, error)
-	ResetPassword(id int, password string) error
-	InsertUserImage(i data.UserImage) (int, error)
+	AllUsers(ctx context.Context) ([]*data.User, error)
+	SearchUsers(ctx context.Context, q string, limit, offset int) ([]*data.User, int, error)
+	GetUser(ctx context.Context, id int) (*data.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*data.User, error)
+	UpdateUser(ctx context.Context, u data.User) error
+	UpdateAvatarVisibility(ctx context.Context, userID int, visibility string, version int) error
+	DeleteUser(ctx context.Context, id, version int) error
+	ScheduleDeletion(ctx context.Context, id int, after *time.Time) error
+	DeleteScheduledUsers(ctx context.Context, due time.Time) ([]int, error)
+	DeletedUsers(ctx context.Context) ([]*data.User, error)
+	RestoreUser(ctx context.Context, id int) error
+	PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) ([]data.PurgedUser, error)
+	InsertUser(ctx context.Context, user data.User) (int, error)
+	ResetPassword(ctx context.Context, id int, password string) error
+	RehashPassword(ctx context.Context, id int, oldHash, password string) error
+	InsertUserImage(ctx context.Context, i data.UserImage) (int, error)
+	AllUserImages(ctx context.Context, userID int) ([]*data.UserImage, error)
+	SetActiveUserImage(ctx context.Context, userID, imageID int) error
+	DeleteUserImage(ctx context.Context, userID, imageID int) error
+	CountUserImagesByFileName(ctx context.Context, fileName string) (int, error)
+	AllRoles(ctx context.Context) ([]*data.Role, error)
+	AllPermissions(ctx context.Context) ([]*data.Permission, error)
+	InsertRole(ctx context.Context, role data.Role) (int, error)
+	AssignRole(ctx context.Context, userID int, role string) error
+	RevokeRole(ctx context.Context, userID int, role string) error
+	GrantPermission(ctx context.Context, role, permission string) error
+	RevokePermission(ctx context.Context, role, permission string) error
+	InsertAuditEvent(ctx context.Context, e data.AuditEvent) (int, error)
+	AuditEvents(ctx context.Context, filter data.AuditFilter) ([]*data.AuditEvent, error)
+	LastAuditEvent(ctx context.Context) (*data.AuditEvent, error)
+	WithTx(ctx context.Context, fn func(repo DatabaseRepo) error) error
 }
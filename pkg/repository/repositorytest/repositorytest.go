@@ -0,0 +1,1145 @@
+// Package repositorytest checks that an implementation of repository.DatabaseRepo
+// behaves the way the handlers expect. Every implementation runs the same suite:
+//
+//	func TestMyRepo(t *testing.T) {
+//		repositorytest.Run(t, func(t *testing.T) repository.DatabaseRepo {
+//			return newEmptyRepo(t)
+//		})
+//	}
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"personal-projects/webapp/pkg/auditchain"
+	"personal-projects/webapp/pkg/data"
+	"personal-projects/webapp/pkg/repository"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Factory returns a repository with no users or images in it, and only the
+// permissions and admin role the migrations create. It is called once for every
+// test in the suite.
+type Factory func(t *testing.T) repository.DatabaseRepo
+
+// Run runs the whole suite against the repositories made by newRepo.
+func Run(t *testing.T, newRepo Factory) {
+	var tests = []struct {
+		name string
+		fn   func(t *testing.T, repo repository.DatabaseRepo)
+	}{
+		{"InsertUser", testInsertUser},
+		{"AllUsers", testAllUsers},
+		{"SearchUsers", testSearchUsers},
+		{"GetUserNotFound", testGetUserNotFound},
+		{"UpdateUser", testUpdateUser},
+		{"EmailAddresses", testEmailAddresses},
+		{"Versions", testVersions},
+		{"UpdateAvatarVisibility", testUpdateAvatarVisibility},
+		{"ResetPassword", testResetPassword},
+		{"RehashPassword", testRehashPassword},
+		{"DeleteUser", testDeleteUser},
+		{"RestoreUser", testRestoreUser},
+		{"ScheduleDeletion", testScheduleDeletion},
+		{"PurgeDeletedUsers", testPurgeDeletedUsers},
+		{"InsertUserImage", testInsertUserImage},
+		{"SetActiveUserImage", testSetActiveUserImage},
+		{"DeleteUserImage", testDeleteUserImage},
+		{"CountUserImagesByFileName", testCountUserImagesByFileName},
+		{"Roles", testRoles},
+		{"AuditEvents", testAuditEvents},
+		{"WithTx", testWithTx},
+		{"CancelledContext", testCancelledContext},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			e.fn(t, newRepo(t))
+		})
+	}
+}
+
+// insertUser adds a user whose password is "secret", failing the test if it can't.
+func insertUser(t *testing.T, repo repository.DatabaseRepo, firstName, lastName string) *data.User {
+	t.Helper()
+
+	id, err := repo.InsertUser(context.Background(), data.User{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     firstName + "." + lastName + "@example.com",
+		Password:  "secret",
+	})
+	if err != nil {
+		t.Fatalf("insert user returned an error: %s", err)
+	}
+
+	user, err := repo.GetUser(context.Background(), id)
+	if err != nil {
+		t.Fatalf("inserted user %d not found: %s", id, err)
+	}
+	return user
+}
+
+// insertImage adds an image for a user, failing the test if it can't.
+func insertImage(t *testing.T, repo repository.DatabaseRepo, userID int, fileName string) int {
+	t.Helper()
+
+	id, err := repo.InsertUserImage(context.Background(), data.UserImage{UserID: userID, FileName: fileName})
+	if err != nil {
+		t.Fatalf("insert user image returned an error: %s", err)
+	}
+	return id
+}
+
+func expectNotFound(t *testing.T, what string, err error) {
+	t.Helper()
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("%s: expected repository.ErrNotFound but got %v", what, err)
+	}
+}
+
+func testInsertUser(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	before := time.Now().Add(-time.Second)
+
+	jack := insertUser(t, repo, "Jack", "Smith")
+	jill := insertUser(t, repo, "Jill", "Smith")
+	if jack.ID <= 0 || jill.ID <= jack.ID {
+		t.Errorf("expected increasing ids but got %d and %d", jack.ID, jill.ID)
+	}
+
+	if jack.Password == "secret" {
+		t.Error("password was stored in plain text")
+	}
+	if ok, err := jack.PasswordMatches("secret"); err != nil || !ok {
+		t.Errorf("stored password does not match: %v", err)
+	}
+	if jack.CreatedAt.Before(before) || jack.UpdatedAt.Before(before) {
+		t.Errorf("expected timestamps to be set, but got created %s and updated %s", jack.CreatedAt, jack.UpdatedAt)
+	}
+	if jack.AvatarVisibility != data.AvatarPublic {
+		t.Errorf("expected avatar visibility %s but got %q", data.AvatarPublic, jack.AvatarVisibility)
+	}
+	if jack.ProfilePic.FileName != "" {
+		t.Errorf("new user has a profile pic: %s", jack.ProfilePic.FileName)
+	}
+
+	byEmail, err := repo.GetUserByEmail(ctx, "Jill.Smith@example.com")
+	if err != nil {
+		t.Fatalf("error getting user by email: %s", err)
+	}
+	if byEmail.ID != jill.ID {
+		t.Errorf("wrong id returned by GetUserByEmail; expected %d but got %d", jill.ID, byEmail.ID)
+	}
+}
+
+func testAllUsers(t *testing.T, repo repository.DatabaseRepo) {
+	users, err := repo.AllUsers(context.Background())
+	if err != nil {
+		t.Errorf("all users reports an error: %s", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("expected an empty repository but got %d users", len(users))
+	}
+
+	insertUser(t, repo, "Jack", "Smith")
+	insertUser(t, repo, "Anne", "Young")
+	insertUser(t, repo, "Zoe", "Adams")
+
+	users, err = repo.AllUsers(context.Background())
+	if err != nil {
+		t.Errorf("all users reports an error: %s", err)
+	}
+
+	var lastNames []string
+	for _, u := range users {
+		lastNames = append(lastNames, u.LastName)
+	}
+	if len(lastNames) != 3 || lastNames[0] != "Adams" || lastNames[1] != "Smith" || lastNames[2] != "Young" {
+		t.Errorf("expected users ordered by last name, but got %v", lastNames)
+	}
+}
+
+func testSearchUsers(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	insertUser(t, repo, "Jack", "Smith")
+	insertUser(t, repo, "Anne", "Young")
+	insertUser(t, repo, "Zoe", "Adams")
+	gone := insertUser(t, repo, "Jane", "Smithers")
+	err := repo.DeleteUser(ctx, gone.ID, gone.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name              string
+		q                 string
+		limit             int
+		offset            int
+		expectedLastNames string
+		expectedTotal     int
+	}{
+		{"everyone", "", 10, 0, "Adams Smith Young", 3},
+		{"email", "ZOE.ADAMS@", 10, 0, "Adams", 1},
+		{"full name", "anne y", 10, 0, "Young", 1},
+		{"part of a name", "S", 10, 0, "Adams Smith", 2},
+		{"first page", "", 2, 0, "Adams Smith", 3},
+		{"second page", "", 2, 2, "Young", 3},
+		{"past the end", "", 2, 4, "", 3},
+		{"percent", "%", 10, 0, "", 0},
+		{"underscore", "_", 10, 0, "", 0},
+		{"nobody", "fish", 10, 0, "", 0},
+	}
+
+	for _, e := range tests {
+		users, total, err := repo.SearchUsers(ctx, e.q, e.limit, e.offset)
+		if err != nil {
+			t.Errorf("%s: search users reports an error: %s", e.name, err)
+			continue
+		}
+
+		var lastNames []string
+		for _, u := range users {
+			lastNames = append(lastNames, u.LastName)
+		}
+		if strings.Join(lastNames, " ") != e.expectedLastNames {
+			t.Errorf("%s: expected %q but got %q", e.name, e.expectedLastNames, strings.Join(lastNames, " "))
+		}
+		if total != e.expectedTotal {
+			t.Errorf("%s: expected %d in all but got %d", e.name, e.expectedTotal, total)
+		}
+	}
+}
+
+func testGetUserNotFound(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+
+	_, err := repo.GetUser(ctx, 1000)
+	expectNotFound(t, "GetUser", err)
+
+	_, err = repo.GetUserByEmail(ctx, "nobody@example.com")
+	expectNotFound(t, "GetUserByEmail", err)
+}
+
+func testUpdateUser(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	user := insertUser(t, repo, "Jack", "Smith")
+
+	// make sure the clock has moved on, however coarse it is
+	time.Sleep(10 * time.Millisecond)
+
+	user.FirstName = "Jane"
+	user.Email = "jane@smith.com"
+	user.Password = "not used"
+	user.Roles = []string{data.RoleAdmin}
+	err := repo.UpdateUser(ctx, *user)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	updated, _ := repo.GetUser(ctx, user.ID)
+	if updated.FirstName != "Jane" || updated.Email != "jane@smith.com" {
+		t.Errorf("expected updated record to have first name Jane and email jane@smith.com, but got %s %s", updated.FirstName, updated.Email)
+	}
+	if len(updated.Roles) != 0 {
+		t.Errorf("UpdateUser changed the roles to %v; only AssignRole should", updated.Roles)
+	}
+	if !updated.UpdatedAt.After(updated.CreatedAt) {
+		t.Errorf("expected updated at (%s) to be after created at (%s)", updated.UpdatedAt, updated.CreatedAt)
+	}
+	if ok, _ := updated.PasswordMatches("secret"); !ok {
+		t.Error("UpdateUser changed the password")
+	}
+
+	err = repo.UpdateUser(ctx, data.User{ID: 1000, Email: "nobody@example.com"})
+	expectNotFound(t, "UpdateUser", err)
+}
+
+func testEmailAddresses(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+
+	id, err := repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: " Jack@Smith.COM ", Password: "secret"})
+	if err != nil {
+		t.Fatalf("insert user returned an error: %s", err)
+	}
+	jack, _ := repo.GetUser(ctx, id)
+	if jack.Email != "jack@smith.com" {
+		t.Errorf("expected the email address to be stored as jack@smith.com but got %q", jack.Email)
+	}
+
+	for _, email := range []string{"jack@smith.com", "JACK@smith.com", "  jack@Smith.com"} {
+		user, err := repo.GetUserByEmail(ctx, email)
+		if err != nil {
+			t.Errorf("GetUserByEmail(%q) returned an error: %s", email, err)
+		} else if user.ID != jack.ID {
+			t.Errorf("GetUserByEmail(%q) returned user %d instead of %d", email, user.ID, jack.ID)
+		}
+	}
+
+	_, err = repo.GetUserByEmail(ctx, "not an address")
+	expectNotFound(t, "GetUserByEmail with an invalid address", err)
+
+	_, err = repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Again", Email: "JACK@SMITH.COM", Password: "secret"})
+	if !errors.Is(err, repository.ErrDuplicateEmail) {
+		t.Errorf("expected repository.ErrDuplicateEmail when inserting a duplicate address but got %v", err)
+	}
+
+	_, err = repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack", Password: "secret"})
+	if !errors.Is(err, data.ErrInvalidEmail) {
+		t.Errorf("expected data.ErrInvalidEmail when inserting an invalid address but got %v", err)
+	}
+
+	jill := insertUser(t, repo, "Jill", "Smith")
+	jill.Email = "Jack@smith.com"
+	err = repo.UpdateUser(ctx, *jill)
+	if !errors.Is(err, repository.ErrDuplicateEmail) {
+		t.Errorf("expected repository.ErrDuplicateEmail when taking another user's address but got %v", err)
+	}
+
+	jill.Email = "not an address"
+	err = repo.UpdateUser(ctx, *jill)
+	if !errors.Is(err, data.ErrInvalidEmail) {
+		t.Errorf("expected data.ErrInvalidEmail when updating to an invalid address but got %v", err)
+	}
+
+	// changing only the case of your own address is fine
+	jack.Email = "JACK@smith.com"
+	err = repo.UpdateUser(ctx, *jack)
+	if err != nil {
+		t.Errorf("error updating the case of a user's own address: %s", err)
+	}
+
+	users, _ := repo.AllUsers(ctx)
+	if len(users) != 2 {
+		t.Errorf("expected 2 users but got %d", len(users))
+	}
+}
+
+func testVersions(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	user := insertUser(t, repo, "Jack", "Smith")
+	if user.Version != 1 {
+		t.Errorf("expected a new user to be at version 1 but got %d", user.Version)
+	}
+
+	// two people read the same version; the first to save wins
+	first, second := *user, *user
+	first.FirstName = "Jane"
+	err := repo.UpdateUser(ctx, first)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	second.LastName = "Jones"
+	err = repo.UpdateUser(ctx, second)
+	if !errors.Is(err, repository.ErrModified) {
+		t.Errorf("expected repository.ErrModified for a stale update but got %v", err)
+	}
+
+	user, _ = repo.GetUser(ctx, user.ID)
+	if user.FirstName != "Jane" || user.LastName != "Smith" {
+		t.Errorf("expected Jane Smith after the stale update was refused but got %s %s", user.FirstName, user.LastName)
+	}
+	if user.Version != 2 {
+		t.Errorf("expected version 2 after one update but got %d", user.Version)
+	}
+
+	// every other change to the user moves the version on too
+	err = repo.UpdateAvatarVisibility(ctx, user.ID, data.AvatarUsers, user.Version)
+	if err != nil {
+		t.Fatalf("error updating avatar visibility: %s", err)
+	}
+	err = repo.ResetPassword(ctx, user.ID, "password")
+	if err != nil {
+		t.Fatalf("error resetting password: %s", err)
+	}
+
+	err = repo.UpdateUser(ctx, *user)
+	if !errors.Is(err, repository.ErrModified) {
+		t.Errorf("expected repository.ErrModified after other changes but got %v", err)
+	}
+
+	user, _ = repo.GetUser(ctx, user.ID)
+	if user.Version != 4 {
+		t.Errorf("expected version 4 but got %d", user.Version)
+	}
+	err = repo.UpdateUser(ctx, *user)
+	if err != nil {
+		t.Errorf("error updating the current version: %s", err)
+	}
+}
+
+func testUpdateAvatarVisibility(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	user := insertUser(t, repo, "Jack", "Smith")
+
+	err := repo.UpdateAvatarVisibility(ctx, user.ID, data.AvatarPrivate, user.Version)
+	if err != nil {
+		t.Errorf("error updating avatar visibility: %s", err)
+	}
+
+	// the version has moved on since
+	err = repo.UpdateAvatarVisibility(ctx, user.ID, data.AvatarPublic, user.Version)
+	if !errors.Is(err, repository.ErrModified) {
+		t.Errorf("expected repository.ErrModified for a stale update but got %v", err)
+	}
+
+	user, _ = repo.GetUser(ctx, user.ID)
+	if user.AvatarVisibility != data.AvatarPrivate {
+		t.Errorf("expected avatar visibility %s but got %s", data.AvatarPrivate, user.AvatarVisibility)
+	}
+
+	err = repo.UpdateAvatarVisibility(ctx, 1000, data.AvatarPrivate, 1)
+	expectNotFound(t, "UpdateAvatarVisibility", err)
+}
+
+func testResetPassword(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	user := insertUser(t, repo, "Jack", "Smith")
+
+	err := repo.ResetPassword(ctx, user.ID, "password")
+	if err != nil {
+		t.Errorf("error resetting user's password: %s", err)
+	}
+
+	user, _ = repo.GetUser(ctx, user.ID)
+	if ok, _ := user.PasswordMatches("password"); !ok || user.Password == "password" {
+		t.Error("password should match 'password', and be hashed")
+	}
+
+	err = repo.ResetPassword(ctx, 1000, "password")
+	expectNotFound(t, "ResetPassword", err)
+}
+
+func testRehashPassword(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	user := insertUser(t, repo, "Jack", "Smith")
+	oldHash := user.Password
+
+	err := repo.RehashPassword(ctx, user.ID, oldHash, "secret")
+	if err != nil {
+		t.Errorf("error rehashing user's password: %s", err)
+	}
+
+	rehashed, _ := repo.GetUser(ctx, user.ID)
+	if rehashed.Password == oldHash {
+		t.Error("password hash was not replaced")
+	}
+	if ok, _ := rehashed.PasswordMatches("secret"); !ok {
+		t.Error("password should still match 'secret'")
+	}
+	// a rehash isn't an edit, so it mustn't fail a concurrent update
+	if rehashed.Version != user.Version {
+		t.Errorf("expected version %d but got %d", user.Version, rehashed.Version)
+	}
+
+	// someone else got there first
+	err = repo.RehashPassword(ctx, user.ID, oldHash, "secret")
+	if !errors.Is(err, repository.ErrModified) {
+		t.Errorf("expected repository.ErrModified but got %v", err)
+	}
+
+	err = repo.RehashPassword(ctx, 1000, oldHash, "secret")
+	expectNotFound(t, "RehashPassword", err)
+}
+
+func testDeleteUser(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	jack := insertUser(t, repo, "Jack", "Smith")
+	jill := insertUser(t, repo, "Jill", "Smith")
+	insertImage(t, repo, jack.ID, "jack.png")
+	insertImage(t, repo, jill.ID, "jill.png")
+
+	err := repo.DeleteUser(ctx, jack.ID, jack.Version+1)
+	if !errors.Is(err, repository.ErrModified) {
+		t.Errorf("expected repository.ErrModified for a stale version but got %v", err)
+	}
+
+	err = repo.DeleteUser(ctx, jack.ID, jack.Version)
+	if err != nil {
+		t.Errorf("error deleting user: %s", err)
+	}
+
+	// a deleted user is gone as far as everything else is concerned
+	_, err = repo.GetUser(ctx, jack.ID)
+	expectNotFound(t, "GetUser after DeleteUser", err)
+	_, err = repo.GetUserByEmail(ctx, jack.Email)
+	expectNotFound(t, "GetUserByEmail after DeleteUser", err)
+	err = repo.UpdateUser(ctx, *jack)
+	expectNotFound(t, "UpdateUser after DeleteUser", err)
+	err = repo.UpdateAvatarVisibility(ctx, jack.ID, data.AvatarPrivate, jack.Version)
+	expectNotFound(t, "UpdateAvatarVisibility after DeleteUser", err)
+	err = repo.ResetPassword(ctx, jack.ID, "new password")
+	expectNotFound(t, "ResetPassword after DeleteUser", err)
+	err = repo.RehashPassword(ctx, jack.ID, jack.Password, "secret")
+	expectNotFound(t, "RehashPassword after DeleteUser", err)
+
+	err = repo.DeleteUser(ctx, jack.ID, jack.Version)
+	expectNotFound(t, "DeleteUser twice", err)
+
+	users, _ := repo.AllUsers(ctx)
+	if len(users) != 1 || users[0].ID != jill.ID {
+		t.Errorf("expected only the other user to be listed, but got %d users", len(users))
+	}
+
+	// the user's images are hidden with them, and nobody else's are
+	images, _ := repo.AllUserImages(ctx, jack.ID)
+	if len(images) != 0 {
+		t.Errorf("expected the deleted user's images to be hidden, but got %d", len(images))
+	}
+	images, _ = repo.AllUserImages(ctx, jill.ID)
+	if len(images) != 1 {
+		t.Errorf("expected the other user's image to be kept, but got %d images", len(images))
+	}
+
+	deleted, err := repo.DeletedUsers(ctx)
+	if err != nil {
+		t.Fatalf("error listing deleted users: %s", err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != jack.ID || deleted[0].DeletedAt == nil ||
+		time.Since(*deleted[0].DeletedAt) > time.Minute {
+		t.Errorf("expected the deleted user, deleted just now, but got %+v", deleted)
+	}
+	if deleted[0].Version != jack.Version+1 {
+		t.Errorf("expected deleting to bump the version to %d, but it is %d", jack.Version+1, deleted[0].Version)
+	}
+
+	// their address is free for someone else
+	_, err = repo.InsertUser(ctx, data.User{FirstName: "New", LastName: "Jack", Email: jack.Email, Password: "secret"})
+	if err != nil {
+		t.Errorf("expected a deleted user's address to be free, but got %s", err)
+	}
+}
+
+func testRestoreUser(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	jack := insertUser(t, repo, "Jack", "Smith")
+	insertImage(t, repo, jack.ID, "jack.png")
+
+	err := repo.RestoreUser(ctx, jack.ID)
+	expectNotFound(t, "RestoreUser of a live user", err)
+	err = repo.RestoreUser(ctx, 1000)
+	expectNotFound(t, "RestoreUser of a missing user", err)
+
+	err = repo.DeleteUser(ctx, jack.ID, jack.Version)
+	if err != nil {
+		t.Fatalf("error deleting user: %s", err)
+	}
+	err = repo.RestoreUser(ctx, jack.ID)
+	if err != nil {
+		t.Fatalf("error restoring user: %s", err)
+	}
+
+	// they come back with their image
+	restored, err := repo.GetUser(ctx, jack.ID)
+	if err != nil {
+		t.Fatalf("restored user not found: %s", err)
+	}
+	if restored.ProfilePic.FileName != "jack.png" || restored.DeletedAt != nil {
+		t.Errorf("expected the user back as they were, but got %+v", restored)
+	}
+	if deleted, _ := repo.DeletedUsers(ctx); len(deleted) != 0 {
+		t.Errorf("expected no deleted users but got %d", len(deleted))
+	}
+
+	// but not if someone else has taken their address in the meantime
+	_ = repo.DeleteUser(ctx, jack.ID, restored.Version)
+	_, err = repo.InsertUser(ctx, data.User{FirstName: "New", LastName: "Jack", Email: jack.Email, Password: "secret"})
+	if err != nil {
+		t.Fatalf("error inserting user: %s", err)
+	}
+	err = repo.RestoreUser(ctx, jack.ID)
+	if !errors.Is(err, repository.ErrDuplicateEmail) {
+		t.Errorf("expected repository.ErrDuplicateEmail but got %v", err)
+	}
+	_, err = repo.GetUser(ctx, jack.ID)
+	expectNotFound(t, "GetUser after a failed RestoreUser", err)
+}
+
+func testScheduleDeletion(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	jack := insertUser(t, repo, "Jack", "Smith")
+	jill := insertUser(t, repo, "Jill", "Smith")
+	john := insertUser(t, repo, "John", "Smith")
+
+	soon := time.Now().Add(time.Hour).Truncate(time.Second)
+	later := soon.Add(24 * time.Hour)
+	err := repo.ScheduleDeletion(ctx, 1000, &soon)
+	expectNotFound(t, "ScheduleDeletion of a missing user", err)
+
+	for _, s := range []struct {
+		id    int
+		after time.Time
+	}{{jack.ID, soon}, {jill.ID, later}, {john.ID, soon}} {
+		err := repo.ScheduleDeletion(ctx, s.id, &s.after)
+		if err != nil {
+			t.Fatalf("error scheduling deletion: %s", err)
+		}
+	}
+
+	// the user can see when, and it counts as a change
+	scheduled, err := repo.GetUser(ctx, jack.ID)
+	if err != nil {
+		t.Fatalf("error reading user: %s", err)
+	}
+	if scheduled.DeleteAfter == nil || !scheduled.DeleteAfter.Equal(soon) {
+		t.Errorf("expected the deletion to be scheduled for %s, but got %v", soon, scheduled.DeleteAfter)
+	}
+	if scheduled.Version != jack.Version+1 {
+		t.Errorf("expected scheduling to bump the version to %d, but it is %d", jack.Version+1, scheduled.Version)
+	}
+
+	// john changes his mind
+	err = repo.ScheduleDeletion(ctx, john.ID, nil)
+	if err != nil {
+		t.Fatalf("error calling off deletion: %s", err)
+	}
+	if u, _ := repo.GetUser(ctx, john.ID); u == nil || u.DeleteAfter != nil {
+		t.Errorf("expected john's deletion to be called off, but got %+v", u)
+	}
+
+	// nobody is due yet
+	ids, err := repo.DeleteScheduledUsers(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("error deleting scheduled users: %s", err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("expected nobody to be deleted, but got %v", ids)
+	}
+
+	ids, err = repo.DeleteScheduledUsers(ctx, soon)
+	if err != nil {
+		t.Fatalf("error deleting scheduled users: %s", err)
+	}
+	if !slices.Equal(ids, []int{jack.ID}) {
+		t.Errorf("expected only jack to be deleted, but got %v", ids)
+	}
+	_, err = repo.GetUser(ctx, jack.ID)
+	expectNotFound(t, "GetUser after DeleteScheduledUsers", err)
+	if u, err := repo.GetUser(ctx, jill.ID); err != nil || u.DeleteAfter == nil {
+		t.Errorf("expected jill to stay scheduled, but got %+v, %v", u, err)
+	}
+
+	// restored, the deletion doesn't come back with him
+	err = repo.RestoreUser(ctx, jack.ID)
+	if err != nil {
+		t.Fatalf("error restoring user: %s", err)
+	}
+	if u, _ := repo.GetUser(ctx, jack.ID); u == nil || u.DeleteAfter != nil {
+		t.Errorf("expected the restored user to have nothing scheduled, but got %+v", u)
+	}
+	ids, _ = repo.DeleteScheduledUsers(ctx, soon)
+	if len(ids) != 0 {
+		t.Errorf("expected the restored user not to be deleted again, but got %v", ids)
+	}
+}
+
+func testPurgeDeletedUsers(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	jack := insertUser(t, repo, "Jack", "Smith")
+	jill := insertUser(t, repo, "Jill", "Smith")
+	john := insertUser(t, repo, "John", "Smith")
+	insertImage(t, repo, jack.ID, "jack1.png")
+	insertImage(t, repo, jack.ID, "jack2.png")
+	insertImage(t, repo, jill.ID, "jill.png")
+
+	for _, u := range []*data.User{jack, jill} {
+		err := repo.DeleteUser(ctx, u.ID, u.Version)
+		if err != nil {
+			t.Fatalf("error deleting user: %s", err)
+		}
+	}
+
+	// nobody was deleted before an hour ago
+	purged, err := repo.PurgeDeletedUsers(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("error purging users: %s", err)
+	}
+	if len(purged) != 0 {
+		t.Errorf("expected nobody to be purged, but got %+v", purged)
+	}
+
+	purged, err = repo.PurgeDeletedUsers(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("error purging users: %s", err)
+	}
+	if len(purged) != 2 || purged[0].ID != jack.ID || purged[1].ID != jill.ID {
+		t.Fatalf("expected both deleted users to be purged, but got %+v", purged)
+	}
+	if !slices.Equal(purged[0].FileNames, []string{"jack1.png", "jack2.png"}) {
+		t.Errorf("expected jack's images, but got %v", purged[0].FileNames)
+	}
+	if !slices.Equal(purged[1].FileNames, []string{"jill.png"}) {
+		t.Errorf("expected jill's image, but got %v", purged[1].FileNames)
+	}
+
+	// they can't be restored now, and the live user is left alone
+	err = repo.RestoreUser(ctx, jack.ID)
+	expectNotFound(t, "RestoreUser after PurgeDeletedUsers", err)
+	if deleted, _ := repo.DeletedUsers(ctx); len(deleted) != 0 {
+		t.Errorf("expected no deleted users but got %d", len(deleted))
+	}
+	if _, err := repo.GetUser(ctx, john.ID); err != nil {
+		t.Errorf("expected the live user to be kept, but got %s", err)
+	}
+}
+
+func testInsertUserImage(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	user := insertUser(t, repo, "Jack", "Smith")
+
+	_, err := repo.InsertUserImage(ctx, data.UserImage{UserID: 1000, FileName: "orphan.png"})
+	expectNotFound(t, "InsertUserImage for a missing user", err)
+
+	firstID := insertImage(t, repo, user.ID, "first.png")
+	secondID := insertImage(t, repo, user.ID, "second.png")
+	if secondID <= firstID {
+		t.Errorf("expected increasing ids but got %d and %d", firstID, secondID)
+	}
+
+	// the newest image comes first, and is the only active one
+	images, err := repo.AllUserImages(ctx, user.ID)
+	if err != nil {
+		t.Errorf("all user images reports an error: %s", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("all user images reports wrong size; expected 2, but got %d", len(images))
+	}
+	if images[0].ID != secondID || !images[0].IsActive || images[1].IsActive {
+		t.Errorf("expected newest image %d to be first and the only active one", secondID)
+	}
+	if images[0].UserID != user.ID || images[0].FileName != "second.png" || images[0].CreatedAt.IsZero() {
+		t.Errorf("image was not stored as inserted: %+v", images[0])
+	}
+
+	user, _ = repo.GetUser(ctx, user.ID)
+	if user.ProfilePic.ID != secondID || user.ProfilePic.FileName != "second.png" {
+		t.Errorf("expected profile pic %d second.png but got %d %s", secondID, user.ProfilePic.ID, user.ProfilePic.FileName)
+	}
+
+	images, _ = repo.AllUserImages(ctx, 1000)
+	if len(images) != 0 {
+		t.Errorf("expected no images for a missing user but got %d", len(images))
+	}
+}
+
+func testSetActiveUserImage(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	jack := insertUser(t, repo, "Jack", "Smith")
+	jill := insertUser(t, repo, "Jill", "Smith")
+	firstID := insertImage(t, repo, jack.ID, "first.png")
+	insertImage(t, repo, jack.ID, "second.png")
+
+	err := repo.SetActiveUserImage(ctx, jack.ID, firstID)
+	if err != nil {
+		t.Errorf("setting active user image failed: %s", err)
+	}
+	jack, _ = repo.GetUser(ctx, jack.ID)
+	if jack.ProfilePic.ID != firstID {
+		t.Errorf("expected profile pic %d but got %d", firstID, jack.ProfilePic.ID)
+	}
+
+	err = repo.SetActiveUserImage(ctx, jill.ID, firstID)
+	expectNotFound(t, "SetActiveUserImage with someone else's image", err)
+
+	// the failed attempt left the owner's choice alone
+	jack, _ = repo.GetUser(ctx, jack.ID)
+	if jack.ProfilePic.ID != firstID {
+		t.Errorf("expected profile pic %d but got %d", firstID, jack.ProfilePic.ID)
+	}
+}
+
+func testDeleteUserImage(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	jack := insertUser(t, repo, "Jack", "Smith")
+	jill := insertUser(t, repo, "Jill", "Smith")
+	firstID := insertImage(t, repo, jack.ID, "first.png")
+	secondID := insertImage(t, repo, jack.ID, "second.png")
+	thirdID := insertImage(t, repo, jack.ID, "third.png")
+
+	err := repo.DeleteUserImage(ctx, jill.ID, thirdID)
+	expectNotFound(t, "DeleteUserImage with someone else's image", err)
+
+	// deleting an inactive image leaves the active one alone
+	err = repo.DeleteUserImage(ctx, jack.ID, firstID)
+	if err != nil {
+		t.Errorf("deleting user image failed: %s", err)
+	}
+	jack, _ = repo.GetUser(ctx, jack.ID)
+	if jack.ProfilePic.ID != thirdID {
+		t.Errorf("expected profile pic %d but got %d", thirdID, jack.ProfilePic.ID)
+	}
+
+	// deleting the active image promotes the newest remaining one
+	err = repo.DeleteUserImage(ctx, jack.ID, thirdID)
+	if err != nil {
+		t.Errorf("deleting user image failed: %s", err)
+	}
+	jack, _ = repo.GetUser(ctx, jack.ID)
+	if jack.ProfilePic.ID != secondID {
+		t.Errorf("expected image %d to become active, but got %d", secondID, jack.ProfilePic.ID)
+	}
+
+	err = repo.DeleteUserImage(ctx, jack.ID, thirdID)
+	expectNotFound(t, "DeleteUserImage twice", err)
+
+	err = repo.DeleteUserImage(ctx, jack.ID, secondID)
+	if err != nil {
+		t.Errorf("deleting last user image failed: %s", err)
+	}
+	jack, _ = repo.GetUser(ctx, jack.ID)
+	if jack.ProfilePic.FileName != "" {
+		t.Errorf("expected no profile pic but got %s", jack.ProfilePic.FileName)
+	}
+}
+
+func testCountUserImagesByFileName(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	jack := insertUser(t, repo, "Jack", "Smith")
+	jill := insertUser(t, repo, "Jill", "Smith")
+	jacksID := insertImage(t, repo, jack.ID, "shared.png")
+	insertImage(t, repo, jill.ID, "shared.png")
+	insertImage(t, repo, jill.ID, "other.png")
+
+	var tests = []struct {
+		name     string
+		fileName string
+		expected int
+	}{
+		{"shared", "shared.png", 2},
+		{"own", "other.png", 1},
+		{"unknown", "missing.png", 0},
+	}
+
+	for _, e := range tests {
+		count, err := repo.CountUserImagesByFileName(ctx, e.fileName)
+		if err != nil {
+			t.Errorf("%s: counting images returned an error: %s", e.name, err)
+		}
+		if count != e.expected {
+			t.Errorf("%s: expected %d images but got %d", e.name, e.expected, count)
+		}
+	}
+
+	// deleted users' images still count, until they are purged
+	err := repo.DeleteUser(ctx, jill.ID, jill.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.DeleteUserImage(ctx, jack.ID, jacksID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, _ := repo.CountUserImagesByFileName(ctx, "shared.png")
+	if count != 1 {
+		t.Errorf("expected jill's image to count but got %d", count)
+	}
+}
+
+func testRoles(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+
+	permissions, err := repo.AllPermissions(ctx)
+	if err != nil {
+		t.Fatalf("error listing permissions: %s", err)
+	}
+	var allPermissions []string
+	for _, p := range permissions {
+		allPermissions = append(allPermissions, p.Name)
+	}
+	for _, p := range data.KnownPermissions {
+		if !slices.Contains(allPermissions, p.Name) {
+			t.Errorf("permission %s is missing", p.Name)
+		}
+	}
+
+	roles, err := repo.AllRoles(ctx)
+	if err != nil {
+		t.Fatalf("error listing roles: %s", err)
+	}
+	if len(roles) != 1 || roles[0].Name != data.RoleAdmin || !slices.Equal(roles[0].Permissions, allPermissions) {
+		t.Errorf("expected just the admin role, with every permission, but got %v", roles)
+	}
+
+	_, err = repo.InsertRole(ctx, data.Role{Name: "editor", Permissions: []string{data.PermUsersWrite, data.PermUsersRead}})
+	if err != nil {
+		t.Fatalf("error inserting role: %s", err)
+	}
+	_, err = repo.InsertRole(ctx, data.Role{Name: "editor"})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertRole twice: expected repository.ErrConflict but got %v", err)
+	}
+	_, err = repo.InsertRole(ctx, data.Role{Name: "broken", Permissions: []string{"nothing:at-all"}})
+	expectNotFound(t, "InsertRole with a missing permission", err)
+	roles, _ = repo.AllRoles(ctx)
+	if len(roles) != 2 || roles[0].Name != data.RoleAdmin || roles[1].Name != "editor" {
+		t.Errorf("expected the admin and editor roles, in that order, but got %v", roles)
+	}
+
+	user := insertUser(t, repo, "Jack", "Smith")
+	if len(user.Roles) != 0 || len(user.Permissions) != 0 {
+		t.Errorf("new user has roles %v and permissions %v", user.Roles, user.Permissions)
+	}
+
+	// assigning a role twice is the same as assigning it once
+	for i := 0; i < 2; i++ {
+		err = repo.AssignRole(ctx, user.ID, "editor")
+		if err != nil {
+			t.Errorf("error assigning role: %s", err)
+		}
+	}
+	got, _ := repo.GetUser(ctx, user.ID)
+	if !slices.Equal(got.Roles, []string{"editor"}) || !slices.Equal(got.Permissions, []string{data.PermUsersRead, data.PermUsersWrite}) {
+		t.Errorf("expected the editor role and its permissions, but got %v and %v", got.Roles, got.Permissions)
+	}
+	if got.Version != user.Version {
+		t.Errorf("assigning a role changed the version from %d to %d", user.Version, got.Version)
+	}
+
+	// permissions granted by more than one role are listed once
+	err = repo.AssignRole(ctx, user.ID, data.RoleAdmin)
+	if err != nil {
+		t.Errorf("error assigning role: %s", err)
+	}
+	got, _ = repo.GetUserByEmail(ctx, user.Email)
+	if !slices.Equal(got.Roles, []string{data.RoleAdmin, "editor"}) || !slices.Equal(got.Permissions, allPermissions) {
+		t.Errorf("expected the admin and editor roles and every permission, but got %v and %v", got.Roles, got.Permissions)
+	}
+	users, _ := repo.AllUsers(ctx)
+	if len(users) != 1 || !slices.Equal(users[0].Roles, got.Roles) || !slices.Equal(users[0].Permissions, got.Permissions) {
+		t.Error("AllUsers does not list the same roles and permissions as GetUser")
+	}
+
+	err = repo.AssignRole(ctx, 1000, "editor")
+	expectNotFound(t, "AssignRole for a missing user", err)
+	err = repo.AssignRole(ctx, user.ID, "nobody")
+	expectNotFound(t, "AssignRole of a missing role", err)
+
+	err = repo.RevokeRole(ctx, user.ID, data.RoleAdmin)
+	if err != nil {
+		t.Errorf("error revoking role: %s", err)
+	}
+	err = repo.RevokeRole(ctx, user.ID, data.RoleAdmin)
+	expectNotFound(t, "RevokeRole twice", err)
+
+	for i := 0; i < 2; i++ {
+		err = repo.GrantPermission(ctx, "editor", data.PermUsersDelete)
+		if err != nil {
+			t.Errorf("error granting permission: %s", err)
+		}
+	}
+	got, _ = repo.GetUser(ctx, user.ID)
+	if !slices.Equal(got.Roles, []string{"editor"}) || !slices.Equal(got.Permissions, []string{data.PermUsersDelete, data.PermUsersRead, data.PermUsersWrite}) {
+		t.Errorf("expected the editor role with users:delete granted, but got %v and %v", got.Roles, got.Permissions)
+	}
+
+	err = repo.GrantPermission(ctx, "nobody", data.PermUsersRead)
+	expectNotFound(t, "GrantPermission to a missing role", err)
+	err = repo.GrantPermission(ctx, "editor", "nothing:at-all")
+	expectNotFound(t, "GrantPermission of a missing permission", err)
+
+	err = repo.RevokePermission(ctx, "editor", data.PermUsersDelete)
+	if err != nil {
+		t.Errorf("error revoking permission: %s", err)
+	}
+	err = repo.RevokePermission(ctx, "editor", data.PermUsersDelete)
+	expectNotFound(t, "RevokePermission twice", err)
+
+	got, _ = repo.GetUser(ctx, user.ID)
+	if slices.Contains(got.Permissions, data.PermUsersDelete) {
+		t.Error("revoked permission is still granted")
+	}
+
+	// the user's roles don't stop them being deleted
+	err = repo.DeleteUser(ctx, user.ID, got.Version)
+	if err != nil {
+		t.Errorf("error deleting a user with roles: %s", err)
+	}
+}
+
+func testAuditEvents(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	// an hour ago, so that events stamped now come after the others
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	_, err := repo.LastAuditEvent(ctx)
+	expectNotFound(t, "last event of an empty audit log", err)
+
+	events := []data.AuditEvent{
+		{Time: start, Action: data.AuditLoginFailed, TargetType: "user", IP: "10.0.0.1", UserAgent: "curl/8.0", Detail: "unknown email address"},
+		{Time: start.Add(time.Minute), ActorID: 1, Action: data.AuditLogin, TargetType: "user", TargetID: "1", IP: "10.0.0.1"},
+		{Time: start.Add(2 * time.Minute), ActorID: 1, Action: data.AuditUserUpdated, TargetType: "user", TargetID: "2",
+			Changes: map[string]data.Change{"email": {Before: "jack@example.com", After: "jack@smith.com"}}},
+		{ActorID: 2, Action: data.AuditLogin, TargetType: "user", TargetID: "2"},
+	}
+	var ids []int
+	for _, e := range events {
+		id, err := repo.InsertAuditEvent(ctx, e)
+		if err != nil {
+			t.Fatalf("error inserting audit event: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] <= 0 || ids[1] <= ids[0] || ids[3] <= ids[2] {
+		t.Errorf("expected increasing ids but got %v", ids)
+	}
+
+	all, err := repo.AuditEvents(ctx, data.AuditFilter{})
+	if err != nil {
+		t.Fatalf("error listing audit events: %s", err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("expected 4 events but got %d", len(all))
+	}
+	if got := all[0]; got.ID != ids[0] || !got.Time.Equal(start) || got.Action != data.AuditLoginFailed ||
+		got.IP != "10.0.0.1" || got.UserAgent != "curl/8.0" || got.Detail != "unknown email address" || got.Changes != nil {
+		t.Errorf("first event was not stored as given: %+v", got)
+	}
+	if change := all[2].Changes["email"]; change.Before != "jack@example.com" || change.After != "jack@smith.com" {
+		t.Errorf("expected the email change to be stored, but got %v", all[2].Changes)
+	}
+	if time.Since(all[3].Time) > time.Minute {
+		t.Errorf("an event without a time should happen now, but happened at %s", all[3].Time)
+	}
+
+	// each event is chained to the one before it, and what is read back hashes the same
+	verifier := auditchain.NewVerifier(nil)
+	for i, e := range all {
+		if i == 0 && e.PrevHash != "" || i > 0 && e.PrevHash != all[i-1].Hash {
+			t.Errorf("event %d is not chained to the one before it: %q", e.ID, e.PrevHash)
+		}
+		err = verifier.Add(e)
+		if err != nil {
+			t.Errorf("expected the chain to verify, but got %s", err)
+		}
+	}
+
+	last, err := repo.LastAuditEvent(ctx)
+	if err != nil {
+		t.Fatalf("error getting the last audit event: %s", err)
+	}
+	if last.ID != ids[3] || last.Hash != all[3].Hash {
+		t.Errorf("expected the last event to be %d, but got %+v", ids[3], last)
+	}
+
+	var tests = []struct {
+		name     string
+		filter   data.AuditFilter
+		expected []int
+	}{
+		{"actor", data.AuditFilter{ActorID: 1}, []int{ids[1], ids[2]}},
+		{"action", data.AuditFilter{Action: data.AuditLogin}, []int{ids[1], ids[3]}},
+		{"target", data.AuditFilter{TargetType: "user", TargetID: "2"}, []int{ids[2], ids[3]}},
+		{"since", data.AuditFilter{Since: start.Add(time.Minute)}, []int{ids[1], ids[2], ids[3]}},
+		{"until", data.AuditFilter{Until: start.Add(time.Minute)}, []int{ids[0]}},
+		{"after", data.AuditFilter{AfterID: ids[1]}, []int{ids[2], ids[3]}},
+		{"limit", data.AuditFilter{Limit: 2}, []int{ids[0], ids[1]}},
+		{"several", data.AuditFilter{ActorID: 1, Action: data.AuditLogin, AfterID: ids[0]}, []int{ids[1]}},
+		{"nothing", data.AuditFilter{ActorID: 3}, nil},
+	}
+
+	for _, e := range tests {
+		got, err := repo.AuditEvents(ctx, e.filter)
+		if err != nil {
+			t.Errorf("%s: error listing audit events: %s", e.name, err)
+			continue
+		}
+		var gotIDs []int
+		for _, event := range got {
+			gotIDs = append(gotIDs, event.ID)
+		}
+		if !slices.Equal(gotIDs, e.expected) {
+			t.Errorf("%s: expected events %v but got %v", e.name, e.expected, gotIDs)
+		}
+	}
+
+	// events written in a rolled back transaction are gone with it
+	_ = repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		_, err := tx.InsertAuditEvent(ctx, data.AuditEvent{Action: data.AuditUserDeleted})
+		if err != nil {
+			return err
+		}
+		return errors.New("roll back")
+	})
+	all, _ = repo.AuditEvents(ctx, data.AuditFilter{})
+	if len(all) != 4 {
+		t.Errorf("expected the rolled back event to be gone, but there are %d events", len(all))
+	}
+}
+
+func testWithTx(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+
+	// a failing transaction leaves nothing behind
+	err := repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		_, err := tx.InsertUser(ctx, data.User{Email: "rollback@example.com", Password: "secret"})
+		if err != nil {
+			return err
+		}
+		return errors.New("roll back")
+	})
+	if err == nil || err.Error() != "roll back" {
+		t.Errorf("expected the error returned by fn but got %v", err)
+	}
+	_, err = repo.GetUserByEmail(ctx, "rollback@example.com")
+	expectNotFound(t, "user inserted in a rolled back transaction", err)
+
+	// a failing nested transaction only undoes its own work
+	var id int
+	err = repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		var err error
+		id, err = tx.InsertUser(ctx, data.User{Email: "commit@example.com", Password: "secret"})
+		if err != nil {
+			return err
+		}
+
+		innerErr := tx.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+			_, err := tx.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "tx.png"})
+			if err != nil {
+				return err
+			}
+			return errors.New("roll back to savepoint")
+		})
+		if innerErr == nil {
+			t.Error("expected the error returned by the inner fn")
+		}
+
+		// what the transaction has done so far is visible inside it
+		_, err = tx.GetUser(ctx, id)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+
+	user, err := repo.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("user inserted in a committed transaction does not exist: %s", err)
+	}
+	if user.ProfilePic.FileName != "" {
+		t.Errorf("image inserted in a rolled back nested transaction exists: %s", user.ProfilePic.FileName)
+	}
+}
+
+func testCancelledContext(t *testing.T, repo repository.DatabaseRepo) {
+	user := insertUser(t, repo, "Jack", "Smith")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := repo.GetUser(ctx, user.ID)
+	if err == nil {
+		t.Error("GetUser: expected an error with a cancelled context")
+	}
+	_, err = repo.AllUsers(ctx)
+	if err == nil {
+		t.Error("AllUsers: expected an error with a cancelled context")
+	}
+	err = repo.UpdateAvatarVisibility(ctx, user.ID, data.AvatarPrivate, user.Version)
+	if err == nil {
+		t.Error("UpdateAvatarVisibility: expected an error with a cancelled context")
+	}
+}
@@ -0,0 +1,110 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultChunkSize = 1024 * 64
+
+// ClamdScanner scans files by streaming them to a clamd daemon with the INSTREAM
+// command, over TCP or a unix socket.
+type ClamdScanner struct {
+	// Network is "tcp" or "unix".
+	Network string
+	// Address is host:port for tcp, or the socket path for unix.
+	Address string
+	// Timeout limits how long a single scan may take. Zero means no limit, other
+	// than the context passed to Scan.
+	Timeout time.Duration
+	// ChunkSize is the size of the chunks we send; clamd's default StreamMaxLength
+	// still limits the total size.
+	ChunkSize int
+}
+
+// Scan sends r to clamd, and reports whether it found anything.
+func (c *ClamdScanner) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return Result{}, fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// the z prefix means commands and replies are terminated by a null byte
+	_, err = conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return Result{}, fmt.Errorf("clamd: %w", err)
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	// each chunk is prefixed with its length as a 4 byte big endian integer, and a
+	// zero length chunk marks the end of the stream
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, readErr := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			_, err = conn.Write(buf[:4+n])
+			if err != nil {
+				return Result{}, fmt.Errorf("clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return Result{}, readErr
+		}
+	}
+
+	_, err = conn.Write([]byte{0, 0, 0, 0})
+	if err != nil {
+		return Result{}, fmt.Errorf("clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return Result{}, fmt.Errorf("clamd: %w", err)
+	}
+
+	return parseReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseReply interprets clamd's answer, which is "stream: OK",
+// "stream: <signature> FOUND" or "<message> ERROR".
+func parseReply(reply string) (Result, error) {
+	switch {
+	case strings.HasSuffix(reply, " ERROR"):
+		return Result{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(reply, " ERROR"))
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(reply, " FOUND")
+		signature = strings.TrimSpace(strings.TrimPrefix(signature, "stream:"))
+		return Result{Infected: true, Signature: signature}, nil
+	case strings.HasSuffix(reply, "OK"):
+		return Result{}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+}
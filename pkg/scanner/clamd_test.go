@@ -0,0 +1,125 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd speaks just enough of clamd's protocol to answer INSTREAM commands. It
+// reports the EICAR test string as infected, and optionally rejects everything.
+func fakeClamd(t *testing.T, network, address, errorReply string) net.Listener {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+						return
+					}
+				}
+
+				switch {
+				case errorReply != "":
+					_, _ = conn.Write([]byte(errorReply + " ERROR\x00"))
+				case bytes.Contains(data.Bytes(), []byte(eicar)):
+					_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				default:
+					_, _ = conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+
+	return l
+}
+
+func TestClamdScanner_Scan(t *testing.T) {
+	tcp := fakeClamd(t, "tcp", "127.0.0.1:0", "")
+	unix := fakeClamd(t, "unix", filepath.Join(t.TempDir(), "clamd.sock"), "")
+	broken := fakeClamd(t, "tcp", "127.0.0.1:0", "INSTREAM size limit exceeded.")
+
+	var tests = []struct {
+		name              string
+		scanner           *ClamdScanner
+		content           string
+		expectedInfected  bool
+		expectedSignature string
+		errorExpected     bool
+	}{
+		{"clean over tcp", &ClamdScanner{Network: "tcp", Address: tcp.Addr().String()}, "hello", false, "", false},
+		{"infected over tcp", &ClamdScanner{Network: "tcp", Address: tcp.Addr().String()}, eicar, true, "Eicar-Test-Signature", false},
+		{"clean over unix socket", &ClamdScanner{Network: "unix", Address: unix.Addr().String()}, "hello", false, "", false},
+		{"infected over unix socket", &ClamdScanner{Network: "unix", Address: unix.Addr().String()}, eicar, true, "Eicar-Test-Signature", false},
+		{"infected across chunks", &ClamdScanner{Network: "tcp", Address: tcp.Addr().String(), ChunkSize: 7}, "padding" + eicar, true, "Eicar-Test-Signature", false},
+		{"clamd error", &ClamdScanner{Network: "tcp", Address: broken.Addr().String()}, "hello", false, "", true},
+		{"clamd not running", &ClamdScanner{Network: "unix", Address: filepath.Join(t.TempDir(), "none.sock")}, "hello", false, "", true},
+	}
+
+	for _, e := range tests {
+		result, err := e.scanner.Scan(context.Background(), strings.NewReader(e.content))
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: expected an error but did not get one", e.name)
+		}
+		if result.Infected != e.expectedInfected || result.Signature != e.expectedSignature {
+			t.Errorf("%s: expected infected=%t (%s) but got %+v", e.name, e.expectedInfected, e.expectedSignature, result)
+		}
+	}
+}
+
+func Test_parseReply(t *testing.T) {
+	var tests = []struct {
+		reply         string
+		infected      bool
+		errorExpected bool
+	}{
+		{"stream: OK", false, false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", true, false},
+		{"INSTREAM size limit exceeded. ERROR", false, true},
+		{"something else", false, true},
+	}
+
+	for _, e := range tests {
+		result, err := parseReply(e.reply)
+		if (err != nil) != e.errorExpected || result.Infected != e.infected {
+			t.Errorf("%q: got %+v, %v", e.reply, result, err)
+		}
+	}
+}
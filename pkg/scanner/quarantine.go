@@ -0,0 +1,62 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Record describes a file that was quarantined. It is written as JSON next to the file.
+type Record struct {
+	FileName  string    `json:"file_name"`
+	UserID    int       `json:"user_id"`
+	Signature string    `json:"signature"`
+	IP        string    `json:"ip,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Quarantine keeps infected files out of the upload directory, where we can inspect
+// them later without serving them to anyone.
+type Quarantine struct {
+	Dir string
+}
+
+// Store copies r into the quarantine directory, along with rec, and returns the path
+// of the quarantined file.
+func (q *Quarantine) Store(r io.Reader, rec Record) (string, error) {
+	err := os.MkdirAll(q.Dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	name := fmt.Sprintf("%s-%d-%s", rec.Time.UTC().Format("20060102T150405.000000000"), rec.UserID, filepath.Base(rec.FileName))
+	path := filepath.Join(q.Dir, name)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(path+".json", b, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,37 @@
+package scanner
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuarantine_Store(t *testing.T) {
+	q := &Quarantine{Dir: filepath.Join(t.TempDir(), "quarantine")}
+
+	path, err := q.Store(strings.NewReader(eicar), Record{FileName: "../evil.png", UserID: 1, Signature: "Eicar-Test-Signature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Dir(path) != q.Dir {
+		t.Errorf("quarantined file %s is outside %s", path, q.Dir)
+	}
+
+	content, _ := os.ReadFile(path)
+	if string(content) != eicar {
+		t.Error("quarantined file has the wrong content")
+	}
+
+	var rec Record
+	b, _ := os.ReadFile(path + ".json")
+	err = json.Unmarshal(b, &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Signature != "Eicar-Test-Signature" || rec.UserID != 1 || rec.Time.IsZero() {
+		t.Errorf("wrong quarantine record: %+v", rec)
+	}
+}
@@ -0,0 +1,23 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrInfected is returned (wrapped) when an uploaded file contains malware.
+var ErrInfected = errors.New("file is infected")
+
+// Result is the outcome of scanning a file.
+type Result struct {
+	Infected bool
+	// Signature names the malware that was found, if any.
+	Signature string
+}
+
+// Scanner is the type for anything that can check a file for malware before we
+// make it available to other users.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
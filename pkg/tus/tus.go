@@ -0,0 +1,506 @@
+package tus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Version is the version of the tus protocol implemented by this package.
+const Version = "1.0.0"
+
+// Extensions lists the tus protocol extensions we support.
+const Extensions = "creation,termination,expiration"
+
+// Upload describes one resumable upload. It is stored as JSON next to the data file.
+type Upload struct {
+	ID       string            `json:"id"`
+	Owner    string            `json:"owner"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"-"`
+	Metadata map[string]string `json:"metadata"`
+	Expires  time.Time         `json:"expires"`
+	// Path is the location of the uploaded data on disk.
+	Path string `json:"-"`
+}
+
+// FileName returns the base name of the file the client said it was uploading, or the
+// upload ID if it did not send a usable one.
+func (u Upload) FileName() string {
+	name := filepath.Base(u.Metadata["filename"])
+	if name == "." || name == "/" || name == ".." {
+		return u.ID
+	}
+	return name
+}
+
+// Config holds the settings for a Handler.
+type Config struct {
+	// Dir is where partial uploads are stored.
+	Dir string
+	// MaxSize is the largest upload we accept, in bytes.
+	MaxSize int64
+	// Expiration is how long an incomplete upload is kept after it was last written to.
+	Expiration time.Duration
+	// Owner identifies the user making a request. Uploads may only be resumed or
+	// terminated by the user who created them.
+	Owner func(r *http.Request) string
+	// MaxUploadsPerOwner is how many incomplete uploads one user may have at a time.
+	// Zero means no limit.
+	MaxUploadsPerOwner int
+	// OnComplete is called with the request that wrote the last byte of an upload. It
+	// takes ownership of the data file at u.Path, for example by moving it elsewhere;
+	// whatever remains is removed afterwards.
+	OnComplete func(r *http.Request, u Upload) error
+}
+
+// Handler implements the server side of the tus resumable upload protocol.
+type Handler struct {
+	Config
+	locks sync.Map
+	// creating serializes Create, so that MaxUploadsPerOwner can't be exceeded by
+	// creating several uploads at once
+	creating sync.Mutex
+}
+
+// New returns a Handler for cfg, creating the upload directory if necessary.
+func New(cfg Config) (*Handler, error) {
+	err := os.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{Config: cfg}, nil
+}
+
+// Routes returns a router with the tus endpoints, to be mounted by the application.
+func (h *Handler) Routes() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(h.tusResumable)
+
+	mux.Options("/", h.Options)
+	mux.Post("/", h.Create)
+	mux.Head("/{uploadID}", h.Head)
+	mux.Patch("/{uploadID}", h.Patch)
+	mux.Delete("/{uploadID}", h.Terminate)
+	return mux
+}
+
+// tusResumable sets the Tus-Resumable header, and rejects requests for other protocol versions.
+func (h *Handler) tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", Version)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != Version {
+			w.Header().Set("Tus-Version", Version)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Options describes the server's capabilities.
+func (h *Handler) Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", Version)
+	w.Header().Set("Tus-Extension", Extensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create starts a new upload, and returns its URL in the Location header.
+func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > h.MaxSize {
+		http.Error(w, fmt.Sprintf("upload must be less than %d bytes", h.MaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not create upload", http.StatusInternalServerError)
+		return
+	}
+
+	owner := h.Owner(r)
+	h.creating.Lock()
+	defer h.creating.Unlock()
+
+	if h.MaxUploadsPerOwner > 0 {
+		n, err := h.countUploads(owner, time.Now())
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "could not create upload", http.StatusInternalServerError)
+			return
+		}
+		if n >= h.MaxUploadsPerOwner {
+			http.Error(w, "too many uploads in progress", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	u := Upload{
+		ID:       id,
+		Owner:    owner,
+		Length:   length,
+		Metadata: metadata,
+		Expires:  time.Now().Add(h.Expiration).UTC(),
+		Path:     h.dataPath(id),
+	}
+
+	f, err := os.Create(u.Path)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not create upload", http.StatusInternalServerError)
+		return
+	}
+	_ = f.Close()
+
+	err = h.saveInfo(u)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+id)
+	w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Head reports how much of an upload the server has, so the client can resume it.
+func (h *Handler) Head(w http.ResponseWriter, r *http.Request) {
+	u, err := h.lookup(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Patch appends the request body to an upload, starting at Upload-Offset.
+func (h *Handler) Patch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "content type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// only uploads that exist get a lock, so that made up ids can't fill up h.locks
+	u, err := h.lookup(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// only one request may write to an upload at a time
+	unlock, ok := h.tryLock(u.ID)
+	if !ok {
+		http.Error(w, "upload is being written to", http.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	// again, now that nobody else can be writing to it
+	u, err = h.lookup(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.Offset {
+		http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(u.Path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not write upload", http.StatusInternalServerError)
+		return
+	}
+
+	// whatever arrives before the client disconnects is kept, and can be resumed from
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, u.Length-u.Offset))
+	_ = f.Close()
+	u.Offset += n
+
+	u.Expires = time.Now().Add(h.Expiration).UTC()
+	err = h.saveInfo(u)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if copyErr != nil {
+		log.Println(copyErr)
+		http.Error(w, "upload interrupted", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+
+	if u.Offset == u.Length {
+		err = h.complete(r, u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Terminate abandons an upload, and removes everything stored for it.
+func (h *Handler) Terminate(w http.ResponseWriter, r *http.Request) {
+	u, err := h.lookup(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// not while it is being written to, or completed
+	unlock, ok := h.tryLock(u.ID)
+	if !ok {
+		http.Error(w, "upload is being written to", http.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	_, err = h.lookup(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	h.remove(u.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeExpired removes incomplete uploads whose expiry time has passed, and returns
+// how many were removed.
+func (h *Handler) PurgeExpired(now time.Time) (int, error) {
+	infos, err := filepath.Glob(filepath.Join(h.Dir, "*.info"))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, info := range infos {
+		u, err := h.loadInfo(strings.TrimSuffix(filepath.Base(info), ".info"))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if !now.After(u.Expires) {
+			continue
+		}
+
+		// uploads being written to are not abandoned, and get a new expiry time
+		unlock, ok := h.tryLock(u.ID)
+		if !ok {
+			continue
+		}
+		u, err = h.loadInfo(u.ID)
+		if err == nil && now.After(u.Expires) {
+			h.remove(u.ID)
+			count++
+		}
+		unlock()
+	}
+
+	return count, nil
+}
+
+// CollectGarbage calls PurgeExpired every interval, until ctx is cancelled.
+func (h *Handler) CollectGarbage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := h.PurgeExpired(now)
+			if err != nil {
+				log.Println(err)
+			}
+			if n > 0 {
+				log.Printf("removed %d expired uploads", n)
+			}
+		}
+	}
+}
+
+// complete hands a finished upload to OnComplete, and then cleans up after it.
+func (h *Handler) complete(r *http.Request, u Upload) error {
+	defer h.remove(u.ID)
+
+	if h.OnComplete == nil {
+		return nil
+	}
+	return h.OnComplete(r, u)
+}
+
+// lookup loads the upload named in the URL, if it exists, has not expired and belongs
+// to the user making the request.
+func (h *Handler) lookup(r *http.Request) (Upload, error) {
+	u, err := h.loadInfo(chi.URLParam(r, "uploadID"))
+	if err != nil {
+		return Upload{}, err
+	}
+	if u.Owner != h.Owner(r) || time.Now().After(u.Expires) {
+		return Upload{}, errors.New("upload not found")
+	}
+	return u, nil
+}
+
+// tryLock takes the lock for an upload, unless someone else holds it. Only the holder
+// may write to, complete or remove the upload.
+func (h *Handler) tryLock(id string) (unlock func(), ok bool) {
+	lock, _ := h.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// countUploads returns how many unexpired uploads owner has.
+func (h *Handler) countUploads(owner string, now time.Time) (int, error) {
+	infos, err := filepath.Glob(filepath.Join(h.Dir, "*.info"))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, info := range infos {
+		u, err := h.loadInfo(strings.TrimSuffix(filepath.Base(info), ".info"))
+		if err != nil {
+			continue
+		}
+		if u.Owner == owner && !now.After(u.Expires) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (h *Handler) loadInfo(id string) (Upload, error) {
+	var u Upload
+	if !validID(id) {
+		return u, errors.New("invalid upload id")
+	}
+
+	b, err := os.ReadFile(h.infoPath(id))
+	if err != nil {
+		return u, err
+	}
+	err = json.Unmarshal(b, &u)
+	if err != nil {
+		return u, err
+	}
+
+	// the size of the data file is the source of truth for the offset
+	u.Path = h.dataPath(id)
+	fi, err := os.Stat(u.Path)
+	if err != nil {
+		return u, err
+	}
+	u.Offset = fi.Size()
+
+	return u, nil
+}
+
+func (h *Handler) saveInfo(u Upload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(h.infoPath(u.ID), b, 0644)
+}
+
+func (h *Handler) remove(id string) {
+	_ = os.Remove(h.dataPath(id))
+	_ = os.Remove(h.infoPath(id))
+	h.locks.Delete(id)
+}
+
+func (h *Handler) dataPath(id string) string {
+	return filepath.Join(h.Dir, id+".bin")
+}
+
+func (h *Handler) infoPath(id string) string {
+	return filepath.Join(h.Dir, id+".info")
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validID makes sure an id taken from a URL can not be used to reach outside Dir.
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseMetadata decodes an Upload-Metadata header, which is a comma separated list
+// of keys, each followed by a space and its base64 encoded value.
+func parseMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %s", key)
+		}
+		metadata[key] = string(decoded)
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,327 @@
+package tus
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHandler(t *testing.T, completed *[]Upload) http.Handler {
+	h, err := New(Config{
+		Dir:        t.TempDir(),
+		MaxSize:    100,
+		Expiration: time.Hour,
+		Owner:      func(r *http.Request) string { return r.Header.Get("X-Owner") },
+		OnComplete: func(r *http.Request, u Upload) error {
+			b, err := os.ReadFile(u.Path)
+			if err != nil {
+				return err
+			}
+			u.Metadata["content"] = string(b)
+			*completed = append(*completed, u)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.Routes()
+}
+
+func tusRequest(method, target, body string, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", Version)
+	req.Header.Set("X-Owner", "1")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestHandler_Upload(t *testing.T) {
+	var completed []Upload
+	routes := newTestHandler(t, &completed)
+
+	// create
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, tusRequest("POST", "/", "", map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("me.png")),
+	}))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: expected status 201 but got %d", rr.Code)
+	}
+	location := rr.Header().Get("Location")
+	if rr.Header().Get("Upload-Expires") == "" {
+		t.Error("create: no Upload-Expires header")
+	}
+
+	var tests = []struct {
+		name           string
+		req            *http.Request
+		expectedStatus int
+		expectedOffset string
+	}{
+		{"head new upload", tusRequest("HEAD", location, "", nil), http.StatusOK, "0"},
+		{"first chunk", tusRequest("PATCH", location, "hello", map[string]string{
+			"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}), http.StatusNoContent, "5"},
+		{"head after first chunk", tusRequest("HEAD", location, "", nil), http.StatusOK, "5"},
+		{"wrong offset", tusRequest("PATCH", location, "world", map[string]string{
+			"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}), http.StatusConflict, ""},
+		{"wrong content type", tusRequest("PATCH", location, "world", map[string]string{
+			"Content-Type": "text/plain", "Upload-Offset": "5"}), http.StatusUnsupportedMediaType, ""},
+		{"someone else's upload", tusRequest("HEAD", location, "", map[string]string{"X-Owner": "2"}), http.StatusNotFound, ""},
+		{"last chunk", tusRequest("PATCH", location, " world", map[string]string{
+			"Content-Type": "application/offset+octet-stream", "Upload-Offset": "5"}), http.StatusNoContent, "11"},
+		{"head after completion", tusRequest("HEAD", location, "", nil), http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, e.req)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedOffset != "" && rr.Header().Get("Upload-Offset") != e.expectedOffset {
+			t.Errorf("%s: expected offset %s but got %s", e.name, e.expectedOffset, rr.Header().Get("Upload-Offset"))
+		}
+	}
+
+	if len(completed) != 1 {
+		t.Fatalf("expected one completed upload, but got %d", len(completed))
+	}
+	if completed[0].FileName() != "me.png" || completed[0].Metadata["content"] != "hello world" {
+		t.Errorf("completed upload has wrong name %s or content %q", completed[0].FileName(), completed[0].Metadata["content"])
+	}
+}
+
+func TestHandler_Create(t *testing.T) {
+	var completed []Upload
+	routes := newTestHandler(t, &completed)
+
+	var tests = []struct {
+		name           string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{"too large", map[string]string{"Upload-Length": "101"}, http.StatusRequestEntityTooLarge},
+		{"no length", map[string]string{}, http.StatusBadRequest},
+		{"bad metadata", map[string]string{"Upload-Length": "1", "Upload-Metadata": "filename !!!"}, http.StatusBadRequest},
+		{"wrong version", map[string]string{"Upload-Length": "1", "Tus-Resumable": "0.2.2"}, http.StatusPreconditionFailed},
+		{"empty upload", map[string]string{"Upload-Length": "0"}, http.StatusBadRequest},
+		{"negative length", map[string]string{"Upload-Length": "-1"}, http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, tusRequest("POST", "/", "", e.headers))
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	if len(completed) != 0 {
+		t.Errorf("expected no uploads to complete, but %d did", len(completed))
+	}
+}
+
+func TestHandler_CreateTooMany(t *testing.T) {
+	h, err := New(Config{
+		Dir:                t.TempDir(),
+		MaxSize:            100,
+		Expiration:         time.Hour,
+		Owner:              func(r *http.Request) string { return r.Header.Get("X-Owner") },
+		MaxUploadsPerOwner: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := h.Routes()
+
+	var tests = []struct {
+		name           string
+		owner          string
+		expectedStatus int
+	}{
+		{"first", "1", http.StatusCreated},
+		{"second", "1", http.StatusCreated},
+		{"one too many", "1", http.StatusTooManyRequests},
+		{"someone else", "2", http.StatusCreated},
+	}
+
+	var location string
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, tusRequest("POST", "/", "", map[string]string{"Upload-Length": "10", "X-Owner": e.owner}))
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.name == "first" {
+			location = rr.Header().Get("Location")
+		}
+	}
+
+	// finishing or abandoning an upload makes room for another
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, tusRequest("DELETE", location, "", nil))
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, tusRequest("POST", "/", "", map[string]string{"Upload-Length": "10"}))
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected status 201 after terminating an upload, but got %d", rr.Code)
+	}
+
+	// and so does letting one expire
+	n, _ := h.countUploads("1", time.Now().Add(2*time.Hour))
+	if n != 0 {
+		t.Errorf("expected expired uploads not to count, but counted %d", n)
+	}
+}
+
+func TestHandler_Options(t *testing.T) {
+	var completed []Upload
+	routes := newTestHandler(t, &completed)
+
+	req := httptest.NewRequest("OPTIONS", "/", nil)
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected status 204 but got %d", rr.Code)
+	}
+	if rr.Header().Get("Tus-Version") != Version || rr.Header().Get("Tus-Max-Size") != "100" {
+		t.Errorf("wrong capability headers: %v", rr.Header())
+	}
+}
+
+func TestHandler_Terminate(t *testing.T) {
+	h, err := New(Config{
+		Dir:        t.TempDir(),
+		MaxSize:    100,
+		Expiration: time.Hour,
+		Owner:      func(r *http.Request) string { return r.Header.Get("X-Owner") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := h.Routes()
+
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, tusRequest("POST", "/", "", map[string]string{"Upload-Length": "10"}))
+	location := rr.Header().Get("Location")
+
+	// not while someone is writing to it
+	unlock, _ := h.tryLock(path.Base(location))
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, tusRequest("DELETE", location, "", nil))
+	if rr.Code != http.StatusLocked {
+		t.Errorf("expected status 423 but got %d", rr.Code)
+	}
+	unlock()
+
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, tusRequest("DELETE", location, "", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected status 204 but got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, tusRequest("HEAD", location, "", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected terminated upload to be gone, but got status %d", rr.Code)
+	}
+}
+
+func TestHandler_PatchUnknownUpload(t *testing.T) {
+	h, err := New(Config{
+		Dir:        t.TempDir(),
+		MaxSize:    100,
+		Expiration: time.Hour,
+		Owner:      func(r *http.Request) string { return r.Header.Get("X-Owner") },
+		OnComplete: func(r *http.Request, u Upload) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := h.Routes()
+
+	for _, id := range []string{"0123456789abcdef0123456789abcdef", "not-an-id"} {
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, tusRequest("PATCH", "/"+id, "hello", map[string]string{
+			"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404 but got %d", id, rr.Code)
+		}
+	}
+
+	h.locks.Range(func(key, value any) bool {
+		t.Errorf("expected no locks for uploads that don't exist, but found one for %v", key)
+		return true
+	})
+}
+
+func TestHandler_PurgeExpired(t *testing.T) {
+	h, err := New(Config{
+		Dir:        t.TempDir(),
+		MaxSize:    100,
+		Expiration: time.Hour,
+		Owner:      func(r *http.Request) string { return "1" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := h.Routes()
+
+	var locations []string
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, tusRequest("POST", "/", "", map[string]string{"Upload-Length": "10"}))
+		locations = append(locations, rr.Header().Get("Location"))
+	}
+
+	n, err := h.PurgeExpired(time.Now())
+	if err != nil || n != 0 {
+		t.Errorf("purged %d fresh uploads (%v)", n, err)
+	}
+
+	// an upload being written to is left alone
+	unlock, _ := h.tryLock(path.Base(locations[0]))
+	n, err = h.PurgeExpired(time.Now().Add(2 * time.Hour))
+	if err != nil || n != 1 {
+		t.Errorf("expected to purge 1 expired upload, but purged %d (%v)", n, err)
+	}
+	unlock()
+
+	n, err = h.PurgeExpired(time.Now().Add(2 * time.Hour))
+	if err != nil || n != 1 {
+		t.Errorf("expected to purge the other expired upload, but purged %d (%v)", n, err)
+	}
+
+	entries, _ := os.ReadDir(h.Dir)
+	if len(entries) != 0 {
+		t.Errorf("expected upload directory to be empty, but found %d files", len(entries))
+	}
+}
+
+func TestUpload_FileName(t *testing.T) {
+	var tests = []struct {
+		filename string
+		expected string
+	}{
+		{"me.png", "me.png"},
+		{"../../etc/passwd", "passwd"},
+		{"", "abc"},
+		{"..", "abc"},
+	}
+
+	for _, e := range tests {
+		u := Upload{ID: "abc", Metadata: map[string]string{"filename": e.filename}}
+		if u.FileName() != e.expected {
+			t.Errorf("%q: expected %s but got %s", e.filename, e.expected, u.FileName())
+		}
+	}
+}
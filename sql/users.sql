@@ -16,10 +16,117 @@ SET xmloption = content;
 SET client_min_messages = warning;
 SET row_security = off;
 
+--
+-- Name: audit_events_append_only(); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.audit_events_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+begin
+    raise exception 'audit events cannot be changed or deleted';
+end
+$$;
+
+
 SET default_tablespace = '';
 
 SET default_table_access_method = heap;
 
+--
+-- Name: audit_events; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.audit_events (
+    id integer NOT NULL,
+    occurred_at timestamp with time zone DEFAULT now() NOT NULL,
+    actor_id integer DEFAULT 0 NOT NULL,
+    action character varying(64) NOT NULL,
+    target_type character varying(64) DEFAULT ''::character varying NOT NULL,
+    target_id character varying(255) DEFAULT ''::character varying NOT NULL,
+    ip character varying(255) DEFAULT ''::character varying NOT NULL,
+    user_agent character varying(512) DEFAULT ''::character varying NOT NULL,
+    detail text DEFAULT ''::text NOT NULL,
+    changes jsonb,
+    prev_hash character varying(64) DEFAULT ''::character varying NOT NULL,
+    hash character varying(64) DEFAULT ''::character varying NOT NULL
+);
+
+
+--
+-- Name: audit_events_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.audit_events ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.audit_events_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: permissions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.permissions (
+    id integer NOT NULL,
+    name character varying(64) NOT NULL,
+    description character varying(255) DEFAULT ''::character varying NOT NULL
+);
+
+
+--
+-- Name: permissions_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.permissions ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.permissions_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: role_permissions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.role_permissions (
+    role_id integer NOT NULL,
+    permission_id integer NOT NULL
+);
+
+
+--
+-- Name: roles; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.roles (
+    id integer NOT NULL,
+    name character varying(64) NOT NULL,
+    description character varying(255) DEFAULT ''::character varying NOT NULL
+);
+
+
+--
+-- Name: roles_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.roles ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.roles_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
 --
 -- Name: user_images; Type: TABLE; Schema: public; Owner: -
 --
@@ -28,6 +135,7 @@ CREATE TABLE public.user_images (
     id integer NOT NULL,
     user_id integer,
     file_name character varying(255),
+    is_active boolean DEFAULT false NOT NULL,
     created_at timestamp without time zone,
     updated_at timestamp without time zone
 );
@@ -47,6 +155,16 @@ ALTER TABLE public.user_images ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY
 );
 
 
+--
+-- Name: user_roles; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.user_roles (
+    user_id integer NOT NULL,
+    role_id integer NOT NULL
+);
+
+
 --
 -- Name: users; Type: TABLE; Schema: public; Owner: -
 --
@@ -56,10 +174,13 @@ CREATE TABLE public.users (
     first_name character varying(255),
     last_name character varying(255),
     email character varying(255),
-    password character varying(60),
-    is_admin integer,
+    password character varying(255),
+    avatar_visibility character varying(10) DEFAULT 'public'::character varying NOT NULL,
+    version integer DEFAULT 1 NOT NULL,
     created_at timestamp without time zone,
-    updated_at timestamp without time zone
+    updated_at timestamp without time zone,
+    deleted_at timestamp with time zone,
+    delete_after timestamp with time zone
 );
 
 
@@ -77,11 +198,69 @@ ALTER TABLE public.users ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
 );
 
 
+--
+-- Data for Name: audit_events; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+COPY public.audit_events (id, occurred_at, actor_id, action, target_type, target_id, ip, user_agent, detail, changes, prev_hash, hash) FROM stdin;
+\.
+
+
+--
+-- Data for Name: permissions; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+COPY public.permissions (id, name, description) FROM stdin;
+1	users:read	List users, and see anyone's profile and picture
+2	users:write	Create and edit users, and reset their passwords
+3	users:delete	Delete users
+4	roles:read	List roles and what they grant
+5	roles:write	Create roles, assign them and change what they grant
+6	debug:read	See runtime counters
+7	audit:read	Search and export the audit log
+8	users:impersonate	Log in as another user, to see what they see
+\.
+
+
+--
+-- Data for Name: role_permissions; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+COPY public.role_permissions (role_id, permission_id) FROM stdin;
+1	1
+1	2
+1	3
+1	4
+1	5
+1	6
+1	7
+1	8
+\.
+
+
+--
+-- Data for Name: roles; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+COPY public.roles (id, name, description) FROM stdin;
+1	admin	Can do everything
+\.
+
+
 --
 -- Data for Name: user_images; Type: TABLE DATA; Schema: public; Owner: -
 --
 
-COPY public.user_images (id, user_id, file_name, created_at, updated_at) FROM stdin;
+COPY public.user_images (id, user_id, file_name, is_active, created_at, updated_at) FROM stdin;
+\.
+
+
+--
+-- Data for Name: user_roles; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+COPY public.user_roles (user_id, role_id) FROM stdin;
+1	1
 \.
 
 
@@ -89,11 +268,32 @@ COPY public.user_images (id, user_id, file_name, created_at, updated_at) FROM st
 -- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: -
 --
 
-COPY public.users (id, first_name, last_name, email, password, is_admin, created_at, updated_at) FROM stdin;
-1	Admin	User	admin@example.com	$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK	1	2022-08-19 00:00:00	2022-08-19 00:00:00
+COPY public.users (id, first_name, last_name, email, password, created_at, updated_at) FROM stdin;
+1	Admin	User	admin@example.com	$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK	2022-08-19 00:00:00	2022-08-19 00:00:00
 \.
 
 
+--
+-- Name: audit_events_id_seq; Type: SEQUENCE SET; Schema: public; Owner: -
+--
+
+SELECT pg_catalog.setval('public.audit_events_id_seq', 1, false);
+
+
+--
+-- Name: permissions_id_seq; Type: SEQUENCE SET; Schema: public; Owner: -
+--
+
+SELECT pg_catalog.setval('public.permissions_id_seq', 8, true);
+
+
+--
+-- Name: roles_id_seq; Type: SEQUENCE SET; Schema: public; Owner: -
+--
+
+SELECT pg_catalog.setval('public.roles_id_seq', 1, true);
+
+
 --
 -- Name: user_images_id_seq; Type: SEQUENCE SET; Schema: public; Owner: -
 --
@@ -108,6 +308,54 @@ SELECT pg_catalog.setval('public.user_images_id_seq', 1, false);
 SELECT pg_catalog.setval('public.users_id_seq', 1, true);
 
 
+--
+-- Name: audit_events audit_events_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.audit_events
+    ADD CONSTRAINT audit_events_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: permissions permissions_name_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.permissions
+    ADD CONSTRAINT permissions_name_key UNIQUE (name);
+
+
+--
+-- Name: permissions permissions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.permissions
+    ADD CONSTRAINT permissions_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: role_permissions role_permissions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.role_permissions
+    ADD CONSTRAINT role_permissions_pkey PRIMARY KEY (role_id, permission_id);
+
+
+--
+-- Name: roles roles_name_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.roles
+    ADD CONSTRAINT roles_name_key UNIQUE (name);
+
+
+--
+-- Name: roles roles_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.roles
+    ADD CONSTRAINT roles_pkey PRIMARY KEY (id);
+
+
 --
 -- Name: user_images user_images_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -116,6 +364,14 @@ ALTER TABLE ONLY public.user_images
     ADD CONSTRAINT user_images_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: user_roles user_roles_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_roles
+    ADD CONSTRAINT user_roles_pkey PRIMARY KEY (user_id, role_id);
+
+
 --
 -- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -124,6 +380,78 @@ ALTER TABLE ONLY public.users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: audit_events_actor_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_actor_id_idx ON public.audit_events USING btree (actor_id);
+
+
+--
+-- Name: audit_events_occurred_at_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_occurred_at_idx ON public.audit_events USING btree (occurred_at);
+
+
+--
+-- Name: audit_events_target_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_target_idx ON public.audit_events USING btree (target_type, target_id);
+
+
+--
+-- Name: user_images_user_id_active_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE UNIQUE INDEX user_images_user_id_active_idx ON public.user_images USING btree (user_id) WHERE is_active;
+
+
+--
+-- Name: users_delete_after_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX users_delete_after_idx ON public.users USING btree (delete_after) WHERE (delete_after IS NOT NULL);
+
+
+--
+-- Name: users_deleted_at_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX users_deleted_at_idx ON public.users USING btree (deleted_at) WHERE (deleted_at IS NOT NULL);
+
+
+--
+-- Name: users_email_lower_live_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE UNIQUE INDEX users_email_lower_live_idx ON public.users USING btree (lower((email)::text)) WHERE (deleted_at IS NULL);
+
+
+--
+-- Name: audit_events audit_events_append_only; Type: TRIGGER; Schema: public; Owner: -
+--
+
+CREATE TRIGGER audit_events_append_only BEFORE DELETE OR UPDATE ON public.audit_events FOR EACH ROW EXECUTE FUNCTION public.audit_events_append_only();
+
+
+--
+-- Name: role_permissions role_permissions_permission_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.role_permissions
+    ADD CONSTRAINT role_permissions_permission_id_fkey FOREIGN KEY (permission_id) REFERENCES public.permissions(id) ON DELETE CASCADE;
+
+
+--
+-- Name: role_permissions role_permissions_role_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.role_permissions
+    ADD CONSTRAINT role_permissions_role_id_fkey FOREIGN KEY (role_id) REFERENCES public.roles(id) ON DELETE CASCADE;
+
+
 --
 -- Name: user_images user_images_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
@@ -132,6 +460,22 @@ ALTER TABLE ONLY public.user_images
     ADD CONSTRAINT user_images_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
 
 
+--
+-- Name: user_roles user_roles_role_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_roles
+    ADD CONSTRAINT user_roles_role_id_fkey FOREIGN KEY (role_id) REFERENCES public.roles(id) ON DELETE CASCADE;
+
+
+--
+-- Name: user_roles user_roles_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_roles
+    ADD CONSTRAINT user_roles_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
 --
 -- PostgreSQL database dump complete
 --